@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/nicobistolfi/go-rest-api/pkg/server"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	logger "github.com/nicobistolfi/go-rest-api/pkg"
+)
+
+func main() {
+	// Load configuration from the config file, environment and flags
+	cfg, err := server.LoadConfigFromArgs(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	gin.SetMode(cfg.GinMode)
+	logger.Init()
+
+	// Stop accepting new connections on SIGINT (Ctrl+C) or SIGTERM (Kubernetes, Docker)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Reload the configuration on SIGHUP or when the config file changes
+	reload := func() (*server.Config, error) {
+		return server.LoadConfigFromArgs(os.Args[1:])
+	}
+
+	srv := server.New(cfg, server.WithLogger(logger.Log), server.WithConfigReload(reload))
+	if err := srv.Run(ctx); err != nil {
+		logger.Fatal("Server stopped with error", zap.Error(err))
+	}
+	logger.Info("Server stopped")
+}
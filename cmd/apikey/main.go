@@ -0,0 +1,58 @@
+// Command apikey generates an API key and prints the api_keys entry to add
+// to the config file. The plaintext key is printed once and never stored.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nicobistolfi/go-rest-api/pkg/auth"
+)
+
+func main() {
+	owner := flag.String("owner", "", "owner of the key, used as the profile ID (required)")
+	name := flag.String("name", "", "description of the key, e.g. the client using it")
+	scopes := flag.String("scopes", "", "comma separated scopes granted to the key")
+	expires := flag.Duration("expires", 0, "lifetime of the key, e.g. 2160h; zero for no expiry")
+	flag.Parse()
+
+	if *owner == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var expiresAt time.Time
+	if *expires > 0 {
+		expiresAt = time.Now().Add(*expires).UTC().Truncate(time.Second)
+	}
+
+	var scopeList []string
+	for _, scope := range strings.Split(*scopes, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			scopeList = append(scopeList, scope)
+		}
+	}
+
+	plaintext, key, err := auth.NewAPIKey(*owner, *name, scopeList, expiresAt)
+	if err != nil {
+		log.Fatalf("Failed to generate API key: %v", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "API key (shown once, hand it to the client):\n\n  %s\n\nAdd this entry to api_keys in the config file:\n\n", plaintext)
+	fmt.Printf("  - id: %q\n", key.ID)
+	fmt.Printf("    owner: %q\n", key.Owner)
+	if key.Name != "" {
+		fmt.Printf("    name: %q\n", key.Name)
+	}
+	fmt.Printf("    hash: %q\n", key.Hash)
+	if len(key.Scopes) > 0 {
+		fmt.Printf("    scopes: [%s]\n", strings.Join(key.Scopes, ", "))
+	}
+	if !key.ExpiresAt.IsZero() {
+		fmt.Printf("    expires_at: %s\n", key.ExpiresAt.Format(time.RFC3339))
+	}
+}
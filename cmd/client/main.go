@@ -0,0 +1,64 @@
+// Command client generates the credentials of a client of the /token
+// endpoint and prints the clients entry to add to the config file. The
+// secret is printed once and never stored.
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nicobistolfi/go-rest-api/pkg/auth"
+)
+
+func main() {
+	name := flag.String("name", "", "description of the client (required)")
+	scopes := flag.String("scopes", "", "comma separated scopes the client may request")
+	grants := flag.String("grants", "", "comma separated grants the client may use (client_credentials, password, refresh_token); defaults to client_credentials")
+	expiry := flag.Duration("expiry", 0, "lifetime of the access tokens issued to the client, e.g. 15m; zero for JWT_EXPIRATION_MINUTES")
+	flag.Parse()
+
+	if *name == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		log.Fatalf("Failed to generate client ID: %v", err)
+	}
+	secret, err := auth.NewClientSecret()
+	if err != nil {
+		log.Fatalf("Failed to generate client secret: %v", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Client credentials (the secret is shown once, hand both to the client):\n\n  client_id:     %s\n  client_secret: %s\n\nAdd this entry to clients in the config file:\n\n", hex.EncodeToString(id), secret)
+	fmt.Printf("  - id: %q\n", hex.EncodeToString(id))
+	fmt.Printf("    name: %q\n", *name)
+	fmt.Printf("    secret_hash: %q\n", auth.HashClientSecret(secret))
+	if list := splitList(*scopes); len(list) > 0 {
+		fmt.Printf("    scopes: [%s]\n", strings.Join(list, ", "))
+	}
+	if list := splitList(*grants); len(list) > 0 {
+		fmt.Printf("    grant_types: [%s]\n", strings.Join(list, ", "))
+	}
+	if *expiry > 0 {
+		fmt.Printf("    access_token_expiry: %s\n", expiry.Round(time.Second))
+	}
+}
+
+// splitList splits a comma separated flag, ignoring empty items
+func splitList(s string) []string {
+	var values []string
+	for _, value := range strings.Split(s, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
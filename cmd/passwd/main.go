@@ -0,0 +1,33 @@
+// Command passwd reads a password from standard input and prints its bcrypt
+// hash, to be used as the password_hash of an entry of users in the config
+// file.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/nicobistolfi/go-rest-api/pkg/auth"
+)
+
+func main() {
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		log.Fatalf("Failed to read password: %v", err)
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		log.Fatal("Password must not be empty")
+	}
+
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		log.Fatalf("Failed to hash password: %v", err)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Printf("password_hash: %q\n", hash)
+}
@@ -4,13 +4,11 @@ import (
 	"context"
 	"log"
 
-	"github.com/nicobistolfi/go-rest-api/internal/api"
-	"github.com/nicobistolfi/go-rest-api/internal/config"
+	"github.com/nicobistolfi/go-rest-api/pkg/server"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	ginadapter "github.com/awslabs/aws-lambda-go-api-proxy/gin"
-	"github.com/gin-gonic/gin"
 
 	logger "github.com/nicobistolfi/go-rest-api/pkg"
 )
@@ -22,20 +20,17 @@ func init() {
 	log.Printf("Gin cold start")
 
 	// Load configuration
-	cfg, err := config.LoadConfig()
+	cfg, err := server.LoadConfig()
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
 	logger.Init()
 
-	// Create a new Gin router
-	r := gin.New()
-
 	// Setup router with middleware and routes
-	api.SetupRouter(r, cfg, logger.Log)
+	srv := server.New(cfg, server.WithLogger(logger.Log))
 
-	ginLambda = ginadapter.New(r)
+	ginLambda = ginadapter.New(srv.Engine())
 }
 
 func Handler(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
@@ -0,0 +1,56 @@
+import axios from "axios";
+import { useEffect, useState } from "react";
+
+// Logs in through the /auth/login flow of the Go API instead of NextAuth.
+// The API redirects back here with its own token in the URL fragment.
+const API_URL = process.env.NEXT_PUBLIC_API_URL || "http://localhost:8080";
+
+export default function ApiLogin() {
+  const [token, setToken] = useState("");
+  const [apiResponse, setApiResponse] = useState("");
+
+  useEffect(() => {
+    const fragment = new URLSearchParams(window.location.hash.slice(1));
+    const accessToken = fragment.get("access_token");
+    if (accessToken) {
+      setToken(accessToken);
+      // Remove the token from the address bar and the history
+      window.history.replaceState(null, "", window.location.pathname);
+    }
+  }, []);
+
+  const login = () => {
+    const returnTo = window.location.origin + window.location.pathname;
+    window.location.href = `${API_URL}/auth/login?return_to=${encodeURIComponent(returnTo)}`;
+  };
+
+  const makeAuthenticatedRequest = async () => {
+    try {
+      const response = await axios.get(`${API_URL}/api/v1/profile`, {
+        headers: {
+          Authorization: `Bearer ${token}`,
+        },
+      });
+      setApiResponse(JSON.stringify(response.data, null, 2));
+    } catch (error) {
+      setApiResponse("Error making authenticated request");
+    }
+  };
+
+  return (
+    <div>
+      <h1>Login with the Go API</h1>
+      {token ? (
+        <div>
+          <button onClick={makeAuthenticatedRequest}>
+            Make Authenticated Request
+          </button>
+          <button onClick={() => setToken("")}>Sign out</button>
+          <pre>{apiResponse}</pre>
+        </div>
+      ) : (
+        <button onClick={login}>Sign in</button>
+      )}
+    </div>
+  );
+}
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/nicobistolfi/go-rest-api/internal/api/middleware"
+
+	logger "github.com/nicobistolfi/go-rest-api/pkg"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// AdminRole is the role required by the /admin routes.
+const AdminRole = "admin"
+
+// GetTokenCacheStats handles GET /admin/token-cache
+func GetTokenCacheStats(cache *middleware.TokenCacheHandle) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, cache.Stats())
+	}
+}
+
+// PurgeTokenCache handles DELETE /admin/token-cache
+func PurgeTokenCache(cache *middleware.TokenCacheHandle) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cache.Purge()
+		logger.Info("Token cache purged", zap.String("admin", adminID(c)))
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// EvictUserTokens handles DELETE /admin/token-cache/users/:id
+func EvictUserTokens(cache *middleware.TokenCacheHandle) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		evicted := cache.EvictUser(id)
+		logger.Info("Evicted cached profiles of user", zap.String("admin", adminID(c)), zap.String("user_id", id), zap.Int("evicted", evicted))
+		c.JSON(http.StatusOK, gin.H{"evicted": evicted})
+	}
+}
+
+// EvictTokenFingerprint handles DELETE /admin/token-cache/tokens/:fingerprint
+func EvictTokenFingerprint(cache *middleware.TokenCacheHandle) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		fingerprint := strings.ToLower(c.Param("fingerprint"))
+		if decoded, err := hex.DecodeString(fingerprint); err != nil || len(decoded) != 16 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Fingerprint must be 32 hex characters"})
+			return
+		}
+		cache.EvictFingerprint(fingerprint)
+		logger.Info("Evicted cached profile", zap.String("admin", adminID(c)), zap.String("credential", fingerprint))
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// adminID returns the ID of the authenticated admin, for audit logs
+func adminID(c *gin.Context) string {
+	if user, ok := c.Get("user"); ok {
+		if profile, ok := user.(middleware.Profile); ok {
+			return profile.ID
+		}
+	}
+	return ""
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nicobistolfi/go-rest-api/internal/api/middleware"
+	"github.com/nicobistolfi/go-rest-api/internal/config"
+	logger "github.com/nicobistolfi/go-rest-api/pkg"
+)
+
+func TestTokenCacheAdmin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger.Init()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Authorization") {
+		case "Bearer admin":
+			w.Write([]byte(`{"id":"root","roles":["admin"]}`))
+		case "Bearer laptop", "Bearer phone":
+			w.Write([]byte(`{"id":"alice"}`))
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer upstream.Close()
+
+	handle := middleware.NewTokenCacheHandle()
+	fingerprintKey := strings.Repeat("k", config.MinSecretLength)
+	router := gin.New()
+	SetupRouter(router, &config.Config{
+		TokenVerifiers:      []string{config.VerifierRemote},
+		TokenURL:            upstream.URL,
+		TokenCacheExpiry:    time.Minute,
+		TokenFingerprintKey: fingerprintKey,
+	}, logger.Log, WithoutRateLimiting(), WithTokenCacheHandle(handle))
+
+	serve := func(method, path, token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		router.ServeHTTP(w, req)
+		return w
+	}
+	for _, token := range []string{"laptop", "phone"} {
+		require.Equal(t, http.StatusOK, serve("GET", "/api/v1/profile", token).Code)
+	}
+
+	t.Run("Requires the admin role", func(t *testing.T) {
+		w := serve("GET", "/api/v1/admin/token-cache", "laptop")
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("Stats", func(t *testing.T) {
+		w := serve("GET", "/api/v1/admin/token-cache", "admin")
+		require.Equal(t, http.StatusOK, w.Code)
+		var stats middleware.TokenCacheStats
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+		assert.Equal(t, 3, stats.Size)
+	})
+
+	t.Run("Evict by fingerprint", func(t *testing.T) {
+		w := serve("DELETE", "/api/v1/admin/token-cache/tokens/not-a-fingerprint", "admin")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = serve("DELETE", "/api/v1/admin/token-cache/tokens/"+middleware.FingerprintWithKey([]byte(fingerprintKey), "Bearer laptop"), "admin")
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, 2, handle.Stats().Size)
+	})
+
+	t.Run("Evict by user", func(t *testing.T) {
+		w := serve("DELETE", "/api/v1/admin/token-cache/users/alice", "admin")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"evicted":1}`, w.Body.String())
+		assert.Equal(t, "MISS", serve("GET", "/api/v1/profile", "phone").Header().Get("X-Token-Cache"))
+	})
+
+	t.Run("Purge", func(t *testing.T) {
+		w := serve("DELETE", "/api/v1/admin/token-cache", "admin")
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		// Including the profile of the admin, cached before the purge
+		assert.Equal(t, 0, handle.Stats().Size)
+	})
+}
@@ -1,32 +1,324 @@
 package api
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
-	"os"
+	"strings"
+	"time"
+
+	"github.com/nicobistolfi/go-rest-api/internal/config"
 
 	"github.com/nicobistolfi/go-rest-api/pkg/auth" // Adjust this import path as needed
 
 	"github.com/gin-gonic/gin"
 )
 
-func GetToken(c *gin.Context) {
-	secretKey := os.Getenv("JWT_SECRET")
-	if secretKey == "" {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "JWT_SECRET is not set"})
-		return
+// newTokenIssuer returns an issuer for access tokens signed with the key
+// ring of cfg that expire after cfg.JWTExpirationMinutes and carry
+// cfg.JWTIssuer and cfg.JWTAudience, with refresh tokens kept in tokens
+func newTokenIssuer(cfg *config.Config, tokens auth.TokenStore) (*auth.TokenIssuer, error) {
+	keys, err := keyRing(cfg)
+	if err != nil {
+		return nil, err
+	}
+	opts := auth.TokenIssuerOptions{
+		AccessTokenExpiry:  time.Duration(cfg.JWTExpirationMinutes) * time.Minute,
+		RefreshTokenExpiry: cfg.RefreshTokenExpiry,
+		Issuer:             cfg.JWTIssuer,
+		Keys:               keys,
+	}
+	if cfg.JWTAudience != "" {
+		opts.Audience = []string{cfg.JWTAudience}
+	}
+	return auth.NewTokenIssuer([]byte(cfg.JWTSecret), tokens, opts), nil
+}
+
+// tokenResponse renders a token pair. token duplicates access_token for
+// clients written before refresh tokens existed.
+func tokenResponse(pair *auth.TokenPair) gin.H {
+	response := gin.H{
+		"token":        pair.AccessToken,
+		"access_token": pair.AccessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(pair.ExpiresIn.Seconds()),
+	}
+	if pair.RefreshToken != "" {
+		response["refresh_token"] = pair.RefreshToken
+	}
+	if len(pair.Scopes) > 0 {
+		response["scope"] = strings.Join(pair.Scopes, " ")
+	}
+	return response
+}
+
+// grantRequest is the body of the /token endpoint, sent as a form as
+// required by RFC 6749 or as JSON
+type grantRequest struct {
+	GrantType    string `json:"grant_type" form:"grant_type"`
+	ClientID     string `json:"client_id" form:"client_id"`
+	ClientSecret string `json:"client_secret" form:"client_secret"`
+	Scope        string `json:"scope" form:"scope"`
+	Username     string `json:"username" form:"username"`
+	Password     string `json:"password" form:"password"`
+	RefreshToken string `json:"refresh_token" form:"refresh_token"`
+}
+
+// oauthError responds with an RFC 6749 error
+func oauthError(c *gin.Context, status int, code, description string) {
+	c.JSON(status, gin.H{"error": code, "error_description": description})
+}
+
+// authenticateClient authenticates the client of an OAuth request with HTTP
+// Basic auth, or with the client_id and client_secret of the body. It
+// responds with an RFC 6749 error and returns false when that fails.
+func authenticateClient(c *gin.Context, clients auth.ClientStore, bodyID, bodySecret string) (*auth.Client, bool) {
+	id, secret, basic := c.Request.BasicAuth()
+	if basic && (bodyID != "" || bodySecret != "") {
+		oauthError(c, http.StatusBadRequest, "invalid_request", "Use either HTTP Basic auth or client_id and client_secret, not both")
+		return nil, false
+	}
+	if !basic {
+		id, secret = bodyID, bodySecret
 	}
 
-	token, err := auth.GenerateJWT([]byte(secretKey))
+	client, err := auth.AuthenticateClient(c.Request.Context(), clients, id, secret)
+	if errors.Is(err, auth.ErrInvalidClient) {
+		c.Header("WWW-Authenticate", `Basic realm="token"`)
+		oauthError(c, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return nil, false
+	}
 	if err != nil {
-		fmt.Printf("Error generating JWT: %v\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
-		return
+		oauthError(c, http.StatusInternalServerError, "server_error", "Failed to authenticate client")
+		return nil, false
 	}
+	return client, true
+}
 
-	c.JSON(http.StatusOK, gin.H{
-		"token": token,
-	})
+// GetToken returns the handler for the /token endpoint. Clients
+// authenticate with HTTP Basic auth or client_id and client_secret in the
+// body, then get tokens with the client_credentials grant, for themselves,
+// the password grant, for a user of users, or the refresh_token grant.
+func GetToken(cfg *config.Config, tokens auth.TokenStore, clients auth.ClientStore, users auth.UserStore) gin.HandlerFunc {
+	issuer, issuerErr := newTokenIssuer(cfg, tokens)
+
+	return func(c *gin.Context) {
+		// Responses carrying tokens must not be cached (RFC 6749 section 5.1)
+		c.Header("Cache-Control", "no-store")
+		c.Header("Pragma", "no-cache")
+
+		if issuerErr != nil {
+			oauthError(c, http.StatusInternalServerError, "server_error", "Signing keys are not available")
+			return
+		}
+
+		var req grantRequest
+		if err := c.ShouldBind(&req); err != nil {
+			oauthError(c, http.StatusBadRequest, "invalid_request", "The request body could not be parsed")
+			return
+		}
+		switch req.GrantType {
+		case "":
+			oauthError(c, http.StatusBadRequest, "invalid_request", "grant_type is required")
+			return
+		case auth.GrantClientCredentials, auth.GrantPassword, auth.GrantRefreshToken:
+		default:
+			oauthError(c, http.StatusBadRequest, "unsupported_grant_type", fmt.Sprintf("Grant type %q is not supported", req.GrantType))
+			return
+		}
+
+		client, ok := authenticateClient(c, clients, req.ClientID, req.ClientSecret)
+		if !ok {
+			return
+		}
+		if !client.AllowsGrant(req.GrantType) {
+			oauthError(c, http.StatusBadRequest, "unauthorized_client", fmt.Sprintf("The client may not use the %s grant", req.GrantType))
+			return
+		}
+
+		var (
+			pair *auth.TokenPair
+			err  error
+		)
+		switch req.GrantType {
+		case auth.GrantClientCredentials, auth.GrantPassword:
+			scopes, scopeErr := client.GrantScopes(strings.Fields(req.Scope))
+			if scopeErr != nil {
+				oauthError(c, http.StatusBadRequest, "invalid_scope", "The requested scope exceeds the scopes granted to the client")
+				return
+			}
+			grant := auth.Grant{
+				User:              auth.User{ID: client.ID, Username: client.Name},
+				ClientID:          client.ID,
+				Scopes:            scopes,
+				AccessTokenExpiry: client.AccessTokenExpiry,
+				// Clients can authenticate again instead (RFC 6749 section 4.4.3)
+				NoRefreshToken: true,
+			}
+			if req.GrantType == auth.GrantPassword {
+				if req.Username == "" || req.Password == "" {
+					oauthError(c, http.StatusBadRequest, "invalid_request", "username and password are required")
+					return
+				}
+				user, userErr := auth.VerifyPassword(c.Request.Context(), users, req.Username, req.Password)
+				if errors.Is(userErr, auth.ErrInvalidCredentials) {
+					oauthError(c, http.StatusBadRequest, "invalid_grant", "Invalid username or password")
+					return
+				}
+				if userErr != nil {
+					oauthError(c, http.StatusInternalServerError, "server_error", "Failed to verify credentials")
+					return
+				}
+				grant.User = *user
+				grant.NoRefreshToken = !client.AllowsGrant(auth.GrantRefreshToken)
+			}
+			pair, err = issuer.IssueGrant(c.Request.Context(), grant)
+		case auth.GrantRefreshToken:
+			if req.RefreshToken == "" {
+				oauthError(c, http.StatusBadRequest, "invalid_request", "refresh_token is required")
+				return
+			}
+			pair, err = issuer.Refresh(c.Request.Context(), req.RefreshToken, client.ID)
+			if errors.Is(err, auth.ErrRefreshTokenReused) || errors.Is(err, auth.ErrInvalidRefreshToken) {
+				oauthError(c, http.StatusBadRequest, "invalid_grant", "The refresh token is invalid, expired or revoked")
+				return
+			}
+		}
+		if err != nil {
+			oauthError(c, http.StatusInternalServerError, "server_error", "Failed to generate token")
+			return
+		}
+
+		c.JSON(http.StatusOK, tokenResponse(pair))
+	}
+}
+
+// tokenRequest is the body of the /token/refresh and /token/revoke
+// endpoints, sent as JSON or as a form
+type tokenRequest struct {
+	RefreshToken string `json:"refresh_token" form:"refresh_token"`
+	Token        string `json:"token" form:"token"`
+}
+
+// RefreshToken returns the handler for the /token/refresh endpoint. The
+// refresh token is exchanged for a new pair and cannot be used again;
+// presenting it twice revokes every token issued from it.
+func RefreshToken(cfg *config.Config, tokens auth.TokenStore) gin.HandlerFunc {
+	issuer, issuerErr := newTokenIssuer(cfg, tokens)
+
+	return func(c *gin.Context) {
+		if issuerErr != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Signing keys are not available"})
+			return
+		}
+
+		var req tokenRequest
+		if err := c.ShouldBind(&req); err != nil || req.RefreshToken == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "refresh_token is required"})
+			return
+		}
+
+		pair, err := issuer.Refresh(c.Request.Context(), req.RefreshToken, "")
+		switch {
+		case errors.Is(err, auth.ErrRefreshTokenReused):
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token was already used; every token issued from it has been revoked"})
+			return
+		case errors.Is(err, auth.ErrInvalidRefreshToken):
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh token"})
+			return
+		}
+
+		c.JSON(http.StatusOK, tokenResponse(pair))
+	}
+}
+
+// RevokeToken returns the handler for the /token/revoke endpoint. It
+// accepts an access token, which is revoked until it expires, or a refresh
+// token, which revokes every token issued from the same login. As in
+// RFC 7009, unknown tokens are not an error.
+func RevokeToken(cfg *config.Config, tokens auth.TokenStore) gin.HandlerFunc {
+	issuer, issuerErr := newTokenIssuer(cfg, tokens)
+
+	return func(c *gin.Context) {
+		if issuerErr != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Signing keys are not available"})
+			return
+		}
+
+		var req tokenRequest
+		if err := c.ShouldBind(&req); err != nil || req.Token == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "token is required"})
+			return
+		}
+
+		if err := issuer.Revoke(c.Request.Context(), req.Token); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke token"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Token revoked"})
+	}
+}
+
+// introspectionRequest is the body of the /introspect endpoint, sent as a
+// form as required by RFC 7662 or as JSON
+type introspectionRequest struct {
+	Token         string `json:"token" form:"token"`
+	TokenTypeHint string `json:"token_type_hint" form:"token_type_hint"`
+	ClientID      string `json:"client_id" form:"client_id"`
+	ClientSecret  string `json:"client_secret" form:"client_secret"`
+}
+
+// Introspect returns the handler for the /introspect endpoint (RFC 7662).
+// Registered clients describe access and refresh tokens issued by /token,
+// and API keys of apiKeys. Invalid, expired and revoked tokens are reported
+// as {"active": false}.
+func Introspect(cfg *config.Config, tokens auth.TokenStore, clients auth.ClientStore, apiKeys auth.APIKeyStore) gin.HandlerFunc {
+	issuer, issuerErr := newTokenIssuer(cfg, tokens)
+
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "no-store")
+		c.Header("Pragma", "no-cache")
+
+		if issuerErr != nil {
+			oauthError(c, http.StatusInternalServerError, "server_error", "Signing keys are not available")
+			return
+		}
+
+		var req introspectionRequest
+		if err := c.ShouldBind(&req); err != nil {
+			oauthError(c, http.StatusBadRequest, "invalid_request", "The request body could not be parsed")
+			return
+		}
+		if _, ok := authenticateClient(c, clients, req.ClientID, req.ClientSecret); !ok {
+			return
+		}
+		if req.Token == "" {
+			oauthError(c, http.StatusBadRequest, "invalid_request", "token is required")
+			return
+		}
+
+		// The token type is told by its format, so token_type_hint is not
+		// needed
+		var (
+			result *auth.Introspection
+			err    error
+		)
+		if _, isAPIKey := auth.ParseAPIKeyID(req.Token); isAPIKey {
+			result, err = auth.IntrospectAPIKey(c.Request.Context(), apiKeys, req.Token)
+		} else {
+			result, err = issuer.Introspect(c.Request.Context(), req.Token)
+		}
+		if err != nil {
+			oauthError(c, http.StatusInternalServerError, "server_error", "Failed to introspect token")
+			return
+		}
+
+		c.JSON(http.StatusOK, result)
+	}
 }
 
 // GetProfile handles the /profile endpoint
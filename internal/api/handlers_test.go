@@ -1,36 +1,226 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
-	"os"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
 
 	"github.com/nicobistolfi/go-rest-api/internal/api/middleware"
+	"github.com/nicobistolfi/go-rest-api/internal/config"
+	"github.com/nicobistolfi/go-rest-api/pkg/auth"
 )
 
+// tokenTestStores returns a client store with a machine client, allowed
+// the client_credentials grant, and web and mobile clients, allowed the
+// password and refresh_token grants, and a user store with jane, whose
+// password is "correct horse"
+func tokenTestStores(t *testing.T) (auth.ClientStore, auth.UserStore) {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	assert.NoError(t, err)
+
+	clients := auth.NewMemoryClientStore(
+		&auth.Client{ID: "machine", Name: "Billing", SecretHash: auth.HashClientSecret("machine-secret"), Scopes: []string{"orders:read", "orders:write"}, AccessTokenExpiry: 5 * time.Minute},
+		&auth.Client{ID: "web", SecretHash: auth.HashClientSecret("web-secret"), Scopes: []string{"profile"}, GrantTypes: []string{auth.GrantPassword, auth.GrantRefreshToken}},
+		&auth.Client{ID: "mobile", SecretHash: auth.HashClientSecret("mobile-secret"), Scopes: []string{"profile"}, GrantTypes: []string{auth.GrantPassword, auth.GrantRefreshToken}},
+	)
+	users := auth.NewMemoryUserStore(&auth.Account{
+		User:         auth.User{ID: "42", Username: "jane", Email: "jane@example.com"},
+		PasswordHash: string(hash),
+	})
+	return clients, users
+}
+
 func TestGetToken(t *testing.T) {
-	r := gin.Default()
+	clients, users := tokenTestStores(t)
+	cfg := &config.Config{JWTSecret: "test_secret", JWTExpirationMinutes: 1, RefreshTokenExpiry: time.Hour}
 
-	r.GET("/token", GetToken)
+	r := gin.New()
+	r.POST("/token", GetToken(cfg, auth.NewMemoryTokenStore(), clients, users))
 
-	os.Setenv("JWT_SECRET", "test_secret")
-	os.Setenv("JWT_EXPIRATION_MINUTES", "1")
+	request := func(form url.Values, basicID, basicSecret string) (*httptest.ResponseRecorder, map[string]any) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if basicID != "" {
+			req.SetBasicAuth(basicID, basicSecret)
+		}
+		r.ServeHTTP(w, req)
+
+		var response map[string]any
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return w, response
+	}
+
+	t.Run("client credentials", func(t *testing.T) {
+		w, response := request(url.Values{"grant_type": {"client_credentials"}, "scope": {"orders:read"}}, "machine", "machine-secret")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+		assert.Equal(t, "Bearer", response["token_type"])
+		assert.Equal(t, float64(300), response["expires_in"])
+		assert.Equal(t, "orders:read", response["scope"])
+		assert.NotContains(t, response, "refresh_token")
+
+		claims, err := auth.ParseJWT(response["access_token"].(string), []byte(cfg.JWTSecret), auth.VerifyOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, "machine", claims.Subject)
+		assert.Equal(t, "machine", claims.ClientID)
+		assert.Equal(t, "orders:read", claims.Scope)
+	})
+
+	t.Run("client credentials in the body", func(t *testing.T) {
+		w, response := request(url.Values{"grant_type": {"client_credentials"}, "client_id": {"machine"}, "client_secret": {"machine-secret"}}, "", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "orders:read orders:write", response["scope"])
+	})
+
+	t.Run("password and refresh token", func(t *testing.T) {
+		w, response := request(url.Values{"grant_type": {"password"}, "username": {"jane"}, "password": {"correct horse"}}, "web", "web-secret")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, float64(60), response["expires_in"])
+		refresh, _ := response["refresh_token"].(string)
+		assert.NotEmpty(t, refresh)
+
+		claims, err := auth.ParseJWT(response["access_token"].(string), []byte(cfg.JWTSecret), auth.VerifyOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, "42", claims.Subject)
+		assert.Equal(t, "web", claims.ClientID)
+
+		// Refresh tokens are bound to the client they were issued to
+		w, response = request(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refresh}}, "mobile", "mobile-secret")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, "invalid_grant", response["error"])
+
+		w, response = request(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refresh}}, "web", "web-secret")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "profile", response["scope"])
+
+		w, response = request(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refresh}}, "web", "web-secret")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, "invalid_grant", response["error"])
+	})
+
+	tests := []struct {
+		name          string
+		form          url.Values
+		id, secret    string
+		wantStatus    int
+		wantError     string
+		wantChallenge bool
+	}{
+		{"missing grant type", url.Values{}, "machine", "machine-secret", http.StatusBadRequest, "invalid_request", false},
+		{"unsupported grant type", url.Values{"grant_type": {"authorization_code"}}, "machine", "machine-secret", http.StatusBadRequest, "unsupported_grant_type", false},
+		{"anonymous", url.Values{"grant_type": {"client_credentials"}}, "", "", http.StatusUnauthorized, "invalid_client", true},
+		{"wrong secret", url.Values{"grant_type": {"client_credentials"}}, "machine", "wrong", http.StatusUnauthorized, "invalid_client", true},
+		{"unknown client", url.Values{"grant_type": {"client_credentials"}}, "nobody", "machine-secret", http.StatusUnauthorized, "invalid_client", true},
+		{"both credential forms", url.Values{"grant_type": {"client_credentials"}, "client_id": {"machine"}}, "machine", "machine-secret", http.StatusBadRequest, "invalid_request", false},
+		{"grant not allowed", url.Values{"grant_type": {"client_credentials"}}, "web", "web-secret", http.StatusBadRequest, "unauthorized_client", false},
+		{"scope not allowed", url.Values{"grant_type": {"client_credentials"}, "scope": {"admin"}}, "machine", "machine-secret", http.StatusBadRequest, "invalid_scope", false},
+		{"wrong password", url.Values{"grant_type": {"password"}, "username": {"jane"}, "password": {"wrong"}}, "web", "web-secret", http.StatusBadRequest, "invalid_grant", false},
+		{"unknown user", url.Values{"grant_type": {"password"}, "username": {"joe"}, "password": {"correct horse"}}, "web", "web-secret", http.StatusBadRequest, "invalid_grant", false},
+		{"missing password", url.Values{"grant_type": {"password"}, "username": {"jane"}}, "web", "web-secret", http.StatusBadRequest, "invalid_request", false},
+		{"invalid refresh token", url.Values{"grant_type": {"refresh_token"}, "refresh_token": {"rt_unknown_token"}}, "web", "web-secret", http.StatusBadRequest, "invalid_grant", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, response := request(tt.form, tt.id, tt.secret)
+			assert.Equal(t, tt.wantStatus, w.Code)
+			assert.Equal(t, tt.wantError, response["error"])
+			assert.NotEmpty(t, response["error_description"])
+			assert.NotContains(t, response, "access_token")
+			assert.Equal(t, tt.wantChallenge, w.Header().Get("WWW-Authenticate") != "")
+		})
+	}
+}
+
+func TestGetTokenWithoutSecret(t *testing.T) {
+	r := gin.Default()
+
+	clients, users := tokenTestStores(t)
+	r.POST("/token", GetToken(&config.Config{}, auth.NewMemoryTokenStore(), clients, users))
 
 	w := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/token", nil)
+	req, _ := http.NewRequest("POST", "/token", nil)
 	r.ServeHTTP(w, req)
 
-	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
 
-	var response map[string]string
-	err := json.Unmarshal(w.Body.Bytes(), &response)
+func TestIntrospect(t *testing.T) {
+	clients, _ := tokenTestStores(t)
+	cfg := &config.Config{JWTSecret: "test_secret", JWTExpirationMinutes: 1, RefreshTokenExpiry: time.Hour}
+	tokens := auth.NewMemoryTokenStore()
+	plaintext, key, err := auth.NewAPIKey("acme", "ci", []string{"orders:read"}, time.Time{})
+	assert.NoError(t, err)
+
+	issuer, err := newTokenIssuer(cfg, tokens)
+	assert.NoError(t, err)
+	pair, err := issuer.IssueGrant(context.Background(), auth.Grant{
+		User:     auth.User{ID: "42", Username: "jane"},
+		ClientID: "web",
+		Scopes:   []string{"profile"},
+	})
 	assert.NoError(t, err)
-	assert.Contains(t, response, "token")
+
+	r := gin.New()
+	r.POST("/introspect", Introspect(cfg, tokens, clients, auth.NewMemoryAPIKeyStore(key)))
+
+	introspect := func(token, basicID, basicSecret string) (*httptest.ResponseRecorder, map[string]any) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/introspect", strings.NewReader(url.Values{"token": {token}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(basicID, basicSecret)
+		r.ServeHTTP(w, req)
+
+		var response map[string]any
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return w, response
+	}
+
+	w, response := introspect(pair.AccessToken, "machine", "machine-secret")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	assert.Equal(t, true, response["active"])
+	assert.Equal(t, "42", response["sub"])
+	assert.Equal(t, "jane", response["username"])
+	assert.Equal(t, "profile", response["scope"])
+	assert.Equal(t, "web", response["client_id"])
+	assert.Equal(t, auth.TokenTypeAccessToken, response["token_type"])
+	assert.NotZero(t, response["exp"])
+
+	_, response = introspect(pair.RefreshToken, "machine", "machine-secret")
+	assert.Equal(t, true, response["active"])
+	assert.Equal(t, auth.TokenTypeRefreshToken, response["token_type"])
+
+	_, response = introspect(plaintext, "machine", "machine-secret")
+	assert.Equal(t, true, response["active"])
+	assert.Equal(t, "acme", response["sub"])
+	assert.Equal(t, auth.TokenTypeAPIKey, response["token_type"])
+
+	// Revoking the refresh token revokes the whole family
+	assert.NoError(t, issuer.Revoke(context.Background(), pair.RefreshToken))
+	for _, token := range []string{pair.AccessToken, pair.RefreshToken, "garbage"} {
+		w, response = introspect(token, "machine", "machine-secret")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, map[string]any{"active": false}, response)
+	}
+
+	w, response = introspect(pair.AccessToken, "machine", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "invalid_client", response["error"])
+
+	w, response = introspect("", "machine", "machine-secret")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "invalid_request", response["error"])
 }
 
 func TestGetProfile(t *testing.T) {
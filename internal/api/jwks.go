@@ -0,0 +1,60 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/nicobistolfi/go-rest-api/internal/config"
+	"github.com/nicobistolfi/go-rest-api/pkg/auth"
+
+	"github.com/gin-gonic/gin"
+)
+
+// keyRing returns the keys issued tokens are signed and verified with.
+// Tokens are signed with JWT_SIGNING_KEY when set, otherwise with
+// JWT_SECRET. JWT_PREVIOUS_KEYS and JWT_PREVIOUS_SECRETS only verify tokens
+// signed before a rotation.
+func keyRing(cfg *config.Config) (*auth.KeyRing, error) {
+	var previous []*auth.SigningKey
+	for _, path := range cfg.JWTPreviousKeys {
+		key, err := auth.LoadSigningKey(path)
+		if err != nil {
+			return nil, err
+		}
+		previous = append(previous, key)
+	}
+	for _, secret := range cfg.JWTPreviousSecrets {
+		previous = append(previous, auth.NewHMACKey([]byte(secret)))
+	}
+
+	if cfg.JWTSigningKey == "" {
+		if cfg.JWTSecret == "" {
+			return nil, errors.New("JWT_SECRET is not set")
+		}
+		return auth.NewKeyRing(auth.NewHMACKey([]byte(cfg.JWTSecret)), previous...)
+	}
+
+	active, err := auth.LoadSigningKey(cfg.JWTSigningKey)
+	if err != nil {
+		return nil, err
+	}
+	return auth.NewKeyRing(active, previous...)
+}
+
+// JWKS returns the handler for the /.well-known/jwks.json endpoint,
+// publishing the public keys of the key ring so that other services can
+// verify our tokens. Secrets are never published.
+func JWKS(cfg *config.Config) gin.HandlerFunc {
+	keys, err := keyRing(cfg)
+
+	return func(c *gin.Context) {
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Signing keys are not available"})
+			return
+		}
+		// Verifiers fetch the set again when they see an unknown kid, so
+		// a short cache lifetime is enough
+		c.Header("Cache-Control", "public, max-age=300")
+		c.JSON(http.StatusOK, keys.JWKS())
+	}
+}
@@ -0,0 +1,166 @@
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nicobistolfi/go-rest-api/internal/config"
+	logger "github.com/nicobistolfi/go-rest-api/pkg"
+	"github.com/nicobistolfi/go-rest-api/pkg/auth"
+)
+
+// writeECKey writes a new P-256 private key to a PEM file
+func writeECKey(t *testing.T) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "signing.pem")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600))
+	return path
+}
+
+func TestSetupRouterSigningKeys(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger.Init()
+
+	oldKey, newKey := writeECKey(t), writeECKey(t)
+	cfg := &config.Config{
+		JWTSecret:            "test_secret",
+		JWTSigningKey:        oldKey,
+		JWTExpirationMinutes: 1,
+		RefreshTokenExpiry:   time.Hour,
+		TokenVerifiers:       []string{config.VerifierJWT},
+		Clients:              []config.Client{{ID: "billing", SecretHash: auth.HashClientSecret("billing-secret")}},
+	}
+	store := config.NewStore(cfg)
+
+	r := gin.New()
+	SetupRouter(r, cfg, logger.Log, WithoutRateLimiting(), WithConfigStore(store))
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	issue := func() string {
+		req, _ := http.NewRequest("POST", server.URL+"/api/v1/token", strings.NewReader("grant_type=client_credentials"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("billing", "billing-secret")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var response map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+		return response["access_token"].(string)
+	}
+	profile := func(token string) int {
+		req, _ := http.NewRequest("GET", server.URL+"/api/v1/profile", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	oldToken := issue()
+	header, _, err := jwt.NewParser().ParseUnverified(oldToken, &auth.Claims{})
+	require.NoError(t, err)
+	assert.Equal(t, auth.AlgorithmES256, header.Method.Alg())
+	assert.NotEmpty(t, header.Header["kid"])
+	assert.Equal(t, http.StatusOK, profile(oldToken))
+
+	// Other services verify our tokens with the published keys
+	keys := auth.NewKeySet(server.URL+"/.well-known/jwks.json", nil, 0)
+	publicKey, err := keys.Key(context.Background(), header.Header["kid"].(string))
+	require.NoError(t, err)
+	_, err = jwt.Parse(oldToken, func(*jwt.Token) (any, error) { return publicKey, nil })
+	assert.NoError(t, err)
+
+	// After a rotation, tokens signed with the previous key stay valid
+	rotated := *cfg
+	rotated.JWTSigningKey = newKey
+	rotated.JWTPreviousKeys = []string{oldKey}
+	store.Reload(func() (*config.Config, error) { return &rotated, nil })
+
+	newToken := issue()
+	newHeader, _, err := jwt.NewParser().ParseUnverified(newToken, &auth.Claims{})
+	require.NoError(t, err)
+	assert.NotEqual(t, header.Header["kid"], newHeader.Header["kid"])
+	assert.Equal(t, http.StatusOK, profile(newToken))
+	assert.Equal(t, http.StatusOK, profile(oldToken))
+
+	resp, err := http.Get(server.URL + "/.well-known/jwks.json")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var set struct {
+		Keys []auth.JWK `json:"keys"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&set))
+	assert.Len(t, set.Keys, 2)
+	assert.Equal(t, newHeader.Header["kid"], set.Keys[0].Kid)
+
+	// Once the previous key is dropped, its tokens are rejected
+	dropped := rotated
+	dropped.JWTPreviousKeys = nil
+	store.Reload(func() (*config.Config, error) { return &dropped, nil })
+	assert.Equal(t, http.StatusUnauthorized, profile(oldToken))
+	assert.Equal(t, http.StatusOK, profile(newToken))
+}
+
+func TestSetupRouterRetiredSecret(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger.Init()
+
+	cfg := &config.Config{
+		JWTSecret:            "old_secret",
+		JWTExpirationMinutes: 1,
+		TokenVerifiers:       []string{config.VerifierJWT},
+	}
+	store := config.NewStore(cfg)
+
+	r := gin.New()
+	SetupRouter(r, cfg, logger.Log, WithoutRateLimiting(), WithConfigStore(store))
+	profile := func(token string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/profile", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	oldToken, err := auth.GenerateJWT([]byte(cfg.JWTSecret))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, profile(oldToken))
+
+	// JWT_SECRET no longer verifies tokens once a signing key is set
+	switched := *cfg
+	switched.JWTSigningKey = writeECKey(t)
+	store.Reload(func() (*config.Config, error) { return &switched, nil })
+	assert.Equal(t, http.StatusUnauthorized, profile(oldToken))
+
+	// unless it is listed as a previous secret
+	retired := switched
+	retired.JWTSecret = ""
+	retired.JWTPreviousSecrets = []string{"old_secret"}
+	store.Reload(func() (*config.Config, error) { return &retired, nil })
+	assert.Equal(t, http.StatusOK, profile(oldToken))
+}
@@ -0,0 +1,80 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/nicobistolfi/go-rest-api/pkg/auth"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// VerifyAPIKeyConfig configures the VerifyAPIKey middleware.
+type VerifyAPIKeyConfig struct {
+	// Store holds the hashed API keys.
+	Store auth.APIKeyStore
+	// Fallthrough passes credentials that are not API keys on to the next
+	// middleware instead of rejecting them.
+	Fallthrough bool
+}
+
+// VerifyAPIKey resolves API keys against cfg.Store without any external
+// call. Keys are accepted in the X-API-Key header, as a bearer token or in
+// the access_token query parameter. It stores the key under "api_key" and a
+// Profile for the key owner under "user".
+func VerifyAPIKey(cfg VerifyAPIKeyConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, verified := c.Get("user"); verified {
+			c.Next()
+			return
+		}
+
+		token := c.GetString("auth_token")
+		if token == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication token is missing"})
+			c.Abort()
+			return
+		}
+		if c.GetString("auth_header") == "Authorization" {
+			token = strings.TrimSpace(strings.TrimPrefix(token, "Bearer "))
+		}
+
+		if _, isAPIKey := auth.ParseAPIKeyID(token); !isAPIKey && cfg.Fallthrough {
+			c.Next()
+			return
+		}
+
+		key, err := auth.VerifyAPIKey(c.Request.Context(), cfg.Store, token)
+		switch {
+		case errors.Is(err, auth.ErrInvalidAPIKey), errors.Is(err, auth.ErrAPIKeyExpired):
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+			c.Abort()
+			return
+		case err != nil:
+			logger.Error("Failed to verify API key", zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to validate API key"})
+			c.Abort()
+			return
+		}
+
+		c.Set("api_key", key)
+		c.Set("user", Profile{
+			ID:     key.Owner,
+			Name:   key.Name,
+			Scopes: key.Scopes,
+		})
+		c.Next()
+	}
+}
+
+// APIKeyFromContext returns the key set by VerifyAPIKey.
+func APIKeyFromContext(c *gin.Context) (*auth.APIKey, bool) {
+	key, ok := c.Get("api_key")
+	if !ok {
+		return nil, false
+	}
+	typed, ok := key.(*auth.APIKey)
+	return typed, ok
+}
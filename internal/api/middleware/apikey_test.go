@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nicobistolfi/go-rest-api/pkg/auth"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestVerifyAPIKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	plaintext, key, err := auth.NewAPIKey("acme", "ci", []string{"orders:read"}, time.Time{})
+	if err != nil {
+		t.Fatalf("NewAPIKey() returned an error: %v", err)
+	}
+	store := auth.NewMemoryAPIKeyStore(key)
+
+	newRouter := func(cfg VerifyAPIKeyConfig, next ...gin.HandlerFunc) *gin.Engine {
+		r := gin.New()
+		r.Use(AuthMiddleware())
+		r.Use(VerifyAPIKey(cfg))
+		r.Use(next...)
+		r.GET("/test", func(c *gin.Context) {
+			user, _ := c.Get("user")
+			c.JSON(http.StatusOK, user)
+		})
+		return r
+	}
+	fallback := func(c *gin.Context) {
+		if _, ok := c.Get("user"); !ok {
+			c.Set("user", Profile{ID: "fallback"})
+		}
+		c.Next()
+	}
+	strict := newRouter(VerifyAPIKeyConfig{Store: store})
+	lenient := newRouter(VerifyAPIKeyConfig{Store: store, Fallthrough: true}, fallback)
+
+	tests := []struct {
+		name           string
+		router         *gin.Engine
+		header         string
+		value          string
+		expectedStatus int
+		expectedID     string
+	}{
+		{"Key in X-API-Key", strict, "X-API-Key", plaintext, http.StatusOK, "acme"},
+		{"Key as bearer token", strict, "Authorization", "Bearer " + plaintext, http.StatusOK, "acme"},
+		{"Wrong key", strict, "X-API-Key", auth.APIKeyPrefix + key.ID + "_wrong", http.StatusUnauthorized, ""},
+		{"Not an API key", strict, "Authorization", "Bearer token", http.StatusUnauthorized, ""},
+		{"Not an API key falls through", lenient, "Authorization", "Bearer token", http.StatusOK, "fallback"},
+		{"Wrong key does not fall through", lenient, "X-API-Key", auth.APIKeyPrefix + key.ID + "_wrong", http.StatusUnauthorized, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/test", nil)
+			req.Header.Set(tt.header, tt.value)
+			resp := httptest.NewRecorder()
+			tt.router.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedStatus {
+				t.Fatalf("Expected status %d, got %d", tt.expectedStatus, resp.Code)
+			}
+			if tt.expectedStatus == http.StatusOK {
+				var profile Profile
+				json.NewDecoder(resp.Body).Decode(&profile)
+				if profile.ID != tt.expectedID {
+					t.Errorf("Expected profile %q, got %q", tt.expectedID, profile.ID)
+				}
+			}
+		})
+	}
+}
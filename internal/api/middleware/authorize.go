@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequireScopes only lets requests through when the authenticated user was
+// granted every one of scopes. Use it after the token verification
+// middlewares. Requests without a user get 401, requests missing a scope
+// get 403 with the missing scopes in the body and in the WWW-Authenticate
+// header (RFC 6750).
+func RequireScopes(scopes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		profile, ok := authenticatedProfile(c)
+		if !ok {
+			return
+		}
+
+		var missing []string
+		for _, scope := range scopes {
+			if !slices.Contains(profile.Scopes, scope) {
+				missing = append(missing, scope)
+			}
+		}
+		if len(missing) > 0 {
+			c.Header("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, strings.Join(scopes, " ")))
+			c.JSON(http.StatusForbidden, gin.H{
+				"error":          "Insufficient scope",
+				"missing_scopes": missing,
+			})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireRole only lets requests through when the authenticated user has at
+// least one of roles. Use it after the token verification middlewares.
+// Requests without a user get 401, users without any of the roles get 403
+// with the required roles in the body.
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		profile, ok := authenticatedProfile(c)
+		if !ok {
+			return
+		}
+
+		for _, role := range roles {
+			if slices.Contains(profile.Roles, role) {
+				c.Next()
+				return
+			}
+		}
+		c.JSON(http.StatusForbidden, gin.H{
+			"error":          "Insufficient role",
+			"required_roles": roles,
+		})
+		c.Abort()
+	}
+}
+
+// authenticatedProfile returns the profile set by the token verification
+// middlewares, or aborts the request with 401
+func authenticatedProfile(c *gin.Context) (Profile, bool) {
+	user, _ := c.Get("user")
+	profile, ok := user.(Profile)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+		c.Abort()
+	}
+	return profile, ok
+}
@@ -0,0 +1,128 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/nicobistolfi/go-rest-api/pkg/auth"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRequireScopesAndRole(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	secret := []byte("secret")
+	newToken := func(roles []string, scopes ...string) string {
+		token, err := auth.GenerateJWTWithOptions(secret, tokenOptionsFor(roles, scopes))
+		if err != nil {
+			t.Fatalf("GenerateJWTWithOptions() returned an error: %v", err)
+		}
+		return token
+	}
+
+	r := gin.New()
+	r.Use(AuthMiddleware(), VerifyJWT(VerifyJWTConfig{Secret: secret}))
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	r.GET("/profile", RequireScopes("profile:read"), ok)
+	r.GET("/orders", RequireScopes("orders:read", "orders:write"), ok)
+	r.GET("/admin", RequireRole("admin", "owner"), ok)
+
+	tests := []struct {
+		name           string
+		path           string
+		token          string
+		expectedStatus int
+		expectedBody   map[string][]string
+	}{
+		{"Granted scope", "/profile", newToken(nil, "profile:read"), http.StatusOK, nil},
+		{"Missing scope", "/profile", newToken(nil, "orders:read"), http.StatusForbidden, map[string][]string{"missing_scopes": {"profile:read"}}},
+		{"Every scope is required", "/orders", newToken(nil, "orders:read"), http.StatusForbidden, map[string][]string{"missing_scopes": {"orders:write"}}},
+		{"One of the roles", "/admin", newToken([]string{"owner"}), http.StatusOK, nil},
+		{"Missing role", "/admin", newToken([]string{"viewer"}), http.StatusForbidden, map[string][]string{"required_roles": {"admin", "owner"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", tt.path, nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+			for field, want := range tt.expectedBody {
+				var body map[string]any
+				json.Unmarshal(w.Body.Bytes(), &body)
+				var got []string
+				for _, v := range body[field].([]any) {
+					got = append(got, v.(string))
+				}
+				if !slices.Equal(got, want) {
+					t.Errorf("Expected %s %v, got %v", field, want, got)
+				}
+			}
+		})
+	}
+
+	// The scope challenge lists every scope of the route
+	req, _ := http.NewRequest("GET", "/orders", nil)
+	req.Header.Set("Authorization", "Bearer "+newToken(nil))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if want := `Bearer error="insufficient_scope", scope="orders:read orders:write"`; w.Header().Get("WWW-Authenticate") != want {
+		t.Errorf("Expected WWW-Authenticate %q, got %q", want, w.Header().Get("WWW-Authenticate"))
+	}
+}
+
+func TestRequireScopesWithoutUser(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	r := gin.New()
+	r.GET("/test", RequireScopes("profile:read"), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/test", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestRemoteScopes(t *testing.T) {
+	githubHeader := http.Header{}
+	githubHeader.Set("X-OAuth-Scopes", "repo, read:user")
+
+	tests := []struct {
+		name     string
+		body     string
+		header   http.Header
+		expected []string
+	}{
+		{"Scopes array", `{"id":"1","scopes":["a","b"]}`, nil, []string{"a", "b"}},
+		{"Scope string", `{"id":"1","scope":"a b"}`, nil, []string{"a", "b"}},
+		{"GitHub header", `{"id":1,"login":"octocat"}`, githubHeader, []string{"repo", "read:user"}},
+		{"No scopes", `{"id":"1"}`, http.Header{}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := remoteScopes([]byte(tt.body), tt.header); !slices.Equal(got, tt.expected) {
+				t.Errorf("remoteScopes() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+// tokenOptionsFor returns the options of a token with roles and scopes
+func tokenOptionsFor(roles, scopes []string) auth.TokenOptions {
+	return auth.TokenOptions{
+		User:       &auth.User{ID: "42", Roles: roles},
+		Expiration: time.Hour,
+		Scopes:     scopes,
+	}
+}
@@ -2,18 +2,22 @@ package middleware
 
 import (
 	"net/http"
-	"os"
-	"strings"
 
 	"github.com/gin-gonic/gin"
 )
 
-func CORSMiddleware() gin.HandlerFunc {
+// CORSMiddleware reflects the request Origin back when it is one of
+// allowedOrigins, or when allowedOrigins contains "*".
+func CORSMiddleware(allowedOrigins []string) gin.HandlerFunc {
+	allowed := make(map[string]bool, len(allowedOrigins))
+	for _, origin := range allowedOrigins {
+		allowed[origin] = true
+	}
+
 	return func(c *gin.Context) {
 		origin := c.Request.Header.Get("Origin")
-		allowedOrigins := os.Getenv("ALLOWED_ORIGINS")
 
-		if origin != "" && (allowedOrigins == "*" || strings.Contains(allowedOrigins, origin)) {
+		if origin != "" && (allowed["*"] || allowed[origin]) {
 			c.Header("Access-Control-Allow-Origin", origin)
 		} else {
 			c.Header("Access-Control-Allow-Origin", "*")
@@ -3,7 +3,6 @@ package middleware
 import (
 	"net/http"
 	"net/http/httptest"
-	"os"
 	"testing"
 
 	"github.com/gin-gonic/gin"
@@ -13,21 +12,11 @@ func TestCORSMiddlewareFunc(t *testing.T) {
 	// Set Gin to Test Mode
 	gin.SetMode(gin.TestMode)
 
-	// Create a new Gin engine
-	r := gin.New()
-
-	// Use the CORSMiddleware
-	r.Use(CORSMiddleware())
-
-	// Define a test route
-	r.GET("/test", func(c *gin.Context) {
-		c.String(http.StatusOK, "test")
-	})
-
 	tests := []struct {
 		name            string
 		method          string
 		origin          string
+		allowedOrigins  []string
 		expectedStatus  int
 		expectedHeaders map[string]string
 	}{
@@ -35,6 +24,7 @@ func TestCORSMiddlewareFunc(t *testing.T) {
 			name:           "OPTIONS request",
 			method:         "OPTIONS",
 			origin:         "http://example.com",
+			allowedOrigins: []string{"http://example.com"},
 			expectedStatus: http.StatusOK,
 			expectedHeaders: map[string]string{
 				"Access-Control-Allow-Origin":      "http://example.com",
@@ -47,16 +37,43 @@ func TestCORSMiddlewareFunc(t *testing.T) {
 			name:           "GET request",
 			method:         "GET",
 			origin:         "http://example.com",
+			allowedOrigins: []string{"http://example.com"},
 			expectedStatus: http.StatusOK,
 			expectedHeaders: map[string]string{
 				"Access-Control-Allow-Origin": "http://example.com",
 			},
 		},
+		{
+			name:           "Wildcard allowed origins",
+			method:         "GET",
+			origin:         "http://other.com",
+			allowedOrigins: []string{"*"},
+			expectedStatus: http.StatusOK,
+			expectedHeaders: map[string]string{
+				"Access-Control-Allow-Origin": "http://other.com",
+			},
+		},
+		{
+			name:           "Origin not allowed",
+			method:         "GET",
+			origin:         "http://example.com.evil.com",
+			allowedOrigins: []string{"http://example.com"},
+			expectedStatus: http.StatusOK,
+			expectedHeaders: map[string]string{
+				"Access-Control-Allow-Origin": "*",
+			},
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			os.Setenv("ALLOWED_ORIGINS", tt.origin)
+			// Create a new Gin engine using the CORSMiddleware
+			r := gin.New()
+			r.Use(CORSMiddleware(tt.allowedOrigins))
+			r.GET("/test", func(c *gin.Context) {
+				c.String(http.StatusOK, "test")
+			})
+
 			req, _ := http.NewRequest(tt.method, "/test", nil)
 			req.Header.Set("Origin", tt.origin)
 			resp := httptest.NewRecorder()
@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// processFingerprintKey is generated per process, so fingerprints cannot be
+// precomputed from known tokens nor reversed from a heap dump or log. It is
+// used when no fingerprint key is configured.
+var processFingerprintKey = func() []byte {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		panic("middleware: failed to generate fingerprint key: " + err.Error())
+	}
+	return key
+}()
+
+// Fingerprint returns a keyed hash identifying credential, used in place of
+// the credential as a cache or rate limit key and in logs. The same
+// credential always has the same fingerprint within a process, so events
+// can be correlated without revealing it.
+func Fingerprint(credential string) string {
+	return FingerprintWithKey(nil, credential)
+}
+
+// FingerprintWithKey returns the fingerprint of credential computed with
+// key, or with the per-process key when key is empty. Every process
+// configured with the same key computes the same fingerprints, as required
+// to share a token cache such as a RedisTokenCache.
+func FingerprintWithKey(key []byte, credential string) string {
+	if len(key) == 0 {
+		key = processFingerprintKey
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(credential))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
@@ -0,0 +1,39 @@
+package middleware
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFingerprint(t *testing.T) {
+	token := "Bearer abcdefghijklmnopqrstuvwxyz"
+
+	fingerprint := Fingerprint(token)
+	if len(fingerprint) != 32 {
+		t.Errorf("Expected a 32 character fingerprint, got %q", fingerprint)
+	}
+	if Fingerprint(token) != fingerprint {
+		t.Error("Expected the same credential to have the same fingerprint")
+	}
+	if Fingerprint(token+"0") == fingerprint {
+		t.Error("Expected different credentials to have different fingerprints")
+	}
+	if strings.Contains(fingerprint, "abcdef") {
+		t.Errorf("Expected the fingerprint not to reveal the token, got %q", fingerprint)
+	}
+}
+
+func TestFingerprintWithKey(t *testing.T) {
+	token := "Bearer abcdefghijklmnopqrstuvwxyz"
+
+	if FingerprintWithKey(nil, token) != Fingerprint(token) {
+		t.Error("Expected an empty key to use the per-process key")
+	}
+	shared := FingerprintWithKey([]byte("shared-secret"), token)
+	if shared == Fingerprint(token) {
+		t.Error("Expected the fingerprint to change with the key")
+	}
+	if FingerprintWithKey([]byte("shared-secret"), token) != shared {
+		t.Error("Expected the same key to give the same fingerprint")
+	}
+}
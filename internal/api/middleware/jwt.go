@@ -0,0 +1,121 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nicobistolfi/go-rest-api/pkg/auth"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"go.uber.org/zap"
+)
+
+// VerifyJWTConfig configures the VerifyJWT middleware.
+type VerifyJWTConfig struct {
+	// Secret is the key the tokens were signed with (JWT_SECRET).
+	Secret []byte
+	// Keys, when set, verifies tokens against the keys of the ring, chosen
+	// by their kid header, instead of Secret.
+	Keys *auth.KeyRing
+	// Issuer and Audience, when not empty, must match the iss and aud claims.
+	Issuer   string
+	Audience string
+	// Leeway is the clock skew tolerated when checking exp, nbf and iat.
+	Leeway time.Duration
+	// Revocations, when set, is checked for the jti and sid claims of
+	// every token, so that revoked tokens are rejected before they expire.
+	Revocations auth.TokenStore
+	// Fallthrough passes tokens that were not signed with Secret or Keys on
+	// to the next middleware instead of rejecting them, so that another
+	// verifier can handle them. Tokens that were signed by us but are
+	// expired or meant for another audience are always rejected.
+	Fallthrough bool
+}
+
+// VerifyJWT validates the tokens issued by the /token endpoint locally,
+// without calling TOKEN_URL. It reads the credential set by AuthMiddleware
+// and stores the token claims under "claims" and the derived Profile under
+// "user".
+func VerifyJWT(cfg VerifyJWTConfig) gin.HandlerFunc {
+	opts := auth.VerifyOptions{
+		Issuer:   cfg.Issuer,
+		Audience: cfg.Audience,
+		Leeway:   cfg.Leeway,
+		Keys:     cfg.Keys,
+	}
+
+	return func(c *gin.Context) {
+		if _, verified := c.Get("user"); verified {
+			c.Next()
+			return
+		}
+
+		token := c.GetString("auth_token")
+		if token == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication token is missing"})
+			c.Abort()
+			return
+		}
+		if c.GetString("auth_header") == "Authorization" {
+			token = strings.TrimSpace(strings.TrimPrefix(token, "Bearer "))
+		}
+
+		claims, err := auth.ParseJWT(token, cfg.Secret, opts)
+		if err != nil {
+			if cfg.Fallthrough && !signedWithSecret(err) {
+				c.Next()
+				return
+			}
+			logger.Debug("JWT verification failed", zap.Error(err))
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			c.Abort()
+			return
+		}
+
+		if cfg.Revocations != nil {
+			revoked, err := auth.IsTokenRevoked(c.Request.Context(), cfg.Revocations, claims)
+			if err != nil {
+				logger.Error("Failed to check token revocation", zap.Error(err))
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to validate token"})
+				c.Abort()
+				return
+			}
+			if revoked {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Token has been revoked"})
+				c.Abort()
+				return
+			}
+		}
+
+		c.Set("claims", claims)
+		c.Set("user", Profile{
+			ID:     claims.Subject,
+			Email:  claims.Email,
+			Name:   claims.Username,
+			Roles:  claims.Roles,
+			Scopes: claims.Scopes(),
+		})
+		c.Next()
+	}
+}
+
+// ClaimsFromContext returns the claims set by VerifyJWT.
+func ClaimsFromContext(c *gin.Context) (*auth.Claims, bool) {
+	claims, ok := c.Get("claims")
+	if !ok {
+		return nil, false
+	}
+	typed, ok := claims.(*auth.Claims)
+	return typed, ok
+}
+
+// signedWithSecret reports whether a verification error happened after the
+// signature was checked, meaning the token was issued by us.
+func signedWithSecret(err error) bool {
+	return !errors.Is(err, jwt.ErrTokenMalformed) &&
+		!errors.Is(err, jwt.ErrTokenUnverifiable) &&
+		!errors.Is(err, jwt.ErrTokenSignatureInvalid)
+}
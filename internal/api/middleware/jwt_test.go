@@ -0,0 +1,153 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nicobistolfi/go-rest-api/pkg/auth"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestVerifyJWT(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	secret := []byte("test-secret")
+	issue := func(secret []byte, opts auth.TokenOptions) string {
+		token, err := auth.GenerateJWTWithOptions(secret, opts)
+		if err != nil {
+			t.Fatalf("Failed to generate JWT: %v", err)
+		}
+		return token
+	}
+	valid := issue(secret, auth.TokenOptions{Expiration: time.Hour, Issuer: "go-rest-api", Audience: []string{"api"}})
+
+	r := gin.New()
+	r.Use(AuthMiddleware())
+	r.Use(VerifyJWT(VerifyJWTConfig{Secret: secret, Issuer: "go-rest-api", Audience: "api"}))
+	r.GET("/test", func(c *gin.Context) {
+		claims, ok := ClaimsFromContext(c)
+		if !ok {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		user, _ := c.Get("user")
+		c.JSON(http.StatusOK, gin.H{"user": user, "issuer": claims.Issuer})
+	})
+
+	tests := []struct {
+		name           string
+		header         string
+		value          string
+		expectedStatus int
+	}{
+		{"Valid bearer token", "Authorization", "Bearer " + valid, http.StatusOK},
+		{"Valid token without Bearer prefix", "Authorization", valid, http.StatusOK},
+		{"Valid token in X-API-Key", "X-API-Key", valid, http.StatusOK},
+		{"Expired token", "Authorization", "Bearer " + issue(secret, auth.TokenOptions{Expiration: -time.Minute, Issuer: "go-rest-api", Audience: []string{"api"}}), http.StatusUnauthorized},
+		{"Wrong audience", "Authorization", "Bearer " + issue(secret, auth.TokenOptions{Expiration: time.Hour, Issuer: "go-rest-api", Audience: []string{"other"}}), http.StatusUnauthorized},
+		{"Wrong secret", "Authorization", "Bearer " + issue([]byte("other-secret"), auth.TokenOptions{Expiration: time.Hour}), http.StatusUnauthorized},
+		{"Opaque token", "Authorization", "Bearer opaque_token", http.StatusUnauthorized},
+		{"Missing token", "", "", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/test", nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			resp := httptest.NewRecorder()
+			r.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, resp.Code)
+			}
+
+			if tt.expectedStatus == http.StatusOK {
+				var body struct {
+					User   Profile `json:"user"`
+					Issuer string  `json:"issuer"`
+				}
+				json.NewDecoder(resp.Body).Decode(&body)
+				if body.User.ID != "123456" || body.User.Name != "user" || body.Issuer != "go-rest-api" {
+					t.Errorf("Unexpected profile data: %+v", body)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyJWTFallthrough(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	secret := []byte("test-secret")
+	remoteCalls := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteCalls++
+		if r.Header.Get("Authorization") != "Bearer opaque_token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(Profile{ID: "remote"})
+	}))
+	defer mockServer.Close()
+
+	r := gin.New()
+	r.Use(AuthMiddleware())
+	r.Use(VerifyJWT(VerifyJWTConfig{Secret: secret, Fallthrough: true}))
+	r.Use(VerifyToken(VerifyTokenConfig{TokenURL: mockServer.URL}))
+	r.GET("/test", func(c *gin.Context) {
+		user, _ := c.Get("user")
+		c.JSON(http.StatusOK, user)
+	})
+
+	local, err := auth.GenerateJWTWithExpiration(secret, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to generate JWT: %v", err)
+	}
+	expired, err := auth.GenerateJWTWithExpiration(secret, -time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to generate JWT: %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		token          string
+		expectedStatus int
+		expectedID     string
+		expectedCalls  int
+	}{
+		{"Local token is verified locally", local, http.StatusOK, "123456", 0},
+		{"Expired local token is rejected locally", expired, http.StatusUnauthorized, "", 0},
+		{"Opaque token falls through", "opaque_token", http.StatusOK, "remote", 1},
+		{"Unknown token is rejected remotely", "unknown_token", http.StatusUnauthorized, "", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remoteCalls = 0
+			req, _ := http.NewRequest("GET", "/test", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			resp := httptest.NewRecorder()
+			r.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, resp.Code)
+			}
+			if remoteCalls != tt.expectedCalls {
+				t.Errorf("Expected %d calls to TOKEN_URL, got %d", tt.expectedCalls, remoteCalls)
+			}
+			if tt.expectedStatus == http.StatusOK {
+				var profile Profile
+				json.NewDecoder(resp.Body).Decode(&profile)
+				if profile.ID != tt.expectedID {
+					t.Errorf("Expected profile %q, got %q", tt.expectedID, profile.ID)
+				}
+			}
+		})
+	}
+}
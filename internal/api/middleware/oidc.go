@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nicobistolfi/go-rest-api/pkg/auth"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// VerifyOIDCConfig configures the VerifyOIDC middleware.
+type VerifyOIDCConfig struct {
+	// Issuer is the OpenID Connect provider, e.g. https://accounts.google.com.
+	Issuer string
+	// Audience, when not empty, must be one of the aud claim values.
+	Audience string
+	// Leeway is the clock skew tolerated when checking exp, nbf and iat.
+	Leeway time.Duration
+	// RefreshInterval is the minimum time between two JWKS fetches caused
+	// by tokens signed with an unknown key.
+	RefreshInterval time.Duration
+	// Client is used for discovery and JWKS requests.
+	Client *http.Client
+	// Fallthrough passes tokens from other issuers on to the next
+	// middleware instead of rejecting them.
+	Fallthrough bool
+	// ProfileMapper, when set, builds the profile from the token claims
+	// instead of the standard sub, email, name, roles and scope claims.
+	ProfileMapper ProfileMapper
+}
+
+// VerifyOIDC validates RS256 and ES256 tokens issued by an OpenID Connect
+// provider against the provider JWKS, without calling TOKEN_URL. It stores
+// the token claims under "oidc_claims" and the derived Profile under "user".
+func VerifyOIDC(cfg VerifyOIDCConfig) gin.HandlerFunc {
+	verifier := auth.NewOIDCVerifier(cfg.Issuer, auth.OIDCOptions{
+		Audience:           cfg.Audience,
+		Leeway:             cfg.Leeway,
+		MinRefreshInterval: cfg.RefreshInterval,
+		Client:             cfg.Client,
+	})
+
+	return func(c *gin.Context) {
+		if _, verified := c.Get("user"); verified {
+			c.Next()
+			return
+		}
+
+		token := c.GetString("auth_token")
+		if token == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authentication token is missing"})
+			c.Abort()
+			return
+		}
+		if c.GetString("auth_header") == "Authorization" {
+			token = strings.TrimSpace(strings.TrimPrefix(token, "Bearer "))
+		}
+
+		if cfg.Fallthrough && !verifier.IssuedBy(token) {
+			c.Next()
+			return
+		}
+
+		claims, err := verifier.Verify(c.Request.Context(), token)
+		if errors.Is(err, auth.ErrIssuerUnavailable) {
+			logger.Error("Failed to fetch OIDC signing keys", zap.String("issuer", verifier.Issuer()), zap.Error(err))
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to validate token"})
+			c.Abort()
+			return
+		}
+		if err != nil {
+			logger.Debug("OIDC verification failed", zap.Error(err))
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			c.Abort()
+			return
+		}
+
+		profile := Profile{
+			ID:     claims.Subject,
+			Email:  claims.Email,
+			Name:   claims.Name,
+			Roles:  claims.Roles,
+			Scopes: claims.Scopes(),
+		}
+		if profile.Name == "" {
+			profile.Name = claims.PreferredUsername
+		}
+		if cfg.ProfileMapper != nil {
+			if profile, err = mapTokenClaims(cfg.ProfileMapper, token); err != nil {
+				logger.Error("Failed to map profile", zap.Error(err))
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse profile"})
+				c.Abort()
+				return
+			}
+		}
+		c.Set("oidc_claims", claims)
+		c.Set("user", profile)
+		c.Next()
+	}
+}
+
+// OIDCClaimsFromContext returns the claims set by VerifyOIDC.
+func OIDCClaimsFromContext(c *gin.Context) (*auth.OIDCClaims, bool) {
+	claims, ok := c.Get("oidc_claims")
+	if !ok {
+		return nil, false
+	}
+	typed, ok := claims.(*auth.OIDCClaims)
+	return typed, ok
+}
+
+// mapTokenClaims maps the payload of a verified JWT with mapper.
+func mapTokenClaims(mapper ProfileMapper, token string) (Profile, error) {
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return Profile{}, errors.New("token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(segments[1])
+	if err != nil {
+		return Profile{}, fmt.Errorf("failed to decode token claims: %w", err)
+	}
+	return mapper.MapProfile(payload, nil)
+}
@@ -0,0 +1,137 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestVerifyOIDC(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var issuer *httptest.Server
+	issuer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"issuer": issuer.URL, "jwks_uri": issuer.URL + "/jwks"})
+		case "/jwks":
+			json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+				"kid": "k1",
+				"kty": "RSA",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer issuer.Close()
+
+	claims := func(iss string) jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":                iss,
+			"sub":                "jane",
+			"aud":                "api",
+			"email":              "jane@example.com",
+			"preferred_username": "jane.doe",
+			"exp":                time.Now().Add(time.Hour).Unix(),
+		}
+	}
+	sign := func(claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "k1"
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatalf("Failed to sign token: %v", err)
+		}
+		return signed
+	}
+
+	newRouter := func(cfg VerifyOIDCConfig, next ...gin.HandlerFunc) *gin.Engine {
+		r := gin.New()
+		r.Use(AuthMiddleware())
+		r.Use(VerifyOIDC(cfg))
+		r.Use(next...)
+		r.GET("/test", func(c *gin.Context) {
+			claims, _ := OIDCClaimsFromContext(c)
+			user, _ := c.Get("user")
+			c.JSON(http.StatusOK, gin.H{"user": user, "claims": claims})
+		})
+		return r
+	}
+	fallback := func(c *gin.Context) {
+		if _, ok := c.Get("user"); !ok {
+			c.Set("user", Profile{ID: "fallback"})
+		}
+		c.Next()
+	}
+
+	foreignAudience := claims(issuer.URL)
+	foreignAudience["aud"] = "other-client"
+	noSubject := claims(issuer.URL)
+	delete(noSubject, "sub")
+
+	strict := newRouter(VerifyOIDCConfig{Issuer: issuer.URL, Audience: "api"})
+	lenient := newRouter(VerifyOIDCConfig{Issuer: issuer.URL, Audience: "api", Fallthrough: true}, fallback)
+	unavailable := newRouter(VerifyOIDCConfig{Issuer: "http://127.0.0.1:1"})
+	mapped := newRouter(VerifyOIDCConfig{Issuer: issuer.URL, Audience: "api", ProfileMapper: mustFieldMapper(FieldMapping{ID: "preferred_username"})})
+
+	tests := []struct {
+		name           string
+		router         *gin.Engine
+		token          string
+		expectedStatus int
+		expectedID     string
+	}{
+		{"Valid token", strict, sign(claims(issuer.URL)), http.StatusOK, "jane"},
+		{"Other issuer", strict, sign(claims("https://other.example.com")), http.StatusUnauthorized, ""},
+		{"Foreign audience", strict, sign(foreignAudience), http.StatusUnauthorized, ""},
+		{"Foreign audience does not fall through", lenient, sign(foreignAudience), http.StatusUnauthorized, ""},
+		{"Without subject", strict, sign(noSubject), http.StatusUnauthorized, ""},
+		{"Opaque token", strict, "opaque_token", http.StatusUnauthorized, ""},
+		{"Valid token with fallthrough", lenient, sign(claims(issuer.URL)), http.StatusOK, "jane"},
+		{"Other issuer falls through", lenient, sign(claims("https://other.example.com")), http.StatusOK, "fallback"},
+		{"Opaque token falls through", lenient, "opaque_token", http.StatusOK, "fallback"},
+		{"Valid token with profile mapper", mapped, sign(claims(issuer.URL)), http.StatusOK, "jane.doe"},
+		{"Issuer unavailable", unavailable, sign(claims("http://127.0.0.1:1")), http.StatusInternalServerError, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/test", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			resp := httptest.NewRecorder()
+			tt.router.ServeHTTP(resp, req)
+
+			if resp.Code != tt.expectedStatus {
+				t.Fatalf("Expected status %d, got %d", tt.expectedStatus, resp.Code)
+			}
+			if tt.expectedStatus == http.StatusOK {
+				var body struct {
+					User Profile `json:"user"`
+				}
+				json.NewDecoder(resp.Body).Decode(&body)
+				if body.User.ID != tt.expectedID {
+					t.Errorf("Expected profile %q, got %q", tt.expectedID, body.User.ID)
+				}
+				if tt.expectedID == "jane" && (body.User.Email != "jane@example.com" || body.User.Name != "jane.doe") {
+					t.Errorf("Unexpected profile data: %+v", body.User)
+				}
+			}
+		})
+	}
+}
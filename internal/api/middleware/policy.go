@@ -0,0 +1,127 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/nicobistolfi/go-rest-api/pkg/policy"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+)
+
+// AuthorizeConfig configures the Authorize middleware.
+type AuthorizeConfig struct {
+	// Policy decides on every request.
+	Policy *policy.Policy
+	// DryRun logs the requests the policy denies without rejecting them,
+	// to audit a new policy before enforcing it.
+	DryRun bool
+}
+
+// Authorize evaluates cfg.Policy for the authenticated user, the HTTP
+// method and the matched route, and rejects denied requests with 403.
+// Every decision is logged. Use it after the token verification
+// middlewares.
+func Authorize(cfg AuthorizeConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		profile, ok := authenticatedProfile(c)
+		if !ok {
+			return
+		}
+
+		req := policyRequest(c, profile)
+		decision := cfg.Policy.Evaluate(req)
+
+		fields := []zap.Field{
+			zap.Bool("allowed", decision.Allowed),
+			zap.String("rule", decision.Rule),
+			zap.String("subject", profile.ID),
+			zap.String("action", req.Action),
+			zap.String("resource", req.Resource),
+			zap.String("path", c.Request.URL.Path),
+			zap.Bool("dry_run", cfg.DryRun),
+		}
+		switch {
+		case decision.Allowed:
+			logger.Info("Policy decision", fields...)
+		case cfg.DryRun:
+			logger.Warn("Policy decision, not enforced", fields...)
+		default:
+			logger.Warn("Policy decision", fields...)
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied by policy"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// policyRequest returns the policy request for profile calling the route
+// matched by c. The subject attributes are id, email, email_domain, name,
+// roles, scopes and claims.<name> for the claims of a profile mapper; the
+// route parameters are the resource attributes.
+func policyRequest(c *gin.Context, profile Profile) policy.Request {
+	_, domain, _ := strings.Cut(profile.Email, "@")
+	resource := c.FullPath()
+	if resource == "" {
+		resource = c.Request.URL.Path
+	}
+
+	params := make(map[string]string, len(c.Params))
+	for _, param := range c.Params {
+		params[param.Key] = param.Value
+	}
+
+	subject := map[string]any{
+		"id":           profile.ID,
+		"email":        profile.Email,
+		"email_domain": domain,
+		"name":         profile.Name,
+		"roles":        profile.Roles,
+		"scopes":       profile.Scopes,
+	}
+	for name, value := range profile.Claims {
+		if attribute, ok := claimAttribute(value); ok {
+			subject["claims."+name] = attribute
+		}
+	}
+
+	return policy.Request{
+		Subject:  subject,
+		Action:   c.Request.Method,
+		Resource: resource,
+		Params:   params,
+	}
+}
+
+// claimAttribute converts a claim to a policy attribute. Strings, numbers
+// and booleans become strings, and lists of them string slices. Objects
+// cannot be compared by the policy and are left out.
+func claimAttribute(value any) (any, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	case []string:
+		return v, true
+	case []any:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			if attribute, ok := claimAttribute(item); ok {
+				if s, isString := attribute.(string); isString {
+					list = append(list, s)
+				}
+			}
+		}
+		return list, true
+	}
+	return nil, false
+}
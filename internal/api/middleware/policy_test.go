@@ -0,0 +1,143 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nicobistolfi/go-rest-api/pkg/policy"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAuthorize(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p, err := policy.New(
+		policy.Rule{
+			Name:       "read-own-profile",
+			Effect:     policy.EffectAllow,
+			Actions:    []string{"GET"},
+			Resources:  []string{"/users/:id"},
+			Conditions: []string{"subject.id == resource.id"},
+		},
+		policy.Rule{
+			Name:       "example-staff",
+			Effect:     policy.EffectAllow,
+			Actions:    []string{"*"},
+			Resources:  []string{"/users/:id"},
+			Conditions: []string{"subject.email_domain == example.com"},
+		},
+	)
+	if err != nil {
+		t.Fatalf("policy.New() returned an error: %v", err)
+	}
+
+	newRouter := func(cfg AuthorizeConfig) *gin.Engine {
+		r := gin.New()
+		r.Use(func(c *gin.Context) {
+			if id := c.GetHeader("X-User"); id != "" {
+				c.Set("user", Profile{ID: id, Email: c.GetHeader("X-Email")})
+			}
+		})
+		r.Use(Authorize(cfg))
+		r.Any("/users/:id", func(c *gin.Context) { c.Status(http.StatusOK) })
+		return r
+	}
+	enforced := newRouter(AuthorizeConfig{Policy: p})
+	dryRun := newRouter(AuthorizeConfig{Policy: p, DryRun: true})
+
+	tests := []struct {
+		name           string
+		router         *gin.Engine
+		method         string
+		path           string
+		user, email    string
+		expectedStatus int
+	}{
+		{"Own profile", enforced, "GET", "/users/42", "42", "", http.StatusOK},
+		{"Other profile", enforced, "GET", "/users/43", "42", "jane@gmail.com", http.StatusForbidden},
+		{"Not an allowed action", enforced, "DELETE", "/users/42", "42", "", http.StatusForbidden},
+		{"Subject attribute", enforced, "DELETE", "/users/43", "42", "jane@example.com", http.StatusOK},
+		{"Unauthenticated", enforced, "GET", "/users/42", "", "", http.StatusUnauthorized},
+		{"Dry run does not enforce", dryRun, "GET", "/users/43", "42", "", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, tt.path, nil)
+			req.Header.Set("X-User", tt.user)
+			req.Header.Set("X-Email", tt.email)
+			w := httptest.NewRecorder()
+			tt.router.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestAuthorizeMappedClaims(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	p, err := policy.New(
+		policy.Rule{
+			Name:       "tenant-members",
+			Effect:     policy.EffectAllow,
+			Actions:    []string{"GET"},
+			Resources:  []string{"/tenants/:id"},
+			Conditions: []string{"subject.claims.tenant == resource.id"},
+		},
+		policy.Rule{
+			Name:       "support",
+			Effect:     policy.EffectAllow,
+			Actions:    []string{"GET"},
+			Resources:  []string{"/tenants/:id"},
+			Conditions: []string{"subject.claims.groups contains support", "subject.claims.level in [2, 3]"},
+		},
+	)
+	if err != nil {
+		t.Fatalf("policy.New() returned an error: %v", err)
+	}
+
+	mapper := mustFieldMapper(FieldMapping{
+		ID:     "id",
+		Claims: map[string]string{"tenant": "app_metadata.tenant", "groups": "groups", "level": "level"},
+	})
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		profile, err := mapper.MapProfile([]byte(c.GetHeader("X-Profile")), nil)
+		if err != nil {
+			t.Errorf("MapProfile() returned an error: %v", err)
+		}
+		c.Set("user", profile)
+	})
+	r.Use(Authorize(AuthorizeConfig{Policy: p}))
+	r.GET("/tenants/:id", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	tests := []struct {
+		name           string
+		profile        string
+		expectedStatus int
+	}{
+		{"Mapped claim", `{"id":"u1","app_metadata":{"tenant":"acme"}}`, http.StatusOK},
+		{"Other tenant", `{"id":"u1","app_metadata":{"tenant":"globex"}}`, http.StatusForbidden},
+		{"Missing claim", `{"id":"u1"}`, http.StatusForbidden},
+		{"Mapped list and number", `{"id":"u1","groups":["support"],"level":2}`, http.StatusOK},
+		{"Object claim", `{"id":"u1","app_metadata":{"tenant":{"id":"acme"}}}`, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/tenants/acme", nil)
+			req.Header.Set("X-Profile", tt.profile)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d: %s", tt.expectedStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ProfileMapper builds a Profile from the body and headers of an upstream
+// response, such as the TOKEN_URL response or the claims of an OIDC token.
+type ProfileMapper interface {
+	MapProfile(body []byte, header http.Header) (Profile, error)
+}
+
+// ProfileMapperFunc adapts a function to ProfileMapper.
+type ProfileMapperFunc func(body []byte, header http.Header) (Profile, error)
+
+// MapProfile implements ProfileMapper.
+func (f ProfileMapperFunc) MapProfile(body []byte, header http.Header) (Profile, error) {
+	return f(body, header)
+}
+
+// FieldMapping tells a field mapper where each Profile field is in a JSON
+// document. Paths are JSON pointers (/app_metadata/roles) or dotted paths
+// (app_metadata.roles), and several paths separated by | are tried in
+// order. Roles and Scopes read lists, or strings separated by spaces or
+// commas.
+type FieldMapping struct {
+	ID     string
+	Email  string
+	Name   string
+	Roles  string
+	Scopes string
+	// Claims are copied into Profile.Claims, keyed by name
+	Claims map[string]string
+}
+
+// Built-in mappers.
+var (
+	// GenericProfileMapper reads a Profile shaped document, accepting sub
+	// for id and a space separated scope string for scopes.
+	GenericProfileMapper = mustFieldMapper(FieldMapping{
+		ID:     "id|sub",
+		Email:  "email",
+		Name:   "name|preferred_username",
+		Roles:  "roles",
+		Scopes: "scopes|scope",
+	})
+	// GoogleProfileMapper reads the responses of the Google userinfo and
+	// tokeninfo endpoints.
+	GoogleProfileMapper = mustFieldMapper(FieldMapping{
+		ID:     "sub|id|user_id",
+		Email:  "email",
+		Name:   "name",
+		Scopes: "scope",
+	})
+	// GitHubProfileMapper reads the response of the GitHub /user endpoint.
+	// The login stands in for private emails, and the scopes are read from
+	// the X-OAuth-Scopes header.
+	GitHubProfileMapper ProfileMapper = ProfileMapperFunc(func(body []byte, header http.Header) (Profile, error) {
+		profile, err := githubFields.MapProfile(body, header)
+		if err != nil {
+			return Profile{}, err
+		}
+		profile.Scopes = oauthScopes(header)
+		return profile, nil
+	})
+	githubFields = mustFieldMapper(FieldMapping{ID: "id", Email: "email|login", Name: "name"})
+)
+
+// defaultProfileMapper reads a Profile shaped document and falls back to the
+// GitHub /user shape when that fails.
+var defaultProfileMapper ProfileMapper = ProfileMapperFunc(func(body []byte, header http.Header) (Profile, error) {
+	var profile Profile
+	if err := json.Unmarshal(body, &profile); err != nil {
+		if profile, err = GitHubProfileMapper.MapProfile(body, header); err != nil {
+			return Profile{}, err
+		}
+	}
+	profile.Scopes = remoteScopes(body, header)
+	return profile, nil
+})
+
+// ProfileMappers are the built-in mappers by name.
+var ProfileMappers = map[string]ProfileMapper{
+	"generic": GenericProfileMapper,
+	"github":  GitHubProfileMapper,
+	"google":  GoogleProfileMapper,
+}
+
+// fieldMapper implements ProfileMapper for a FieldMapping.
+type fieldMapper struct {
+	id, email, name, roles, scopes []jsonPath
+	claims                         map[string][]jsonPath
+}
+
+// NewFieldMapper returns a mapper reading the fields of mapping. The ID
+// path is required.
+func NewFieldMapper(mapping FieldMapping) (ProfileMapper, error) {
+	if mapping.ID == "" {
+		return nil, errors.New("the id path is required")
+	}
+
+	var errs []error
+	parse := func(field, paths string) []jsonPath {
+		parsed, err := parsePaths(paths)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", field, err))
+		}
+		return parsed
+	}
+	m := &fieldMapper{
+		id:     parse("id", mapping.ID),
+		email:  parse("email", mapping.Email),
+		name:   parse("name", mapping.Name),
+		roles:  parse("roles", mapping.Roles),
+		scopes: parse("scopes", mapping.Scopes),
+		claims: make(map[string][]jsonPath, len(mapping.Claims)),
+	}
+	for claim, paths := range mapping.Claims {
+		m.claims[claim] = parse("claims."+claim, paths)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return m, nil
+}
+
+func mustFieldMapper(mapping FieldMapping) ProfileMapper {
+	m, err := NewFieldMapper(mapping)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// MapProfile implements ProfileMapper.
+func (m *fieldMapper) MapProfile(body []byte, _ http.Header) (Profile, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var doc any
+	if err := decoder.Decode(&doc); err != nil {
+		return Profile{}, fmt.Errorf("failed to parse profile: %w", err)
+	}
+
+	id := stringValue(lookup(doc, m.id))
+	if id == "" {
+		return Profile{}, errors.New("profile has no id")
+	}
+	profile := Profile{
+		ID:     id,
+		Email:  stringValue(lookup(doc, m.email)),
+		Name:   stringValue(lookup(doc, m.name)),
+		Roles:  listValue(lookup(doc, m.roles)),
+		Scopes: listValue(lookup(doc, m.scopes)),
+	}
+	for claim, paths := range m.claims {
+		if value := lookup(doc, paths); value != nil {
+			if profile.Claims == nil {
+				profile.Claims = make(map[string]any, len(m.claims))
+			}
+			profile.Claims[claim] = value
+		}
+	}
+	return profile, nil
+}
+
+// jsonPath is a parsed path to a value in a JSON document.
+type jsonPath []string
+
+// parsePaths parses |-separated JSON pointers or dotted paths.
+func parsePaths(s string) ([]jsonPath, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var paths []jsonPath
+	for _, raw := range strings.Split(s, "|") {
+		raw = strings.TrimSpace(raw)
+		var path jsonPath
+		if pointer, ok := strings.CutPrefix(raw, "/"); ok {
+			// RFC 6901: ~1 stands for / and ~0 for ~
+			for _, token := range strings.Split(pointer, "/") {
+				if strings.Contains(strings.NewReplacer("~0", "", "~1", "").Replace(token), "~") {
+					return nil, fmt.Errorf("%q is not a valid JSON pointer", raw)
+				}
+				path = append(path, strings.NewReplacer("~1", "/", "~0", "~").Replace(token))
+			}
+		} else {
+			path = strings.Split(raw, ".")
+			for _, segment := range path {
+				if segment == "" {
+					return nil, fmt.Errorf("%q is not a valid path", raw)
+				}
+			}
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// lookup returns the first non-null value found at paths in doc.
+func lookup(doc any, paths []jsonPath) any {
+	for _, path := range paths {
+		value := doc
+		for _, segment := range path {
+			switch node := value.(type) {
+			case map[string]any:
+				value = node[segment]
+			case []any:
+				i, err := strconv.Atoi(segment)
+				if err != nil || i < 0 || i >= len(node) {
+					value = nil
+				} else {
+					value = node[i]
+				}
+			default:
+				value = nil
+			}
+		}
+		if value != nil {
+			return value
+		}
+	}
+	return nil
+}
+
+// stringValue returns strings, numbers and booleans as a string.
+func stringValue(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
+
+// listValue returns a list of scalars, or a string split on spaces and
+// commas, as a list of strings.
+func listValue(value any) []string {
+	switch v := value.(type) {
+	case []any:
+		var list []string
+		for _, item := range v {
+			if s := stringValue(item); s != "" {
+				list = append(list, s)
+			}
+		}
+		return list
+	case string:
+		return strings.FieldsFunc(v, func(r rune) bool { return r == ' ' || r == ',' })
+	}
+	return nil
+}
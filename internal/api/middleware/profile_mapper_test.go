@@ -0,0 +1,142 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestProfileMappers(t *testing.T) {
+	custom, err := NewFieldMapper(FieldMapping{
+		ID:     "/user/uuid",
+		Email:  "user.emails.0",
+		Name:   "user.display_name|user.login",
+		Roles:  "/app_metadata/roles",
+		Scopes: "permissions",
+		Claims: map[string]string{"tenant": "/app_metadata/tenant", "a/b": "/a~1b", "missing": "nope"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		mapper   ProfileMapper
+		body     string
+		header   http.Header
+		expected Profile
+		wantErr  bool
+	}{
+		{
+			name:     "Generic",
+			mapper:   GenericProfileMapper,
+			body:     `{"sub":"u1","email":"jane@example.com","preferred_username":"jane","roles":["admin"],"scope":"read write"}`,
+			expected: Profile{ID: "u1", Email: "jane@example.com", Name: "jane", Roles: []string{"admin"}, Scopes: []string{"read", "write"}},
+		},
+		{
+			name:     "GitHub",
+			mapper:   GitHubProfileMapper,
+			body:     `{"id":42,"login":"octocat","name":"The Octocat","email":null}`,
+			header:   http.Header{"X-Oauth-Scopes": {"repo, user"}},
+			expected: Profile{ID: "42", Email: "octocat", Name: "The Octocat", Scopes: []string{"repo", "user"}},
+		},
+		{
+			name:     "Google",
+			mapper:   GoogleProfileMapper,
+			body:     `{"sub":"1089","email":"jane@gmail.com","name":"Jane","scope":"openid email"}`,
+			expected: Profile{ID: "1089", Email: "jane@gmail.com", Name: "Jane", Scopes: []string{"openid", "email"}},
+		},
+		{
+			name:   "Field mapping",
+			mapper: custom,
+			body:   `{"user":{"uuid":"u2","emails":["jane@example.com"],"login":"jane"},"app_metadata":{"roles":"admin,editor","tenant":"acme"},"permissions":["read"],"a/b":true}`,
+			expected: Profile{
+				ID:     "u2",
+				Email:  "jane@example.com",
+				Name:   "jane",
+				Roles:  []string{"admin", "editor"},
+				Scopes: []string{"read"},
+				Claims: map[string]any{"tenant": "acme", "a/b": true},
+			},
+		},
+		{name: "Missing id", mapper: GenericProfileMapper, body: `{"email":"jane@example.com"}`, wantErr: true},
+		{name: "Invalid JSON", mapper: GenericProfileMapper, body: `not json`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile, err := tt.mapper.MapProfile([]byte(tt.body), tt.header)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Expected an error, got %+v", profile)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(profile, tt.expected) {
+				t.Errorf("Expected %+v, got %+v", tt.expected, profile)
+			}
+		})
+	}
+}
+
+func TestNewFieldMapper(t *testing.T) {
+	tests := []struct {
+		name    string
+		mapping FieldMapping
+	}{
+		{"Missing id", FieldMapping{Email: "email"}},
+		{"Invalid pointer", FieldMapping{ID: "/a~2"}},
+		{"Empty segment", FieldMapping{ID: "user..id"}},
+		{"Invalid claim", FieldMapping{ID: "id", Claims: map[string]string{"tenant": "a..b"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewFieldMapper(tt.mapping); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
+
+func TestVerifyTokenProfileMapper(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"sub":"u1","email":"jane@example.com","org":{"id":"acme"}}`))
+	}))
+	defer mockServer.Close()
+
+	mapper := mustFieldMapper(FieldMapping{ID: "sub", Email: "email", Claims: map[string]string{"org": "org.id"}})
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set("auth_token", "Bearer token")
+		c.Set("auth_header", "Authorization")
+		c.Next()
+	})
+	r.Use(VerifyToken(VerifyTokenConfig{TokenURL: mockServer.URL, ProfileMapper: mapper}))
+	r.GET("/test", func(c *gin.Context) {
+		user, _ := c.Get("user")
+		c.JSON(http.StatusOK, user)
+	})
+
+	req, _ := http.NewRequest("GET", "/test", nil)
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, resp.Code)
+	}
+	var profile Profile
+	json.NewDecoder(resp.Body).Decode(&profile)
+	if profile.ID != "u1" || profile.Email != "jane@example.com" || profile.Claims["org"] != "acme" {
+		t.Errorf("Unexpected profile: %+v", profile)
+	}
+}
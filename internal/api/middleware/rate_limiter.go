@@ -9,7 +9,29 @@ import (
 	"golang.org/x/time/rate"
 )
 
+// RateLimiterConfig configures RateLimiterWithConfig.
+type RateLimiterConfig struct {
+	// Limit and Burst configure the token bucket of every client, keyed on
+	// its IP and the fingerprint of its credential.
+	Limit rate.Limit
+	Burst int
+	// KeyPrefix, when set, is prepended to every client key.
+	KeyPrefix string
+	// FingerprintKey is the key of the credential fingerprints, which are
+	// also logged. When empty, the per-process key is used.
+	FingerprintKey []byte
+}
+
 func RateLimiter(r rate.Limit, b int, keyPrefixes ...string) gin.HandlerFunc {
+	cfg := RateLimiterConfig{Limit: r, Burst: b}
+	if len(keyPrefixes) > 0 {
+		cfg.KeyPrefix = keyPrefixes[0]
+	}
+	return RateLimiterWithConfig(cfg)
+}
+
+// RateLimiterWithConfig returns a rate limiter configured by cfg.
+func RateLimiterWithConfig(cfg RateLimiterConfig) gin.HandlerFunc {
 	type client struct {
 		limiter  *rate.Limiter
 		lastSeen int64 //lint:ignore U1000 This field is currently unused but may be used in future implementations
@@ -33,33 +55,28 @@ func RateLimiter(r rate.Limit, b int, keyPrefixes ...string) gin.HandlerFunc {
 			key = c.GetHeader("X-Forwarded-For")
 		}
 
+		// Key on the fingerprint so the clients map never holds credentials
+		credential := "none"
 		if auth := c.GetHeader("Authorization"); auth != "" {
-			key += ":" + auth
+			credential = FingerprintWithKey(cfg.FingerprintKey, auth)
+			key += ":" + credential
 		}
 
-		// Add the optional keyPrefix to the key if provided
-		if len(keyPrefixes) > 0 && keyPrefixes[0] != "" {
-			key = keyPrefixes[0] + ":" + key
+		// Add the optional KeyPrefix to the key if provided
+		if cfg.KeyPrefix != "" {
+			key = cfg.KeyPrefix + ":" + key
 		}
 
 		mu.Lock()
 		if _, found := clients[key]; !found {
-			clients[key] = &client{limiter: rate.NewLimiter(r, b)}
+			clients[key] = &client{limiter: rate.NewLimiter(cfg.Limit, cfg.Burst)}
 		}
 		if !clients[key].limiter.Allow() {
 			mu.Unlock()
 			// Log the rate limit exceeded event
-			authHeader := c.GetHeader("Authorization")
-			maskedAuth := "No Authorization"
-			if authHeader != "" {
-				maskedAuth = "Bearer *****"
-				if len(authHeader) > 15 {
-					maskedAuth = authHeader[:15] + "*****"
-				}
-			}
 			logger.Info("Rate limit exceeded",
 				zap.String("client_ip", c.ClientIP()),
-				zap.String("authorization", maskedAuth))
+				zap.String("credential", credential))
 			c.AbortWithStatus(http.StatusTooManyRequests)
 			return
 		}
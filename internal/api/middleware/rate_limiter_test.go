@@ -3,10 +3,13 @@ package middleware
 import (
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 	"golang.org/x/time/rate"
 )
 
@@ -164,3 +167,38 @@ func TestRateLimiterRecovery(t *testing.T) {
 		t.Errorf("Expected status %d, got %d", http.StatusOK, resp.Code)
 	}
 }
+
+func TestRateLimiterLogsFingerprint(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	core, logs := observer.New(zap.InfoLevel)
+	defer func(previous *zap.Logger) { logger = previous }(logger)
+	logger = zap.New(core)
+
+	key := []byte("shared-fingerprint-key")
+	r := gin.New()
+	r.Use(RateLimiterWithConfig(RateLimiterConfig{Limit: rate.Limit(1), Burst: 1, FingerprintKey: key}))
+	r.GET("/test", func(c *gin.Context) {
+		c.String(http.StatusOK, "test")
+	})
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", "/test", nil)
+		req.Header.Set("Authorization", "Bearer secret-token-value")
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	entries := logs.FilterMessage("Rate limit exceeded").All()
+	if len(entries) != 1 {
+		t.Fatalf("Expected one rate limit event, got %d", len(entries))
+	}
+	fields := entries[0].ContextMap()
+	if fields["credential"] != FingerprintWithKey(key, "Bearer secret-token-value") {
+		t.Errorf("Expected the credential fingerprint, got %v", fields["credential"])
+	}
+	for _, value := range fields {
+		if s, ok := value.(string); ok && strings.Contains(s, "secret") {
+			t.Errorf("Expected the log not to contain the token, got %v", fields)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package middleware
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// Defaults of RedisTokenCacheOptions.
+const (
+	DefaultRedisDialTimeout = 2 * time.Second
+	DefaultRedisTimeout     = time.Second
+	DefaultRedisPoolSize    = 10
+	DefaultRedisPrefix      = "go-rest-api:token:"
+)
+
+// RedisTokenCacheOptions configures a RedisTokenCache.
+type RedisTokenCacheOptions struct {
+	// Addr is the host:port of the Redis server, version 7 or later.
+	// Username, Password and DB are sent with AUTH and SELECT when set, and
+	// TLS, when set, encrypts the connections.
+	Addr     string
+	Username string
+	Password string
+	DB       int
+	TLS      *tls.Config
+	// Prefix is prepended to every key, so that several deployments can
+	// share a server. Purge only removes the keys under Prefix.
+	Prefix string
+	// DialTimeout bounds connecting and Timeout every command. PoolSize is
+	// the maximum number of open connections.
+	DialTimeout time.Duration
+	Timeout     time.Duration
+	PoolSize    int
+	// MaxStale is how long expired profiles are kept for GetStale.
+	MaxStale time.Duration
+}
+
+// ParseRedisURL returns the options of a redis:// or rediss:// (TLS) URL,
+// such as redis://:password@localhost:6379/0. The other options keep their
+// defaults.
+func ParseRedisURL(rawURL string) (RedisTokenCacheOptions, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		// Leave out the URL, which may hold a password
+		return RedisTokenCacheOptions{}, fmt.Errorf("invalid URL: %w", errors.Unwrap(err))
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return RedisTokenCacheOptions{}, fmt.Errorf("unsupported scheme %q (use redis or rediss)", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return RedisTokenCacheOptions{}, errors.New("missing host")
+	}
+
+	opts := RedisTokenCacheOptions{Addr: u.Host}
+	if u.Port() == "" {
+		opts.Addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		opts.Username = u.User.Username()
+		opts.Password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if opts.DB, err = strconv.Atoi(db); err != nil || opts.DB < 0 {
+			return RedisTokenCacheOptions{}, fmt.Errorf("invalid database %q", db)
+		}
+	}
+	if u.Scheme == "rediss" {
+		opts.TLS = &tls.Config{ServerName: u.Hostname()}
+	}
+	return opts, nil
+}
+
+// RedisTokenCache is a TokenCache kept in Redis, so that every replica and
+// serverless instance shares the validated profiles. Profiles are stored as
+// JSON and expire through the Redis TTL, and a set per user lists the keys
+// of their profiles for DeleteUser. Every process sharing it must set
+// the same VerifyTokenConfig.FingerprintKey. It is safe for concurrent use.
+type RedisTokenCache struct {
+	opts   RedisTokenCacheOptions
+	client *redis.Client
+
+	mu    sync.Mutex
+	stats TokenCacheStats
+}
+
+// redisEntry is the value stored under the key of a profile.
+type redisEntry struct {
+	Profile Profile `json:"profile"`
+	// Expiry is in Unix milliseconds
+	Expiry int64 `json:"expiry"`
+}
+
+// NewRedisTokenCache returns a cache configured by opts. Connections are
+// opened on first use and closed by Close.
+func NewRedisTokenCache(opts RedisTokenCacheOptions) *RedisTokenCache {
+	if opts.Prefix == "" {
+		opts.Prefix = DefaultRedisPrefix
+	}
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = DefaultRedisDialTimeout
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultRedisTimeout
+	}
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = DefaultRedisPoolSize
+	}
+	client := redis.NewClient(&redis.Options{
+		Addr:         opts.Addr,
+		Username:     opts.Username,
+		Password:     opts.Password,
+		DB:           opts.DB,
+		TLSConfig:    opts.TLS,
+		DialTimeout:  opts.DialTimeout,
+		ReadTimeout:  opts.Timeout,
+		WriteTimeout: opts.Timeout,
+		PoolSize:     opts.PoolSize,
+		// A failed lookup falls back to the token provider, so commands
+		// are not retried
+		MaxRetries:      -1,
+		DisableIdentity: true,
+	})
+	return &RedisTokenCache{opts: opts, client: client}
+}
+
+// GetStale returns the profile cached under key and its expiry, including
+// profiles that expired less than MaxStale ago.
+func (c *RedisTokenCache) GetStale(key string) (Profile, time.Time, bool) {
+	value, err := c.client.Get(context.Background(), c.opts.Prefix+key).Bytes()
+	var entry redisEntry
+	if err == nil {
+		err = json.Unmarshal(value, &entry)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case errors.Is(err, redis.Nil):
+		c.stats.Misses++
+		return Profile{}, time.Time{}, false
+	case err != nil:
+		c.failed("GET", err)
+		c.stats.Misses++
+		return Profile{}, time.Time{}, false
+	}
+
+	expiry := time.UnixMilli(entry.Expiry)
+	if time.Now().Before(expiry) {
+		c.stats.Hits++
+	} else {
+		c.stats.Stale++
+	}
+	return entry.Profile, expiry, true
+}
+
+// Set caches profile under key with a TTL of MaxStale past expiry, and adds
+// key to the set of the user in the same transaction.
+func (c *RedisTokenCache) Set(key string, profile Profile, expiry time.Time) {
+	ttl := time.Until(expiry.Add(c.opts.MaxStale))
+	if ttl <= 0 {
+		c.Delete(key)
+		return
+	}
+	value, err := json.Marshal(redisEntry{Profile: profile, Expiry: expiry.UnixMilli()})
+	if err == nil {
+		ctx := context.Background()
+		_, err = c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, c.opts.Prefix+key, value, ttl)
+			if profile.ID != "" {
+				// The set lives as long as the longest profile it lists:
+				// NX sets the TTL of a new set and GT only extends it
+				userKey := c.userKey(profile.ID)
+				pipe.SAdd(ctx, userKey, key)
+				pipe.Do(ctx, "PEXPIRE", userKey, ttl.Milliseconds(), "NX")
+				pipe.Do(ctx, "PEXPIRE", userKey, ttl.Milliseconds(), "GT")
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		c.mu.Lock()
+		c.failed("SET", err)
+		c.mu.Unlock()
+	}
+}
+
+// userKey returns the key of the set of the user id.
+func (c *RedisTokenCache) userKey(id string) string {
+	return c.opts.Prefix + "user:" + id
+}
+
+// Delete removes the profile cached under key.
+func (c *RedisTokenCache) Delete(key string) {
+	if err := c.client.Del(context.Background(), c.opts.Prefix+key).Err(); err != nil {
+		c.mu.Lock()
+		c.failed("DEL", err)
+		c.mu.Unlock()
+	}
+}
+
+// DeleteUser removes every profile of the user id, by every process sharing
+// the cache, and returns how many were removed.
+func (c *RedisTokenCache) DeleteUser(id string) int {
+	ctx := context.Background()
+	userKey := c.userKey(id)
+	keys, err := c.client.SMembers(ctx, userKey).Result()
+	var deleted *redis.IntCmd
+	if err == nil {
+		for i, key := range keys {
+			keys[i] = c.opts.Prefix + key
+		}
+		_, err = c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if len(keys) > 0 {
+				deleted = pipe.Del(ctx, keys...)
+			}
+			pipe.Del(ctx, userKey)
+			return nil
+		})
+	}
+	if err != nil {
+		c.mu.Lock()
+		c.failed("DEL", err)
+		c.mu.Unlock()
+		return 0
+	}
+	if deleted == nil {
+		return 0
+	}
+	return int(deleted.Val())
+}
+
+// Purge removes every profile cached under the prefix, by every process
+// sharing the cache.
+func (c *RedisTokenCache) Purge() {
+	ctx := context.Background()
+	iter := c.client.Scan(ctx, 0, globEscaper.Replace(c.opts.Prefix)+"*", 100).Iterator()
+	var keys []string
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		err := c.client.Del(ctx, keys...).Err()
+		keys = keys[:0]
+		return err
+	}
+
+	var err error
+	for err == nil && iter.Next(ctx) {
+		if keys = append(keys, iter.Val()); len(keys) == 100 {
+			err = flush()
+		}
+	}
+	if err == nil {
+		err = iter.Err()
+	}
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		c.mu.Lock()
+		c.failed("SCAN", err)
+		c.mu.Unlock()
+	}
+}
+
+// Stats returns the counters of this process. Size and Bytes are not
+// tracked.
+func (c *RedisTokenCache) Stats() TokenCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// Close closes the connections. The cache must not be used afterwards.
+func (c *RedisTokenCache) Close() error {
+	return c.client.Close()
+}
+
+// failed records a failed command. c.mu must be held.
+func (c *RedisTokenCache) failed(command string, err error) {
+	c.stats.Errors++
+	logger.Warn("Token cache command failed", zap.String("command", command), zap.Error(err))
+}
+
+// globEscaper escapes the SCAN MATCH pattern characters.
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
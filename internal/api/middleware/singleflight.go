@@ -0,0 +1,57 @@
+package middleware
+
+import "sync"
+
+// flightGroup collapses concurrent calls with the same key into one.
+type flightGroup[T any] struct {
+	mu     sync.Mutex
+	flying map[string]*flight[T]
+}
+
+type flight[T any] struct {
+	done   chan struct{}
+	result T
+	// completed is false when fn panicked
+	completed bool
+}
+
+// do calls fn, unless a call for key is already running, in which case it
+// waits for that call and returns its result with shared set.
+func (g *flightGroup[T]) do(key string, fn func() T) (result T, shared bool) {
+	g.mu.Lock()
+	if f, found := g.flying[key]; found {
+		g.mu.Unlock()
+		<-f.done
+		if !f.completed {
+			panic("middleware: shared call panicked")
+		}
+		return f.result, true
+	}
+	if g.flying == nil {
+		g.flying = make(map[string]*flight[T])
+	}
+	f := &flight[T]{done: make(chan struct{})}
+	g.flying[key] = f
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.flying, key)
+		g.mu.Unlock()
+		close(f.done)
+	}()
+	f.result = fn()
+	f.completed = true
+	return f.result, false
+}
+
+// doAsync calls fn in the background, unless a call for key is already
+// running.
+func (g *flightGroup[T]) doAsync(key string, fn func() T) {
+	g.mu.Lock()
+	_, running := g.flying[key]
+	g.mu.Unlock()
+	if !running {
+		go g.do(key, fn)
+	}
+}
@@ -1,14 +1,20 @@
 package middleware
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
-	"os"
-	"sync"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/nicobistolfi/go-rest-api/pkg/auth"
+
 	"github.com/gin-gonic/gin"
 	"go.uber.org/zap"
 )
@@ -17,52 +23,103 @@ var logger *zap.Logger
 
 func init() {
 	logger, _ = zap.NewProduction()
-
-	// Set cache expiry from environment variable or use default
-	cacheExpiryStr := os.Getenv("TOKEN_CACHE_EXPIRY")
-	if cacheExpiryStr == "" {
-		cacheExpiry = 5 * time.Minute
-	} else {
-		duration, err := time.ParseDuration(cacheExpiryStr)
-		if err != nil {
-			logger.Warn("Invalid TOKEN_CACHE_EXPIRY, using default of 5 minutes", zap.Error(err))
-			cacheExpiry = 5 * time.Minute
-		} else {
-			cacheExpiry = duration
-		}
-	}
 }
 
+// Profile is the authenticated user. Roles and Scopes are checked by
+// RequireRole and RequireScopes.
 type Profile struct {
-	ID    string `json:"id"`
-	Email string `json:"email"`
-	Name  string `json:"name"`
+	ID     string   `json:"id"`
+	Email  string   `json:"email"`
+	Name   string   `json:"name"`
+	Roles  []string `json:"roles,omitempty"`
+	Scopes []string `json:"scopes,omitempty"`
+	// Claims are extra attributes copied from the upstream profile by a
+	// ProfileMapper
+	Claims map[string]any `json:"claims,omitempty"`
 }
 
-type cacheEntry struct {
-	profile Profile
-	expiry  time.Time
+// DefaultTokenCacheExpiry is used when VerifyTokenConfig.CacheExpiry is not set.
+const DefaultTokenCacheExpiry = 5 * time.Minute
+
+// VerifyTokenConfig configures the VerifyToken middleware.
+type VerifyTokenConfig struct {
+	// TokenURL is the endpoint called with the client credential to
+	// validate it and fetch the user profile.
+	TokenURL string
+	// CacheExpiry is how long a validated profile is cached.
+	CacheExpiry time.Duration
+	// Cache holds the validated profiles, e.g. a RedisTokenCache shared
+	// by every replica. When nil, every VerifyToken instance gets its own
+	// MemoryTokenCache of DefaultTokenCacheMaxEntries profiles.
+	Cache TokenCache
+	// FingerprintKey is the key of the token fingerprints profiles are
+	// cached under. When empty, the per-process key is used; replicas
+	// sharing Cache must set the same key.
+	FingerprintKey []byte
+	// NegativeCacheExpiry is how long tokens rejected by TokenURL with a
+	// 401, or reported inactive by introspection, are rejected without
+	// asking again. Zero disables negative caching.
+	NegativeCacheExpiry time.Duration
+	// StaleWhileRevalidate is how long after its expiry a cached profile is
+	// still served, marked STALE, while it is refreshed in the background.
+	// MaxStale is how long after its expiry it is served when TokenURL is
+	// unavailable; it is raised to StaleWhileRevalidate when lower. A Cache
+	// must keep profiles for at least MaxStale (TokenCacheOptions.MaxStale).
+	// Zero disables stale profiles.
+	StaleWhileRevalidate time.Duration
+	MaxStale             time.Duration
+	// Client sends the requests to TokenURL. When nil, every VerifyToken
+	// instance gets its own client configured by DefaultUpstreamOptions.
+	Client *UpstreamClient
+	// IntrospectionClientID and IntrospectionClientSecret, when set, make
+	// TokenURL an RFC 7662 introspection endpoint, such as /introspect of
+	// another deployment, called with these client credentials. Profiles
+	// are then cached until the token expires at the latest.
+	IntrospectionClientID     string
+	IntrospectionClientSecret string
+	// ProfileMapper builds the profile from the TokenURL response. When
+	// nil, the response is read as a Profile, falling back to the GitHub
+	// /user shape. It is not used for introspection responses.
+	ProfileMapper ProfileMapper
 }
 
-var (
-	tokenCache  = make(map[string]cacheEntry)
-	cacheMutex  sync.RWMutex
-	cacheExpiry time.Duration
-)
+func VerifyToken(cfg VerifyTokenConfig) gin.HandlerFunc {
+	verifyCacheExpiry := cfg.CacheExpiry
+	if verifyCacheExpiry <= 0 {
+		verifyCacheExpiry = DefaultTokenCacheExpiry
+	}
+
+	maxStale := max(cfg.MaxStale, cfg.StaleWhileRevalidate)
+
+	// Every VerifyToken instance has its own cache so routers configured
+	// with different token URLs never share validated profiles.
+	tokenCache := cfg.Cache
+	if tokenCache == nil {
+		tokenCache = NewMemoryTokenCache(TokenCacheOptions{
+			MaxEntries:      DefaultTokenCacheMaxEntries,
+			CleanupInterval: DefaultTokenCacheCleanupInterval,
+			MaxStale:        maxStale,
+		})
+	}
+	var negativeCache *MemoryTokenCache
+	if cfg.NegativeCacheExpiry > 0 {
+		negativeCache = NewMemoryTokenCache(TokenCacheOptions{
+			MaxEntries:      DefaultTokenCacheMaxEntries,
+			CleanupInterval: DefaultTokenCacheCleanupInterval,
+		})
+	}
+	if cfg.Client == nil {
+		cfg.Client = NewUpstreamClient(DefaultUpstreamOptions)
+	}
+	var flights flightGroup[verification]
 
-func VerifyToken(customCacheExpiry ...string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		verifyCacheExpiry := cacheExpiry
-		if len(customCacheExpiry) > 0 {
-			verifyCacheExpiryParsed, err := time.ParseDuration(customCacheExpiry[0])
-			if err != nil {
-				logger.Warn("Invalid cache expiry, using default", zap.Error(err))
-			} else {
-				fmt.Printf("Using custom cache expiry: %v\n", verifyCacheExpiryParsed)
-				verifyCacheExpiry = verifyCacheExpiryParsed
-				fmt.Printf("verifyCacheExpiry: %v\n", verifyCacheExpiry)
-			}
+		// Skip tokens already verified by an earlier verifier such as VerifyJWT
+		if _, verified := c.Get("user"); verified {
+			c.Next()
+			return
 		}
+
 		// Get the token from the context set by AuthMiddleware
 		token, exists := c.Get("auth_token")
 		authHeader, authHeaderExists := c.Get("auth_header")
@@ -85,102 +142,274 @@ func VerifyToken(customCacheExpiry ...string) gin.HandlerFunc {
 			return
 		}
 
-		tokenURL := os.Getenv("TOKEN_URL")
-		fmt.Printf("tokenURL: %v\n", tokenURL)
-
-		if tokenURL == "" {
+		if cfg.TokenURL == "" {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "TOKEN_URL not set"})
 			c.Abort()
 			return
 		}
 
-		// Check cache first
-		cacheMutex.RLock()
-		entry, found := tokenCache[tokenString]
-		cacheMutex.RUnlock()
-
-		valid := time.Now().Before(entry.expiry)
-		fmt.Printf("Valid: %v\n", valid)
-
-		if found && valid {
-			fmt.Println("Token is still valid in cache")
-			// Token is still valid in cache
+		// Check cache first. Profiles are cached under the fingerprint of
+		// the token so that the cache never holds live credentials.
+		cacheKey := FingerprintWithKey(cfg.FingerprintKey, tokenString)
+		cached, expiry, found := tokenCache.GetStale(cacheKey)
+		staleness := time.Since(expiry)
+		if found && staleness < 0 {
 			c.Header("X-Token-Cache", "HIT")
-			c.Set("user", entry.profile)
+			c.Set("user", cached)
 			c.Next()
 			return
 		}
 
-		// Token not found in cache or expired
-		c.Header("X-Token-Cache", "MISS")
+		// Concurrent requests with the same token share a single call to
+		// TOKEN_URL. The call outlives the request that started it, as the
+		// others wait for it too.
+		ctx := context.WithoutCancel(c.Request.Context())
+		validate := func() verification {
+			profile, expiry, err := validateToken(ctx, cfg, authHeader.(string), tokenString)
+			var verr *verifyError
+			switch {
+			case err == nil:
+				cacheExpiry := time.Now().Add(verifyCacheExpiry)
+				if !expiry.IsZero() && expiry.Before(cacheExpiry) {
+					cacheExpiry = expiry
+				}
+				tokenCache.Set(cacheKey, profile, cacheExpiry)
+			case errors.As(err, &verr) && verr.invalid:
+				// Stop serving a stale profile of a revoked token
+				tokenCache.Delete(cacheKey)
+				if negativeCache != nil {
+					negativeCache.Set(cacheKey, Profile{}, time.Now().Add(cfg.NegativeCacheExpiry))
+				}
+			}
+			return verification{profile: profile, err: err}
+		}
 
-		// Validate token using the TOKEN_URL
-		req, err := http.NewRequest("GET", tokenURL, nil)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create request"})
-			c.Abort()
+		if found && staleness < cfg.StaleWhileRevalidate {
+			flights.doAsync(cacheKey, validate)
+			c.Header("X-Token-Cache", "STALE")
+			c.Set("user", cached)
+			c.Next()
 			return
 		}
-		req.Header.Set(authHeader.(string), tokenString)
+		if negativeCache != nil {
+			if _, found := negativeCache.Get(cacheKey); found {
+				c.Header("X-Token-Cache", "NEGATIVE")
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+				c.Abort()
+				return
+			}
+		}
 
-		client := &http.Client{}
-		resp, err := client.Do(req)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to validate token"})
-			c.Abort()
+		result, shared := flights.do(cacheKey, validate)
+		var verr *verifyError
+		if found && staleness < maxStale && errors.As(result.err, &verr) && verr.unavailable() {
+			logger.Warn("Serving stale profile, token provider is unavailable",
+				zap.String("credential", cacheKey), zap.Duration("staleness", staleness), zap.Error(result.err))
+			c.Header("X-Token-Cache", "STALE")
+			c.Set("user", cached)
+			c.Next()
 			return
 		}
-		defer resp.Body.Close()
 
-		if resp.StatusCode != http.StatusOK {
-			// use logger to log the error
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		if shared {
+			c.Header("X-Token-Cache", "SHARED")
+		} else {
+			c.Header("X-Token-Cache", "MISS")
+		}
+		if result.err != nil {
+			status, message := http.StatusInternalServerError, "Failed to validate token"
+			var verr *verifyError
+			if errors.As(result.err, &verr) {
+				status, message = verr.status, verr.message
+			}
+			if verr != nil && verr.retryAfter > 0 {
+				c.Header("Retry-After", strconv.Itoa(int(math.Ceil(verr.retryAfter.Seconds()))))
+			}
+			if status >= http.StatusInternalServerError && status != http.StatusServiceUnavailable {
+				logger.Error("Failed to validate token", zap.Error(result.err))
+			}
+			c.JSON(status, gin.H{"error": message})
 			c.Abort()
 			return
 		}
 
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read response"})
-			c.Abort()
-			return
+		c.Set("user", result.profile)
+		c.Next()
+	}
+}
+
+// verification is the outcome of validating a token with TOKEN_URL.
+type verification struct {
+	profile Profile
+	err     error
+}
+
+// verifyError is a failed validation and the response it maps to.
+type verifyError struct {
+	status  int
+	message string
+	// invalid is set when TOKEN_URL rejected the token, which makes the
+	// failure worth caching
+	invalid bool
+	// retryAfter is set when the token provider circuit is open
+	retryAfter time.Duration
+	err        error
+}
+
+func (e *verifyError) Error() string {
+	if e.err != nil {
+		return e.message + ": " + e.err.Error()
+	}
+	return e.message
+}
+
+// unavailable reports whether the token provider could not answer, as
+// opposed to rejecting the token.
+func (e *verifyError) unavailable() bool {
+	return e.status == http.StatusBadGateway || e.status == http.StatusServiceUnavailable
+}
+
+func (e *verifyError) Unwrap() error {
+	return e.err
+}
+
+// upstreamError maps a failed request to the token provider to a response.
+func upstreamError(err error) *verifyError {
+	var open *CircuitOpenError
+	if errors.As(err, &open) {
+		return &verifyError{status: http.StatusServiceUnavailable, message: "Token provider is unavailable", retryAfter: open.RetryAfter, err: err}
+	}
+	return &verifyError{status: http.StatusBadGateway, message: "Token provider is unavailable", err: err}
+}
+
+// validateToken asks TOKEN_URL about token and returns the profile of its
+// owner and, for introspected tokens, its expiry.
+func validateToken(ctx context.Context, cfg VerifyTokenConfig, authHeader, token string) (Profile, time.Time, error) {
+	if cfg.IntrospectionClientID != "" {
+		profile, expiry, err := introspectToken(ctx, cfg, token)
+		var verr *verifyError
+		switch {
+		case errors.Is(err, errInactiveToken):
+			return Profile{}, time.Time{}, &verifyError{status: http.StatusUnauthorized, message: "Invalid token", invalid: true}
+		case errors.As(err, &verr):
+			return Profile{}, time.Time{}, verr
+		case err != nil:
+			return Profile{}, time.Time{}, &verifyError{status: http.StatusInternalServerError, message: "Failed to validate token", err: err}
 		}
+		return profile, expiry, nil
+	}
 
-		var profile Profile
-		if err := json.Unmarshal(body, &profile); err != nil {
-			// Use a custom unmarshaling to map the fields correctly
-			var githubProfile struct {
-				ID    uint   `json:"id"`
-				Email string `json:"email"`
-				Name  string `json:"name"`
-				Login string `json:"login"`
-			}
-			if err := json.Unmarshal(body, &githubProfile); err != nil {
-				logger.Error("Failed to parse GitHub profile", zap.Error(err))
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse profile"})
-				c.Abort()
-				return
-			}
-			profile = Profile{
-				ID:    fmt.Sprintf("%d", githubProfile.ID),
-				Email: githubProfile.Email,
-				Name:  githubProfile.Name,
-			}
-			// If Email is empty, use Login as a fallback
-			if profile.Email == "" {
-				profile.Email = githubProfile.Login
-			}
+	// Validate token using the TOKEN_URL
+	req, err := http.NewRequestWithContext(ctx, "GET", cfg.TokenURL, nil)
+	if err != nil {
+		return Profile{}, time.Time{}, &verifyError{status: http.StatusInternalServerError, message: "Failed to create request", err: err}
+	}
+	req.Header.Set(authHeader, token)
+
+	resp, err := cfg.Client.Do(req)
+	if err != nil {
+		return Profile{}, time.Time{}, upstreamError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return Profile{}, time.Time{}, upstreamError(fmt.Errorf("token provider returned %s", resp.Status))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Profile{}, time.Time{}, &verifyError{
+			status:  http.StatusUnauthorized,
+			message: "Invalid token",
+			invalid: resp.StatusCode == http.StatusUnauthorized,
 		}
+	}
 
-		// Cache the result
-		cacheMutex.Lock()
-		tokenCache[tokenString] = cacheEntry{
-			profile: profile,
-			expiry:  time.Now().Add(verifyCacheExpiry),
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return Profile{}, time.Time{}, &verifyError{status: http.StatusInternalServerError, message: "Failed to read response", err: err}
+	}
+
+	mapper := cfg.ProfileMapper
+	if mapper == nil {
+		mapper = defaultProfileMapper
+	}
+	profile, err := mapper.MapProfile(body, resp.Header)
+	if err != nil {
+		return Profile{}, time.Time{}, &verifyError{status: http.StatusInternalServerError, message: "Failed to parse profile", err: err}
+	}
+	return profile, time.Time{}, nil
+}
+
+// remoteScopes returns the scopes of a TOKEN_URL response: the scopes array
+// or space separated scope string of the profile, or the X-OAuth-Scopes
+// header GitHub sends
+func remoteScopes(body []byte, header http.Header) []string {
+	var granted struct {
+		Scopes []string `json:"scopes"`
+		Scope  string   `json:"scope"`
+	}
+	if json.Unmarshal(body, &granted) == nil {
+		if len(granted.Scopes) > 0 {
+			return granted.Scopes
 		}
-		cacheMutex.Unlock()
+		if granted.Scope != "" {
+			return strings.Fields(granted.Scope)
+		}
+	}
 
-		c.Set("user", profile)
-		c.Next()
+	return oauthScopes(header)
+}
+
+// oauthScopes returns the scopes of the X-OAuth-Scopes header
+func oauthScopes(header http.Header) []string {
+	var scopes []string
+	for _, scope := range strings.Split(header.Get("X-OAuth-Scopes"), ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+// errInactiveToken is returned by introspectToken for tokens the
+// introspection endpoint reports as inactive
+var errInactiveToken = errors.New("inactive token")
+
+// introspectToken asks the RFC 7662 endpoint cfg.TokenURL about token and
+// returns the profile of its subject and its expiry
+func introspectToken(ctx context.Context, cfg VerifyTokenConfig, token string) (Profile, time.Time, error) {
+	token = strings.TrimSpace(strings.TrimPrefix(token, "Bearer "))
+	form := url.Values{"token": {token}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Profile{}, time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(cfg.IntrospectionClientID, cfg.IntrospectionClientSecret)
+
+	resp, err := cfg.Client.Do(req)
+	if err != nil {
+		return Profile{}, time.Time{}, upstreamError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return Profile{}, time.Time{}, upstreamError(fmt.Errorf("introspection endpoint returned %s", resp.Status))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return Profile{}, time.Time{}, fmt.Errorf("introspection endpoint returned %s", resp.Status)
+	}
+
+	var result auth.Introspection
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return Profile{}, time.Time{}, fmt.Errorf("failed to parse introspection response: %w", err)
+	}
+	if !result.Active {
+		return Profile{}, time.Time{}, errInactiveToken
 	}
+	return Profile{
+		ID:     result.Subject,
+		Email:  result.Email,
+		Name:   result.Username,
+		Roles:  result.Roles,
+		Scopes: strings.Fields(result.Scope),
+	}, result.Expiry(), nil
 }
@@ -0,0 +1,293 @@
+package middleware
+
+import (
+	"container/list"
+	"encoding/json"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Defaults of the cache VerifyToken creates when VerifyTokenConfig.Cache
+// is not set.
+const (
+	DefaultTokenCacheMaxEntries      = 10000
+	DefaultTokenCacheCleanupInterval = time.Minute
+)
+
+// entryOverhead approximates the memory used by an entry besides its key
+// and profile: the map slot, the list element and the entry itself.
+const entryOverhead = 128
+
+// TokenCacheOptions bounds a MemoryTokenCache.
+type TokenCacheOptions struct {
+	// MaxEntries is the maximum number of cached profiles, or zero for no
+	// limit.
+	MaxEntries int
+	// MaxBytes is the approximate maximum memory used by cached profiles,
+	// or zero for no limit.
+	MaxBytes int
+	// CleanupInterval is how often expired profiles are removed, or zero
+	// to only remove them when they are looked up or evicted.
+	CleanupInterval time.Duration
+	// MaxStale is how long expired profiles are kept for GetStale.
+	MaxStale time.Duration
+}
+
+// TokenCache holds the profiles validated by VerifyToken, keyed by token
+// fingerprint. Implementations must be safe for concurrent use and keep
+// expired profiles for GetStale as long as VerifyTokenConfig.MaxStale. A
+// cache that cannot reach its backend reports misses rather than failing
+// requests.
+type TokenCache interface {
+	// GetStale returns the profile cached under key and its expiry,
+	// including profiles that already expired.
+	GetStale(key string) (Profile, time.Time, bool)
+	// Set caches profile under key until expiry.
+	Set(key string, profile Profile, expiry time.Time)
+	// Delete removes the profile cached under key.
+	Delete(key string)
+	// DeleteUser removes every profile of the user id and returns how
+	// many were removed.
+	DeleteUser(id string) int
+	// Purge removes every cached profile.
+	Purge()
+	// Stats returns the current counters.
+	Stats() TokenCacheStats
+}
+
+// TokenCacheStats are the counters of a token cache.
+type TokenCacheStats struct {
+	// Size is the number of cached profiles and Bytes their approximate
+	// memory use. They are not tracked by shared caches.
+	Size  int `json:"size"`
+	Bytes int `json:"bytes"`
+	// Hits and Misses count lookups, and Stale the lookups that found an
+	// expired profile. Evictions counts profiles removed to stay within the
+	// limits, Expirations those removed once expired.
+	Hits        uint64 `json:"hits"`
+	Misses      uint64 `json:"misses"`
+	Stale       uint64 `json:"stale"`
+	Evictions   uint64 `json:"evictions"`
+	Expirations uint64 `json:"expirations"`
+	// Errors counts the failed calls to the backend of a shared cache.
+	Errors uint64 `json:"errors"`
+}
+
+// MemoryTokenCache is an in-memory LRU cache of validated profiles keyed by
+// token fingerprint. It is safe for concurrent use.
+type MemoryTokenCache struct {
+	*memoryTokenCache
+}
+
+type memoryTokenCache struct {
+	opts TokenCacheOptions
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// lru holds *memoryEntry values, most recently used first
+	lru   *list.List
+	stats TokenCacheStats
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+type memoryEntry struct {
+	key     string
+	profile Profile
+	expiry  time.Time
+	size    int
+}
+
+// NewMemoryTokenCache returns an empty cache bounded by opts. When
+// opts.CleanupInterval is set, a janitor removes expired profiles until
+// Close is called or the cache is garbage collected.
+func NewMemoryTokenCache(opts TokenCacheOptions) *MemoryTokenCache {
+	c := &memoryTokenCache{
+		opts:    opts,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+	cache := &MemoryTokenCache{c}
+
+	if opts.CleanupInterval > 0 {
+		c.stop = make(chan struct{})
+		go c.janitor(opts.CleanupInterval)
+		// The janitor only references the inner cache, so the finalizer
+		// stops it once the cache is dropped, e.g. when a reload replaces
+		// VerifyToken
+		runtime.SetFinalizer(cache, (*MemoryTokenCache).Close)
+	}
+	return cache
+}
+
+// Get returns the profile cached under key, if it has not expired.
+func (c *memoryTokenCache) Get(key string) (Profile, bool) {
+	profile, expiry, found := c.GetStale(key)
+	if !found || !time.Now().Before(expiry) {
+		return Profile{}, false
+	}
+	return profile, true
+}
+
+// GetStale returns the profile cached under key and its expiry, including
+// profiles that expired less than MaxStale ago.
+func (c *memoryTokenCache) GetStale(key string) (Profile, time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, found := c.entries[key]
+	if !found {
+		c.stats.Misses++
+		return Profile{}, time.Time{}, false
+	}
+	entry := elem.Value.(*memoryEntry)
+	now := time.Now()
+	if c.removable(entry, now) {
+		c.remove(elem)
+		c.stats.Expirations++
+		c.stats.Misses++
+		return Profile{}, time.Time{}, false
+	}
+
+	c.lru.MoveToFront(elem)
+	if now.Before(entry.expiry) {
+		c.stats.Hits++
+	} else {
+		c.stats.Stale++
+	}
+	return entry.profile, entry.expiry, true
+}
+
+// Set caches profile under key until expiry, evicting the least recently
+// used profiles when the cache is full.
+func (c *memoryTokenCache) Set(key string, profile Profile, expiry time.Time) {
+	entry := &memoryEntry{key: key, profile: profile, expiry: expiry, size: entrySize(key, profile)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, found := c.entries[key]; found {
+		c.remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.stats.Size++
+	c.stats.Bytes += entry.size
+
+	for c.lru.Len() > 0 && c.full() {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// Delete removes the profile cached under key.
+func (c *memoryTokenCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, found := c.entries[key]; found {
+		c.remove(elem)
+	}
+}
+
+// DeleteUser removes every profile of the user id and returns how many
+// were removed.
+func (c *memoryTokenCache) DeleteUser(id string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if elem.Value.(*memoryEntry).profile.ID == id {
+			c.remove(elem)
+			removed++
+		}
+		elem = next
+	}
+	return removed
+}
+
+// Purge removes every cached profile.
+func (c *memoryTokenCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.stats.Size = 0
+	c.stats.Bytes = 0
+}
+
+// Stats returns the current counters.
+func (c *memoryTokenCache) Stats() TokenCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// Close stops the janitor. The cache remains usable.
+func (c *memoryTokenCache) Close() {
+	c.closeOnce.Do(func() {
+		if c.stop != nil {
+			close(c.stop)
+		}
+	})
+}
+
+func (c *memoryTokenCache) full() bool {
+	return (c.opts.MaxEntries > 0 && c.stats.Size > c.opts.MaxEntries) ||
+		(c.opts.MaxBytes > 0 && c.stats.Bytes > c.opts.MaxBytes)
+}
+
+// removable reports whether entry is too old to be returned at all.
+func (c *memoryTokenCache) removable(entry *memoryEntry, now time.Time) bool {
+	return !now.Before(entry.expiry.Add(c.opts.MaxStale))
+}
+
+// remove deletes elem. c.mu must be held.
+func (c *memoryTokenCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*memoryEntry)
+	delete(c.entries, entry.key)
+	c.stats.Size--
+	c.stats.Bytes -= entry.size
+}
+
+// removeExpired deletes the profiles that expired more than MaxStale
+// before now.
+func (c *memoryTokenCache) removeExpired(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for elem := c.lru.Back(); elem != nil; {
+		prev := elem.Prev()
+		if c.removable(elem.Value.(*memoryEntry), now) {
+			c.remove(elem)
+			c.stats.Expirations++
+		}
+		elem = prev
+	}
+}
+
+func (c *memoryTokenCache) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			c.removeExpired(now)
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// entrySize approximates the memory used by caching profile under key.
+func entrySize(key string, profile Profile) int {
+	size := entryOverhead + len(key)
+	if encoded, err := json.Marshal(profile); err == nil {
+		size += len(encoded)
+	}
+	return size
+}
@@ -0,0 +1,77 @@
+package middleware
+
+import "sync"
+
+// TokenCacheHandle gives access to the token cache a router currently uses,
+// which changes when the verifier settings change, e.g. to evict the
+// profiles of a user who logged out or was disabled at the identity
+// provider. The zero value has no cache and is ready to use. It is safe for
+// concurrent use.
+type TokenCacheHandle struct {
+	mu             sync.RWMutex
+	cache          TokenCache
+	fingerprintKey []byte
+}
+
+// NewTokenCacheHandle returns a handle without a cache.
+func NewTokenCacheHandle() *TokenCacheHandle {
+	return &TokenCacheHandle{}
+}
+
+// Attach makes the handle operate on cache, whose profiles are cached
+// under fingerprints computed with fingerprintKey, as set in
+// VerifyTokenConfig.FingerprintKey.
+func (h *TokenCacheHandle) Attach(cache TokenCache, fingerprintKey []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.cache = cache
+	h.fingerprintKey = fingerprintKey
+}
+
+// Stats returns the counters of the cache.
+func (h *TokenCacheHandle) Stats() TokenCacheStats {
+	if cache := h.current(); cache != nil {
+		return cache.Stats()
+	}
+	return TokenCacheStats{}
+}
+
+// Purge removes every cached profile.
+func (h *TokenCacheHandle) Purge() {
+	if cache := h.current(); cache != nil {
+		cache.Purge()
+	}
+}
+
+// EvictUser removes every profile of the user id and returns how many were
+// removed.
+func (h *TokenCacheHandle) EvictUser(id string) int {
+	if cache := h.current(); cache != nil {
+		return cache.DeleteUser(id)
+	}
+	return 0
+}
+
+// EvictFingerprint removes the profile cached for the credential with
+// fingerprint, as logged by the middlewares.
+func (h *TokenCacheHandle) EvictFingerprint(fingerprint string) {
+	if cache := h.current(); cache != nil {
+		cache.Delete(fingerprint)
+	}
+}
+
+// EvictToken removes the profile cached for credential, as stored under
+// "auth_token" by AuthMiddleware: the whole Authorization header, such as
+// "Bearer <token>", or the API key. Call it e.g. on logout.
+func (h *TokenCacheHandle) EvictToken(credential string) {
+	h.mu.RLock()
+	key := h.fingerprintKey
+	h.mu.RUnlock()
+	h.EvictFingerprint(FingerprintWithKey(key, credential))
+}
+
+func (h *TokenCacheHandle) current() TokenCache {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.cache
+}
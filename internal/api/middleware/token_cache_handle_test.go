@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenCacheHandle(t *testing.T) {
+	var handle TokenCacheHandle
+	// Without a cache, the handle does nothing
+	handle.Purge()
+	if removed := handle.EvictUser("alice"); removed != 0 {
+		t.Errorf("Expected nothing to be removed, got %d", removed)
+	}
+
+	cache := NewMemoryTokenCache(TokenCacheOptions{})
+	handle.Attach(cache, nil)
+	expiry := time.Now().Add(time.Minute)
+	cache.Set(Fingerprint("Bearer laptop"), Profile{ID: "alice"}, expiry)
+	cache.Set(Fingerprint("Bearer phone"), Profile{ID: "alice"}, expiry)
+	cache.Set(Fingerprint("Bearer other"), Profile{ID: "bob"}, expiry)
+	cache.Set(Fingerprint("Bearer another"), Profile{ID: "bob"}, expiry)
+
+	handle.EvictToken("Bearer laptop")
+	handle.EvictFingerprint(Fingerprint("Bearer other"))
+	if stats := handle.Stats(); stats.Size != 2 {
+		t.Errorf("Expected 2 profiles left, got %+v", stats)
+	}
+	if removed := handle.EvictUser("alice"); removed != 1 {
+		t.Errorf("Expected 1 profile to be removed, got %d", removed)
+	}
+	handle.Purge()
+	if stats := handle.Stats(); stats.Size != 0 {
+		t.Errorf("Expected an empty cache, got %+v", stats)
+	}
+}
@@ -0,0 +1,134 @@
+package middleware
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMemoryTokenCache(t *testing.T) {
+	cache := NewMemoryTokenCache(TokenCacheOptions{MaxEntries: 2})
+	expiry := time.Now().Add(time.Minute)
+
+	cache.Set("a", Profile{ID: "a"}, expiry)
+	cache.Set("b", Profile{ID: "b"}, expiry)
+	if _, found := cache.Get("a"); !found {
+		t.Fatal("Expected a to be cached")
+	}
+	// b is now the least recently used entry
+	cache.Set("c", Profile{ID: "c"}, expiry)
+
+	if _, found := cache.Get("b"); found {
+		t.Error("Expected b to be evicted")
+	}
+	for _, token := range []string{"a", "c"} {
+		if profile, found := cache.Get(token); !found || profile.ID != token {
+			t.Errorf("Expected %s to be cached, got %+v", token, profile)
+		}
+	}
+
+	cache.Delete("a")
+	if _, found := cache.Get("a"); found {
+		t.Error("Expected a to be deleted")
+	}
+
+	cache.Set("expired", Profile{ID: "expired"}, time.Now().Add(-time.Second))
+	if _, found := cache.Get("expired"); found {
+		t.Error("Expected expired profiles to be misses")
+	}
+
+	stats := cache.Stats()
+	expected := TokenCacheStats{Size: 1, Hits: 3, Misses: 3, Evictions: 1, Expirations: 1}
+	// Bytes depend on the encoding of the profile
+	stats.Bytes = 0
+	if stats != expected {
+		t.Errorf("Expected stats %+v, got %+v", expected, stats)
+	}
+}
+
+func TestMemoryTokenCacheGetStale(t *testing.T) {
+	cache := NewMemoryTokenCache(TokenCacheOptions{MaxStale: time.Minute})
+	expiry := time.Now().Add(-time.Second)
+
+	cache.Set("stale", Profile{ID: "stale"}, expiry)
+	cache.Set("gone", Profile{ID: "gone"}, time.Now().Add(-2*time.Minute))
+
+	if _, found := cache.Get("stale"); found {
+		t.Error("Expected Get to skip stale profiles")
+	}
+	profile, staleExpiry, found := cache.GetStale("stale")
+	if !found || profile.ID != "stale" || !staleExpiry.Equal(expiry) {
+		t.Errorf("Expected the stale profile and its expiry, got %+v %v", profile, staleExpiry)
+	}
+	if _, _, found := cache.GetStale("gone"); found {
+		t.Error("Expected profiles past MaxStale to be removed")
+	}
+
+	stats := cache.Stats()
+	if stats.Size != 1 || stats.Stale != 2 || stats.Hits != 0 || stats.Expirations != 1 {
+		t.Errorf("Expected 1 entry, 2 stale lookups and 1 expiration, got %+v", stats)
+	}
+}
+
+func TestMemoryTokenCacheDeleteUser(t *testing.T) {
+	cache := NewMemoryTokenCache(TokenCacheOptions{})
+	expiry := time.Now().Add(time.Minute)
+
+	cache.Set("laptop", Profile{ID: "alice"}, expiry)
+	cache.Set("phone", Profile{ID: "alice"}, expiry)
+	cache.Set("other", Profile{ID: "bob"}, expiry)
+
+	if removed := cache.DeleteUser("alice"); removed != 2 {
+		t.Errorf("Expected 2 profiles to be removed, got %d", removed)
+	}
+	for _, key := range []string{"laptop", "phone"} {
+		if _, found := cache.Get(key); found {
+			t.Errorf("Expected %s to be removed", key)
+		}
+	}
+	if _, found := cache.Get("other"); !found {
+		t.Error("Expected the profiles of other users to be kept")
+	}
+}
+
+func TestMemoryTokenCacheMaxBytes(t *testing.T) {
+	size := entrySize("token-0", Profile{ID: "0"})
+	cache := NewMemoryTokenCache(TokenCacheOptions{MaxBytes: 3 * size})
+	expiry := time.Now().Add(time.Minute)
+
+	for i := 0; i < 5; i++ {
+		cache.Set(fmt.Sprintf("token-%d", i), Profile{ID: fmt.Sprint(i)}, expiry)
+	}
+
+	stats := cache.Stats()
+	if stats.Size != 3 || stats.Bytes != 3*size || stats.Evictions != 2 {
+		t.Errorf("Expected 3 entries of %d bytes and 2 evictions, got %+v", size, stats)
+	}
+	if _, found := cache.Get("token-1"); found {
+		t.Error("Expected the oldest entries to be evicted")
+	}
+}
+
+func TestMemoryTokenCacheJanitor(t *testing.T) {
+	cache := NewMemoryTokenCache(TokenCacheOptions{CleanupInterval: 10 * time.Millisecond})
+	defer cache.Close()
+
+	cache.Set("short", Profile{ID: "short"}, time.Now().Add(20*time.Millisecond))
+	cache.Set("long", Profile{ID: "long"}, time.Now().Add(time.Hour))
+
+	deadline := time.Now().Add(time.Second)
+	for cache.Stats().Size != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the janitor to remove expired profiles, got %+v", cache.Stats())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if stats := cache.Stats(); stats.Expirations != 1 || stats.Misses != 0 {
+		t.Errorf("Expected one expiration without lookups, got %+v", stats)
+	}
+
+	cache.Purge()
+	if stats := cache.Stats(); stats.Size != 0 || stats.Bytes != 0 {
+		t.Errorf("Expected an empty cache after Purge, got %+v", stats)
+	}
+}
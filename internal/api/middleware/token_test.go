@@ -2,11 +2,15 @@ package middleware
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
-	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/gin-gonic/gin"
 )
 
@@ -28,16 +32,13 @@ func TestVerifyToken(t *testing.T) {
 	}))
 	defer mockServer.Close()
 
-	os.Setenv("TOKEN_URL", mockServer.URL)
-	defer os.Unsetenv("TOKEN_URL")
-
 	r := gin.New()
 	r.Use(func(c *gin.Context) {
 		c.Set("auth_token", c.GetHeader("Authorization"))
 		c.Set("auth_header", "Authorization")
 		c.Next()
 	})
-	r.Use(VerifyToken())
+	r.Use(VerifyToken(VerifyTokenConfig{TokenURL: mockServer.URL}))
 	r.GET("/test", func(c *gin.Context) {
 		user, _ := c.Get("user")
 		c.JSON(http.StatusOK, user)
@@ -76,3 +77,510 @@ func TestVerifyToken(t *testing.T) {
 		})
 	}
 }
+
+func TestVerifyTokenInstancesAreIndependent(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	newTokenServer := func(id string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(Profile{ID: id})
+		}))
+	}
+	serverA := newTokenServer("from-a")
+	defer serverA.Close()
+	serverB := newTokenServer("from-b")
+	defer serverB.Close()
+
+	newRouter := func(tokenURL string) *gin.Engine {
+		r := gin.New()
+		r.Use(AuthMiddleware())
+		r.Use(VerifyToken(VerifyTokenConfig{TokenURL: tokenURL}))
+		r.GET("/test", func(c *gin.Context) {
+			user, _ := c.Get("user")
+			c.JSON(http.StatusOK, user)
+		})
+		return r
+	}
+	routerA := newRouter(serverA.URL)
+	routerB := newRouter(serverB.URL)
+
+	for _, tt := range []struct {
+		router     *gin.Engine
+		expectedID string
+	}{
+		{routerA, "from-a"},
+		{routerB, "from-b"},
+	} {
+		req, _ := http.NewRequest("GET", "/test", nil)
+		req.Header.Set("Authorization", "Bearer shared_token")
+		resp := httptest.NewRecorder()
+		tt.router.ServeHTTP(resp, req)
+
+		var profile Profile
+		json.NewDecoder(resp.Body).Decode(&profile)
+		if profile.ID != tt.expectedID {
+			t.Errorf("Expected profile %q, got %q", tt.expectedID, profile.ID)
+		}
+		if resp.Header().Get("X-Token-Cache") != "MISS" {
+			t.Errorf("Expected cache MISS, got %q", resp.Header().Get("X-Token-Cache"))
+		}
+	}
+}
+
+func TestVerifyTokenWithoutTokenURL(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	r := gin.New()
+	r.Use(AuthMiddleware())
+	r.Use(VerifyToken(VerifyTokenConfig{}))
+	r.GET("/test", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	req, _ := http.NewRequest("GET", "/test", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status %d, got %d", http.StatusInternalServerError, resp.Code)
+	}
+}
+
+func TestVerifyTokenIntrospection(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	calls := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if id, secret, _ := r.BasicAuth(); id != "gateway" || secret != "gateway-secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost || r.PostFormValue("token") != "valid_token" {
+			json.NewEncoder(w).Encode(map[string]any{"active": false})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"active":   true,
+			"sub":      "42",
+			"username": "jane",
+			"scope":    "profile orders:read",
+			"roles":    []string{"admin"},
+			"exp":      time.Now().Add(time.Hour).Unix(),
+		})
+	}))
+	defer mockServer.Close()
+
+	newRouter := func(secret string) *gin.Engine {
+		r := gin.New()
+		r.Use(func(c *gin.Context) {
+			c.Set("auth_token", c.GetHeader("Authorization"))
+			c.Set("auth_header", "Authorization")
+			c.Next()
+		})
+		r.Use(VerifyToken(VerifyTokenConfig{
+			TokenURL:                  mockServer.URL,
+			IntrospectionClientID:     "gateway",
+			IntrospectionClientSecret: secret,
+		}))
+		r.GET("/test", func(c *gin.Context) {
+			user, _ := c.Get("user")
+			c.JSON(http.StatusOK, user)
+		})
+		return r
+	}
+	get := func(r *gin.Engine, token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/test", nil)
+		req.Header.Set("Authorization", token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	r := newRouter("gateway-secret")
+	w := get(r, "Bearer valid_token")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	var profile Profile
+	json.NewDecoder(w.Body).Decode(&profile)
+	if profile.ID != "42" || profile.Name != "jane" || len(profile.Scopes) != 2 || profile.Roles[0] != "admin" {
+		t.Errorf("Unexpected profile: %+v", profile)
+	}
+
+	// Active tokens are cached
+	if w := get(r, "Bearer valid_token"); w.Header().Get("X-Token-Cache") != "HIT" || calls != 1 {
+		t.Errorf("Expected a cache hit, got %q after %d calls", w.Header().Get("X-Token-Cache"), calls)
+	}
+
+	if w := get(r, "Bearer revoked_token"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for an inactive token, got %d", http.StatusUnauthorized, w.Code)
+	}
+	if w := get(newRouter("wrong"), "Bearer valid_token"); w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status %d when the endpoint rejects our credentials, got %d", http.StatusInternalServerError, w.Code)
+	}
+}
+
+func TestVerifyTokenCachesFingerprints(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Profile{ID: "123"})
+	}))
+	defer mockServer.Close()
+
+	cache := NewMemoryTokenCache(TokenCacheOptions{})
+	r := gin.New()
+	r.Use(AuthMiddleware())
+	r.Use(VerifyToken(VerifyTokenConfig{TokenURL: mockServer.URL, Cache: cache}))
+	r.GET("/test", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	req, _ := http.NewRequest("GET", "/test", nil)
+	req.Header.Set("Authorization", "Bearer live_token")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	if _, found := cache.Get("Bearer live_token"); found {
+		t.Error("Expected the raw token not to be a cache key")
+	}
+	if _, found := cache.Get(Fingerprint("Bearer live_token")); !found {
+		t.Error("Expected the profile to be cached under the token fingerprint")
+	}
+}
+
+func TestVerifyTokenCoalescesRequests(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var calls atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		json.NewEncoder(w).Encode(Profile{ID: "123"})
+	}))
+	defer mockServer.Close()
+
+	r := gin.New()
+	r.Use(AuthMiddleware())
+	r.Use(VerifyToken(VerifyTokenConfig{TokenURL: mockServer.URL}))
+	r.GET("/test", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	serve := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/test", nil)
+		req.Header.Set("Authorization", "Bearer popular_token")
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		return resp
+	}
+
+	var wg sync.WaitGroup
+	responses := make([]*httptest.ResponseRecorder, 5)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		responses[0] = serve()
+	}()
+	<-started
+	for i := 1; i < len(responses); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = serve()
+		}(i)
+	}
+	// Give the other requests time to join the running call
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("Expected a single call to TOKEN_URL, got %d", n)
+	}
+	counts := map[string]int{}
+	for _, resp := range responses {
+		if resp.Code != http.StatusOK {
+			t.Errorf("Expected status %d, got %d", http.StatusOK, resp.Code)
+		}
+		counts[resp.Header().Get("X-Token-Cache")]++
+	}
+	if counts["MISS"] != 1 || counts["SHARED"] != len(responses)-1 {
+		t.Errorf("Expected one MISS and %d SHARED, got %v", len(responses)-1, counts)
+	}
+}
+
+func TestVerifyTokenNegativeCache(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name           string
+		upstreamStatus int
+		negativeExpiry time.Duration
+		expectedCalls  int32
+		expectedCache  string
+	}{
+		{"Rejected token is cached", http.StatusUnauthorized, time.Minute, 1, "NEGATIVE"},
+		{"Negative caching disabled", http.StatusUnauthorized, 0, 2, "MISS"},
+		{"Upstream errors are not cached", http.StatusForbidden, time.Minute, 2, "MISS"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				w.WriteHeader(tt.upstreamStatus)
+			}))
+			defer mockServer.Close()
+
+			r := gin.New()
+			r.Use(AuthMiddleware())
+			r.Use(VerifyToken(VerifyTokenConfig{TokenURL: mockServer.URL, NegativeCacheExpiry: tt.negativeExpiry}))
+			r.GET("/test", func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			var resp *httptest.ResponseRecorder
+			for i := 0; i < 2; i++ {
+				req, _ := http.NewRequest("GET", "/test", nil)
+				req.Header.Set("Authorization", "Bearer bad_token")
+				resp = httptest.NewRecorder()
+				r.ServeHTTP(resp, req)
+				if resp.Code != http.StatusUnauthorized {
+					t.Fatalf("Expected status %d, got %d", http.StatusUnauthorized, resp.Code)
+				}
+			}
+
+			if n := calls.Load(); n != tt.expectedCalls {
+				t.Errorf("Expected %d calls to TOKEN_URL, got %d", tt.expectedCalls, n)
+			}
+			if cache := resp.Header().Get("X-Token-Cache"); cache != tt.expectedCache {
+				t.Errorf("Expected cache %s, got %q", tt.expectedCache, cache)
+			}
+		})
+	}
+}
+
+func TestVerifyTokenProviderFailures(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var calls atomic.Int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer mockServer.Close()
+
+	client := NewUpstreamClient(UpstreamOptions{MaxRetries: 1, FailureThreshold: 1, OpenTimeout: time.Minute})
+	r := gin.New()
+	r.Use(AuthMiddleware())
+	r.Use(VerifyToken(VerifyTokenConfig{TokenURL: mockServer.URL, Client: client}))
+	r.GET("/test", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	serve := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/test", nil)
+		req.Header.Set("Authorization", "Bearer token")
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		return resp
+	}
+
+	if resp := serve(); resp.Code != http.StatusBadGateway {
+		t.Errorf("Expected status %d, got %d", http.StatusBadGateway, resp.Code)
+	}
+	resp := serve()
+	if resp.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d, got %d", http.StatusServiceUnavailable, resp.Code)
+	}
+	if retryAfter := resp.Header().Get("Retry-After"); retryAfter != "60" {
+		t.Errorf("Expected Retry-After 60, got %q", retryAfter)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("Expected the open circuit to fail fast after 2 calls, got %d", n)
+	}
+}
+
+func TestVerifyTokenStaleWhileRevalidate(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var calls atomic.Int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		json.NewEncoder(w).Encode(Profile{ID: "123", Name: fmt.Sprintf("v%d", n)})
+	}))
+	defer mockServer.Close()
+
+	r := gin.New()
+	r.Use(AuthMiddleware())
+	r.Use(VerifyToken(VerifyTokenConfig{TokenURL: mockServer.URL, CacheExpiry: 20 * time.Millisecond, StaleWhileRevalidate: time.Minute}))
+	r.GET("/test", func(c *gin.Context) {
+		user, _ := c.Get("user")
+		c.JSON(http.StatusOK, user)
+	})
+
+	serve := func() (string, string) {
+		req, _ := http.NewRequest("GET", "/test", nil)
+		req.Header.Set("Authorization", "Bearer token")
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		var profile Profile
+		json.NewDecoder(resp.Body).Decode(&profile)
+		return resp.Header().Get("X-Token-Cache"), profile.Name
+	}
+
+	if cache, name := serve(); cache != "MISS" || name != "v1" {
+		t.Fatalf("Expected MISS with v1, got %s with %s", cache, name)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if cache, name := serve(); cache != "STALE" || name != "v1" {
+		t.Fatalf("Expected STALE with v1, got %s with %s", cache, name)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for calls.Load() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected a background refresh")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// The refreshed profile is cached once the call returns
+	for {
+		cache, name := serve()
+		if cache == "HIT" && name == "v2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected HIT with v2, got %s with %s", cache, name)
+		}
+	}
+}
+
+func TestVerifyTokenMaxStale(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var upstreamStatus atomic.Int32
+	upstreamStatus.Store(http.StatusOK)
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status := int(upstreamStatus.Load()); status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		json.NewEncoder(w).Encode(Profile{ID: "123"})
+	}))
+	defer mockServer.Close()
+
+	newRouter := func(maxStale time.Duration) *gin.Engine {
+		r := gin.New()
+		r.Use(AuthMiddleware())
+		r.Use(VerifyToken(VerifyTokenConfig{
+			TokenURL:    mockServer.URL,
+			CacheExpiry: 20 * time.Millisecond,
+			MaxStale:    maxStale,
+			Client:      NewUpstreamClient(UpstreamOptions{}),
+		}))
+		r.GET("/test", func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+		return r
+	}
+	serve := func(r *gin.Engine) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/test", nil)
+		req.Header.Set("Authorization", "Bearer token")
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		return resp
+	}
+
+	tests := []struct {
+		name           string
+		maxStale       time.Duration
+		upstreamStatus int
+		expectedStatus int
+		expectedCache  string
+	}{
+		{"Provider down within max staleness", time.Minute, http.StatusServiceUnavailable, http.StatusOK, "STALE"},
+		{"Provider down past max staleness", 10 * time.Millisecond, http.StatusServiceUnavailable, http.StatusBadGateway, "MISS"},
+		{"Token revoked", time.Minute, http.StatusUnauthorized, http.StatusUnauthorized, "MISS"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreamStatus.Store(http.StatusOK)
+			r := newRouter(tt.maxStale)
+			serve(r)
+
+			time.Sleep(30 * time.Millisecond)
+			upstreamStatus.Store(int32(tt.upstreamStatus))
+			resp := serve(r)
+			if resp.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, resp.Code)
+			}
+			if cache := resp.Header().Get("X-Token-Cache"); cache != tt.expectedCache {
+				t.Errorf("Expected cache %s, got %q", tt.expectedCache, cache)
+			}
+		})
+	}
+
+	// A revoked token is not served stale once the provider is down
+	r := newRouter(time.Minute)
+	upstreamStatus.Store(http.StatusOK)
+	serve(r)
+	time.Sleep(30 * time.Millisecond)
+	upstreamStatus.Store(http.StatusUnauthorized)
+	serve(r)
+	upstreamStatus.Store(http.StatusServiceUnavailable)
+	if resp := serve(r); resp.Code != http.StatusBadGateway {
+		t.Errorf("Expected status %d after revocation, got %d", http.StatusBadGateway, resp.Code)
+	}
+}
+
+func TestVerifyTokenSharedCache(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var calls atomic.Int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		json.NewEncoder(w).Encode(Profile{ID: "123"})
+	}))
+	defer mockServer.Close()
+
+	redis := miniredis.RunT(t)
+	// Two replicas sharing the cache and the fingerprint key
+	replicas := make([]*gin.Engine, 2)
+	for i := range replicas {
+		cache := NewRedisTokenCache(RedisTokenCacheOptions{Addr: redis.Addr()})
+		defer cache.Close()
+		replicas[i] = gin.New()
+		replicas[i].Use(AuthMiddleware())
+		replicas[i].Use(VerifyToken(VerifyTokenConfig{TokenURL: mockServer.URL, Cache: cache, FingerprintKey: []byte("shared-fingerprint-key")}))
+		replicas[i].GET("/test", func(c *gin.Context) {
+			user, _ := c.Get("user")
+			c.JSON(http.StatusOK, user)
+		})
+	}
+
+	for i, expected := range []string{"MISS", "HIT"} {
+		req, _ := http.NewRequest("GET", "/test", nil)
+		req.Header.Set("Authorization", "Bearer token")
+		resp := httptest.NewRecorder()
+		replicas[i].ServeHTTP(resp, req)
+
+		if resp.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, resp.Code)
+		}
+		if cache := resp.Header().Get("X-Token-Cache"); cache != expected {
+			t.Errorf("Expected replica %d to answer %s, got %s", i, expected, cache)
+		}
+	}
+	if calls.Load() != 1 {
+		t.Errorf("Expected 1 call to the token provider, got %d", calls.Load())
+	}
+}
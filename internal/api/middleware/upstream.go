@@ -0,0 +1,259 @@
+package middleware
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Defaults of the client VerifyToken creates when VerifyTokenConfig.Client
+// is not set.
+var DefaultUpstreamOptions = UpstreamOptions{
+	ConnectTimeout:   2 * time.Second,
+	Timeout:          5 * time.Second,
+	MaxRetries:       2,
+	RetryBackoff:     100 * time.Millisecond,
+	FailureThreshold: 5,
+	OpenTimeout:      30 * time.Second,
+}
+
+// UpstreamOptions configures an UpstreamClient.
+type UpstreamOptions struct {
+	// ConnectTimeout bounds establishing a connection, including the TLS
+	// handshake, and Timeout each attempt as a whole, including reading
+	// the response body.
+	ConnectTimeout time.Duration
+	Timeout        time.Duration
+	// MaxRetries is how many times a request failing with a network error
+	// or a 5xx response is retried. Retries wait RetryBackoff, doubled on
+	// every retry, with full jitter.
+	MaxRetries   int
+	RetryBackoff time.Duration
+	// FailureThreshold is the number of consecutive failed requests that
+	// opens the circuit, or zero to never open it. An open circuit fails
+	// requests fast for OpenTimeout, then lets a single probe through.
+	FailureThreshold int
+	OpenTimeout      time.Duration
+	// OnStateChange, when set, is called on every circuit transition, e.g.
+	// to update a metric. It runs with the client locked and must not call
+	// the client.
+	OnStateChange func(from, to CircuitState)
+}
+
+// CircuitState is the state of the circuit breaker of an UpstreamClient.
+type CircuitState int
+
+const (
+	// CircuitClosed lets requests through.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen fails requests fast.
+	CircuitOpen
+	// CircuitHalfOpen lets a single probe through.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half_open"
+	}
+	return fmt.Sprintf("CircuitState(%d)", int(s))
+}
+
+// CircuitOpenError is returned by UpstreamClient.Do while the circuit is
+// open.
+type CircuitOpenError struct {
+	// RetryAfter is how long until the circuit lets a probe through.
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit open, retry after %s", e.RetryAfter)
+}
+
+// UpstreamStats are the counters of an UpstreamClient.
+type UpstreamStats struct {
+	State string `json:"state"`
+	// Requests counts calls to Do, Retries the additional attempts,
+	// Failures the requests that failed after their last attempt and
+	// Rejected those failed fast by the open circuit.
+	Requests uint64 `json:"requests"`
+	Retries  uint64 `json:"retries"`
+	Failures uint64 `json:"failures"`
+	Rejected uint64 `json:"rejected"`
+}
+
+// UpstreamClient sends requests to a token provider with timeouts, retries
+// and a circuit breaker. It reuses connections and is safe for concurrent
+// use.
+type UpstreamClient struct {
+	opts   UpstreamOptions
+	client *http.Client
+
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	// openUntil is when an open circuit lets a probe through
+	openUntil time.Time
+	probing   bool
+	stats     UpstreamStats
+}
+
+// NewUpstreamClient returns a client configured by opts.
+func NewUpstreamClient(opts UpstreamOptions) *UpstreamClient {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{Timeout: opts.ConnectTimeout, KeepAlive: 30 * time.Second}
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = opts.ConnectTimeout
+
+	return &UpstreamClient{
+		opts:   opts,
+		client: &http.Client{Transport: transport, Timeout: opts.Timeout},
+	}
+}
+
+// Do sends req, retrying network errors and 5xx responses. The response of
+// the last attempt is returned, whatever its status. Requests with a body
+// are only retried when req.GetBody is set, as it is by http.NewRequest.
+func (u *UpstreamClient) Do(req *http.Request) (*http.Response, error) {
+	if err := u.allow(); err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		attemptReq := req
+		if attempt > 0 {
+			attemptReq = req.Clone(req.Context())
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					u.record(false)
+					return nil, err
+				}
+				attemptReq.Body = body
+			}
+		}
+
+		resp, err := u.client.Do(attemptReq)
+		failed := err != nil || resp.StatusCode >= http.StatusInternalServerError
+		canRetry := req.Body == nil || req.GetBody != nil
+		if !failed || !canRetry || attempt >= u.opts.MaxRetries || req.Context().Err() != nil {
+			u.record(!failed)
+			return resp, err
+		}
+		if resp != nil {
+			logger.Debug("Retrying token provider request", zap.Int("attempt", attempt+1), zap.Int("status", resp.StatusCode))
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		} else {
+			logger.Debug("Retrying token provider request", zap.Int("attempt", attempt+1), zap.Error(err))
+		}
+
+		select {
+		case <-time.After(u.backoff(attempt)):
+		case <-req.Context().Done():
+			u.record(false)
+			return nil, req.Context().Err()
+		}
+		u.mu.Lock()
+		u.stats.Retries++
+		u.mu.Unlock()
+	}
+}
+
+// Stats returns the current counters.
+func (u *UpstreamClient) Stats() UpstreamStats {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	stats := u.stats
+	stats.State = u.state.String()
+	return stats
+}
+
+// backoff returns a random delay up to RetryBackoff doubled attempt times.
+func (u *UpstreamClient) backoff(attempt int) time.Duration {
+	limit := u.opts.RetryBackoff << attempt
+	if limit <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(limit)))
+}
+
+// allow returns a *CircuitOpenError when the circuit does not let the
+// request through.
+func (u *UpstreamClient) allow() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.stats.Requests++
+	switch u.state {
+	case CircuitOpen:
+		if wait := time.Until(u.openUntil); wait > 0 {
+			u.stats.Rejected++
+			return &CircuitOpenError{RetryAfter: wait}
+		}
+		u.transition(CircuitHalfOpen)
+		u.probing = true
+	case CircuitHalfOpen:
+		if u.probing {
+			u.stats.Rejected++
+			return &CircuitOpenError{RetryAfter: time.Second}
+		}
+		u.probing = true
+	}
+	return nil
+}
+
+// record updates the circuit with the outcome of a request.
+func (u *UpstreamClient) record(ok bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.probing = false
+	if ok {
+		u.failures = 0
+		if u.state != CircuitClosed {
+			u.transition(CircuitClosed)
+		}
+		return
+	}
+
+	u.stats.Failures++
+	u.failures++
+	if u.opts.FailureThreshold <= 0 {
+		return
+	}
+	if u.state == CircuitHalfOpen || (u.state == CircuitClosed && u.failures >= u.opts.FailureThreshold) {
+		u.openUntil = time.Now().Add(u.opts.OpenTimeout)
+		u.transition(CircuitOpen)
+	}
+}
+
+// transition moves the circuit to state. u.mu must be held.
+func (u *UpstreamClient) transition(state CircuitState) {
+	from := u.state
+	u.state = state
+
+	fields := []zap.Field{zap.Stringer("from", from), zap.Stringer("to", state), zap.Int("consecutive_failures", u.failures)}
+	switch state {
+	case CircuitOpen:
+		logger.Warn("Token provider circuit opened", append(fields, zap.Duration("open_timeout", u.opts.OpenTimeout))...)
+	case CircuitHalfOpen:
+		logger.Info("Token provider circuit half open, probing", fields...)
+	case CircuitClosed:
+		logger.Info("Token provider circuit closed", fields...)
+	}
+	if u.opts.OnStateChange != nil {
+		u.opts.OnStateChange(from, state)
+	}
+}
@@ -0,0 +1,135 @@
+package middleware
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpstreamClientRetries(t *testing.T) {
+	tests := []struct {
+		name           string
+		statuses       []int
+		expectedStatus int
+		expectedCalls  int32
+	}{
+		{"Retries 5xx until success", []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusOK}, http.StatusOK, 3},
+		{"Gives up after MaxRetries", []int{500, 500, 500, 500}, http.StatusInternalServerError, 3},
+		{"Does not retry 4xx", []int{http.StatusUnauthorized, http.StatusOK}, http.StatusUnauthorized, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				if string(body) != "token=abc" {
+					t.Errorf("Expected the body on every attempt, got %q", body)
+				}
+				w.WriteHeader(tt.statuses[calls.Add(1)-1])
+			}))
+			defer server.Close()
+
+			client := NewUpstreamClient(UpstreamOptions{MaxRetries: 2, RetryBackoff: time.Millisecond})
+			req, _ := http.NewRequest(http.MethodPost, server.URL, strings.NewReader("token=abc"))
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, resp.StatusCode)
+			}
+			if n := calls.Load(); n != tt.expectedCalls {
+				t.Errorf("Expected %d calls, got %d", tt.expectedCalls, n)
+			}
+			if stats := client.Stats(); stats.Requests != 1 || stats.Retries != uint64(tt.expectedCalls-1) {
+				t.Errorf("Unexpected stats: %+v", stats)
+			}
+		})
+	}
+}
+
+func TestUpstreamClientTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := NewUpstreamClient(UpstreamOptions{Timeout: 20 * time.Millisecond, MaxRetries: 1})
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	start := time.Now()
+	if _, err := client.Do(req); err == nil {
+		t.Fatal("Expected a timeout")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the request to time out quickly, took %s", elapsed)
+	}
+	if stats := client.Stats(); stats.Retries != 1 || stats.Failures != 1 {
+		t.Errorf("Expected one retry and one failure, got %+v", stats)
+	}
+}
+
+func TestUpstreamClientCircuitBreaker(t *testing.T) {
+	var healthy atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	var transitions []string
+	client := NewUpstreamClient(UpstreamOptions{
+		FailureThreshold: 2,
+		OpenTimeout:      50 * time.Millisecond,
+		OnStateChange: func(from, to CircuitState) {
+			transitions = append(transitions, from.String()+"->"+to.String())
+		},
+	})
+	do := func() error {
+		req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	do()
+	do()
+	var open *CircuitOpenError
+	if err := do(); !errors.As(err, &open) || open.RetryAfter <= 0 {
+		t.Fatalf("Expected the circuit to be open, got %v", err)
+	}
+
+	// A failed probe opens the circuit again
+	time.Sleep(60 * time.Millisecond)
+	do()
+	if err := do(); !errors.As(err, &open) {
+		t.Fatalf("Expected the circuit to open again, got %v", err)
+	}
+
+	// A successful probe closes it
+	healthy.Store(true)
+	time.Sleep(60 * time.Millisecond)
+	if err := do(); err != nil {
+		t.Fatalf("Expected the probe to go through, got %v", err)
+	}
+
+	expected := "closed->open,open->half_open,half_open->open,open->half_open,half_open->closed"
+	if got := strings.Join(transitions, ","); got != expected {
+		t.Errorf("Expected transitions %s, got %s", expected, got)
+	}
+	if stats := client.Stats(); stats.State != "closed" || stats.Rejected != 2 || stats.Failures != 3 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
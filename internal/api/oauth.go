@@ -0,0 +1,226 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nicobistolfi/go-rest-api/internal/config"
+	"github.com/nicobistolfi/go-rest-api/pkg/auth"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// oauthFlowCookie holds the state of a login between /auth/login and
+	// the callback, signed with a key derived from JWT_SECRET
+	oauthFlowCookie = "oauth_flow"
+	// oauthFlowExpiry is how long the user has to complete a login
+	oauthFlowExpiry   = 10 * time.Minute
+	oauthFlowAudience = "oauth_flow"
+	// oauthFlowKeyLabel separates the flow cookie key from JWT_SECRET so
+	// the cookie cannot be passed off as an access token
+	oauthFlowKeyLabel = "go-rest-api oauth flow"
+)
+
+// oauthFlowKey returns the key the flow cookie is signed with
+func oauthFlowKey(cfg *config.Config) []byte {
+	mac := hmac.New(sha256.New, []byte(cfg.JWTSecret))
+	mac.Write([]byte(oauthFlowKeyLabel))
+	return mac.Sum(nil)
+}
+
+// oauthFlow is the state of a login in progress
+type oauthFlow struct {
+	State        string `json:"state"`
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"code_verifier"`
+	ReturnTo     string `json:"return_to,omitempty"`
+	jwt.RegisteredClaims
+}
+
+func newOAuthClient(cfg *config.Config) *auth.OAuthClient {
+	verifier := auth.NewOIDCVerifier(cfg.OIDCIssuer, auth.OIDCOptions{
+		Audience:           cfg.OAuthClientID,
+		Leeway:             cfg.JWTLeeway,
+		MinRefreshInterval: cfg.OIDCJWKSRefreshInterval,
+	})
+	return auth.NewOAuthClient(verifier, auth.OAuthOptions{
+		ClientID:     cfg.OAuthClientID,
+		ClientSecret: cfg.OAuthClientSecret,
+		RedirectURL:  cfg.OAuthRedirectURL,
+		Scopes:       cfg.OAuthScopes,
+	})
+}
+
+// OAuthLogin returns the handler for /auth/login. It starts an
+// authorization code flow with PKCE against OIDC_ISSUER and redirects the
+// user to the provider. The optional return_to query parameter is where the
+// callback sends the user with the issued token, and must be one of
+// ALLOWED_ORIGINS.
+func OAuthLogin(cfg *config.Config) gin.HandlerFunc {
+	client := newOAuthClient(cfg)
+	flowKey := oauthFlowKey(cfg)
+
+	return func(c *gin.Context) {
+		returnTo := c.Query("return_to")
+		if returnTo != "" && !allowedReturnTo(cfg.AllowedOrigins, returnTo) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "return_to is not an allowed origin"})
+			return
+		}
+
+		flow := oauthFlow{ReturnTo: returnTo}
+		for _, value := range []*string{&flow.State, &flow.Nonce, &flow.CodeVerifier} {
+			random, err := auth.RandomString(32)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+				return
+			}
+			*value = random
+		}
+
+		redirectURL, err := client.AuthCodeURL(c.Request.Context(), flow.State, flow.Nonce, auth.CodeChallenge(flow.CodeVerifier))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+			return
+		}
+
+		now := time.Now()
+		flow.Audience = jwt.ClaimStrings{oauthFlowAudience}
+		flow.ExpiresAt = jwt.NewNumericDate(now.Add(oauthFlowExpiry))
+		flow.IssuedAt = jwt.NewNumericDate(now)
+		cookie, err := jwt.NewWithClaims(jwt.SigningMethodHS256, flow).SignedString(flowKey)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+			return
+		}
+
+		c.SetSameSite(http.SameSiteLaxMode)
+		c.SetCookie(oauthFlowCookie, cookie, int(oauthFlowExpiry.Seconds()), "/", "", secureCookie(cfg), true)
+		c.Redirect(http.StatusFound, redirectURL)
+	}
+}
+
+// OAuthCallback returns the handler for the path of OAUTH_REDIRECT_URL. It
+// validates the state, exchanges the code, verifies the ID token and its
+// nonce and issues an access token signed with the active signing key and
+// a refresh token for the user.
+func OAuthCallback(cfg *config.Config, tokens auth.TokenStore) gin.HandlerFunc {
+	client := newOAuthClient(cfg)
+	issuer, issuerErr := newTokenIssuer(cfg, tokens)
+	flowKey := oauthFlowKey(cfg)
+
+	return func(c *gin.Context) {
+		if issuerErr != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Signing keys are not available"})
+			return
+		}
+
+		cookie, err := c.Cookie(oauthFlowCookie)
+		// The flow cookie is single use
+		c.SetSameSite(http.SameSiteLaxMode)
+		c.SetCookie(oauthFlowCookie, "", -1, "/", "", secureCookie(cfg), true)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Login session is missing or expired"})
+			return
+		}
+
+		flow := &oauthFlow{}
+		_, err = jwt.ParseWithClaims(cookie, flow, func(token *jwt.Token) (interface{}, error) {
+			return flowKey, nil
+		}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithAudience(oauthFlowAudience), jwt.WithExpirationRequired())
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Login session is missing or expired"})
+			return
+		}
+
+		if subtle.ConstantTimeCompare([]byte(c.Query("state")), []byte(flow.State)) != 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid state"})
+			return
+		}
+		if reason := c.Query("error"); reason != "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Login failed", "reason": reason})
+			return
+		}
+		code := c.Query("code")
+		if code == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Authorization code is missing"})
+			return
+		}
+
+		token, err := client.Exchange(c.Request.Context(), code, flow.CodeVerifier)
+		var oauthErr *auth.OAuthError
+		switch {
+		case errors.As(err, &oauthErr):
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Login failed", "reason": oauthErr.Code})
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to exchange authorization code"})
+			return
+		}
+
+		claims, err := client.VerifyIDToken(c.Request.Context(), token.IDToken, flow.Nonce)
+		if errors.Is(err, auth.ErrIssuerUnavailable) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify ID token"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid ID token"})
+			return
+		}
+
+		username := claims.PreferredUsername
+		if username == "" {
+			username = claims.Name
+		}
+		pair, err := issuer.Issue(c.Request.Context(), auth.User{ID: claims.Subject, Username: username, Email: claims.Email})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+			return
+		}
+
+		if flow.ReturnTo != "" {
+			// The access token is passed in the fragment so it never
+			// reaches the logs of the frontend server. The refresh token is
+			// only returned in the JSON response, as URLs end up in the
+			// browser history.
+			fragment := url.Values{
+				"access_token": {pair.AccessToken},
+				"token_type":   {"Bearer"},
+				"expires_in":   {strconv.Itoa(int(pair.ExpiresIn.Seconds()))},
+			}
+			c.Redirect(http.StatusFound, flow.ReturnTo+"#"+fragment.Encode())
+			return
+		}
+
+		c.JSON(http.StatusOK, tokenResponse(pair))
+	}
+}
+
+// allowedReturnTo reports whether returnTo is an absolute URL on one of the
+// allowed origins. The * wildcard is not honoured to avoid open redirects.
+func allowedReturnTo(allowedOrigins []string, returnTo string) bool {
+	u, err := url.Parse(returnTo)
+	if err != nil || u.Scheme == "" || u.Host == "" || u.Fragment != "" {
+		return false
+	}
+	origin := u.Scheme + "://" + u.Host
+	for _, allowed := range allowedOrigins {
+		if allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// secureCookie reports whether cookies should only be sent over HTTPS.
+func secureCookie(cfg *config.Config) bool {
+	return strings.HasPrefix(cfg.OAuthRedirectURL, "https://")
+}
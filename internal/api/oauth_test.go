@@ -0,0 +1,227 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/nicobistolfi/go-rest-api/internal/config"
+	logger "github.com/nicobistolfi/go-rest-api/pkg"
+	"github.com/nicobistolfi/go-rest-api/pkg/auth"
+)
+
+// fakeProvider is an OpenID Connect provider that hands out a fixed code
+// and checks the PKCE verifier when it is exchanged
+type fakeProvider struct {
+	*httptest.Server
+	key       *rsa.PrivateKey
+	challenge string
+	nonce     string
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	p := &fakeProvider{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"jwks_uri":               p.URL + "/jwks",
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kid": "k1",
+			"kty": "RSA",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if r.FormValue("code") != "good-code" || id != "client" || secret != "client-secret" ||
+			auth.CodeChallenge(r.FormValue("code_verifier")) != p.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss":                p.URL,
+			"sub":                "jane",
+			"aud":                "client",
+			"nonce":              p.nonce,
+			"email":              "jane@example.com",
+			"preferred_username": "jane.doe",
+			"iat":                time.Now().Unix(),
+			"exp":                time.Now().Add(time.Hour).Unix(),
+		})
+		idToken.Header["kid"] = "k1"
+		signed, err := idToken.SignedString(key)
+		require.NoError(t, err)
+		json.NewEncoder(w).Encode(map[string]any{"access_token": "provider-token", "token_type": "Bearer", "id_token": signed})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+func TestOAuthLoginFlow(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger.Init()
+
+	provider := newFakeProvider(t)
+	cfg := &config.Config{
+		OIDCIssuer:           provider.URL,
+		OAuthClientID:        "client",
+		OAuthClientSecret:    "client-secret",
+		OAuthRedirectURL:     "http://localhost:8080/auth/callback",
+		OAuthScopes:          []string{"openid", "email"},
+		AllowedOrigins:       []string{"http://localhost:3000"},
+		JWTSecret:            "test_secret",
+		JWTExpirationMinutes: 5,
+		TokenVerifiers:       []string{config.VerifierJWT},
+	}
+	r := gin.New()
+	SetupRouter(r, cfg, logger.Log, WithoutRateLimiting())
+
+	// login starts the flow and returns the flow cookie and the parameters
+	// sent to the provider
+	login := func(query string) (*http.Cookie, url.Values) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/auth/login"+query, nil)
+		r.ServeHTTP(w, req)
+		require.Equal(t, http.StatusFound, w.Code)
+
+		location, err := url.Parse(w.Header().Get("Location"))
+		require.NoError(t, err)
+		assert.Equal(t, provider.URL+"/authorize", location.Scheme+"://"+location.Host+location.Path)
+
+		params := location.Query()
+		provider.challenge = params.Get("code_challenge")
+		provider.nonce = params.Get("nonce")
+
+		cookies := w.Result().Cookies()
+		require.Len(t, cookies, 1)
+		assert.True(t, cookies[0].HttpOnly)
+		return cookies[0], params
+	}
+	callback := func(cookie *http.Cookie, query url.Values) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/auth/callback?"+query.Encode(), nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Successful login", func(t *testing.T) {
+		cookie, params := login("")
+		assert.Equal(t, "code", params.Get("response_type"))
+		assert.Equal(t, "client", params.Get("client_id"))
+		assert.Equal(t, "openid email", params.Get("scope"))
+		assert.Equal(t, "S256", params.Get("code_challenge_method"))
+
+		w := callback(cookie, url.Values{"code": {"good-code"}, "state": {params.Get("state")}})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var response struct {
+			Token string `json:"token"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		claims, err := auth.ParseJWT(response.Token, []byte(cfg.JWTSecret), auth.VerifyOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, "jane", claims.Subject)
+		assert.Equal(t, "jane@example.com", claims.Email)
+
+		// The issued token opens the protected routes
+		w = httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/profile", nil)
+		req.Header.Set("Authorization", "Bearer "+response.Token)
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"id":"jane"`)
+	})
+
+	t.Run("Redirects to return_to", func(t *testing.T) {
+		cookie, params := login("?return_to=" + url.QueryEscape("http://localhost:3000/logged-in"))
+
+		w := callback(cookie, url.Values{"code": {"good-code"}, "state": {params.Get("state")}})
+		require.Equal(t, http.StatusFound, w.Code, w.Body.String())
+
+		location, err := url.Parse(w.Header().Get("Location"))
+		require.NoError(t, err)
+		assert.Equal(t, "/logged-in", location.Path)
+		fragment, err := url.ParseQuery(location.Fragment)
+		require.NoError(t, err)
+		assert.NotEmpty(t, fragment.Get("access_token"))
+		assert.Equal(t, "Bearer", fragment.Get("token_type"))
+	})
+
+	t.Run("Rejects return_to outside the allowed origins", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/auth/login?return_to="+url.QueryEscape("https://evil.example.com"), nil)
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Rejects a wrong state", func(t *testing.T) {
+		cookie, _ := login("")
+		w := callback(cookie, url.Values{"code": {"good-code"}, "state": {"forged"}})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Rejects a callback without the flow cookie", func(t *testing.T) {
+		_, params := login("")
+		w := callback(nil, url.Values{"code": {"good-code"}, "state": {params.Get("state")}})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Rejects a code exchanged with another verifier", func(t *testing.T) {
+		cookie, params := login("")
+		provider.challenge = auth.CodeChallenge("attacker-verifier")
+		w := callback(cookie, url.Values{"code": {"good-code"}, "state": {params.Get("state")}})
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("Rejects an ID token with another nonce", func(t *testing.T) {
+		cookie, params := login("")
+		provider.nonce = "replayed-nonce"
+		w := callback(cookie, url.Values{"code": {"good-code"}, "state": {params.Get("state")}})
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("The flow cookie is not an access token", func(t *testing.T) {
+		cookie, _ := login("")
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/profile", nil)
+		req.Header.Set("Authorization", "Bearer "+cookie.Value)
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("Reports provider errors", func(t *testing.T) {
+		cookie, params := login("")
+		w := callback(cookie, url.Values{"error": {"access_denied"}, "state": {params.Get("state")}})
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		assert.Contains(t, w.Body.String(), "access_denied")
+	})
+}
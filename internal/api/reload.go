@@ -0,0 +1,52 @@
+package api
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nicobistolfi/go-rest-api/internal/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// builtHandler is a middleware built from a configuration snapshot.
+type builtHandler struct {
+	cfg      *config.Config
+	settings any
+	handler  gin.HandlerFunc
+}
+
+// reloadable returns a middleware that delegates to the handler returned by
+// build, rebuilding it when the settings it depends on change in store.
+// Changes to unrelated settings keep the existing handler and its state,
+// such as rate limiter buckets or cached tokens.
+func reloadable(store *config.Store, settings func(*config.Config) any, build func(*config.Config) gin.HandlerFunc) gin.HandlerFunc {
+	var (
+		mu      sync.Mutex
+		current atomic.Pointer[builtHandler]
+	)
+
+	initial := store.Load()
+	current.Store(&builtHandler{cfg: initial, settings: settings(initial), handler: build(initial)})
+
+	return func(c *gin.Context) {
+		cfg := store.Load()
+		built := current.Load()
+
+		if built.cfg != cfg {
+			mu.Lock()
+			if built = current.Load(); built.cfg != cfg {
+				next := &builtHandler{cfg: cfg, settings: settings(cfg), handler: built.handler}
+				if !reflect.DeepEqual(next.settings, built.settings) {
+					next.handler = build(cfg)
+				}
+				current.Store(next)
+				built = next
+			}
+			mu.Unlock()
+		}
+
+		built.handler(c)
+	}
+}
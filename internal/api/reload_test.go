@@ -0,0 +1,61 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/nicobistolfi/go-rest-api/internal/config"
+)
+
+func TestReloadable(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	initial := &config.Config{Port: "8080", RateLimitRequests: 1}
+	store := config.NewStore(initial)
+
+	builds := 0
+	r := gin.New()
+	r.Use(reloadable(store,
+		func(cfg *config.Config) any { return cfg.RateLimitRequests },
+		func(cfg *config.Config) gin.HandlerFunc {
+			builds++
+			limit := cfg.RateLimitRequests
+			return func(c *gin.Context) {
+				c.Header("X-Limit", string(rune('0'+limit)))
+				c.Next()
+			}
+		},
+	))
+	r.GET("/test", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	limit := func() string {
+		req, _ := http.NewRequest("GET", "/test", nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Header().Get("X-Limit")
+	}
+
+	assert.Equal(t, "1", limit())
+	assert.Equal(t, 1, builds)
+
+	// Unrelated changes keep the existing handler
+	store.Reload(func() (*config.Config, error) {
+		return &config.Config{Port: "9090", RateLimitRequests: 1}, nil
+	})
+	assert.Equal(t, "1", limit())
+	assert.Equal(t, 1, builds)
+
+	// Relevant changes rebuild it
+	store.Reload(func() (*config.Config, error) {
+		return &config.Config{Port: "9090", RateLimitRequests: 2}, nil
+	})
+	assert.Equal(t, "2", limit())
+	assert.Equal(t, "2", limit())
+	assert.Equal(t, 2, builds)
+}
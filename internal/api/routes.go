@@ -1,21 +1,49 @@
 package api
 
 import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/nicobistolfi/go-rest-api/internal/api/middleware"
 	"github.com/nicobistolfi/go-rest-api/internal/config"
+	"github.com/nicobistolfi/go-rest-api/pkg/auth"
+	"github.com/nicobistolfi/go-rest-api/pkg/policy"
 
 	logger "github.com/nicobistolfi/go-rest-api/pkg"
 
 	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
 	"golang.org/x/time/rate"
 )
 
 type RouterOption func(*routerOptions)
 
 type routerOptions struct {
+	store            *config.Store
 	skipRateLimiting bool
+	corsMiddleware   gin.HandlerFunc
+	rateLimiter      gin.HandlerFunc
+	authMiddlewares  []gin.HandlerFunc
+	apiKeyStore      auth.APIKeyStore
+	tokenStore       auth.TokenStore
+	tokenCache       middleware.TokenCache
+	tokenCacheHandle *middleware.TokenCacheHandle
+	upstreamClient   *middleware.UpstreamClient
+	clientStore      auth.ClientStore
+	userStore        auth.UserStore
+	middlewares      []gin.HandlerFunc
+	routeGroups      []routeGroup
+}
+
+type routeGroup struct {
+	relativePath string
+	protected    bool
+	middlewares  []gin.HandlerFunc
+	register     func(*gin.RouterGroup)
 }
 
 func WithoutRateLimiting() RouterOption {
@@ -24,22 +52,188 @@ func WithoutRateLimiting() RouterOption {
 	}
 }
 
+// WithConfigStore makes the default middlewares read their settings from
+// store, so that rate limits, allowed origins and token verification
+// settings follow configuration reloads.
+func WithConfigStore(store *config.Store) RouterOption {
+	return func(ro *routerOptions) {
+		ro.store = store
+	}
+}
+
+// WithCORSMiddleware replaces the default CORS middleware.
+func WithCORSMiddleware(handler gin.HandlerFunc) RouterOption {
+	return func(ro *routerOptions) {
+		ro.corsMiddleware = handler
+	}
+}
+
+// WithRateLimiter replaces the default rate limiting middleware.
+func WithRateLimiter(handler gin.HandlerFunc) RouterOption {
+	return func(ro *routerOptions) {
+		ro.rateLimiter = handler
+	}
+}
+
+// WithAuthMiddleware replaces the middleware chain that guards protected
+// routes (AuthMiddleware followed by the verifiers in TOKEN_VERIFIERS by
+// default).
+func WithAuthMiddleware(handlers ...gin.HandlerFunc) RouterOption {
+	return func(ro *routerOptions) {
+		ro.authMiddlewares = handlers
+	}
+}
+
+// WithAPIKeyStore makes the apikey token verifier look keys up in store
+// instead of the keys listed in the configuration.
+func WithAPIKeyStore(store auth.APIKeyStore) RouterOption {
+	return func(ro *routerOptions) {
+		ro.apiKeyStore = store
+	}
+}
+
+// WithTokenStore keeps refresh tokens and revoked tokens in store instead
+// of in memory, which is required when running several instances.
+func WithTokenStore(store auth.TokenStore) RouterOption {
+	return func(ro *routerOptions) {
+		ro.tokenStore = store
+	}
+}
+
+// WithTokenCache makes the remote token verifier cache profiles in cache
+// instead of the cache configured by the TOKEN_CACHE_* settings, e.g. to
+// export its Stats. The cache is purged when TOKEN_URL changes.
+func WithTokenCache(cache middleware.TokenCache) RouterOption {
+	return func(ro *routerOptions) {
+		ro.tokenCache = cache
+	}
+}
+
+// WithTokenCacheHandle makes handle operate on the cache of the remote
+// token verifier, so that other packages can evict profiles, e.g. on
+// logout.
+func WithTokenCacheHandle(handle *middleware.TokenCacheHandle) RouterOption {
+	return func(ro *routerOptions) {
+		ro.tokenCacheHandle = handle
+	}
+}
+
+// WithUpstreamClient makes the remote token verifier call TOKEN_URL with
+// client instead of a client configured by the TOKEN_UPSTREAM_* settings,
+// e.g. to export its Stats.
+func WithUpstreamClient(client *middleware.UpstreamClient) RouterOption {
+	return func(ro *routerOptions) {
+		ro.upstreamClient = client
+	}
+}
+
+// WithClientStore makes the /token endpoint look clients up in store
+// instead of the clients listed in the configuration.
+func WithClientStore(store auth.ClientStore) RouterOption {
+	return func(ro *routerOptions) {
+		ro.clientStore = store
+	}
+}
+
+// WithUserStore makes the password grant of the /token endpoint look users
+// up in store instead of the users listed in the configuration.
+func WithUserStore(store auth.UserStore) RouterOption {
+	return func(ro *routerOptions) {
+		ro.userStore = store
+	}
+}
+
+// WithMiddleware adds global middleware that runs after the built-in ones.
+func WithMiddleware(handlers ...gin.HandlerFunc) RouterOption {
+	return func(ro *routerOptions) {
+		ro.middlewares = append(ro.middlewares, handlers...)
+	}
+}
+
+// WithRouteGroup registers an additional route group. The middlewares run
+// before any route in the group.
+func WithRouteGroup(relativePath string, register func(*gin.RouterGroup), middlewares ...gin.HandlerFunc) RouterOption {
+	return func(ro *routerOptions) {
+		ro.routeGroups = append(ro.routeGroups, routeGroup{
+			relativePath: relativePath,
+			middlewares:  middlewares,
+			register:     register,
+		})
+	}
+}
+
+// WithProtectedRouteGroup registers an additional route group guarded by
+// the same authentication chain as the built-in protected routes.
+func WithProtectedRouteGroup(relativePath string, register func(*gin.RouterGroup), middlewares ...gin.HandlerFunc) RouterOption {
+	return func(ro *routerOptions) {
+		ro.routeGroups = append(ro.routeGroups, routeGroup{
+			relativePath: relativePath,
+			protected:    true,
+			middlewares:  middlewares,
+			register:     register,
+		})
+	}
+}
+
 func SetupRouter(router *gin.Engine, cfg *config.Config, logger *logger.Logger, opts ...RouterOption) {
 	options := &routerOptions{}
 	for _, opt := range opts {
 		opt(options)
 	}
 
+	store := options.store
+	if store == nil {
+		store = config.NewStore(cfg)
+	}
+	tokens := options.tokenStore
+	if tokens == nil {
+		tokens = auth.NewMemoryTokenStore()
+	}
+	if options.tokenCacheHandle == nil {
+		options.tokenCacheHandle = middleware.NewTokenCacheHandle()
+	}
+	// The fingerprint key is only read at startup, so that fingerprints
+	// stay stable while the process runs
+	fingerprintKey := []byte(cfg.TokenFingerprintKey)
+
+	if options.corsMiddleware == nil {
+		options.corsMiddleware = reloadable(store,
+			func(cfg *config.Config) any { return cfg.AllowedOrigins },
+			func(cfg *config.Config) gin.HandlerFunc { return middleware.CORSMiddleware(cfg.AllowedOrigins) },
+		)
+	}
+	if options.rateLimiter == nil {
+		options.rateLimiter = reloadable(store,
+			func(cfg *config.Config) any { return []any{cfg.RateLimitRequests, cfg.RateLimitDuration} },
+			func(cfg *config.Config) gin.HandlerFunc {
+				limit, burst := rateLimit(cfg)
+				return middleware.RateLimiterWithConfig(middleware.RateLimiterConfig{Limit: limit, Burst: burst, FingerprintKey: fingerprintKey})
+			},
+		)
+	}
+	if options.authMiddlewares == nil {
+		options.authMiddlewares = append([]gin.HandlerFunc{middleware.AuthMiddleware()}, tokenVerifiers(store, cfg.TokenVerifiers, options.apiKeyStore, tokens, options.tokenCache, options.tokenCacheHandle, options.upstreamClient, fingerprintKey)...)
+	}
+	protectedMiddlewares := append(slices.Clone(options.authMiddlewares), authorizationPolicy(store))
+
 	// Add global middleware
 	router.Use(gin.Recovery())
-	router.Use(middleware.CORSMiddleware())
+	router.Use(options.corsMiddleware)
 	router.Use(middleware.LoggerMiddleware(logger))
 
 	if options.skipRateLimiting {
 		logger.Info("Rate limiting is disabled")
 	} else {
 		// Apply rate limiting middleware
-		router.Use(middleware.RateLimiter(rate.Every(time.Second), 10)) // 10 requests per second
+		router.Use(options.rateLimiter)
+		router.Use(reloadable(store,
+			func(cfg *config.Config) any { return cfg.RouteRateLimits },
+			func(cfg *config.Config) gin.HandlerFunc { return routeRateLimiter(cfg.RouteRateLimits, fingerprintKey) },
+		))
+	}
+
+	if len(options.middlewares) > 0 {
+		router.Use(options.middlewares...)
 	}
 
 	// Public routes
@@ -52,16 +246,448 @@ func SetupRouter(router *gin.Engine, cfg *config.Config, logger *logger.Logger,
 	}
 
 	// Auth routes
-	auth := router.Group("/api/v1")
+	tokenSettings := func(cfg *config.Config) any {
+		return []any{keySettings(cfg), cfg.JWTExpirationMinutes, cfg.RefreshTokenExpiry, cfg.JWTIssuer, cfg.JWTAudience}
+	}
+	router.GET("/.well-known/jwks.json", reloadable(store, keySettings, JWKS))
+	withTokens := func(handler func(*config.Config, auth.TokenStore) gin.HandlerFunc) func(*config.Config) gin.HandlerFunc {
+		return func(cfg *config.Config) gin.HandlerFunc { return handler(cfg, tokens) }
+	}
+	authRoutes := router.Group("/api/v1")
 	{
-		auth.POST("/token", GetToken)
+		authRoutes.POST("/token", reloadable(store,
+			func(cfg *config.Config) any { return []any{tokenSettings(cfg), cfg.Clients, cfg.Users} },
+			func(cfg *config.Config) gin.HandlerFunc {
+				clients, users := options.clientStore, options.userStore
+				if clients == nil {
+					clients = clientStore(cfg.Clients)
+				}
+				if users == nil {
+					users = userStore(cfg.Users)
+				}
+				return GetToken(cfg, tokens, clients, users)
+			},
+		))
+		authRoutes.POST("/introspect", reloadable(store,
+			func(cfg *config.Config) any { return []any{tokenSettings(cfg), cfg.Clients, cfg.APIKeys} },
+			func(cfg *config.Config) gin.HandlerFunc {
+				clients, apiKeys := options.clientStore, options.apiKeyStore
+				if clients == nil {
+					clients = clientStore(cfg.Clients)
+				}
+				if apiKeys == nil {
+					apiKeys = apiKeyStore(cfg.APIKeys)
+				}
+				return Introspect(cfg, tokens, clients, apiKeys)
+			},
+		))
+		authRoutes.POST("/token/refresh", reloadable(store, tokenSettings, withTokens(RefreshToken)))
+		authRoutes.POST("/token/revoke", reloadable(store, tokenSettings, withTokens(RevokeToken)))
+	}
+
+	// Login routes
+	if cfg.OAuthClientID != "" {
+		settings := func(cfg *config.Config) any {
+			return []any{
+				cfg.OIDCIssuer, cfg.OIDCJWKSRefreshInterval, cfg.OAuthClientID, cfg.OAuthClientSecret,
+				cfg.OAuthRedirectURL, cfg.OAuthScopes, cfg.AllowedOrigins,
+				keySettings(cfg), cfg.JWTExpirationMinutes, cfg.RefreshTokenExpiry, cfg.JWTIssuer, cfg.JWTAudience, cfg.JWTLeeway,
+			}
+		}
+		router.GET("/auth/login", reloadable(store, settings, OAuthLogin))
+		router.GET(callbackPath(cfg.OAuthRedirectURL), reloadable(store, settings, withTokens(OAuthCallback)))
 	}
 
 	// Protected routes
-	protected := router.Group("/api/v1")
-	protected.Use(middleware.AuthMiddleware())
-	protected.Use(middleware.VerifyToken())
-	{
-		protected.GET("/profile", GetProfile)
+	if cfg.DisableProtectedRoutes {
+		logger.Info("Protected routes are disabled")
+	} else {
+		protected := router.Group("/api/v1")
+		protected.Use(protectedMiddlewares...)
+		{
+			protected.GET("/profile", GetProfile)
+		}
+
+		admin := protected.Group("/admin", middleware.RequireRole(AdminRole))
+		{
+			admin.GET("/token-cache", GetTokenCacheStats(options.tokenCacheHandle))
+			admin.DELETE("/token-cache", PurgeTokenCache(options.tokenCacheHandle))
+			admin.DELETE("/token-cache/users/:id", EvictUserTokens(options.tokenCacheHandle))
+			admin.DELETE("/token-cache/tokens/:fingerprint", EvictTokenFingerprint(options.tokenCacheHandle))
+		}
+	}
+
+	// Additional route groups
+	for _, rg := range options.routeGroups {
+		group := router.Group(rg.relativePath)
+		if rg.protected {
+			group.Use(protectedMiddlewares...)
+		}
+		group.Use(rg.middlewares...)
+		rg.register(group)
+	}
+}
+
+// authorizationPolicy checks requests to protected routes against
+// POLICY_FILE, when set. The file is read again when POLICY_FILE or
+// POLICY_MODE changes.
+func authorizationPolicy(store *config.Store) gin.HandlerFunc {
+	return reloadable(store,
+		func(cfg *config.Config) any { return []any{cfg.PolicyFile, cfg.PolicyMode} },
+		func(cfg *config.Config) gin.HandlerFunc {
+			if cfg.PolicyFile == "" {
+				return func(c *gin.Context) { c.Next() }
+			}
+			p, err := policy.Load(cfg.PolicyFile)
+			if err != nil {
+				logger.Error("Failed to load authorization policy", zap.Error(err))
+				return func(c *gin.Context) {
+					c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Authorization policy is not available"})
+				}
+			}
+			return middleware.Authorize(middleware.AuthorizeConfig{
+				Policy: p,
+				DryRun: cfg.PolicyMode == config.PolicyModeDryRun,
+			})
+		},
+	)
+}
+
+// keySettings returns the settings the key ring is built from. Key files
+// are read again when one of them changes.
+func keySettings(cfg *config.Config) any {
+	return []any{cfg.JWTSecret, cfg.JWTSigningKey, cfg.JWTPreviousKeys, cfg.JWTPreviousSecrets}
+}
+
+// callbackPath returns the path of the login callback route, taken from
+// OAUTH_REDIRECT_URL.
+func callbackPath(redirectURL string) string {
+	u, err := url.Parse(redirectURL)
+	if err != nil || u.Path == "" {
+		return "/auth/callback"
+	}
+	return u.Path
+}
+
+// tokenVerifiers builds the verifiers named in TOKEN_VERIFIERS in order.
+// Every verifier but the last passes tokens it does not recognise on to the
+// next one. The list itself is fixed at startup, while the settings of each
+// verifier follow configuration reloads. An empty list means the remote
+// verifier, so that protected routes are never left unguarded. The apikey
+// verifier uses apiKeys, or the keys of the configuration when nil, and
+// the jwt verifier rejects tokens revoked in tokens. The cache of the remote
+// verifier is keyed on fingerprints computed with fingerprintKey and
+// attached to handle.
+func tokenVerifiers(store *config.Store, names []string, apiKeys auth.APIKeyStore, tokens auth.TokenStore, cache middleware.TokenCache, handle *middleware.TokenCacheHandle, upstream *middleware.UpstreamClient, fingerprintKey []byte) []gin.HandlerFunc {
+	if len(names) == 0 {
+		names = []string{config.VerifierRemote}
+	}
+	handlers := make([]gin.HandlerFunc, 0, len(names))
+	for i, name := range names {
+		last := i == len(names)-1
+		switch name {
+		case config.VerifierAPIKey:
+			if apiKeys != nil {
+				handlers = append(handlers, middleware.VerifyAPIKey(middleware.VerifyAPIKeyConfig{Store: apiKeys, Fallthrough: !last}))
+				continue
+			}
+			handlers = append(handlers, reloadable(store,
+				func(cfg *config.Config) any { return cfg.APIKeys },
+				func(cfg *config.Config) gin.HandlerFunc {
+					return middleware.VerifyAPIKey(middleware.VerifyAPIKeyConfig{Store: apiKeyStore(cfg.APIKeys), Fallthrough: !last})
+				},
+			))
+		case config.VerifierJWT:
+			handlers = append(handlers, reloadable(store,
+				func(cfg *config.Config) any {
+					return []any{keySettings(cfg), cfg.JWTIssuer, cfg.JWTAudience, cfg.JWTLeeway}
+				},
+				func(cfg *config.Config) gin.HandlerFunc {
+					keys, err := keyRing(cfg)
+					if err != nil {
+						logger.Error("Failed to load signing keys", zap.Error(err))
+						return func(c *gin.Context) {
+							c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Signing keys are not available"})
+						}
+					}
+					return middleware.VerifyJWT(middleware.VerifyJWTConfig{
+						Secret:      []byte(cfg.JWTSecret),
+						Keys:        keys,
+						Issuer:      cfg.JWTIssuer,
+						Audience:    cfg.JWTAudience,
+						Leeway:      cfg.JWTLeeway,
+						Revocations: tokens,
+						Fallthrough: !last,
+					})
+				},
+			))
+		case config.VerifierOIDC:
+			handlers = append(handlers, reloadable(store,
+				func(cfg *config.Config) any {
+					return []any{cfg.OIDCIssuer, cfg.OIDCAudience, cfg.OAuthClientID, cfg.OIDCJWKSRefreshInterval, cfg.JWTLeeway, cfg.OIDCProfileMapper, cfg.ProfileMappers}
+				},
+				func(cfg *config.Config) gin.HandlerFunc {
+					mapper, err := profileMapper(cfg.OIDCProfileMapper, cfg.ProfileMappers)
+					if err != nil {
+						logger.Error("Failed to build profile mapper", zap.String("mapper", cfg.OIDCProfileMapper), zap.Error(err))
+						return func(c *gin.Context) {
+							c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Profile mapper is not available"})
+						}
+					}
+					// Without an audience, the ID tokens the provider issues to
+					// other clients would be accepted
+					audience := cfg.OIDCAudience
+					if audience == "" {
+						audience = cfg.OAuthClientID
+					}
+					return middleware.VerifyOIDC(middleware.VerifyOIDCConfig{
+						Issuer:          cfg.OIDCIssuer,
+						Audience:        audience,
+						Leeway:          cfg.JWTLeeway,
+						RefreshInterval: cfg.OIDCJWKSRefreshInterval,
+						Fallthrough:     !last,
+						ProfileMapper:   mapper,
+					})
+				},
+			))
+		case config.VerifierRemote:
+			caches := &tokenCaches{}
+			// The TOKEN_URL and fingerprint key of the previous build, which
+			// the cached profiles were validated with and are stored under
+			var previous *[2]string
+			handlers = append(handlers, reloadable(store,
+				func(cfg *config.Config) any {
+					return []any{cfg.TokenURL, cfg.TokenCacheExpiry, cfg.TokenCacheMaxEntries, cfg.TokenCacheMaxBytes, cfg.TokenCacheCleanupInterval, cfg.TokenNegativeCacheExpiry,
+						cfg.TokenCacheStaleWhileRevalidate, cfg.TokenCacheMaxStale, cfg.TokenCacheBackend, cfg.TokenCacheRedisURL, cfg.TokenCacheRedisPrefix,
+						cfg.TokenUpstreamConnectTimeout, cfg.TokenUpstreamTimeout, cfg.TokenUpstreamMaxRetries, cfg.TokenUpstreamRetryBackoff,
+						cfg.TokenUpstreamFailureThreshold, cfg.TokenUpstreamOpenTimeout,
+						cfg.TokenIntrospectionClientID, cfg.TokenIntrospectionClientSecret, cfg.TokenProfileMapper, cfg.ProfileMappers}
+				},
+				func(cfg *config.Config) gin.HandlerFunc {
+					mapper, err := profileMapper(cfg.TokenProfileMapper, cfg.ProfileMappers)
+					if err != nil {
+						logger.Error("Failed to build profile mapper", zap.String("mapper", cfg.TokenProfileMapper), zap.Error(err))
+						return func(c *gin.Context) {
+							c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Profile mapper is not available"})
+						}
+					}
+					tokenCache := cache
+					if tokenCache == nil {
+						tokenCache, err = caches.build(cfg)
+						if err != nil {
+							logger.Error("Failed to build token cache", zap.String("backend", cfg.TokenCacheBackend), zap.Error(err))
+							return func(c *gin.Context) {
+								c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Token cache is not available"})
+							}
+						}
+					}
+					// Profiles of the previous provider must not be served by
+					// the new one. The first build keeps the profiles of an
+					// injected or shared cache, as do reloads of other settings
+					current := [2]string{cfg.TokenURL, string(fingerprintKey)}
+					if previous != nil && *previous != current {
+						tokenCache.Purge()
+					}
+					previous = &current
+					handle.Attach(tokenCache, fingerprintKey)
+					client := upstream
+					if client == nil {
+						client = middleware.NewUpstreamClient(middleware.UpstreamOptions{
+							ConnectTimeout:   cfg.TokenUpstreamConnectTimeout,
+							Timeout:          cfg.TokenUpstreamTimeout,
+							MaxRetries:       cfg.TokenUpstreamMaxRetries,
+							RetryBackoff:     cfg.TokenUpstreamRetryBackoff,
+							FailureThreshold: cfg.TokenUpstreamFailureThreshold,
+							OpenTimeout:      cfg.TokenUpstreamOpenTimeout,
+						})
+					}
+					return middleware.VerifyToken(middleware.VerifyTokenConfig{
+						TokenURL:                  cfg.TokenURL,
+						CacheExpiry:               cfg.TokenCacheExpiry,
+						Cache:                     tokenCache,
+						FingerprintKey:            fingerprintKey,
+						NegativeCacheExpiry:       cfg.TokenNegativeCacheExpiry,
+						StaleWhileRevalidate:      cfg.TokenCacheStaleWhileRevalidate,
+						MaxStale:                  cfg.TokenCacheMaxStale,
+						Client:                    client,
+						IntrospectionClientID:     cfg.TokenIntrospectionClientID,
+						IntrospectionClientSecret: cfg.TokenIntrospectionClientSecret,
+						ProfileMapper:             mapper,
+					})
+				},
+			))
+		}
+	}
+	return handlers
+}
+
+// tokenCaches builds the cache of the remote verifier configured by the
+// TOKEN_CACHE_* settings. A cache is reused while its settings do not
+// change, so that reloads of other settings keep the cached profiles. The
+// Redis cache is closed once replaced, so that reloads do not leak
+// connection pools. Builds are serialized by reloadable.
+type tokenCaches struct {
+	memory        *middleware.MemoryTokenCache
+	memoryOpts    middleware.TokenCacheOptions
+	redis         *middleware.RedisTokenCache
+	redisSettings redisCacheSettings
+}
+
+// redisCacheSettings are the settings a RedisTokenCache is built from.
+type redisCacheSettings struct {
+	url, prefix string
+	maxStale    time.Duration
+}
+
+func (b *tokenCaches) build(cfg *config.Config) (middleware.TokenCache, error) {
+	maxStale := max(cfg.TokenCacheMaxStale, cfg.TokenCacheStaleWhileRevalidate)
+	if cfg.TokenCacheBackend != config.TokenCacheRedis {
+		b.closeRedis()
+		opts := middleware.TokenCacheOptions{
+			MaxEntries:      cfg.TokenCacheMaxEntries,
+			MaxBytes:        cfg.TokenCacheMaxBytes,
+			CleanupInterval: cfg.TokenCacheCleanupInterval,
+			MaxStale:        maxStale,
+		}
+		if b.memory == nil || b.memoryOpts != opts {
+			b.memory, b.memoryOpts = middleware.NewMemoryTokenCache(opts), opts
+		}
+		return b.memory, nil
+	}
+	b.memory = nil
+
+	settings := redisCacheSettings{url: cfg.TokenCacheRedisURL, prefix: cfg.TokenCacheRedisPrefix, maxStale: maxStale}
+	if b.redis != nil && b.redisSettings == settings {
+		return b.redis, nil
+	}
+	opts, err := middleware.ParseRedisURL(cfg.TokenCacheRedisURL)
+	if err != nil {
+		return nil, err
+	}
+	opts.Prefix = cfg.TokenCacheRedisPrefix
+	opts.MaxStale = maxStale
+	b.closeRedis()
+	b.redis, b.redisSettings = middleware.NewRedisTokenCache(opts), settings
+	return b.redis, nil
+}
+
+// closeRedis closes the Redis cache, if any. Requests still served by the
+// previous verifier then fall back to the token provider.
+func (b *tokenCaches) closeRedis() {
+	if b.redis != nil {
+		b.redis.Close()
+		b.redis = nil
+	}
+}
+
+// profileMapper returns the built-in or configured mapper called name, or nil
+// when name is empty.
+func profileMapper(name string, mappers []config.ProfileMapper) (middleware.ProfileMapper, error) {
+	if name == "" {
+		return nil, nil
+	}
+	if mapper, ok := middleware.ProfileMappers[name]; ok {
+		return mapper, nil
+	}
+	for _, mapper := range mappers {
+		if mapper.Name != name {
+			continue
+		}
+		claims := make(map[string]string, len(mapper.Claims))
+		for _, claim := range mapper.Claims {
+			claimName, path, _ := strings.Cut(claim, "=")
+			claims[strings.TrimSpace(claimName)] = strings.TrimSpace(path)
+		}
+		return middleware.NewFieldMapper(middleware.FieldMapping{
+			ID:     mapper.IDPath,
+			Email:  mapper.EmailPath,
+			Name:   mapper.NamePath,
+			Roles:  mapper.RolesPath,
+			Scopes: mapper.ScopesPath,
+			Claims: claims,
+		})
+	}
+	return nil, fmt.Errorf("unknown profile mapper %q", name)
+}
+
+// apiKeyStore returns a store holding the keys of the configuration.
+func apiKeyStore(keys []config.APIKey) auth.APIKeyStore {
+	stored := make([]*auth.APIKey, len(keys))
+	for i, key := range keys {
+		stored[i] = &auth.APIKey{
+			ID:        key.ID,
+			Owner:     key.Owner,
+			Name:      key.Name,
+			Hash:      key.Hash,
+			Scopes:    key.Scopes,
+			ExpiresAt: key.ExpiresAt,
+		}
+	}
+	return auth.NewMemoryAPIKeyStore(stored...)
+}
+
+// clientStore returns a store holding the clients of the configuration.
+func clientStore(clients []config.Client) auth.ClientStore {
+	stored := make([]*auth.Client, len(clients))
+	for i, client := range clients {
+		stored[i] = &auth.Client{
+			ID:                client.ID,
+			Name:              client.Name,
+			SecretHash:        client.SecretHash,
+			Scopes:            client.Scopes,
+			GrantTypes:        client.GrantTypes,
+			AccessTokenExpiry: client.AccessTokenExpiry,
+		}
+	}
+	return auth.NewMemoryClientStore(stored...)
+}
+
+// userStore returns a store holding the users of the configuration.
+func userStore(users []config.User) auth.UserStore {
+	stored := make([]*auth.Account, len(users))
+	for i, user := range users {
+		stored[i] = &auth.Account{
+			User:         auth.User{ID: user.ID, Username: user.Username, Email: user.Email, Roles: user.Roles},
+			PasswordHash: user.PasswordHash,
+		}
+	}
+	return auth.NewMemoryUserStore(stored...)
+}
+
+// rateLimit converts RateLimitRequests per RateLimitDuration into a token
+// bucket rate and burst, defaulting to 10 requests per second when unset.
+func rateLimit(cfg *config.Config) (rate.Limit, int) {
+	requests, duration := cfg.RateLimitRequests, cfg.RateLimitDuration
+	if requests <= 0 || duration <= 0 {
+		requests, duration = 10, time.Second
+	}
+	return rate.Limit(float64(requests) / duration.Seconds()), requests
+}
+
+// routeRateLimiter applies the per-route limits from the configuration on
+// top of the global rate limiter. Routes are matched by their registered
+// pattern, so /users/:id is limited as a whole.
+func routeRateLimiter(limits []config.RouteRateLimit, fingerprintKey []byte) gin.HandlerFunc {
+	limiters := make(map[string]gin.HandlerFunc, len(limits))
+	for _, l := range limits {
+		key := strings.ToUpper(l.Method) + " " + l.Path
+		limiters[key] = middleware.RateLimiterWithConfig(middleware.RateLimiterConfig{
+			Limit:          rate.Limit(float64(l.Requests) / l.Duration.Seconds()),
+			Burst:          l.Requests,
+			KeyPrefix:      key,
+			FingerprintKey: fingerprintKey,
+		})
+	}
+
+	return func(c *gin.Context) {
+		limiter, found := limiters[c.Request.Method+" "+c.FullPath()]
+		if !found {
+			limiter, found = limiters[" "+c.FullPath()]
+		}
+		if !found {
+			c.Next()
+			return
+		}
+		limiter(c)
 	}
 }
@@ -0,0 +1,577 @@
+package api
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/nicobistolfi/go-rest-api/internal/api/middleware"
+	"github.com/nicobistolfi/go-rest-api/internal/config"
+	logger "github.com/nicobistolfi/go-rest-api/pkg"
+	"github.com/nicobistolfi/go-rest-api/pkg/auth"
+)
+
+func TestSetupRouterUsesConfig(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger.Init()
+
+	cfg := &config.Config{
+		RateLimitRequests: 2,
+		RateLimitDuration: time.Minute,
+		AllowedOrigins:    []string{"https://app.example.com"},
+	}
+
+	r := gin.New()
+	SetupRouter(r, cfg, logger.Log)
+
+	var codes []int
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("GET", "/api/v1/ping", nil)
+		req.Header.Set("Origin", "https://app.example.com")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		codes = append(codes, w.Code)
+
+		if w.Code == http.StatusOK {
+			assert.Equal(t, "https://app.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+		}
+	}
+
+	assert.Equal(t, []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}, codes)
+}
+
+func TestRateLimit(t *testing.T) {
+	limit, burst := rateLimit(&config.Config{RateLimitRequests: 30, RateLimitDuration: time.Minute})
+	assert.InDelta(t, 0.5, float64(limit), 1e-9)
+	assert.Equal(t, 30, burst)
+
+	limit, burst = rateLimit(&config.Config{})
+	assert.InDelta(t, 10, float64(limit), 1e-9)
+	assert.Equal(t, 10, burst)
+}
+
+func TestSetupRouterRouteRateLimits(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger.Init()
+
+	cfg := &config.Config{
+		RateLimitRequests: 100,
+		RateLimitDuration: time.Second,
+		RouteRateLimits: []config.RouteRateLimit{
+			{Method: "GET", Path: "/api/v1/ping", Requests: 1, Duration: time.Minute},
+		},
+	}
+
+	r := gin.New()
+	SetupRouter(r, cfg, logger.Log)
+
+	request := func(path string) int {
+		req, _ := http.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, request("/api/v1/ping"))
+	assert.Equal(t, http.StatusTooManyRequests, request("/api/v1/ping"))
+	// Other routes only use the global limit
+	assert.Equal(t, http.StatusOK, request("/api/v1/health"))
+	assert.Equal(t, http.StatusOK, request("/api/v1/health"))
+}
+
+func TestSetupRouterJWTVerifier(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger.Init()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	assert.NoError(t, err)
+
+	cfg := &config.Config{
+		JWTSecret:            "test_secret",
+		JWTExpirationMinutes: 1,
+		JWTIssuer:            "go-rest-api",
+		JWTAudience:          "api",
+		TokenVerifiers:       []string{config.VerifierJWT},
+		RefreshTokenExpiry:   time.Hour,
+		Clients: []config.Client{{
+			ID:         "web",
+			SecretHash: auth.HashClientSecret("web-secret"),
+			GrantTypes: []string{config.GrantPassword, config.GrantRefreshToken},
+		}},
+		Users: []config.User{{ID: "123456", Username: "jane", PasswordHash: string(hash)}},
+	}
+
+	r := gin.New()
+	SetupRouter(r, cfg, logger.Log, WithoutRateLimiting())
+
+	post := func(path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// Anonymous callers no longer get tokens
+	assert.Equal(t, http.StatusUnauthorized, post("/api/v1/token", `{"grant_type":"client_credentials"}`).Code)
+
+	w := post("/api/v1/token", `{"grant_type":"password","client_id":"web","client_secret":"web-secret","username":"jane","password":"correct horse"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response map[string]any
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	token, _ := response["token"].(string)
+	refresh, _ := response["refresh_token"].(string)
+
+	profile := func(token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/profile", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w = profile(token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"id":"123456"`)
+
+	assert.Equal(t, http.StatusUnauthorized, profile("opaque_token").Code)
+
+	// Refresh tokens issued to a client can only be used by that client
+	assert.Equal(t, http.StatusUnauthorized, post("/api/v1/token/refresh", `{"refresh_token":"`+refresh+`"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, post("/api/v1/token/refresh", `{}`).Code)
+
+	// Refreshing rotates the refresh token; replaying the old one is rejected
+	refreshGrant := `{"grant_type":"refresh_token","client_id":"web","client_secret":"web-secret","refresh_token":"` + refresh + `"}`
+	assert.Equal(t, http.StatusOK, post("/api/v1/token", refreshGrant).Code)
+	assert.Equal(t, http.StatusBadRequest, post("/api/v1/token", refreshGrant).Code)
+
+	// A revoked access token is rejected before it expires
+	assert.Equal(t, http.StatusOK, post("/api/v1/token/revoke", `{"token":"`+token+`"}`).Code)
+	w = profile(token)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "Token has been revoked")
+}
+
+func TestSetupRouterAPIKeyVerifier(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger.Init()
+
+	plaintext, key, err := auth.NewAPIKey("acme", "ci", nil, time.Time{})
+	assert.NoError(t, err)
+	custom, customKey, err := auth.NewAPIKey("globex", "ci", nil, time.Time{})
+	assert.NoError(t, err)
+
+	cfg := &config.Config{
+		TokenVerifiers: []string{config.VerifierAPIKey},
+		APIKeys:        []config.APIKey{{ID: key.ID, Owner: key.Owner, Hash: key.Hash}},
+	}
+
+	profile := func(r *gin.Engine, apiKey string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/profile", nil)
+		req.Header.Set("X-API-Key", apiKey)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	r := gin.New()
+	SetupRouter(r, cfg, logger.Log, WithoutRateLimiting())
+	w := profile(r, plaintext)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"id":"acme"`)
+	assert.Equal(t, http.StatusUnauthorized, profile(r, custom).Code)
+
+	// A custom store replaces the keys of the configuration
+	r = gin.New()
+	SetupRouter(r, cfg, logger.Log, WithoutRateLimiting(), WithAPIKeyStore(auth.NewMemoryAPIKeyStore(customKey)))
+	assert.Equal(t, http.StatusOK, profile(r, custom).Code)
+	assert.Equal(t, http.StatusUnauthorized, profile(r, plaintext).Code)
+}
+
+func TestSetupRouterAuthorization(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger.Init()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	plaintext, key, err := auth.NewAPIKey("acme", "ci", []string{"reports:read"}, time.Time{})
+	assert.NoError(t, err)
+
+	cfg := &config.Config{
+		JWTSecret:            "test_secret",
+		JWTExpirationMinutes: 1,
+		RefreshTokenExpiry:   time.Hour,
+		TokenVerifiers:       []string{config.VerifierAPIKey, config.VerifierJWT},
+		APIKeys:              []config.APIKey{{ID: key.ID, Owner: key.Owner, Hash: key.Hash, Scopes: key.Scopes}},
+		Clients: []config.Client{{
+			ID:         "web",
+			SecretHash: auth.HashClientSecret("web-secret"),
+			Scopes:     []string{"reports:read"},
+			GrantTypes: []string{config.GrantPassword},
+		}},
+		Users: []config.User{
+			{ID: "1", Username: "jane", PasswordHash: string(hash), Roles: []string{"admin"}},
+			{ID: "2", Username: "joe", PasswordHash: string(hash)},
+		},
+	}
+
+	r := gin.New()
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	SetupRouter(r, cfg, logger.Log, WithoutRateLimiting(),
+		WithProtectedRouteGroup("/admin", func(g *gin.RouterGroup) { g.GET("/users", ok) }, middleware.RequireRole("admin")),
+		WithProtectedRouteGroup("/reports", func(g *gin.RouterGroup) { g.GET("", ok) }, middleware.RequireScopes("reports:read")),
+	)
+
+	login := func(username string) string {
+		w := httptest.NewRecorder()
+		body := `{"grant_type":"password","client_id":"web","client_secret":"web-secret","username":"` + username + `","password":"correct horse"}`
+		req, _ := http.NewRequest("POST", "/api/v1/token", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response map[string]any
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response["access_token"].(string)
+	}
+	get := func(path, header, value string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set(header, value)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	jane, joe := login("jane"), login("joe")
+	assert.Equal(t, http.StatusOK, get("/admin/users", "Authorization", "Bearer "+jane).Code)
+	w := get("/admin/users", "Authorization", "Bearer "+joe)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.JSONEq(t, `{"error":"Insufficient role","required_roles":["admin"]}`, w.Body.String())
+
+	// Scopes come from the client grant and from the API key record
+	assert.Equal(t, http.StatusOK, get("/reports", "Authorization", "Bearer "+joe).Code)
+	assert.Equal(t, http.StatusOK, get("/reports", "X-API-Key", plaintext).Code)
+	assert.Equal(t, http.StatusForbidden, get("/admin/users", "X-API-Key", plaintext).Code)
+	assert.Equal(t, http.StatusUnauthorized, get("/admin/users", "X-API-Key", "").Code)
+}
+
+func TestSetupRouterAuthorizationPolicy(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger.Init()
+
+	reader, readerKey, err := auth.NewAPIKey("acme", "reader", []string{"profile:read"}, time.Time{})
+	assert.NoError(t, err)
+	other, otherKey, err := auth.NewAPIKey("globex", "ci", nil, time.Time{})
+	assert.NoError(t, err)
+
+	policyFile := filepath.Join(t.TempDir(), "policy.yaml")
+	assert.NoError(t, os.WriteFile(policyFile, []byte(`
+rules:
+  - name: read-profile
+    effect: allow
+    actions: [GET]
+    resources: [/api/v1/profile]
+    conditions:
+      - subject.scopes contains profile:read
+`), 0o600))
+
+	cfg := &config.Config{
+		TokenVerifiers: []string{config.VerifierAPIKey},
+		APIKeys: []config.APIKey{
+			{ID: readerKey.ID, Owner: readerKey.Owner, Hash: readerKey.Hash, Scopes: readerKey.Scopes},
+			{ID: otherKey.ID, Owner: otherKey.Owner, Hash: otherKey.Hash},
+		},
+		PolicyFile: policyFile,
+	}
+	store := config.NewStore(cfg)
+
+	r := gin.New()
+	SetupRouter(r, cfg, logger.Log, WithoutRateLimiting(), WithConfigStore(store))
+
+	profile := func(apiKey string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/profile", nil)
+		req.Header.Set("X-API-Key", apiKey)
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, profile(reader))
+	assert.Equal(t, http.StatusForbidden, profile(other))
+	assert.Equal(t, http.StatusUnauthorized, profile("ak_wrong_key"))
+
+	// In dry run mode denials are only logged
+	dryRun := *cfg
+	dryRun.PolicyMode = config.PolicyModeDryRun
+	store.Reload(func() (*config.Config, error) { return &dryRun, nil })
+	assert.Equal(t, http.StatusOK, profile(other))
+}
+
+func TestSetupRouterIntrospection(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger.Init()
+
+	// The issuing deployment mints tokens and introspects them for the
+	// gateway client
+	issuing := gin.New()
+	SetupRouter(issuing, &config.Config{
+		JWTSecret:            "test_secret",
+		JWTExpirationMinutes: 1,
+		RefreshTokenExpiry:   time.Hour,
+		TokenVerifiers:       []string{config.VerifierJWT},
+		Clients: []config.Client{
+			{ID: "billing", SecretHash: auth.HashClientSecret("billing-secret"), Scopes: []string{"orders:read"}},
+			{ID: "gateway", SecretHash: auth.HashClientSecret("gateway-secret")},
+		},
+	}, logger.Log, WithoutRateLimiting())
+	server := httptest.NewServer(issuing)
+	defer server.Close()
+
+	// Another deployment verifies them without sharing the secret
+	verifying := gin.New()
+	SetupRouter(verifying, &config.Config{
+		TokenVerifiers:                 []string{config.VerifierRemote},
+		TokenURL:                       server.URL + "/api/v1/introspect",
+		TokenIntrospectionClientID:     "gateway",
+		TokenIntrospectionClientSecret: "gateway-secret",
+	}, logger.Log, WithoutRateLimiting())
+
+	req, _ := http.NewRequest("POST", server.URL+"/api/v1/token", strings.NewReader("grant_type=client_credentials"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("billing", "billing-secret")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	var response map[string]any
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+	resp.Body.Close()
+	token := response["access_token"].(string)
+
+	profile := func(token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/profile", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		verifying.ServeHTTP(w, req)
+		return w
+	}
+
+	w := profile(token)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"id":"billing","email":"","name":"","scopes":["orders:read"]}`, w.Body.String())
+	assert.Equal(t, http.StatusUnauthorized, profile("forged").Code)
+}
+
+func TestSetupRouterProfileMapper(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger.Init()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"user_id":"u1","mail":"jane@example.com","groups":["admin"],"org":"acme"}`))
+	}))
+	defer upstream.Close()
+
+	router := gin.New()
+	SetupRouter(router, &config.Config{
+		TokenVerifiers:     []string{config.VerifierRemote},
+		TokenURL:           upstream.URL,
+		TokenProfileMapper: "corp",
+		ProfileMappers: []config.ProfileMapper{{
+			Name:      "corp",
+			IDPath:    "user_id",
+			EmailPath: "/mail",
+			RolesPath: "groups",
+			Claims:    []string{"org = org"},
+		}},
+	}, logger.Log, WithoutRateLimiting())
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/v1/profile", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"id":"u1","email":"jane@example.com","name":"","roles":["admin"],"claims":{"org":"acme"}}`, w.Body.String())
+}
+
+func TestSetupRouterTokenCache(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger.Init()
+
+	calls := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte(`{"id":"u1"}`))
+	}))
+	defer upstream.Close()
+
+	cache := middleware.NewMemoryTokenCache(middleware.TokenCacheOptions{MaxEntries: 1})
+	router := gin.New()
+	SetupRouter(router, &config.Config{
+		TokenVerifiers:   []string{config.VerifierRemote},
+		TokenURL:         upstream.URL,
+		TokenCacheExpiry: time.Minute,
+	}, logger.Log, WithoutRateLimiting(), WithTokenCache(cache))
+
+	for _, token := range []string{"first", "first", "second"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/profile", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	assert.Equal(t, 2, calls)
+	stats := cache.Stats()
+	assert.Equal(t, 1, stats.Size)
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(2), stats.Misses)
+	assert.Equal(t, uint64(1), stats.Evictions)
+}
+
+func TestSetupRouterTokenCacheReload(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger.Init()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"u1"}`))
+	}))
+	defer upstream.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"u2"}`))
+	}))
+	defer other.Close()
+
+	// Starting the server keeps the profiles of an injected cache
+	cache := middleware.NewMemoryTokenCache(middleware.TokenCacheOptions{})
+	cache.Set("warm", middleware.Profile{ID: "u0"}, time.Now().Add(time.Minute))
+	cfg := &config.Config{
+		TokenVerifiers:   []string{config.VerifierRemote},
+		TokenURL:         upstream.URL,
+		TokenCacheExpiry: time.Minute,
+	}
+	store := config.NewStore(cfg)
+	router := gin.New()
+	SetupRouter(router, cfg, logger.Log, WithoutRateLimiting(), WithConfigStore(store), WithTokenCache(cache))
+	assert.Equal(t, 1, cache.Stats().Size)
+	profile := func() string {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/profile", nil)
+		req.Header.Set("Authorization", "Bearer token")
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		return w.Header().Get("X-Token-Cache")
+	}
+
+	assert.Equal(t, "MISS", profile())
+	assert.Equal(t, 2, cache.Stats().Size)
+
+	// Reloads of other verifier settings keep the profiles
+	slower := *cfg
+	slower.TokenUpstreamTimeout = time.Minute
+	store.Reload(func() (*config.Config, error) { return &slower, nil })
+	assert.Equal(t, "HIT", profile())
+	assert.Equal(t, 2, cache.Stats().Size)
+
+	// A new TOKEN_URL purges the profiles validated by the previous one
+	moved := slower
+	moved.TokenURL = other.URL
+	store.Reload(func() (*config.Config, error) { return &moved, nil })
+	assert.Equal(t, "MISS", profile())
+	assert.Equal(t, 1, cache.Stats().Size)
+}
+
+func TestSetupRouterRedisTokenCacheUnavailable(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger.Init()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"u1"}`))
+	}))
+	defer upstream.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	redisURL := "redis://" + listener.Addr().String()
+	listener.Close()
+
+	router := gin.New()
+	SetupRouter(router, &config.Config{
+		TokenVerifiers:      []string{config.VerifierRemote},
+		TokenURL:            upstream.URL,
+		TokenCacheExpiry:    time.Minute,
+		TokenCacheBackend:   config.TokenCacheRedis,
+		TokenCacheRedisURL:  redisURL,
+		TokenFingerprintKey: strings.Repeat("k", config.MinSecretLength),
+	}, logger.Log, WithoutRateLimiting())
+
+	// Requests are validated with TOKEN_URL while Redis is down
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/v1/profile", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "MISS", w.Header().Get("X-Token-Cache"))
+}
+
+func TestSetupRouterRedisTokenCacheReload(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger.Init()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"u1"}`))
+	}))
+	defer upstream.Close()
+	redis := miniredis.RunT(t)
+
+	cfg := &config.Config{
+		TokenVerifiers:      []string{config.VerifierRemote},
+		TokenURL:            upstream.URL,
+		TokenCacheExpiry:    time.Minute,
+		TokenCacheBackend:   config.TokenCacheRedis,
+		TokenCacheRedisURL:  "redis://" + redis.Addr(),
+		TokenFingerprintKey: strings.Repeat("k", config.MinSecretLength),
+	}
+	// Profiles cached by other replicas survive the start of this one
+	redis.Set(middleware.DefaultRedisPrefix+"other", "{}")
+	store := config.NewStore(cfg)
+	router := gin.New()
+	SetupRouter(router, cfg, logger.Log, WithoutRateLimiting(), WithConfigStore(store))
+	assert.True(t, redis.Exists(middleware.DefaultRedisPrefix+"other"))
+	profile := func() string {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/profile", nil)
+		req.Header.Set("Authorization", "Bearer token")
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		return w.Header().Get("X-Token-Cache")
+	}
+
+	assert.Equal(t, "MISS", profile())
+	assert.Equal(t, 1, redis.TotalConnectionCount())
+
+	// Reloads that keep the Redis settings reuse the connections
+	longer := *cfg
+	longer.TokenCacheExpiry = time.Hour
+	store.Reload(func() (*config.Config, error) { return &longer, nil })
+	assert.Equal(t, "HIT", profile())
+	assert.Equal(t, 1, redis.TotalConnectionCount())
+
+	// Other settings close the previous connections
+	prefixed := longer
+	prefixed.TokenCacheRedisPrefix = "other:"
+	store.Reload(func() (*config.Config, error) { return &prefixed, nil })
+	assert.Equal(t, "MISS", profile())
+	assert.Equal(t, 2, redis.TotalConnectionCount())
+	assert.Eventually(t, func() bool { return redis.CurrentConnectionCount() == 1 }, time.Second, 10*time.Millisecond)
+}
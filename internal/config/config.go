@@ -1,6 +1,8 @@
 package config
 
 import (
+	"fmt"
+	"net"
 	"os"
 	"strconv"
 	"time"
@@ -8,50 +10,340 @@ import (
 	"github.com/joho/godotenv"
 )
 
+// Config holds the application configuration. Every field tagged with
+// `config` can be set from a config file using the tag as key, from the
+// environment using the upper-cased key, and from a command-line flag using
+// the key with dashes instead of underscores. See LoadConfigFromArgs for the
+// precedence order.
+//
+// Fields tagged with `secret:"true"` can also be read from a file, such as a
+// Kubernetes or Docker secret mount, by appending _FILE to the environment
+// variable (JWT_SECRET_FILE), _file to the config file key or -file to the
+// flag. Setting both forms in the same layer is an error.
 type Config struct {
-	// OAuth configuration
-	OIDCIssuer        string
-	OAuthClientID     string
-	OAuthClientSecret string
-	OAuthRedirectURL  string
+	// OAuth configuration. OIDCIssuer is also the provider trusted by the
+	// oidc token verifier, which requires OIDCAudience, or OAuthClientID
+	// when it is empty, in the aud claim and fetches the provider keys
+	// again for unknown key IDs at most once per OIDCJWKSRefreshInterval.
+	OIDCIssuer              string        `config:"oidc_issuer"`
+	OIDCAudience            string        `config:"oidc_audience"`
+	OIDCJWKSRefreshInterval time.Duration `config:"oidc_jwks_refresh_interval"`
+	OAuthClientID           string        `config:"oauth_client_id"`
+	OAuthClientSecret       string        `config:"oauth_client_secret" secret:"true"`
+	OAuthRedirectURL        string        `config:"oauth_redirect_url"`
+	// OAuthScopes are requested by the /auth/login flow, which is enabled
+	// when OAuthClientID is set.
+	OAuthScopes []string `config:"oauth_scopes"`
 
 	// JWT configuration
-	JWTSecret            string
-	JWTExpirationMinutes int
+	JWTSecret            string `config:"jwt_secret" secret:"true"`
+	JWTExpirationMinutes int    `config:"jwt_expiration_minutes"`
+	// JWTIssuer and JWTAudience are set as the iss and aud claims of issued
+	// tokens and, when not empty, required by the jwt verifier.
+	JWTIssuer   string `config:"jwt_issuer"`
+	JWTAudience string `config:"jwt_audience"`
+	// JWTLeeway is the clock skew tolerated when checking exp, nbf and iat.
+	JWTLeeway time.Duration `config:"jwt_leeway"`
+	// JWTSigningKey is the path of a PEM encoded RSA, P-256 or Ed25519
+	// private key that signs tokens instead of JWTSecret. JWTPreviousKeys
+	// are paths of PEM encoded keys, private or public, and
+	// JWTPreviousSecrets are retired HMAC secrets, that only verify tokens,
+	// so that tokens signed before a rotation stay valid.
+	JWTSigningKey      string   `config:"jwt_signing_key"`
+	JWTPreviousKeys    []string `config:"jwt_previous_keys"`
+	JWTPreviousSecrets []string `config:"jwt_previous_secrets" secret:"true"`
+	// RefreshTokenExpiry is the lifetime of the refresh tokens issued with
+	// every access token.
+	RefreshTokenExpiry time.Duration `config:"refresh_token_expiry"`
 
-	// API Key configuration
-	ValidAPIKey string
+	// API Key configuration. APIKeys are checked by the apikey token
+	// verifier and can only be set from a config file. ValidAPIKey is no
+	// longer read and is only kept so existing configurations still load.
+	ValidAPIKey string   `config:"valid_api_key" secret:"true"`
+	APIKeys     []APIKey `config:"api_keys"`
+
+	// Clients may request tokens from /token and Users are the accounts
+	// accepted by its password grant. Both can only be set from a config
+	// file.
+	Clients []Client `config:"clients"`
+	Users   []User   `config:"users"`
+
+	// Token verification configuration. TokenVerifiers lists the verifiers
+	// that guard protected routes, tried in order: "jwt" accepts tokens
+	// issued by /token, "oidc" accepts tokens issued by OIDCIssuer and
+	// "remote" validates tokens against TokenURL.
+	TokenVerifiers         []string      `config:"token_verifiers"`
+	TokenURL               string        `config:"token_url"`
+	TokenCacheExpiry       time.Duration `config:"token_cache_expiry"`
+	DisableProtectedRoutes bool          `config:"disable_protected_routes"`
+	// The remote verifier caches at most TokenCacheMaxEntries profiles
+	// using about TokenCacheMaxBytes of memory, evicting the least recently
+	// used ones; zero disables a limit. Expired profiles are removed every
+	// TokenCacheCleanupInterval.
+	TokenCacheMaxEntries      int           `config:"token_cache_max_entries"`
+	TokenCacheMaxBytes        int           `config:"token_cache_max_bytes"`
+	TokenCacheCleanupInterval time.Duration `config:"token_cache_cleanup_interval"`
+	// TokenNegativeCacheExpiry is how long tokens rejected by TokenURL are
+	// rejected without asking it again. Zero disables negative caching.
+	TokenNegativeCacheExpiry time.Duration `config:"token_negative_cache_expiry"`
+	// Expired profiles are served, marked STALE, for
+	// TokenCacheStaleWhileRevalidate while they are refreshed in the
+	// background, and for TokenCacheMaxStale while TokenURL is unavailable.
+	// Zero disables stale profiles.
+	TokenCacheStaleWhileRevalidate time.Duration `config:"token_cache_stale_while_revalidate"`
+	TokenCacheMaxStale             time.Duration `config:"token_cache_max_stale"`
+	// TokenCacheBackend is where the remote verifier caches profiles:
+	// "memory", per process, or "redis", shared by every replica through
+	// the server at TokenCacheRedisURL under TokenCacheRedisPrefix.
+	// TokenFingerprintKey is the secret key of the token fingerprints the
+	// profiles are cached under; replicas sharing a cache must use the same
+	// one. When empty, every process generates its own.
+	TokenCacheBackend     string `config:"token_cache_backend"`
+	TokenCacheRedisURL    string `config:"token_cache_redis_url" secret:"true"`
+	TokenCacheRedisPrefix string `config:"token_cache_redis_prefix"`
+	TokenFingerprintKey   string `config:"token_fingerprint_key" secret:"true"`
+	// Requests to TokenURL time out after TokenUpstreamConnectTimeout to
+	// connect and TokenUpstreamTimeout overall (zero disables a timeout),
+	// and network errors and 5xx
+	// responses are retried TokenUpstreamMaxRetries times with jittered
+	// backoff from TokenUpstreamRetryBackoff. After
+	// TokenUpstreamFailureThreshold consecutive failures (zero disables
+	// it), requests fail fast for TokenUpstreamOpenTimeout.
+	TokenUpstreamConnectTimeout   time.Duration `config:"token_upstream_connect_timeout"`
+	TokenUpstreamTimeout          time.Duration `config:"token_upstream_timeout"`
+	TokenUpstreamMaxRetries       int           `config:"token_upstream_max_retries"`
+	TokenUpstreamRetryBackoff     time.Duration `config:"token_upstream_retry_backoff"`
+	TokenUpstreamFailureThreshold int           `config:"token_upstream_failure_threshold"`
+	TokenUpstreamOpenTimeout      time.Duration `config:"token_upstream_open_timeout"`
+	// TokenIntrospectionClientID and TokenIntrospectionClientSecret, when
+	// set, make the remote verifier call TokenURL as an RFC 7662
+	// introspection endpoint, such as /api/v1/introspect of another
+	// deployment, with these client credentials.
+	TokenIntrospectionClientID     string `config:"token_introspection_client_id"`
+	TokenIntrospectionClientSecret string `config:"token_introspection_client_secret" secret:"true"`
+
+	// Profile mapping. TokenProfileMapper and OIDCProfileMapper select how
+	// the remote and oidc verifiers build the user profile: "generic",
+	// "github", "google" or the name of one of ProfileMappers. Empty keeps
+	// the default of each verifier. ProfileMappers can only be set from a
+	// config file.
+	TokenProfileMapper string          `config:"token_profile_mapper"`
+	OIDCProfileMapper  string          `config:"oidc_profile_mapper"`
+	ProfileMappers     []ProfileMapper `config:"profile_mappers"`
+
+	// Authorization policy. When PolicyFile is set, every request to a
+	// protected route is checked against its rules. PolicyMode "dry_run"
+	// only logs the requests the policy would deny.
+	PolicyFile string `config:"policy_file"`
+	PolicyMode string `config:"policy_mode"`
+
+	// CORS configuration
+	AllowedOrigins []string `config:"allowed_origins"`
 
 	// Rate Limiting configuration
-	RateLimitRequests int
-	RateLimitDuration time.Duration
+	RateLimitRequests int              `config:"rate_limit_requests"`
+	RateLimitDuration time.Duration    `config:"rate_limit_duration"`
+	RouteRateLimits   []RouteRateLimit `config:"route_rate_limits"`
+
+	// Logging configuration
+	LogLevel string `config:"log_level"`
+
+	// Server configuration
+	GinMode         string        `config:"gin_mode"`
+	Host            string        `config:"host"`
+	Port            string        `config:"port"`
+	ShutdownTimeout time.Duration `config:"shutdown_timeout"`
+
+	// ReloadInterval is how often ConfigFile is checked for changes when
+	// hot reload is enabled. Zero disables polling; SIGHUP still works.
+	ReloadInterval time.Duration `config:"reload_interval"`
+
+	// ConfigFile is the config file the configuration was loaded from, if
+	// any. It is set by the loader and cannot be configured.
+	ConfigFile string
 
 	// Other configuration options
 	// ...
 }
 
+// RouteRateLimit limits a single route on top of the global rate limit.
+// RouteRateLimits can only be set from a config file.
+type RouteRateLimit struct {
+	// Method is the HTTP method, or empty for every method.
+	Method string `config:"method"`
+	// Path is the route pattern as registered, e.g. /api/v1/users/:id.
+	Path     string        `config:"path"`
+	Requests int           `config:"requests"`
+	Duration time.Duration `config:"duration"`
+}
+
+// APIKey is an API key provisioned from the config file. Only the SHA-256
+// hash of the key is configured; generate keys with cmd/apikey.
+type APIKey struct {
+	// ID is the lookup prefix of the key, the part after ak_.
+	ID     string   `config:"id"`
+	Owner  string   `config:"owner"`
+	Name   string   `config:"name"`
+	Hash   string   `config:"hash"`
+	Scopes []string `config:"scopes"`
+	// ExpiresAt is an RFC 3339 timestamp, or zero for keys that do not
+	// expire.
+	ExpiresAt time.Time `config:"expires_at"`
+}
+
+// Client is an application allowed to request tokens from /token. Only the
+// SHA-256 hash of its secret is configured; generate clients with
+// cmd/client.
+type Client struct {
+	ID         string `config:"id"`
+	Name       string `config:"name"`
+	SecretHash string `config:"secret_hash"`
+	// Scopes are the scopes the client may request.
+	Scopes []string `config:"scopes"`
+	// GrantTypes are the grants the client may use: client_credentials,
+	// password and refresh_token. Empty allows client_credentials only.
+	GrantTypes []string `config:"grant_types"`
+	// AccessTokenExpiry overrides JWTExpirationMinutes for the client when
+	// not zero.
+	AccessTokenExpiry time.Duration `config:"access_token_expiry"`
+}
+
+// User is an account accepted by the password grant. Only the bcrypt hash
+// of the password is configured; generate it with cmd/passwd.
+type User struct {
+	ID           string `config:"id"`
+	Username     string `config:"username"`
+	Email        string `config:"email"`
+	PasswordHash string `config:"password_hash"`
+	// Roles are set as the roles claim of the user's tokens.
+	Roles []string `config:"roles"`
+}
+
+// ProfileMapper maps the fields of an upstream profile to the user profile.
+// Paths are JSON pointers (/app_metadata/roles) or dotted paths
+// (app_metadata.roles); several paths separated by | are tried in order.
+type ProfileMapper struct {
+	Name       string `config:"name"`
+	IDPath     string `config:"id_path"`
+	EmailPath  string `config:"email_path"`
+	NamePath   string `config:"name_path"`
+	RolesPath  string `config:"roles_path"`
+	ScopesPath string `config:"scopes_path"`
+	// Claims are copied into the profile claims, each written as
+	// name=path.
+	Claims []string `config:"claims"`
+}
+
+// Default returns the configuration used when nothing else is set.
+func Default() *Config {
+	return &Config{
+		OIDCIssuer:              "https://accounts.google.com",
+		OIDCJWKSRefreshInterval: time.Minute,
+		OAuthRedirectURL:        "http://localhost:8080/auth/callback",
+		OAuthScopes:             []string{"openid", "email", "profile"},
+
+		JWTSecret:            defaultJWTSecret,
+		JWTExpirationMinutes: 60,
+		RefreshTokenExpiry:   30 * 24 * time.Hour,
+
+		ValidAPIKey: defaultAPIKey,
+
+		TokenVerifiers:   []string{VerifierRemote},
+		TokenCacheExpiry: 5 * time.Minute,
+
+		TokenCacheMaxEntries:      10000,
+		TokenCacheCleanupInterval: time.Minute,
+		TokenNegativeCacheExpiry:  10 * time.Second,
+		TokenCacheBackend:         TokenCacheMemory,
+		TokenCacheRedisPrefix:     "go-rest-api:token:",
+
+		TokenUpstreamConnectTimeout:   2 * time.Second,
+		TokenUpstreamTimeout:          5 * time.Second,
+		TokenUpstreamMaxRetries:       2,
+		TokenUpstreamRetryBackoff:     100 * time.Millisecond,
+		TokenUpstreamFailureThreshold: 5,
+		TokenUpstreamOpenTimeout:      30 * time.Second,
+
+		PolicyMode: PolicyModeEnforce,
+
+		RateLimitRequests: 10,
+		RateLimitDuration: time.Second,
+
+		LogLevel: "info",
+
+		GinMode:         "debug",
+		Port:            "8080",
+		ShutdownTimeout: 15 * time.Second,
+		ReloadInterval:  10 * time.Second,
+	}
+}
+
+// LoadConfig loads the configuration from the config file named by
+// CONFIG_FILE, if any, and the environment, then validates it. The returned
+// error is a *ValidationError listing every problem found.
 func LoadConfig() (*Config, error) {
+	return load(nil)
+}
+
+// LoadConfigFromArgs is like LoadConfig but also parses command-line flags
+// from args (usually os.Args[1:]). Each layer overrides the previous one:
+//
+//  1. built-in defaults
+//  2. the config file given by -config or CONFIG_FILE (YAML, JSON or TOML)
+//  3. environment variables, including those loaded from .env
+//  4. command-line flags
+//
+// It returns flag.ErrHelp when -h or -help is passed.
+func LoadConfigFromArgs(args []string) (*Config, error) {
+	if args == nil {
+		args = []string{}
+	}
+	return load(args)
+}
+
+func load(args []string) (*Config, error) {
 	// Load .env file if it exists
 	_ = godotenv.Load() // Ignore error if .env file doesn't exist
 
-	config := &Config{
-		OIDCIssuer:        getEnv("OIDC_ISSUER", "https://accounts.google.com"),
-		OAuthClientID:     getEnv("OAUTH_CLIENT_ID", ""),
-		OAuthClientSecret: getEnv("OAUTH_CLIENT_SECRET", ""),
-		OAuthRedirectURL:  getEnv("OAUTH_REDIRECT_URL", "http://localhost:8080/auth/callback"),
+	config := Default()
+	fields := configFields(config)
 
-		JWTSecret:            getEnv("JWT_SECRET", "default_jwt_secret"),
-		JWTExpirationMinutes: getEnvAsInt("JWT_EXPIRATION_MINUTES", 60),
+	var flagValues map[string]string
+	configFile := getEnv("CONFIG_FILE", "")
+	if args != nil {
+		var err error
+		flagValues, err = parseFlags(fields, args)
+		if err != nil {
+			return nil, err
+		}
+		if path, ok := flagValues["config"]; ok {
+			configFile = path
+		}
+	}
 
-		ValidAPIKey: getEnv("VALID_API_KEY", "default_api_key"),
+	var problems []FieldError
+	if configFile != "" {
+		config.ConfigFile = configFile
+		problems = append(problems, applyFile(fields, configFile)...)
+	}
+	problems = append(problems, applyEnv(fields)...)
+	problems = append(problems, applyFlags(fields, flagValues)...)
 
-		RateLimitRequests: getEnvAsInt("RATE_LIMIT_REQUESTS", 10),
-		RateLimitDuration: getEnvAsDuration("RATE_LIMIT_DURATION", time.Second),
+	if err := config.Validate(); err != nil {
+		problems = append(problems, err.(*ValidationError).Errors...)
+	}
+	if len(problems) > 0 {
+		return nil, &ValidationError{Errors: problems}
 	}
 
 	return config, nil
 }
 
+// Address returns the host:port the HTTP server listens on.
+func (c *Config) Address() string {
+	return net.JoinHostPort(c.Host, c.Port)
+}
+
 func getEnv(key, defaultValue string) string {
 	if value, exists := os.LookupEnv(key); exists {
 		return value
@@ -59,18 +351,53 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
-func getEnvAsInt(key string, defaultValue int) int {
+// getEnvAsInt returns defaultValue when key is unset or empty, and an error
+// when it is set to something other than an integer.
+func getEnvAsInt(key string, defaultValue int) (int, error) {
 	valueStr := getEnv(key, "")
-	if value, err := strconv.Atoi(valueStr); err == nil {
-		return value
+	if valueStr == "" {
+		return defaultValue, nil
 	}
-	return defaultValue
+	value, err := strconv.Atoi(valueStr)
+	if err != nil {
+		return defaultValue, fmt.Errorf("%q is not a valid integer", valueStr)
+	}
+	return value, nil
 }
 
-func getEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
+// getEnvAsBool returns defaultValue when key is unset or empty, and an error
+// when it is set to something other than a boolean.
+func getEnvAsBool(key string, defaultValue bool) (bool, error) {
 	valueStr := getEnv(key, "")
-	if value, err := time.ParseDuration(valueStr); err == nil {
-		return value
+	if valueStr == "" {
+		return defaultValue, nil
 	}
-	return defaultValue
+	value, err := strconv.ParseBool(valueStr)
+	if err != nil {
+		return defaultValue, fmt.Errorf("%q is not a valid boolean (use true or false)", valueStr)
+	}
+	return value, nil
+}
+
+// getEnvAsSlice splits a comma separated value, ignoring empty items.
+func getEnvAsSlice(key string, defaultValue []string) []string {
+	valueStr := getEnv(key, "")
+	if valueStr == "" {
+		return defaultValue
+	}
+	return splitList(valueStr)
+}
+
+// getEnvAsDuration returns defaultValue when key is unset or empty, and an
+// error when it is set to something other than a duration.
+func getEnvAsDuration(key string, defaultValue time.Duration) (time.Duration, error) {
+	valueStr := getEnv(key, "")
+	if valueStr == "" {
+		return defaultValue, nil
+	}
+	value, err := time.ParseDuration(valueStr)
+	if err != nil {
+		return defaultValue, fmt.Errorf("%q is not a valid duration (e.g. 30s, 5m, 1h)", valueStr)
+	}
+	return value, nil
 }
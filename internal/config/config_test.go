@@ -2,21 +2,27 @@ package config
 
 import (
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
 
 func TestLoadConfig(t *testing.T) {
 	// Set up test environment variables
-	os.Setenv("OIDC_ISSUER", "https://test.issuer.com")
-	os.Setenv("OAUTH_CLIENT_ID", "test_client_id")
-	os.Setenv("OAUTH_CLIENT_SECRET", "test_client_secret")
-	os.Setenv("OAUTH_REDIRECT_URL", "http://test.redirect.url")
-	os.Setenv("JWT_SECRET", "test_jwt_secret")
-	os.Setenv("JWT_EXPIRATION_MINUTES", "120")
-	os.Setenv("VALID_API_KEY", "test_api_key")
-	os.Setenv("RATE_LIMIT_REQUESTS", "20")
-	os.Setenv("RATE_LIMIT_DURATION", "1m")
+	t.Setenv("OIDC_ISSUER", "https://test.issuer.com")
+	t.Setenv("OAUTH_CLIENT_ID", "test_client_id")
+	t.Setenv("OAUTH_CLIENT_SECRET", "test_client_secret")
+	t.Setenv("OAUTH_REDIRECT_URL", "http://test.redirect.url")
+	t.Setenv("JWT_SECRET", "test_jwt_secret")
+	t.Setenv("JWT_EXPIRATION_MINUTES", "120")
+	t.Setenv("VALID_API_KEY", "test_api_key")
+	t.Setenv("RATE_LIMIT_REQUESTS", "20")
+	t.Setenv("RATE_LIMIT_DURATION", "1m")
+	t.Setenv("PORT", "9090")
+	t.Setenv("SHUTDOWN_TIMEOUT", "30s")
+	t.Setenv("TOKEN_URL", "https://test.token.url")
+	t.Setenv("TOKEN_CACHE_EXPIRY", "10m")
+	t.Setenv("ALLOWED_ORIGINS", "https://a.example.com, https://b.example.com")
 
 	// Load the configuration
 	config, err := LoadConfig()
@@ -41,6 +47,12 @@ func TestLoadConfig(t *testing.T) {
 		{"ValidAPIKey", config.ValidAPIKey, "test_api_key"},
 		{"RateLimitRequests", config.RateLimitRequests, 20},
 		{"RateLimitDuration", config.RateLimitDuration, time.Minute},
+		{"Port", config.Port, "9090"},
+		{"ShutdownTimeout", config.ShutdownTimeout, 30 * time.Second},
+		{"Address", config.Address(), ":9090"},
+		{"TokenURL", config.TokenURL, "https://test.token.url"},
+		{"TokenCacheExpiry", config.TokenCacheExpiry, 10 * time.Minute},
+		{"AllowedOrigins", strings.Join(config.AllowedOrigins, "|"), "https://a.example.com|https://b.example.com"},
 	}
 
 	for _, tt := range tests {
@@ -68,27 +80,51 @@ func TestGetEnv(t *testing.T) {
 func TestGetEnvAsInt(t *testing.T) {
 	// Test with valid integer
 	os.Setenv("TEST_INT_VAR", "42")
-	if got := getEnvAsInt("TEST_INT_VAR", 0); got != 42 {
-		t.Errorf("getEnvAsInt() = %v, want %v", got, 42)
+	if got, err := getEnvAsInt("TEST_INT_VAR", 0); got != 42 || err != nil {
+		t.Errorf("getEnvAsInt() = %v, %v, want %v, nil", got, err, 42)
 	}
 
 	// Test with invalid integer
 	os.Setenv("TEST_INVALID_INT", "not_an_int")
-	if got := getEnvAsInt("TEST_INVALID_INT", 10); got != 10 {
-		t.Errorf("getEnvAsInt() = %v, want %v", got, 10)
+	if got, err := getEnvAsInt("TEST_INVALID_INT", 10); got != 10 || err == nil {
+		t.Errorf("getEnvAsInt() = %v, %v, want %v and an error", got, err, 10)
+	}
+}
+
+func TestGetEnvAsBool(t *testing.T) {
+	os.Setenv("TEST_BOOL_VAR", "true")
+	if got, err := getEnvAsBool("TEST_BOOL_VAR", false); !got || err != nil {
+		t.Errorf("getEnvAsBool() = %v, %v, want %v, nil", got, err, true)
+	}
+
+	os.Setenv("TEST_INVALID_BOOL", "maybe")
+	if got, err := getEnvAsBool("TEST_INVALID_BOOL", false); got || err == nil {
+		t.Errorf("getEnvAsBool() = %v, %v, want %v and an error", got, err, false)
 	}
 }
 
 func TestGetEnvAsDuration(t *testing.T) {
 	// Test with valid duration
 	os.Setenv("TEST_DURATION_VAR", "5m")
-	if got := getEnvAsDuration("TEST_DURATION_VAR", time.Second); got != 5*time.Minute {
-		t.Errorf("getEnvAsDuration() = %v, want %v", got, 5*time.Minute)
+	if got, err := getEnvAsDuration("TEST_DURATION_VAR", time.Second); got != 5*time.Minute || err != nil {
+		t.Errorf("getEnvAsDuration() = %v, %v, want %v, nil", got, err, 5*time.Minute)
 	}
 
 	// Test with invalid duration
 	os.Setenv("TEST_INVALID_DURATION", "not_a_duration")
-	if got := getEnvAsDuration("TEST_INVALID_DURATION", time.Hour); got != time.Hour {
-		t.Errorf("getEnvAsDuration() = %v, want %v", got, time.Hour)
+	if got, err := getEnvAsDuration("TEST_INVALID_DURATION", time.Hour); got != time.Hour || err == nil {
+		t.Errorf("getEnvAsDuration() = %v, %v, want %v and an error", got, err, time.Hour)
+	}
+}
+
+func TestGetEnvAsSlice(t *testing.T) {
+	os.Setenv("TEST_SLICE_VAR", "a, b,,c")
+	got := getEnvAsSlice("TEST_SLICE_VAR", nil)
+	if strings.Join(got, "|") != "a|b|c" {
+		t.Errorf("getEnvAsSlice() = %v, want %v", got, []string{"a", "b", "c"})
+	}
+
+	if got := getEnvAsSlice("NON_EXISTING_SLICE_VAR", []string{"default"}); len(got) != 1 || got[0] != "default" {
+		t.Errorf("getEnvAsSlice() = %v, want %v", got, []string{"default"})
 	}
 }
@@ -0,0 +1,380 @@
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	timeType     = reflect.TypeOf(time.Time{})
+)
+
+// field is a settable configuration value identified by its `config` tag.
+type field struct {
+	key    string
+	value  reflect.Value
+	secret bool
+}
+
+// env returns the environment variable that sets the field.
+func (f field) env() string {
+	return strings.ToUpper(f.key)
+}
+
+// flag returns the command-line flag that sets the field.
+func (f field) flag() string {
+	return strings.ReplaceAll(f.key, "_", "-")
+}
+
+// scalar reports whether the field can be set from a single string, which
+// is required for environment variables and flags.
+func (f field) scalar() bool {
+	return f.value.Kind() != reflect.Slice || f.value.Type().Elem().Kind() == reflect.String
+}
+
+// configFields returns the tagged fields of the struct pointed to by ptr.
+func configFields(ptr any) []field {
+	v := reflect.ValueOf(ptr).Elem()
+	t := v.Type()
+
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("config")
+		if key == "" {
+			continue
+		}
+		fields = append(fields, field{
+			key:    key,
+			value:  v.Field(i),
+			secret: t.Field(i).Tag.Get("secret") == "true",
+		})
+	}
+	return fields
+}
+
+// readSecretFile returns the content of a mounted secret without the
+// trailing newline most tools add when the secret is created.
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// applyEnv sets every scalar field whose environment variable is set.
+func applyEnv(fields []field) []FieldError {
+	var problems []FieldError
+	for _, f := range fields {
+		if !f.scalar() {
+			continue
+		}
+
+		if path := getEnv(f.env()+"_FILE", ""); f.secret && path != "" {
+			if getEnv(f.env(), "") != "" {
+				problems = append(problems, FieldError{Field: f.env(), Message: fmt.Sprintf("both %s and %s_FILE are set; use only one", f.env(), f.env())})
+				continue
+			}
+			secret, err := readSecretFile(path)
+			if err != nil {
+				problems = append(problems, FieldError{Field: f.env() + "_FILE", Message: err.Error()})
+				continue
+			}
+			if err := setString(f.value, secret); err != nil {
+				problems = append(problems, FieldError{Field: f.env() + "_FILE", Message: err.Error()})
+			}
+			continue
+		}
+
+		var err error
+		switch v := f.value; {
+		case v.Type() == durationType:
+			var d time.Duration
+			d, err = getEnvAsDuration(f.env(), time.Duration(v.Int()))
+			v.SetInt(int64(d))
+		case v.Kind() == reflect.String:
+			v.SetString(getEnv(f.env(), v.String()))
+		case v.Kind() == reflect.Int:
+			var i int
+			i, err = getEnvAsInt(f.env(), int(v.Int()))
+			v.SetInt(int64(i))
+		case v.Kind() == reflect.Bool:
+			var b bool
+			b, err = getEnvAsBool(f.env(), v.Bool())
+			v.SetBool(b)
+		case v.Kind() == reflect.Slice:
+			v.Set(reflect.ValueOf(getEnvAsSlice(f.env(), v.Interface().([]string))))
+		}
+		if err != nil {
+			problems = append(problems, FieldError{Field: f.env(), Message: err.Error()})
+		}
+	}
+	return problems
+}
+
+// parseFlags parses args into raw values keyed by flag name. Values are
+// applied later by applyFlags so that flags override the other layers.
+func parseFlags(fields []field, args []string) (map[string]string, error) {
+	values := make(map[string]string)
+	record := func(name string) func(string) error {
+		return func(value string) error {
+			values[name] = value
+			return nil
+		}
+	}
+
+	fs := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+	fs.Func("config", "path to a YAML, JSON or TOML config file (overrides CONFIG_FILE)", record("config"))
+	for _, f := range fields {
+		if !f.scalar() {
+			continue
+		}
+		if f.value.Kind() == reflect.Bool {
+			fs.BoolFunc(f.flag(), "overrides "+f.env(), record(f.flag()))
+			continue
+		}
+		fs.Func(f.flag(), "overrides "+f.env(), record(f.flag()))
+		if f.secret {
+			fs.Func(f.flag()+"-file", "overrides "+f.env()+" with the content of a file", record(f.flag()+"-file"))
+		}
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	return values, nil
+}
+
+// applyFlags sets every field that was passed as a flag.
+func applyFlags(fields []field, values map[string]string) []FieldError {
+	var problems []FieldError
+	for _, f := range fields {
+		value, ok := values[f.flag()]
+		if path, fromFile := values[f.flag()+"-file"]; f.secret && fromFile {
+			if ok {
+				problems = append(problems, FieldError{Field: "-" + f.flag(), Message: fmt.Sprintf("both -%s and -%s-file are set; use only one", f.flag(), f.flag())})
+				continue
+			}
+			secret, err := readSecretFile(path)
+			if err != nil {
+				problems = append(problems, FieldError{Field: "-" + f.flag() + "-file", Message: err.Error()})
+				continue
+			}
+			value, ok = secret, true
+		}
+		if !ok {
+			continue
+		}
+		if err := setString(f.value, value); err != nil {
+			problems = append(problems, FieldError{Field: "-" + f.flag(), Message: err.Error()})
+		}
+	}
+	return problems
+}
+
+// applyFile sets the fields present in the config file at path. The format
+// is chosen from the file extension.
+func applyFile(fields []field, path string) []FieldError {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return []FieldError{{Field: "CONFIG_FILE", Message: err.Error()}}
+	}
+
+	values := make(map[string]any)
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	case ".json":
+		err = json.Unmarshal(data, &values)
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	default:
+		return []FieldError{{Field: "CONFIG_FILE", Message: fmt.Sprintf("unsupported config file extension %q (use .yaml, .yml, .json or .toml)", ext)}}
+	}
+	if err != nil {
+		return []FieldError{{Field: "CONFIG_FILE", Message: fmt.Sprintf("failed to parse %s: %v", path, err)}}
+	}
+
+	return applyMap(fields, values, "")
+}
+
+// applyMap sets fields from decoded config file values. Unknown keys are
+// reported so that typos do not go unnoticed.
+func applyMap(fields []field, values map[string]any, prefix string) []FieldError {
+	byKey := make(map[string]field, len(fields))
+	for _, f := range fields {
+		byKey[f.key] = f
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var problems []FieldError
+	for _, key := range keys {
+		if base, found := strings.CutSuffix(key, "_file"); found && byKey[base].secret {
+			if _, ok := values[base]; ok {
+				problems = append(problems, FieldError{Field: prefix + base, Message: fmt.Sprintf("both %s and %s are set; use only one", base, key)})
+				continue
+			}
+			secret, err := readSecretFile(fmt.Sprint(values[key]))
+			if err != nil {
+				problems = append(problems, FieldError{Field: prefix + key, Message: err.Error()})
+				continue
+			}
+			if err := setString(byKey[base].value, secret); err != nil {
+				problems = append(problems, FieldError{Field: prefix + key, Message: err.Error()})
+			}
+			continue
+		}
+
+		f, ok := byKey[key]
+		if !ok {
+			problems = append(problems, FieldError{Field: prefix + key, Message: "unknown setting"})
+			continue
+		}
+		problems = append(problems, setAny(f.value, values[key], prefix+key)...)
+	}
+	return problems
+}
+
+// setAny sets v from a value decoded from a config file.
+func setAny(v reflect.Value, raw any, path string) []FieldError {
+	if t, ok := raw.(time.Time); ok && v.Type() == timeType {
+		// YAML and TOML decode timestamps themselves
+		v.Set(reflect.ValueOf(t))
+		return nil
+	}
+	if v.Kind() != reflect.Slice {
+		if err := setString(v, formatScalar(raw)); err != nil {
+			return []FieldError{{Field: path, Message: err.Error()}}
+		}
+		return nil
+	}
+
+	items, ok := raw.([]any)
+	if !ok {
+		if s, isString := raw.(string); isString && v.Type().Elem().Kind() == reflect.String {
+			// Allow lists of strings to be written as comma separated values
+			return setAny(v, []any{s}, path)
+		}
+		return []FieldError{{Field: path, Message: "must be a list"}}
+	}
+
+	var problems []FieldError
+	slice := reflect.MakeSlice(v.Type(), len(items), len(items))
+	for i, item := range items {
+		itemPath := fmt.Sprintf("%s[%d]", path, i)
+		elem := slice.Index(i)
+
+		if elem.Kind() != reflect.Struct {
+			if err := setString(elem, formatScalar(item)); err != nil {
+				problems = append(problems, FieldError{Field: itemPath, Message: err.Error()})
+			}
+			continue
+		}
+
+		values, ok := item.(map[string]any)
+		if !ok {
+			problems = append(problems, FieldError{Field: itemPath, Message: "must be an object"})
+			continue
+		}
+		problems = append(problems, applyMap(configFields(elem.Addr().Interface()), values, itemPath+".")...)
+	}
+
+	if v.Type().Elem().Kind() == reflect.String {
+		// Flatten comma separated items, matching the environment format
+		var values []string
+		for _, item := range slice.Interface().([]string) {
+			values = append(values, splitList(item)...)
+		}
+		v.Set(reflect.ValueOf(values))
+		return problems
+	}
+
+	v.Set(slice)
+	return problems
+}
+
+// formatScalar formats a value decoded from a config file for setString.
+// JSON numbers decode as float64, which %v would print as 1e+06.
+func formatScalar(raw any) string {
+	switch n := raw.(type) {
+	case float64:
+		return strconv.FormatFloat(n, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(n), 'f', -1, 32)
+	case int:
+		return strconv.Itoa(n)
+	case int64:
+		return strconv.FormatInt(n, 10)
+	case uint64:
+		return strconv.FormatUint(n, 10)
+	}
+	return fmt.Sprint(raw)
+}
+
+// setString parses s into v according to its type.
+func setString(v reflect.Value, s string) error {
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("%q is not a valid duration (e.g. 30s, 5m, 1h)", s)
+		}
+		v.SetInt(int64(d))
+	case v.Type() == timeType:
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return fmt.Errorf("%q is not a valid RFC 3339 timestamp (e.g. 2030-01-02T15:04:05Z)", s)
+		}
+		v.Set(reflect.ValueOf(t))
+	case v.Kind() == reflect.String:
+		v.SetString(s)
+	case v.Kind() == reflect.Int:
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("%q is not a valid integer", s)
+		}
+		v.SetInt(int64(i))
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("%q is not a valid boolean (use true or false)", s)
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		v.Set(reflect.ValueOf(splitList(s)))
+	default:
+		return fmt.Errorf("cannot be set from a single value")
+	}
+	return nil
+}
+
+// splitList splits a comma separated value, ignoring empty items.
+func splitList(s string) []string {
+	var values []string
+	for _, value := range strings.Split(s, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
@@ -0,0 +1,323 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfigFromFile(t *testing.T) {
+	files := map[string]string{
+		"config.yaml": `
+token_url: https://idp.example.com/userinfo
+rate_limit_requests: 50
+rate_limit_duration: 1m
+allowed_origins:
+  - https://a.example.com
+  - https://b.example.com
+route_rate_limits:
+  - method: POST
+    path: /api/v1/token
+    requests: 5
+    duration: 1m
+`,
+		"config.json": `{
+  "token_url": "https://idp.example.com/userinfo",
+  "rate_limit_requests": 50,
+  "rate_limit_duration": "1m",
+  "allowed_origins": ["https://a.example.com", "https://b.example.com"],
+  "route_rate_limits": [{"method": "POST", "path": "/api/v1/token", "requests": 5, "duration": "1m"}]
+}`,
+		"config.toml": `
+token_url = "https://idp.example.com/userinfo"
+rate_limit_requests = 50
+rate_limit_duration = "1m"
+allowed_origins = "https://a.example.com,https://b.example.com"
+
+[[route_rate_limits]]
+method = "POST"
+path = "/api/v1/token"
+requests = 5
+duration = "1m"
+`,
+	}
+
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("CONFIG_FILE", writeConfigFile(t, name, content))
+
+			cfg, err := LoadConfig()
+			if err != nil {
+				t.Fatalf("LoadConfig() returned an error: %v", err)
+			}
+
+			if cfg.TokenURL != "https://idp.example.com/userinfo" {
+				t.Errorf("TokenURL = %v", cfg.TokenURL)
+			}
+			if cfg.RateLimitRequests != 50 || cfg.RateLimitDuration != time.Minute {
+				t.Errorf("rate limit = %d per %v, want 50 per 1m", cfg.RateLimitRequests, cfg.RateLimitDuration)
+			}
+			if strings.Join(cfg.AllowedOrigins, "|") != "https://a.example.com|https://b.example.com" {
+				t.Errorf("AllowedOrigins = %v", cfg.AllowedOrigins)
+			}
+			want := []RouteRateLimit{{Method: "POST", Path: "/api/v1/token", Requests: 5, Duration: time.Minute}}
+			if len(cfg.RouteRateLimits) != 1 || cfg.RouteRateLimits[0] != want[0] {
+				t.Errorf("RouteRateLimits = %+v, want %+v", cfg.RouteRateLimits, want)
+			}
+			// Values missing from the file keep their defaults
+			if cfg.Port != "8080" {
+				t.Errorf("Port = %v, want default 8080", cfg.Port)
+			}
+		})
+	}
+}
+
+func TestLoadConfigLargeNumbers(t *testing.T) {
+	t.Setenv("CONFIG_FILE", writeConfigFile(t, "config.json", `{
+  "token_url": "https://idp.example.com/userinfo",
+  "rate_limit_requests": 1000000,
+  "token_cache_max_bytes": 10000000,
+  "route_rate_limits": [{"method": "POST", "path": "/api/v1/token", "requests": 2000000, "duration": "1m"}]
+}`))
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig() returned an error: %v", err)
+	}
+	if cfg.RateLimitRequests != 1000000 {
+		t.Errorf("RateLimitRequests = %d, want 1000000", cfg.RateLimitRequests)
+	}
+	if cfg.TokenCacheMaxBytes != 10000000 {
+		t.Errorf("TokenCacheMaxBytes = %d, want 10000000", cfg.TokenCacheMaxBytes)
+	}
+	if len(cfg.RouteRateLimits) != 1 || cfg.RouteRateLimits[0].Requests != 2000000 {
+		t.Errorf("RouteRateLimits = %+v, want 2000000 requests", cfg.RouteRateLimits)
+	}
+
+	t.Setenv("CONFIG_FILE", writeConfigFile(t, "config.json", `{"rate_limit_requests": 1.5}`))
+	if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), `"1.5" is not a valid integer`) {
+		t.Errorf("LoadConfig() error = %v, want an error for 1.5", err)
+	}
+}
+
+func TestLoadConfigAPIKeys(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+	files := map[string]string{
+		"config.yaml": `
+token_url: https://idp.example.com/userinfo
+api_keys:
+  - id: 0a1b2c3d4e5f
+    owner: acme
+    hash: ` + hash + `
+    scopes: [orders:read, orders:write]
+    expires_at: 2030-01-02T15:04:05Z
+  - id: 111111111111
+    owner: acme
+    hash: ` + hash + `
+`,
+		"config.json": `{
+  "token_url": "https://idp.example.com/userinfo",
+  "api_keys": [
+    {"id": "0a1b2c3d4e5f", "owner": "acme", "hash": "` + hash + `", "scopes": ["orders:read", "orders:write"], "expires_at": "2030-01-02T15:04:05Z"},
+    {"id": "111111111111", "owner": "acme", "hash": "` + hash + `"}
+  ]
+}`,
+		"config.toml": `
+token_url = "https://idp.example.com/userinfo"
+
+[[api_keys]]
+id = "0a1b2c3d4e5f"
+owner = "acme"
+hash = "` + hash + `"
+scopes = ["orders:read", "orders:write"]
+expires_at = 2030-01-02T15:04:05Z
+
+[[api_keys]]
+id = "111111111111"
+owner = "acme"
+hash = "` + hash + `"
+`,
+	}
+
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("CONFIG_FILE", writeConfigFile(t, name, content))
+
+			cfg, err := LoadConfig()
+			if err != nil {
+				t.Fatalf("LoadConfig() returned an error: %v", err)
+			}
+
+			if len(cfg.APIKeys) != 2 {
+				t.Fatalf("APIKeys = %+v, want 2 keys", cfg.APIKeys)
+			}
+			key := cfg.APIKeys[0]
+			if key.ID != "0a1b2c3d4e5f" || key.Owner != "acme" || strings.Join(key.Scopes, ",") != "orders:read,orders:write" {
+				t.Errorf("APIKeys[0] = %+v", key)
+			}
+			if !key.ExpiresAt.Equal(time.Date(2030, 1, 2, 15, 4, 5, 0, time.UTC)) {
+				t.Errorf("APIKeys[0].ExpiresAt = %v", key.ExpiresAt)
+			}
+			if !cfg.APIKeys[1].ExpiresAt.IsZero() {
+				t.Errorf("APIKeys[1].ExpiresAt = %v, want zero", cfg.APIKeys[1].ExpiresAt)
+			}
+		})
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", `
+token_url: https://file.example.com
+port: "7000"
+rate_limit_requests: 30
+shutdown_timeout: 5s
+`)
+	t.Setenv("PORT", "7001")
+	t.Setenv("RATE_LIMIT_REQUESTS", "31")
+
+	cfg, err := LoadConfigFromArgs([]string{"-config", path, "-rate-limit-requests", "32", "-disable-protected-routes"})
+	if err != nil {
+		t.Fatalf("LoadConfigFromArgs() returned an error: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		got      interface{}
+		expected interface{}
+	}{
+		{"File only", cfg.ShutdownTimeout, 5 * time.Second},
+		{"Env overrides file", cfg.Port, "7001"},
+		{"Flag overrides env and file", cfg.RateLimitRequests, 32},
+		{"Boolean flag without value", cfg.DisableProtectedRoutes, true},
+		{"Default", cfg.JWTExpirationMinutes, 60},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.got != tt.expected {
+				t.Errorf("got %v, want %v", tt.got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	t.Setenv("CONFIG_FILE", writeConfigFile(t, "config.yaml", `
+token_url: https://idp.example.com/userinfo
+rate_limit_request: 10
+token_cache_expiry: soon
+route_rate_limits:
+  - path: /api/v1/ping
+    requests: 0
+    duration: 1s
+`))
+
+	_, err := LoadConfig()
+
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("LoadConfig() = %v, want a *ValidationError", err)
+	}
+	for _, field := range []string{"rate_limit_request:", "token_cache_expiry:", "route_rate_limits[0].requests:"} {
+		if !strings.Contains(err.Error(), field) {
+			t.Errorf("LoadConfig() error does not mention %s\n%v", field, err)
+		}
+	}
+}
+
+func TestLoadConfigFromArgsErrors(t *testing.T) {
+	t.Setenv("TOKEN_URL", "https://idp.example.com/userinfo")
+
+	if _, err := LoadConfigFromArgs([]string{"-h"}); !errors.Is(err, flag.ErrHelp) {
+		t.Errorf("LoadConfigFromArgs(-h) = %v, want flag.ErrHelp", err)
+	}
+	if _, err := LoadConfigFromArgs([]string{"-rate-limit-requests", "ten"}); err == nil || !strings.Contains(err.Error(), "-rate-limit-requests:") {
+		t.Errorf("LoadConfigFromArgs(-rate-limit-requests ten) = %v, want an error for -rate-limit-requests", err)
+	}
+	if _, err := LoadConfig(); err != nil {
+		t.Errorf("LoadConfig() returned an error: %v", err)
+	}
+}
+
+func TestLoadConfigSecretFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeSecret := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("Failed to write secret: %v", err)
+		}
+		return path
+	}
+
+	t.Setenv("TOKEN_URL", "https://idp.example.com/userinfo")
+	t.Setenv("JWT_SECRET_FILE", writeSecret("jwt_secret", "jwt-from-file\n"))
+	t.Setenv("OAUTH_CLIENT_SECRET_FILE", writeSecret("oauth_client_secret", "oauth-from-file\r\n"))
+	t.Setenv("JWT_PREVIOUS_SECRETS_FILE", writeSecret("jwt_previous_secrets", "old-secret,older-secret\n"))
+
+	cfg, err := LoadConfigFromArgs([]string{"-valid-api-key-file", writeSecret("valid_api_key", "key-from-flag-file")})
+	if err != nil {
+		t.Fatalf("LoadConfigFromArgs() returned an error: %v", err)
+	}
+
+	if cfg.JWTSecret != "jwt-from-file" {
+		t.Errorf("JWTSecret = %q, want %q", cfg.JWTSecret, "jwt-from-file")
+	}
+	if cfg.OAuthClientSecret != "oauth-from-file" {
+		t.Errorf("OAuthClientSecret = %q, want %q", cfg.OAuthClientSecret, "oauth-from-file")
+	}
+	if want := []string{"old-secret", "older-secret"}; !slices.Equal(cfg.JWTPreviousSecrets, want) {
+		t.Errorf("JWTPreviousSecrets = %q, want %q", cfg.JWTPreviousSecrets, want)
+	}
+	if cfg.ValidAPIKey != "key-from-flag-file" {
+		t.Errorf("ValidAPIKey = %q, want %q", cfg.ValidAPIKey, "key-from-flag-file")
+	}
+}
+
+func TestLoadConfigSecretFileFromConfigFile(t *testing.T) {
+	secretPath := filepath.Join(t.TempDir(), "jwt_secret")
+	if err := os.WriteFile(secretPath, []byte("jwt-from-file\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write secret: %v", err)
+	}
+	t.Setenv("CONFIG_FILE", writeConfigFile(t, "config.yaml", "token_url: https://idp.example.com/userinfo\njwt_secret_file: "+secretPath+"\n"))
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatalf("LoadConfig() returned an error: %v", err)
+	}
+	if cfg.JWTSecret != "jwt-from-file" {
+		t.Errorf("JWTSecret = %q, want %q", cfg.JWTSecret, "jwt-from-file")
+	}
+}
+
+func TestLoadConfigSecretFileErrors(t *testing.T) {
+	t.Setenv("TOKEN_URL", "https://idp.example.com/userinfo")
+	t.Setenv("JWT_SECRET", "from-env")
+	t.Setenv("JWT_SECRET_FILE", filepath.Join(t.TempDir(), "jwt_secret"))
+	t.Setenv("VALID_API_KEY_FILE", filepath.Join(t.TempDir(), "missing"))
+
+	_, err := LoadConfig()
+	if err == nil {
+		t.Fatal("LoadConfig() returned no error")
+	}
+	for _, want := range []string{"both JWT_SECRET and JWT_SECRET_FILE are set", "VALID_API_KEY_FILE:"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("LoadConfig() error does not mention %q\n%v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), "from-env") {
+		t.Errorf("LoadConfig() error leaks the secret value\n%v", err)
+	}
+}
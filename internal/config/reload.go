@@ -0,0 +1,94 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// Change describes a setting that differs between two configurations.
+// Secret values are redacted.
+type Change struct {
+	Key string
+	Old string
+	New string
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s: %s -> %s", c.Key, c.Old, c.New)
+}
+
+// Diff returns the settings that differ between old and new, in field order.
+func Diff(old, new *Config) []Change {
+	oldFields, newFields := configFields(old), configFields(new)
+
+	var changes []Change
+	for i, f := range oldFields {
+		oldValue, newValue := f.value.Interface(), newFields[i].value.Interface()
+		if reflect.DeepEqual(oldValue, newValue) {
+			continue
+		}
+
+		change := Change{Key: f.key, Old: fmt.Sprintf("%v", oldValue), New: fmt.Sprintf("%v", newValue)}
+		if f.secret {
+			change.Old, change.New = "[redacted]", "[redacted]"
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// Store holds the current configuration. Readers call Load on every use so
+// that a reload takes effect without restarting the server.
+type Store struct {
+	current atomic.Pointer[Config]
+
+	mu        sync.Mutex
+	listeners []func(old, new *Config)
+}
+
+// NewStore returns a Store holding cfg.
+func NewStore(cfg *Config) *Store {
+	s := &Store{}
+	s.current.Store(cfg)
+	return s
+}
+
+// Load returns the current configuration. It must be treated as read-only.
+func (s *Store) Load() *Config {
+	return s.current.Load()
+}
+
+// OnChange registers fn to be called after every reload that changed at
+// least one setting.
+func (s *Store) OnChange(fn func(old, new *Config)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, fn)
+}
+
+// Reload calls load and atomically swaps in the configuration it returns.
+// If load fails, usually because the new configuration is invalid, the
+// current configuration is kept and the error is returned.
+func (s *Store) Reload(load func() (*Config, error)) ([]Change, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	old := s.current.Load()
+	changes := Diff(old, next)
+	if len(changes) == 0 {
+		return nil, nil
+	}
+
+	s.current.Store(next)
+	for _, fn := range s.listeners {
+		fn(old, next)
+	}
+	return changes, nil
+}
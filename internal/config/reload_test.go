@@ -0,0 +1,69 @@
+package config
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDiff(t *testing.T) {
+	old := validConfig()
+	new := validConfig()
+	new.RateLimitRequests = 20
+	new.AllowedOrigins = []string{"https://example.com"}
+	new.JWTSecret = "rotated"
+
+	changes := Diff(old, new)
+
+	expected := []Change{
+		{Key: "jwt_secret", Old: "[redacted]", New: "[redacted]"},
+		{Key: "allowed_origins", Old: "[]", New: "[https://example.com]"},
+		{Key: "rate_limit_requests", Old: "10", New: "20"},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("Diff() = %v, want %v", changes, expected)
+	}
+	for i := range expected {
+		if changes[i] != expected[i] {
+			t.Errorf("Diff()[%d] = %v, want %v", i, changes[i], expected[i])
+		}
+	}
+}
+
+func TestStoreReload(t *testing.T) {
+	initial := validConfig()
+	store := NewStore(initial)
+
+	var notified *Config
+	store.OnChange(func(old, new *Config) {
+		notified = new
+	})
+
+	// A failing load keeps the current configuration
+	if _, err := store.Reload(func() (*Config, error) {
+		return nil, errors.New("invalid")
+	}); err == nil {
+		t.Error("Reload() returned no error for a failing load")
+	}
+	if store.Load() != initial || notified != nil {
+		t.Error("Reload() replaced the configuration after a failing load")
+	}
+
+	// An identical configuration is not swapped in
+	if changes, err := store.Reload(func() (*Config, error) { return validConfig(), nil }); err != nil || len(changes) != 0 {
+		t.Errorf("Reload() = %v, %v, want no changes", changes, err)
+	}
+	if store.Load() != initial {
+		t.Error("Reload() replaced the configuration although nothing changed")
+	}
+
+	next := validConfig()
+	next.TokenCacheExpiry = time.Minute
+	changes, err := store.Reload(func() (*Config, error) { return next, nil })
+	if err != nil || len(changes) != 1 || changes[0].Key != "token_cache_expiry" {
+		t.Errorf("Reload() = %v, %v, want a token_cache_expiry change", changes, err)
+	}
+	if store.Load() != next || notified != next {
+		t.Error("Reload() did not swap in the new configuration")
+	}
+}
@@ -0,0 +1,320 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/nicobistolfi/go-rest-api/pkg/auth"
+	"github.com/nicobistolfi/go-rest-api/pkg/policy"
+
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MinSecretLength is the minimum length of JWT_SECRET when running with
+// GIN_MODE=release and JWT_SECRET is used.
+const MinSecretLength = 32
+
+// Grants accepted in Client.GrantTypes.
+const (
+	GrantClientCredentials = "client_credentials"
+	GrantPassword          = "password"
+	GrantRefreshToken      = "refresh_token"
+)
+
+// Token verifiers accepted in TokenVerifiers.
+const (
+	VerifierAPIKey = "apikey"
+	VerifierJWT    = "jwt"
+	VerifierOIDC   = "oidc"
+	VerifierRemote = "remote"
+)
+
+// Backends accepted in TokenCacheBackend.
+const (
+	TokenCacheMemory = "memory"
+	TokenCacheRedis  = "redis"
+)
+
+// Built-in mappers accepted in TokenProfileMapper and OIDCProfileMapper.
+const (
+	ProfileMapperGeneric = "generic"
+	ProfileMapperGitHub  = "github"
+	ProfileMapperGoogle  = "google"
+)
+
+// Modes accepted in PolicyMode.
+const (
+	PolicyModeEnforce = "enforce"
+	PolicyModeDryRun  = "dry_run"
+)
+
+const (
+	defaultJWTSecret = "default_jwt_secret"
+	defaultAPIKey    = "default_api_key"
+)
+
+// FieldError describes a single invalid configuration value. Field is the
+// name of the environment variable that sets it.
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ValidationError aggregates every problem found in a configuration.
+type ValidationError struct {
+	Errors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "invalid configuration (%d problem", len(e.Errors))
+	if len(e.Errors) != 1 {
+		b.WriteString("s")
+	}
+	b.WriteString("):")
+	for _, fe := range e.Errors {
+		b.WriteString("\n  - ")
+		b.WriteString(fe.Error())
+	}
+	return b.String()
+}
+
+// Unwrap returns the individual field errors.
+func (e *ValidationError) Unwrap() []error {
+	errs := make([]error, len(e.Errors))
+	for i, fe := range e.Errors {
+		errs[i] = fe
+	}
+	return errs
+}
+
+// Validate checks the configuration for values the server cannot run with.
+// It returns a *ValidationError listing every problem, or nil.
+func (c *Config) Validate() error {
+	v := &validator{}
+
+	v.check(c.JWTExpirationMinutes > 0, "JWT_EXPIRATION_MINUTES", "must be greater than 0")
+	v.check(c.RateLimitRequests > 0, "RATE_LIMIT_REQUESTS", "must be greater than 0")
+	v.check(c.RateLimitDuration > 0, "RATE_LIMIT_DURATION", "must be greater than 0")
+	v.check(c.TokenCacheExpiry > 0, "TOKEN_CACHE_EXPIRY", "must be greater than 0")
+	v.check(c.TokenCacheMaxEntries >= 0, "TOKEN_CACHE_MAX_ENTRIES", "must not be negative")
+	v.check(c.TokenCacheMaxBytes >= 0, "TOKEN_CACHE_MAX_BYTES", "must not be negative")
+	v.check(c.TokenCacheCleanupInterval >= 0, "TOKEN_CACHE_CLEANUP_INTERVAL", "must not be negative")
+	v.check(c.TokenNegativeCacheExpiry >= 0, "TOKEN_NEGATIVE_CACHE_EXPIRY", "must not be negative")
+	v.check(c.TokenCacheStaleWhileRevalidate >= 0, "TOKEN_CACHE_STALE_WHILE_REVALIDATE", "must not be negative")
+	v.check(c.TokenCacheMaxStale >= c.TokenCacheStaleWhileRevalidate, "TOKEN_CACHE_MAX_STALE", "must not be less than TOKEN_CACHE_STALE_WHILE_REVALIDATE")
+	switch c.TokenCacheBackend {
+	case "", TokenCacheMemory:
+	case TokenCacheRedis:
+		if c.TokenCacheRedisURL == "" {
+			v.add("TOKEN_CACHE_REDIS_URL", "is required by the redis token cache")
+		} else if u, err := url.Parse(c.TokenCacheRedisURL); err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" {
+			// The URL may hold a password, so it is not included
+			v.add("TOKEN_CACHE_REDIS_URL", "is not a redis:// or rediss:// URL")
+		}
+		v.check(c.TokenFingerprintKey != "", "TOKEN_FINGERPRINT_KEY", "is required by the redis token cache so that replicas share cache keys")
+	default:
+		v.add("TOKEN_CACHE_BACKEND", fmt.Sprintf("%q is not a valid backend (use %s or %s)", c.TokenCacheBackend, TokenCacheMemory, TokenCacheRedis))
+	}
+	v.check(c.TokenFingerprintKey == "" || len(c.TokenFingerprintKey) >= MinSecretLength, "TOKEN_FINGERPRINT_KEY", fmt.Sprintf("must be at least %d characters long", MinSecretLength))
+	v.check(c.TokenUpstreamConnectTimeout >= 0, "TOKEN_UPSTREAM_CONNECT_TIMEOUT", "must not be negative")
+	v.check(c.TokenUpstreamTimeout >= 0, "TOKEN_UPSTREAM_TIMEOUT", "must not be negative")
+	v.check(c.TokenUpstreamMaxRetries >= 0, "TOKEN_UPSTREAM_MAX_RETRIES", "must not be negative")
+	v.check(c.TokenUpstreamRetryBackoff >= 0, "TOKEN_UPSTREAM_RETRY_BACKOFF", "must not be negative")
+	v.check(c.TokenUpstreamFailureThreshold >= 0, "TOKEN_UPSTREAM_FAILURE_THRESHOLD", "must not be negative")
+	if c.TokenUpstreamFailureThreshold > 0 {
+		v.check(c.TokenUpstreamOpenTimeout > 0, "TOKEN_UPSTREAM_OPEN_TIMEOUT", "must be greater than 0 when TOKEN_UPSTREAM_FAILURE_THRESHOLD is set")
+	}
+	v.check(c.ShutdownTimeout >= 0, "SHUTDOWN_TIMEOUT", "must not be negative")
+	v.check(c.ReloadInterval >= 0, "RELOAD_INTERVAL", "must not be negative")
+	v.check(c.JWTLeeway >= 0, "JWT_LEEWAY", "must not be negative")
+	v.check(c.RefreshTokenExpiry > 0, "REFRESH_TOKEN_EXPIRY", "must be greater than 0")
+
+	if _, err := zapcore.ParseLevel(c.LogLevel); err != nil {
+		v.add("LOG_LEVEL", fmt.Sprintf("%q is not a valid level (use debug, info, warn or error)", c.LogLevel))
+	}
+
+	for i, rl := range c.RouteRateLimits {
+		field := fmt.Sprintf("route_rate_limits[%d]", i)
+		v.check(rl.Path != "", field+".path", "is required")
+		v.check(rl.Requests > 0, field+".requests", "must be greater than 0")
+		v.check(rl.Duration > 0, field+".duration", "must be greater than 0")
+	}
+
+	keyIDs := make(map[string]bool, len(c.APIKeys))
+	for i, key := range c.APIKeys {
+		field := fmt.Sprintf("api_keys[%d]", i)
+		v.check(key.ID != "", field+".id", "is required")
+		v.check(!keyIDs[key.ID], field+".id", fmt.Sprintf("%q is used by another key", key.ID))
+		v.check(key.Owner != "", field+".owner", "is required")
+		if hash, err := hex.DecodeString(key.Hash); err != nil || len(hash) != sha256.Size {
+			v.add(field+".hash", "must be a hex encoded SHA-256 hash")
+		}
+		keyIDs[key.ID] = true
+	}
+
+	clientIDs := make(map[string]bool, len(c.Clients))
+	for i, client := range c.Clients {
+		field := fmt.Sprintf("clients[%d]", i)
+		v.check(client.ID != "", field+".id", "is required")
+		v.check(!clientIDs[client.ID], field+".id", fmt.Sprintf("%q is used by another client", client.ID))
+		if hash, err := hex.DecodeString(client.SecretHash); err != nil || len(hash) != sha256.Size {
+			v.add(field+".secret_hash", "must be a hex encoded SHA-256 hash")
+		}
+		for _, grant := range client.GrantTypes {
+			if grant != GrantClientCredentials && grant != GrantPassword && grant != GrantRefreshToken {
+				v.add(field+".grant_types", fmt.Sprintf("%q is not a valid grant (use %s, %s or %s)", grant, GrantClientCredentials, GrantPassword, GrantRefreshToken))
+			}
+		}
+		v.check(client.AccessTokenExpiry >= 0, field+".access_token_expiry", "must not be negative")
+		clientIDs[client.ID] = true
+	}
+
+	usernames := make(map[string]bool, len(c.Users))
+	for i, user := range c.Users {
+		field := fmt.Sprintf("users[%d]", i)
+		v.check(user.ID != "", field+".id", "is required")
+		v.check(user.Username != "", field+".username", "is required")
+		v.check(!usernames[user.Username], field+".username", fmt.Sprintf("%q is used by another user", user.Username))
+		if _, err := bcrypt.Cost([]byte(user.PasswordHash)); err != nil {
+			v.add(field+".password_hash", "must be a bcrypt hash")
+		}
+		usernames[user.Username] = true
+	}
+
+	mappers := map[string]bool{ProfileMapperGeneric: true, ProfileMapperGitHub: true, ProfileMapperGoogle: true}
+	for i, mapper := range c.ProfileMappers {
+		field := fmt.Sprintf("profile_mappers[%d]", i)
+		v.check(mapper.Name != "", field+".name", "is required")
+		v.check(!mappers[mapper.Name], field+".name", fmt.Sprintf("%q is used by a built-in or another mapper", mapper.Name))
+		v.check(mapper.IDPath != "", field+".id_path", "is required")
+		for _, claim := range mapper.Claims {
+			name, path, ok := strings.Cut(claim, "=")
+			v.check(ok && strings.TrimSpace(name) != "" && strings.TrimSpace(path) != "", field+".claims", fmt.Sprintf("%q is not a name=path pair", claim))
+		}
+		mappers[mapper.Name] = true
+	}
+	v.check(c.TokenProfileMapper == "" || mappers[c.TokenProfileMapper], "TOKEN_PROFILE_MAPPER", fmt.Sprintf("%q is not a built-in or configured mapper", c.TokenProfileMapper))
+	v.check(c.OIDCProfileMapper == "" || mappers[c.OIDCProfileMapper], "OIDC_PROFILE_MAPPER", fmt.Sprintf("%q is not a built-in or configured mapper", c.OIDCProfileMapper))
+
+	if c.JWTSigningKey != "" {
+		if key, err := auth.LoadSigningKey(c.JWTSigningKey); err != nil {
+			v.add("JWT_SIGNING_KEY", err.Error())
+		} else {
+			v.check(key.CanSign(), "JWT_SIGNING_KEY", "must be a private key")
+		}
+	}
+	for _, path := range c.JWTPreviousKeys {
+		if _, err := auth.LoadSigningKey(path); err != nil {
+			v.add("JWT_PREVIOUS_KEYS", err.Error())
+		}
+	}
+
+	if c.PolicyFile != "" {
+		if _, err := policy.Load(c.PolicyFile); err != nil {
+			v.add("POLICY_FILE", err.Error())
+		}
+	}
+	v.check(c.PolicyMode == "" || c.PolicyMode == PolicyModeEnforce || c.PolicyMode == PolicyModeDryRun, "POLICY_MODE",
+		fmt.Sprintf("%q is not a valid mode (use %s or %s)", c.PolicyMode, PolicyModeEnforce, PolicyModeDryRun))
+
+	if port, err := strconv.Atoi(c.Port); err != nil || port < 0 || port > 65535 {
+		v.add("PORT", fmt.Sprintf("%q is not a valid port number", c.Port))
+	}
+
+	verifiers := make(map[string]bool, len(c.TokenVerifiers))
+	for _, name := range c.TokenVerifiers {
+		switch {
+		case name != VerifierAPIKey && name != VerifierJWT && name != VerifierOIDC && name != VerifierRemote:
+			v.add("TOKEN_VERIFIERS", fmt.Sprintf("%q is not a valid verifier (use %s, %s, %s or %s)", name, VerifierAPIKey, VerifierJWT, VerifierOIDC, VerifierRemote))
+		case verifiers[name]:
+			v.add("TOKEN_VERIFIERS", fmt.Sprintf("%q is listed more than once", name))
+		}
+		verifiers[name] = true
+	}
+	if !c.DisableProtectedRoutes {
+		v.check(len(c.TokenVerifiers) > 0, "TOKEN_VERIFIERS", "must list at least one verifier when protected routes are enabled")
+		if verifiers[VerifierJWT] {
+			v.check(c.JWTSecret != "" || c.JWTSigningKey != "", "JWT_SECRET", "is required by the jwt verifier unless JWT_SIGNING_KEY is set")
+		}
+		if verifiers[VerifierOIDC] {
+			v.check(c.OIDCIssuer != "", "OIDC_ISSUER", "is required by the oidc verifier")
+			v.check(c.OIDCAudience != "" || c.OAuthClientID != "", "OIDC_AUDIENCE", "is required by the oidc verifier unless OAUTH_CLIENT_ID is set")
+			v.check(c.OIDCJWKSRefreshInterval > 0, "OIDC_JWKS_REFRESH_INTERVAL", "must be greater than 0")
+		}
+	}
+
+	if c.OAuthClientID != "" {
+		v.check(c.OIDCIssuer != "", "OIDC_ISSUER", "is required by the login flow (OAUTH_CLIENT_ID is set)")
+		v.check(c.OAuthRedirectURL != "", "OAUTH_REDIRECT_URL", "is required by the login flow (OAUTH_CLIENT_ID is set)")
+		v.check(c.JWTSecret != "", "JWT_SECRET", "is required by the login flow (OAUTH_CLIENT_ID is set)")
+		v.check(slices.Contains(c.OAuthScopes, "openid"), "OAUTH_SCOPES", "must include openid")
+	}
+
+	v.check(c.TokenIntrospectionClientID == "" || c.TokenIntrospectionClientSecret != "", "TOKEN_INTROSPECTION_CLIENT_SECRET", "is required when TOKEN_INTROSPECTION_CLIENT_ID is set")
+
+	if c.TokenURL == "" {
+		v.check(c.DisableProtectedRoutes || !verifiers[VerifierRemote], "TOKEN_URL", "is required by the remote verifier (set DISABLE_PROTECTED_ROUTES=true to run without protected routes)")
+	} else {
+		v.url("TOKEN_URL", c.TokenURL)
+	}
+	v.url("OIDC_ISSUER", c.OIDCIssuer)
+	v.url("OAUTH_REDIRECT_URL", c.OAuthRedirectURL)
+
+	// JWT_SECRET only signs tokens when no signing key is set, but always
+	// signs the login flow cookie
+	if c.GinMode == "release" && (c.JWTSigningKey == "" || c.OAuthClientID != "") {
+		v.secret("JWT_SECRET", c.JWTSecret, defaultJWTSecret)
+	}
+
+	if len(v.errors) > 0 {
+		return &ValidationError{Errors: v.errors}
+	}
+	return nil
+}
+
+type validator struct {
+	errors []FieldError
+}
+
+func (v *validator) add(field, message string) {
+	v.errors = append(v.errors, FieldError{Field: field, Message: message})
+}
+
+func (v *validator) check(ok bool, field, message string) {
+	if !ok {
+		v.add(field, message)
+	}
+}
+
+// url checks that an optional value is an absolute http(s) URL.
+func (v *validator) url(field, value string) {
+	if value == "" {
+		return
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.add(field, fmt.Sprintf("%q is not an absolute http(s) URL", value))
+	}
+}
+
+// secret rejects built-in defaults and short values. The value itself is
+// never included in the message.
+func (v *validator) secret(field, value, defaultValue string) {
+	switch {
+	case value == "" || value == defaultValue:
+		v.add(field, "must be set to a non-default value when GIN_MODE=release")
+	case len(value) < MinSecretLength:
+		v.add(field, fmt.Sprintf("must be at least %d characters long when GIN_MODE=release", MinSecretLength))
+	}
+}
@@ -0,0 +1,218 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func validConfig() *Config {
+	return &Config{
+		OIDCIssuer:              "https://accounts.google.com",
+		OAuthRedirectURL:        "http://localhost:8080/auth/callback",
+		OIDCJWKSRefreshInterval: time.Minute,
+		JWTSecret:               defaultJWTSecret,
+		JWTExpirationMinutes:    60,
+		RefreshTokenExpiry:      time.Hour,
+		ValidAPIKey:             defaultAPIKey,
+		TokenVerifiers:          []string{VerifierRemote},
+		TokenURL:                "https://api.github.com/user",
+		TokenCacheExpiry:        5 * time.Minute,
+		RateLimitRequests:       10,
+		RateLimitDuration:       time.Second,
+		LogLevel:                "info",
+		GinMode:                 "debug",
+		Port:                    "8080",
+		ShutdownTimeout:         15 * time.Second,
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name           string
+		modify         func(c *Config)
+		expectedFields []string
+	}{
+		{"Valid configuration", func(c *Config) {}, nil},
+		{"Default secrets allowed outside release", func(c *Config) { c.JWTSecret = "short" }, nil},
+		{"Missing TOKEN_URL", func(c *Config) { c.TokenURL = "" }, []string{"TOKEN_URL"}},
+		{"Missing TOKEN_URL with protected routes disabled", func(c *Config) {
+			c.TokenURL = ""
+			c.DisableProtectedRoutes = true
+		}, nil},
+		{"Missing TOKEN_URL with only the jwt verifier", func(c *Config) {
+			c.TokenURL = ""
+			c.TokenVerifiers = []string{VerifierJWT}
+		}, nil},
+		{"Invalid token verifiers", func(c *Config) {
+			c.TokenVerifiers = []string{"jwt", "opaque", "jwt"}
+		}, []string{"TOKEN_VERIFIERS", "TOKEN_VERIFIERS"}},
+		{"No token verifiers", func(c *Config) { c.TokenVerifiers = nil }, []string{"TOKEN_VERIFIERS"}},
+		{"Missing JWT_SECRET with the jwt verifier", func(c *Config) {
+			c.JWTSecret = ""
+			c.JWTLeeway = -time.Second
+			c.TokenVerifiers = []string{VerifierJWT, VerifierRemote}
+		}, []string{"JWT_LEEWAY", "JWT_SECRET"}},
+		{"Signing key instead of JWT_SECRET", func(c *Config) {
+			c.JWTSecret = ""
+			c.JWTSigningKey = "testdata/missing.pem"
+			c.JWTPreviousKeys = []string{"testdata/missing.pem"}
+			c.TokenVerifiers = []string{VerifierJWT}
+		}, []string{"JWT_SIGNING_KEY", "JWT_PREVIOUS_KEYS"}},
+		{"Invalid policy", func(c *Config) {
+			c.PolicyFile = "testdata/missing.yaml"
+			c.PolicyMode = "audit"
+		}, []string{"POLICY_FILE", "POLICY_MODE"}},
+		{"Negative token cache limits", func(c *Config) {
+			c.TokenCacheMaxEntries = -1
+			c.TokenCacheMaxBytes = -1
+			c.TokenCacheCleanupInterval = -time.Second
+			c.TokenNegativeCacheExpiry = -time.Second
+		}, []string{"TOKEN_CACHE_MAX_ENTRIES", "TOKEN_CACHE_MAX_BYTES", "TOKEN_CACHE_CLEANUP_INTERVAL", "TOKEN_NEGATIVE_CACHE_EXPIRY"}},
+		{"Max staleness below the revalidation window", func(c *Config) {
+			c.TokenCacheStaleWhileRevalidate = time.Minute
+			c.TokenCacheMaxStale = time.Second
+		}, []string{"TOKEN_CACHE_MAX_STALE"}},
+		{"Invalid token cache backend", func(c *Config) {
+			c.TokenCacheBackend = "memcached"
+			c.TokenFingerprintKey = "short"
+		}, []string{"TOKEN_CACHE_BACKEND", "TOKEN_FINGERPRINT_KEY"}},
+		{"Redis token cache without URL or fingerprint key", func(c *Config) {
+			c.TokenCacheBackend = TokenCacheRedis
+		}, []string{"TOKEN_CACHE_REDIS_URL", "TOKEN_FINGERPRINT_KEY"}},
+		{"Redis token cache with an invalid URL", func(c *Config) {
+			c.TokenCacheBackend = TokenCacheRedis
+			c.TokenCacheRedisURL = "http://:secret@cache:6379"
+			c.TokenFingerprintKey = strings.Repeat("k", MinSecretLength)
+		}, []string{"TOKEN_CACHE_REDIS_URL"}},
+		{"Invalid token provider client settings", func(c *Config) {
+			c.TokenUpstreamTimeout = -time.Second
+			c.TokenUpstreamMaxRetries = -1
+			c.TokenUpstreamFailureThreshold = 3
+		}, []string{"TOKEN_UPSTREAM_TIMEOUT", "TOKEN_UPSTREAM_MAX_RETRIES", "TOKEN_UPSTREAM_OPEN_TIMEOUT"}},
+		{"Invalid profile mappers", func(c *Config) {
+			c.ProfileMappers = []ProfileMapper{
+				{Name: "github", IDPath: "id"},
+				{Name: "auth0", Claims: []string{"tenant"}},
+			}
+			c.TokenProfileMapper = "okta"
+			c.OIDCProfileMapper = "auth0"
+		}, []string{"profile_mappers[0].name", "profile_mappers[1].id_path", "profile_mappers[1].claims", "TOKEN_PROFILE_MAPPER"}},
+		{"Missing OIDC_ISSUER with the oidc verifier", func(c *Config) {
+			c.OIDCIssuer = ""
+			c.OIDCAudience = "api"
+			c.TokenVerifiers = []string{VerifierOIDC}
+		}, []string{"OIDC_ISSUER"}},
+		{"Missing OIDC_AUDIENCE with the oidc verifier", func(c *Config) {
+			c.TokenVerifiers = []string{VerifierOIDC}
+		}, []string{"OIDC_AUDIENCE"}},
+		{"OAUTH_CLIENT_ID as the oidc audience", func(c *Config) {
+			c.OAuthClientID = "client"
+			c.OAuthScopes = []string{"openid"}
+			c.TokenVerifiers = []string{VerifierOIDC}
+		}, nil},
+		{"Login flow without openid scope", func(c *Config) {
+			c.OAuthClientID = "client"
+			c.OAuthScopes = []string{"email"}
+			c.OAuthRedirectURL = ""
+		}, []string{"OAUTH_REDIRECT_URL", "OAUTH_SCOPES"}},
+		{"Invalid API keys", func(c *Config) {
+			c.APIKeys = []APIKey{
+				{ID: "a", Owner: "acme", Hash: strings.Repeat("0", 64)},
+				{ID: "a", Hash: "not-a-hash"},
+			}
+		}, []string{"api_keys[1].id", "api_keys[1].owner", "api_keys[1].hash"}},
+		{"Invalid clients and users", func(c *Config) {
+			c.Clients = []Client{
+				{ID: "web", SecretHash: strings.Repeat("0", 64), GrantTypes: []string{GrantPassword}},
+				{ID: "web", SecretHash: "plaintext", GrantTypes: []string{"implicit"}, AccessTokenExpiry: -time.Minute},
+			}
+			c.Users = []User{
+				{ID: "1", Username: "jane", PasswordHash: "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy"},
+				{Username: "jane", PasswordHash: "secret"},
+			}
+		}, []string{"clients[1].id", "clients[1].secret_hash", "clients[1].grant_types", "clients[1].access_token_expiry", "users[1].id", "users[1].username", "users[1].password_hash"}},
+		{"Malformed URLs", func(c *Config) {
+			c.OIDCIssuer = "accounts.google.com"
+			c.OAuthRedirectURL = "://callback"
+		}, []string{"OIDC_ISSUER", "OAUTH_REDIRECT_URL"}},
+		{"Default secrets in release", func(c *Config) { c.GinMode = "release" }, []string{"JWT_SECRET"}},
+		{"Short secrets in release", func(c *Config) {
+			c.GinMode = "release"
+			c.JWTSecret = "too-short"
+		}, []string{"JWT_SECRET"}},
+		{"Signing key instead of JWT_SECRET in release", func(c *Config) {
+			c.GinMode = "release"
+			c.JWTSigningKey = "testdata/missing.pem"
+		}, []string{"JWT_SIGNING_KEY"}},
+		{"Non-positive numbers", func(c *Config) {
+			c.RateLimitRequests = 0
+			c.RateLimitDuration = 0
+			c.Port = "http"
+		}, []string{"RATE_LIMIT_REQUESTS", "RATE_LIMIT_DURATION", "PORT"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig()
+			tt.modify(cfg)
+
+			err := cfg.Validate()
+			if tt.expectedFields == nil {
+				if err != nil {
+					t.Fatalf("Validate() returned an error: %v", err)
+				}
+				return
+			}
+
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) {
+				t.Fatalf("Validate() = %v, want a *ValidationError", err)
+			}
+			var fields []string
+			for _, fe := range validationErr.Errors {
+				fields = append(fields, fe.Field)
+			}
+			if strings.Join(fields, ",") != strings.Join(tt.expectedFields, ",") {
+				t.Errorf("Validate() reported %v, want %v", fields, tt.expectedFields)
+			}
+		})
+	}
+}
+
+func TestValidationErrorDoesNotLeakSecrets(t *testing.T) {
+	cfg := validConfig()
+	cfg.GinMode = "release"
+	cfg.JWTSecret = "hunter2"
+
+	err := cfg.Validate()
+	if err == nil || strings.Contains(err.Error(), "hunter2") {
+		t.Errorf("Validate() = %v, want an error without the secret value", err)
+	}
+}
+
+func TestLoadConfigAggregatesErrors(t *testing.T) {
+	t.Setenv("TOKEN_URL", "")
+	t.Setenv("RATE_LIMIT_REQUESTS", "ten")
+	t.Setenv("TOKEN_CACHE_EXPIRY", "5 minutes")
+	t.Setenv("OIDC_ISSUER", "not a url")
+
+	cfg, err := LoadConfig()
+	if cfg != nil {
+		t.Errorf("LoadConfig() returned a config along with an error")
+	}
+
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("LoadConfig() = %v, want a *ValidationError", err)
+	}
+	if len(validationErr.Errors) != 4 {
+		t.Errorf("LoadConfig() reported %d problems, want 4:\n%v", len(validationErr.Errors), err)
+	}
+	for _, field := range []string{"RATE_LIMIT_REQUESTS", "TOKEN_CACHE_EXPIRY", "TOKEN_URL", "OIDC_ISSUER"} {
+		if !strings.Contains(err.Error(), field+":") {
+			t.Errorf("LoadConfig() error does not mention %s:\n%v", field, err)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APIKeyPrefix starts every API key, so that keys are easy to recognise in
+// requests and to find with secret scanners
+const APIKeyPrefix = "ak_"
+
+// lastUsedInterval limits how often the last used timestamp of a key is
+// written, so that busy keys do not turn every request into a store write
+const lastUsedInterval = time.Minute
+
+var (
+	// ErrInvalidAPIKey is returned for malformed, unknown or revoked keys
+	ErrInvalidAPIKey = errors.New("invalid API key")
+	// ErrAPIKeyExpired is returned for keys past their expiry
+	ErrAPIKeyExpired = errors.New("API key expired")
+	// ErrAPIKeyNotFound is returned by stores for unknown key IDs
+	ErrAPIKeyNotFound = errors.New("API key not found")
+)
+
+// APIKey is a stored API key. Only the SHA-256 hash of the key is kept; the
+// plaintext is shown once when the key is created.
+//
+// A key reads "ak_<id>_<secret>". The ID is stored in clear and used to look
+// the key up, the secret only exists in the hash.
+type APIKey struct {
+	ID     string
+	Owner  string
+	Name   string
+	Hash   string
+	Scopes []string
+	// ExpiresAt is zero for keys that do not expire
+	ExpiresAt  time.Time
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+}
+
+// Expired reports whether the key is past its expiry at t
+func (k *APIKey) Expired(t time.Time) bool {
+	return !k.ExpiresAt.IsZero() && !t.Before(k.ExpiresAt)
+}
+
+// HasScope reports whether the key was granted scope
+func (k *APIKey) HasScope(scope string) bool {
+	return slices.Contains(k.Scopes, scope)
+}
+
+// APIKeyStore persists API keys
+type APIKeyStore interface {
+	// Get returns the key with the given ID or ErrAPIKeyNotFound
+	Get(ctx context.Context, id string) (*APIKey, error)
+	// Put creates or replaces a key
+	Put(ctx context.Context, key *APIKey) error
+	// Delete removes a key. Deleting an unknown key is not an error.
+	Delete(ctx context.Context, id string) error
+	// List returns the keys of owner, or every key when owner is empty
+	List(ctx context.Context, owner string) ([]*APIKey, error)
+	// Touch records that the key was used at t
+	Touch(ctx context.Context, id string, t time.Time) error
+}
+
+// NewAPIKey generates a key for owner. The plaintext is returned separately
+// and must be handed to the client; it cannot be recovered from the key.
+func NewAPIKey(owner, name string, scopes []string, expiresAt time.Time) (string, *APIKey, error) {
+	id := make([]byte, 6)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+	secret, err := RandomString(32)
+	if err != nil {
+		return "", nil, err
+	}
+
+	plaintext := APIKeyPrefix + hex.EncodeToString(id) + "_" + secret
+	return plaintext, &APIKey{
+		ID:        hex.EncodeToString(id),
+		Owner:     owner,
+		Name:      name,
+		Hash:      HashAPIKey(plaintext),
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// HashAPIKey returns the hex encoded SHA-256 hash of a plaintext key. API
+// keys carry 256 bits of entropy, so a fast hash is enough.
+func HashAPIKey(plaintext string) string {
+	sum := sha256.Sum256([]byte(plaintext))
+	return hex.EncodeToString(sum[:])
+}
+
+// ParseAPIKeyID returns the lookup ID of a plaintext key
+func ParseAPIKeyID(plaintext string) (string, bool) {
+	return splitOpaqueToken(APIKeyPrefix, plaintext)
+}
+
+// VerifyAPIKey resolves a plaintext key to its stored key. It checks the
+// hash in constant time and the expiry, and records when the key was used.
+func VerifyAPIKey(ctx context.Context, store APIKeyStore, plaintext string) (*APIKey, error) {
+	id, ok := ParseAPIKeyID(plaintext)
+	if !ok {
+		return nil, ErrInvalidAPIKey
+	}
+
+	key, err := store.Get(ctx, id)
+	if errors.Is(err, ErrAPIKeyNotFound) {
+		return nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(HashAPIKey(plaintext)), []byte(strings.ToLower(key.Hash))) != 1 {
+		return nil, ErrInvalidAPIKey
+	}
+	now := time.Now()
+	if key.Expired(now) {
+		return nil, ErrAPIKeyExpired
+	}
+
+	if now.Sub(key.LastUsedAt) >= lastUsedInterval {
+		if err := store.Touch(ctx, id, now); err != nil {
+			return nil, err
+		}
+		key.LastUsedAt = now
+	}
+	return key, nil
+}
+
+// RotateAPIKey creates a new key with the owner, name and scopes of the key
+// with the given ID, and makes the old key expire after overlap so that
+// clients can switch without downtime. A zero overlap revokes the old key
+// immediately.
+func RotateAPIKey(ctx context.Context, store APIKeyStore, id string, overlap time.Duration) (string, *APIKey, error) {
+	old, err := store.Get(ctx, id)
+	if err != nil {
+		return "", nil, err
+	}
+
+	plaintext, key, err := NewAPIKey(old.Owner, old.Name, old.Scopes, old.ExpiresAt)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := store.Put(ctx, key); err != nil {
+		return "", nil, err
+	}
+
+	if overlap <= 0 {
+		if err := store.Delete(ctx, id); err != nil {
+			return "", nil, err
+		}
+		return plaintext, key, nil
+	}
+	if expiresAt := time.Now().Add(overlap); old.ExpiresAt.IsZero() || expiresAt.Before(old.ExpiresAt) {
+		old.ExpiresAt = expiresAt
+		if err := store.Put(ctx, old); err != nil {
+			return "", nil, err
+		}
+	}
+	return plaintext, key, nil
+}
+
+// MemoryAPIKeyStore keeps API keys in memory
+type MemoryAPIKeyStore struct {
+	mu   sync.RWMutex
+	keys map[string]APIKey
+}
+
+// NewMemoryAPIKeyStore returns a store holding keys
+func NewMemoryAPIKeyStore(keys ...*APIKey) *MemoryAPIKeyStore {
+	s := &MemoryAPIKeyStore{keys: make(map[string]APIKey, len(keys))}
+	for _, key := range keys {
+		_ = s.Put(context.Background(), key)
+	}
+	return s
+}
+
+// Get implements APIKeyStore
+func (s *MemoryAPIKeyStore) Get(_ context.Context, id string) (*APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key, ok := s.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrAPIKeyNotFound, id)
+	}
+	return &key, nil
+}
+
+// Put implements APIKeyStore
+func (s *MemoryAPIKeyStore) Put(_ context.Context, key *APIKey) error {
+	if key.ID == "" {
+		return errors.New("API key ID is required")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored := *key
+	stored.Scopes = slices.Clone(key.Scopes)
+	s.keys[key.ID] = stored
+	return nil
+}
+
+// Delete implements APIKeyStore
+func (s *MemoryAPIKeyStore) Delete(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.keys, id)
+	return nil
+}
+
+// List implements APIKeyStore. Keys are sorted by creation time.
+func (s *MemoryAPIKeyStore) List(_ context.Context, owner string) ([]*APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var keys []*APIKey
+	for _, key := range s.keys {
+		if owner == "" || key.Owner == owner {
+			key := key
+			keys = append(keys, &key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].ID < keys[j].ID
+		}
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+// Touch implements APIKeyStore
+func (s *MemoryAPIKeyStore) Touch(_ context.Context, id string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.keys[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrAPIKeyNotFound, id)
+	}
+	key.LastUsedAt = t
+	s.keys[id] = key
+	return nil
+}
@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyAPIKey(t *testing.T) {
+	ctx := context.Background()
+
+	plaintext, key, err := NewAPIKey("acme", "ci", []string{"orders:read"}, time.Time{})
+	if err != nil {
+		t.Fatalf("NewAPIKey() returned an error: %v", err)
+	}
+	expiredPlaintext, expiredKey, err := NewAPIKey("acme", "old", nil, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("NewAPIKey() returned an error: %v", err)
+	}
+	store := NewMemoryAPIKeyStore(key, expiredKey)
+
+	if !strings.HasPrefix(plaintext, APIKeyPrefix+key.ID+"_") {
+		t.Errorf("Expected the key to start with its ID, got %q", plaintext)
+	}
+	if strings.Contains(key.Hash, plaintext) || key.Hash != HashAPIKey(plaintext) {
+		t.Errorf("Expected only the hash of the key to be stored")
+	}
+
+	tests := []struct {
+		name        string
+		plaintext   string
+		expectedErr error
+	}{
+		{"Valid key", plaintext, nil},
+		{"Wrong secret", APIKeyPrefix + key.ID + "_wrong", ErrInvalidAPIKey},
+		{"Unknown ID", APIKeyPrefix + "000000000000_secret", ErrInvalidAPIKey},
+		{"Expired key", expiredPlaintext, ErrAPIKeyExpired},
+		{"Not an API key", "Bearer token", ErrInvalidAPIKey},
+		{"Missing secret", APIKeyPrefix + key.ID, ErrInvalidAPIKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := VerifyAPIKey(ctx, store, tt.plaintext)
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("VerifyAPIKey() error = %v, want %v", err, tt.expectedErr)
+			}
+			if err == nil && (got.Owner != "acme" || !got.HasScope("orders:read")) {
+				t.Errorf("Unexpected key: %+v", got)
+			}
+		})
+	}
+
+	stored, err := store.Get(ctx, key.ID)
+	if err != nil {
+		t.Fatalf("Get() returned an error: %v", err)
+	}
+	if stored.LastUsedAt.IsZero() {
+		t.Errorf("Expected the last used timestamp to be recorded")
+	}
+}
+
+func TestRotateAPIKey(t *testing.T) {
+	ctx := context.Background()
+
+	oldPlaintext, oldKey, err := NewAPIKey("acme", "ci", []string{"orders:read"}, time.Time{})
+	if err != nil {
+		t.Fatalf("NewAPIKey() returned an error: %v", err)
+	}
+	store := NewMemoryAPIKeyStore(oldKey)
+
+	newPlaintext, newKey, err := RotateAPIKey(ctx, store, oldKey.ID, time.Hour)
+	if err != nil {
+		t.Fatalf("RotateAPIKey() returned an error: %v", err)
+	}
+	if newKey.Owner != "acme" || !newKey.HasScope("orders:read") || newKey.ID == oldKey.ID {
+		t.Errorf("Unexpected rotated key: %+v", newKey)
+	}
+
+	// Both keys work during the overlap
+	for _, plaintext := range []string{oldPlaintext, newPlaintext} {
+		if _, err := VerifyAPIKey(ctx, store, plaintext); err != nil {
+			t.Errorf("VerifyAPIKey() returned an error during the overlap: %v", err)
+		}
+	}
+	keys, _ := store.List(ctx, "acme")
+	if len(keys) != 2 {
+		t.Errorf("Expected 2 active keys for the owner, got %d", len(keys))
+	}
+	old, _ := store.Get(ctx, oldKey.ID)
+	if old.ExpiresAt.IsZero() || old.ExpiresAt.After(time.Now().Add(time.Hour)) {
+		t.Errorf("Expected the old key to expire after the overlap, got %v", old.ExpiresAt)
+	}
+
+	// Without an overlap the old key is revoked immediately
+	_, _, err = RotateAPIKey(ctx, store, newKey.ID, 0)
+	if err != nil {
+		t.Fatalf("RotateAPIKey() returned an error: %v", err)
+	}
+	if _, err := VerifyAPIKey(ctx, store, newPlaintext); !errors.Is(err, ErrInvalidAPIKey) {
+		t.Errorf("VerifyAPIKey() error = %v, want %v", err, ErrInvalidAPIKey)
+	}
+}
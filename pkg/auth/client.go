@@ -0,0 +1,212 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Grant types accepted by the token endpoint
+const (
+	GrantClientCredentials = "client_credentials"
+	GrantPassword          = "password"
+	GrantRefreshToken      = "refresh_token"
+)
+
+var (
+	// ErrInvalidClient is returned for unknown clients and wrong secrets
+	ErrInvalidClient = errors.New("invalid client")
+	// ErrClientNotFound is returned by stores for unknown client IDs
+	ErrClientNotFound = errors.New("client not found")
+	// ErrInvalidScope is returned when a client requests a scope it was not
+	// granted
+	ErrInvalidScope = errors.New("invalid scope")
+	// ErrInvalidCredentials is returned for unknown users and wrong
+	// passwords
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	// ErrUserNotFound is returned by stores for unknown usernames
+	ErrUserNotFound = errors.New("user not found")
+)
+
+// Client is an application allowed to request tokens. Only the SHA-256
+// hash of its secret is kept.
+type Client struct {
+	ID         string
+	Name       string
+	SecretHash string
+	// Scopes are the scopes the client may request. Tokens get every one of
+	// them when the request does not name any.
+	Scopes []string
+	// GrantTypes are the grants the client may use. An empty list only
+	// allows the client_credentials grant.
+	GrantTypes []string
+	// AccessTokenExpiry overrides the lifetime of the access tokens issued
+	// to the client when not zero
+	AccessTokenExpiry time.Duration
+}
+
+// AllowsGrant reports whether the client may use grant
+func (c *Client) AllowsGrant(grant string) bool {
+	if len(c.GrantTypes) == 0 {
+		return grant == GrantClientCredentials
+	}
+	return slices.Contains(c.GrantTypes, grant)
+}
+
+// GrantScopes returns the scopes to grant for the requested ones, or
+// ErrInvalidScope when the client may not request one of them
+func (c *Client) GrantScopes(requested []string) ([]string, error) {
+	if len(requested) == 0 {
+		return slices.Clone(c.Scopes), nil
+	}
+	for _, scope := range requested {
+		if !slices.Contains(c.Scopes, scope) {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidScope, scope)
+		}
+	}
+	return requested, nil
+}
+
+// ClientStore looks clients up
+type ClientStore interface {
+	// GetClient returns the client with the given ID or ErrClientNotFound
+	GetClient(ctx context.Context, id string) (*Client, error)
+}
+
+// HashClientSecret returns the hex encoded SHA-256 hash of a client
+// secret. Secrets are generated with NewClientSecret and carry 256 bits of
+// entropy, so a fast hash is enough.
+func HashClientSecret(secret string) string {
+	return HashAPIKey(secret)
+}
+
+// NewClientSecret generates a client secret
+func NewClientSecret() (string, error) {
+	return RandomString(32)
+}
+
+// AuthenticateClient returns the client with the given ID if secret
+// matches, or ErrInvalidClient
+func AuthenticateClient(ctx context.Context, store ClientStore, id, secret string) (*Client, error) {
+	if id == "" || secret == "" {
+		return nil, ErrInvalidClient
+	}
+
+	client, err := store.GetClient(ctx, id)
+	if errors.Is(err, ErrClientNotFound) {
+		return nil, ErrInvalidClient
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(HashClientSecret(secret)), []byte(strings.ToLower(client.SecretHash))) != 1 {
+		return nil, ErrInvalidClient
+	}
+	return client, nil
+}
+
+// MemoryClientStore keeps clients in memory
+type MemoryClientStore struct {
+	mu      sync.RWMutex
+	clients map[string]Client
+}
+
+// NewMemoryClientStore returns a store holding clients
+func NewMemoryClientStore(clients ...*Client) *MemoryClientStore {
+	s := &MemoryClientStore{clients: make(map[string]Client, len(clients))}
+	for _, client := range clients {
+		s.clients[client.ID] = *client
+	}
+	return s
+}
+
+// GetClient implements ClientStore
+func (s *MemoryClientStore) GetClient(_ context.Context, id string) (*Client, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	client, ok := s.clients[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrClientNotFound, id)
+	}
+	return &client, nil
+}
+
+// Account is a user that can log in with a password. Only the bcrypt hash
+// of the password is kept.
+type Account struct {
+	User
+	PasswordHash string
+}
+
+// UserStore looks accounts up for the password grant
+type UserStore interface {
+	// FindUser returns the account with the given username or
+	// ErrUserNotFound
+	FindUser(ctx context.Context, username string) (*Account, error)
+}
+
+// HashPassword returns the bcrypt hash of password
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// unknownUserHash is compared against when the user does not exist, so
+// that response times do not reveal which usernames are taken
+var unknownUserHash, _ = bcrypt.GenerateFromPassword([]byte("unknown user"), bcrypt.DefaultCost)
+
+// VerifyPassword returns the user with the given username if password
+// matches, or ErrInvalidCredentials
+func VerifyPassword(ctx context.Context, store UserStore, username, password string) (*User, error) {
+	account, err := store.FindUser(ctx, username)
+	if errors.Is(err, ErrUserNotFound) {
+		_ = bcrypt.CompareHashAndPassword(unknownUserHash, []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(account.PasswordHash), []byte(password)) != nil {
+		return nil, ErrInvalidCredentials
+	}
+	user := account.User
+	return &user, nil
+}
+
+// MemoryUserStore keeps accounts in memory
+type MemoryUserStore struct {
+	mu       sync.RWMutex
+	accounts map[string]Account
+}
+
+// NewMemoryUserStore returns a store holding accounts, looked up by
+// username
+func NewMemoryUserStore(accounts ...*Account) *MemoryUserStore {
+	s := &MemoryUserStore{accounts: make(map[string]Account, len(accounts))}
+	for _, account := range accounts {
+		s.accounts[account.Username] = *account
+	}
+	return s
+}
+
+// FindUser implements UserStore
+func (s *MemoryUserStore) FindUser(_ context.Context, username string) (*Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	account, ok := s.accounts[username]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUserNotFound, username)
+	}
+	return &account, nil
+}
@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAuthenticateClient(t *testing.T) {
+	ctx := context.Background()
+
+	secret, err := NewClientSecret()
+	if err != nil {
+		t.Fatalf("NewClientSecret() returned an error: %v", err)
+	}
+	store := NewMemoryClientStore(&Client{ID: "billing", SecretHash: HashClientSecret(secret)})
+
+	tests := []struct {
+		name        string
+		id, secret  string
+		expectedErr error
+	}{
+		{"Valid secret", "billing", secret, nil},
+		{"Wrong secret", "billing", "wrong", ErrInvalidClient},
+		{"Unknown client", "shipping", secret, ErrInvalidClient},
+		{"Missing secret", "billing", "", ErrInvalidClient},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := AuthenticateClient(ctx, store, tt.id, tt.secret)
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("AuthenticateClient() error = %v, want %v", err, tt.expectedErr)
+			}
+			if err == nil && client.ID != "billing" {
+				t.Errorf("Unexpected client: %+v", client)
+			}
+		})
+	}
+}
+
+func TestClientGrants(t *testing.T) {
+	machine := &Client{Scopes: []string{"orders:read", "orders:write"}}
+	if !machine.AllowsGrant(GrantClientCredentials) || machine.AllowsGrant(GrantPassword) {
+		t.Errorf("Expected clients without grant types to only allow %s", GrantClientCredentials)
+	}
+
+	web := &Client{GrantTypes: []string{GrantPassword}}
+	if web.AllowsGrant(GrantClientCredentials) || !web.AllowsGrant(GrantPassword) {
+		t.Errorf("Expected clients to only allow their grant types")
+	}
+
+	scopes, err := machine.GrantScopes(nil)
+	if err != nil || !slices.Equal(scopes, machine.Scopes) {
+		t.Errorf("GrantScopes(nil) = %v, %v, want every scope of the client", scopes, err)
+	}
+	scopes, err = machine.GrantScopes([]string{"orders:read"})
+	if err != nil || !slices.Equal(scopes, []string{"orders:read"}) {
+		t.Errorf("GrantScopes() = %v, %v, want the requested scope", scopes, err)
+	}
+	if _, err := machine.GrantScopes([]string{"orders:read", "admin"}); !errors.Is(err, ErrInvalidScope) {
+		t.Errorf("GrantScopes() error = %v, want %v", err, ErrInvalidScope)
+	}
+}
+
+func TestVerifyPassword(t *testing.T) {
+	ctx := context.Background()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword() returned an error: %v", err)
+	}
+	store := NewMemoryUserStore(&Account{
+		User:         User{ID: "42", Username: "jane", Email: "jane@example.com"},
+		PasswordHash: string(hash),
+	})
+
+	user, err := VerifyPassword(ctx, store, "jane", "correct horse")
+	if err != nil {
+		t.Fatalf("VerifyPassword() returned an error: %v", err)
+	}
+	if user.ID != "42" || user.Email != "jane@example.com" {
+		t.Errorf("Unexpected user: %+v", user)
+	}
+
+	if _, err := VerifyPassword(ctx, store, "jane", "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("VerifyPassword() error = %v, want %v", err, ErrInvalidCredentials)
+	}
+	if _, err := VerifyPassword(ctx, store, "joe", "correct horse"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("VerifyPassword() error = %v, want %v", err, ErrInvalidCredentials)
+	}
+}
+
+func TestTokenIssuerClientGrant(t *testing.T) {
+	ctx := context.Background()
+	issuer := NewTokenIssuer([]byte("secret"), NewMemoryTokenStore(), TokenIssuerOptions{
+		AccessTokenExpiry:  time.Hour,
+		RefreshTokenExpiry: time.Hour,
+	})
+
+	pair, err := issuer.IssueGrant(ctx, Grant{
+		User:              User{ID: "42"},
+		ClientID:          "web",
+		Scopes:            []string{"profile"},
+		AccessTokenExpiry: time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("IssueGrant() returned an error: %v", err)
+	}
+	if pair.ExpiresIn != time.Minute {
+		t.Errorf("Expected the client expiry to override the default, got %v", pair.ExpiresIn)
+	}
+
+	if _, err := issuer.Refresh(ctx, pair.RefreshToken, "mobile"); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Fatalf("Refresh() by another client error = %v, want %v", err, ErrInvalidRefreshToken)
+	}
+	refreshed, err := issuer.Refresh(ctx, pair.RefreshToken, "web")
+	if err != nil {
+		t.Fatalf("Refresh() returned an error: %v", err)
+	}
+
+	claims, err := ParseJWT(refreshed.AccessToken, []byte("secret"), VerifyOptions{})
+	if err != nil {
+		t.Fatalf("ParseJWT() returned an error: %v", err)
+	}
+	if claims.ClientID != "web" || claims.Scope != "profile" || refreshed.ExpiresIn != time.Minute {
+		t.Errorf("Expected refreshed tokens to keep the grant, got %+v", claims)
+	}
+
+	pair, err = issuer.IssueGrant(ctx, Grant{User: User{ID: "web"}, ClientID: "web", NoRefreshToken: true})
+	if err != nil {
+		t.Fatalf("IssueGrant() returned an error: %v", err)
+	}
+	if pair.RefreshToken != "" {
+		t.Errorf("Expected no refresh token, got %q", pair.RefreshToken)
+	}
+}
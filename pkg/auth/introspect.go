@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Token types reported by introspection
+const (
+	TokenTypeAccessToken  = "access_token"
+	TokenTypeRefreshToken = "refresh_token"
+	TokenTypeAPIKey       = "api_key"
+)
+
+// Introspection describes a token as in RFC 7662. Inactive tokens only
+// carry Active, so that nothing is revealed about invalid, expired or
+// revoked tokens.
+type Introspection struct {
+	Active    bool     `json:"active"`
+	Scope     string   `json:"scope,omitempty"`
+	ClientID  string   `json:"client_id,omitempty"`
+	Username  string   `json:"username,omitempty"`
+	TokenType string   `json:"token_type,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Audience  []string `json:"aud,omitempty"`
+	Issuer    string   `json:"iss,omitempty"`
+	ID        string   `json:"jti,omitempty"`
+	// Email and Roles extend RFC 7662 with the profile of the user
+	Email string   `json:"email,omitempty"`
+	Roles []string `json:"roles,omitempty"`
+}
+
+// Introspect describes an access or refresh token issued by i. Tokens that
+// are invalid, expired or revoked, and refresh tokens that were already
+// exchanged, are inactive.
+func (i *TokenIssuer) Introspect(ctx context.Context, token string) (*Introspection, error) {
+	if strings.HasPrefix(token, RefreshTokenPrefix) {
+		stored, err := i.lookup(ctx, token)
+		if errors.Is(err, ErrInvalidRefreshToken) {
+			return &Introspection{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if stored.Used {
+			return &Introspection{}, nil
+		}
+		return &Introspection{
+			Active:    true,
+			Scope:     strings.Join(stored.Scopes, " "),
+			ClientID:  stored.ClientID,
+			Username:  stored.User.Username,
+			TokenType: TokenTypeRefreshToken,
+			ExpiresAt: stored.ExpiresAt.Unix(),
+			Subject:   stored.User.ID,
+			Issuer:    i.opts.Issuer,
+			Email:     stored.User.Email,
+			Roles:     stored.User.Roles,
+		}, nil
+	}
+
+	claims, err := ParseJWT(token, i.secret, VerifyOptions{Issuer: i.opts.Issuer, Keys: i.opts.Keys})
+	if err != nil {
+		return &Introspection{}, nil
+	}
+	revoked, err := IsTokenRevoked(ctx, i.store, claims)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return &Introspection{}, nil
+	}
+
+	result := &Introspection{
+		Active:    true,
+		Scope:     claims.Scope,
+		ClientID:  claims.ClientID,
+		Username:  claims.Username,
+		TokenType: TokenTypeAccessToken,
+		Subject:   claims.Subject,
+		Audience:  claims.Audience,
+		Issuer:    claims.Issuer,
+		ID:        claims.ID,
+		Email:     claims.Email,
+		Roles:     claims.Roles,
+	}
+	if claims.ExpiresAt != nil {
+		result.ExpiresAt = claims.ExpiresAt.Unix()
+	}
+	if claims.IssuedAt != nil {
+		result.IssuedAt = claims.IssuedAt.Unix()
+	}
+	if claims.NotBefore != nil {
+		result.NotBefore = claims.NotBefore.Unix()
+	}
+	return result, nil
+}
+
+// IntrospectAPIKey describes an API key of store. Unknown, revoked and
+// expired keys are inactive.
+func IntrospectAPIKey(ctx context.Context, store APIKeyStore, plaintext string) (*Introspection, error) {
+	key, err := VerifyAPIKey(ctx, store, plaintext)
+	if errors.Is(err, ErrInvalidAPIKey) || errors.Is(err, ErrAPIKeyExpired) {
+		return &Introspection{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Introspection{
+		Active:    true,
+		Scope:     strings.Join(key.Scopes, " "),
+		TokenType: TokenTypeAPIKey,
+		Subject:   key.Owner,
+		ID:        key.ID,
+	}
+	if !key.ExpiresAt.IsZero() {
+		result.ExpiresAt = key.ExpiresAt.Unix()
+	}
+	if !key.CreatedAt.IsZero() {
+		result.IssuedAt = key.CreatedAt.Unix()
+	}
+	return result, nil
+}
+
+// Expiry returns the expiry of an active token, or the zero time when it
+// does not expire
+func (r *Introspection) Expiry() time.Time {
+	if r.ExpiresAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(r.ExpiresAt, 0)
+}
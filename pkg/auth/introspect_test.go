@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTokenIssuerIntrospect(t *testing.T) {
+	ctx := context.Background()
+	issuer := NewTokenIssuer([]byte("secret"), NewMemoryTokenStore(), TokenIssuerOptions{
+		AccessTokenExpiry:  time.Hour,
+		RefreshTokenExpiry: time.Hour,
+		Issuer:             "go-rest-api",
+	})
+
+	pair, err := issuer.IssueGrant(ctx, Grant{
+		User:     User{ID: "42", Username: "jane", Email: "jane@example.com", Roles: []string{"admin"}},
+		ClientID: "web",
+		Scopes:   []string{"profile", "orders:read"},
+	})
+	if err != nil {
+		t.Fatalf("IssueGrant() returned an error: %v", err)
+	}
+
+	access, err := issuer.Introspect(ctx, pair.AccessToken)
+	if err != nil {
+		t.Fatalf("Introspect() returned an error: %v", err)
+	}
+	if !access.Active || access.Subject != "42" || access.Scope != "profile orders:read" || access.ClientID != "web" ||
+		access.TokenType != TokenTypeAccessToken || access.Issuer != "go-rest-api" || access.ID == "" || access.Roles[0] != "admin" {
+		t.Errorf("Unexpected access token introspection: %+v", access)
+	}
+	if time.Until(access.Expiry()) > time.Hour || time.Until(access.Expiry()) < 59*time.Minute {
+		t.Errorf("Unexpected expiry %v", access.Expiry())
+	}
+
+	refresh, err := issuer.Introspect(ctx, pair.RefreshToken)
+	if err != nil {
+		t.Fatalf("Introspect() returned an error: %v", err)
+	}
+	if !refresh.Active || refresh.Subject != "42" || refresh.TokenType != TokenTypeRefreshToken || refresh.ClientID != "web" {
+		t.Errorf("Unexpected refresh token introspection: %+v", refresh)
+	}
+
+	// Exchanged refresh tokens and revoked access tokens are inactive
+	if _, err := issuer.Refresh(ctx, pair.RefreshToken, "web"); err != nil {
+		t.Fatalf("Refresh() returned an error: %v", err)
+	}
+	if err := issuer.Revoke(ctx, pair.AccessToken); err != nil {
+		t.Fatalf("Revoke() returned an error: %v", err)
+	}
+	for name, token := range map[string]string{
+		"used refresh token":   pair.RefreshToken,
+		"revoked access token": pair.AccessToken,
+		"garbage":              "garbage",
+		"unknown refresh":      RefreshTokenPrefix + "unknown_secret",
+	} {
+		result, err := issuer.Introspect(ctx, token)
+		if err != nil {
+			t.Fatalf("Introspect() of the %s returned an error: %v", name, err)
+		}
+		if !reflect.DeepEqual(*result, Introspection{}) {
+			t.Errorf("Expected the %s to be inactive without details, got %+v", name, result)
+		}
+	}
+}
+
+func TestIntrospectAPIKey(t *testing.T) {
+	ctx := context.Background()
+	plaintext, key, err := NewAPIKey("acme", "ci", []string{"orders:read"}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("NewAPIKey() returned an error: %v", err)
+	}
+	store := NewMemoryAPIKeyStore(key)
+
+	result, err := IntrospectAPIKey(ctx, store, plaintext)
+	if err != nil {
+		t.Fatalf("IntrospectAPIKey() returned an error: %v", err)
+	}
+	if !result.Active || result.Subject != "acme" || result.Scope != "orders:read" || result.TokenType != TokenTypeAPIKey || result.ExpiresAt == 0 {
+		t.Errorf("Unexpected introspection: %+v", result)
+	}
+
+	result, err = IntrospectAPIKey(ctx, store, APIKeyPrefix+key.ID+"_wrong")
+	if err != nil || result.Active {
+		t.Errorf("IntrospectAPIKey() = %+v, %v, want an inactive key", result, err)
+	}
+}
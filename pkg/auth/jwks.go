@@ -0,0 +1,226 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrIssuerUnavailable is returned when the discovery document or the JWKS
+// of an issuer cannot be fetched
+var ErrIssuerUnavailable = errors.New("issuer unavailable")
+
+// ErrUnknownKey is returned when a token is signed with a key that is not in
+// the JWKS, even after refreshing it
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// DefaultMinRefreshInterval is the minimum time between two JWKS fetches
+// triggered by tokens signed with an unknown key
+const DefaultMinRefreshInterval = time.Minute
+
+// KeySet is a JSON Web Key Set fetched from a URL. Keys are cached and the
+// set is fetched again when a token refers to an unknown kid, at most once
+// per MinRefreshInterval, so that rotated keys are picked up without letting
+// bogus tokens hammer the issuer. While the last fetch failed, unknown kids
+// are reported as ErrIssuerUnavailable rather than ErrUnknownKey.
+type KeySet struct {
+	url                string
+	client             *http.Client
+	minRefreshInterval time.Duration
+
+	mu        sync.RWMutex
+	keys      map[string]crypto.PublicKey
+	lastFetch time.Time
+	fetchErr  error
+
+	// fetchMu serializes fetches so concurrent misses share one request
+	fetchMu sync.Mutex
+}
+
+// NewKeySet returns a KeySet for the JWKS at url. Keys are fetched on first
+// use. A nil client uses a client with a 10 second timeout and a zero
+// minRefreshInterval uses DefaultMinRefreshInterval.
+func NewKeySet(url string, client *http.Client, minRefreshInterval time.Duration) *KeySet {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if minRefreshInterval <= 0 {
+		minRefreshInterval = DefaultMinRefreshInterval
+	}
+	return &KeySet{
+		url:                url,
+		client:             client,
+		minRefreshInterval: minRefreshInterval,
+	}
+}
+
+// Key returns the public key with the given kid, refreshing the set when
+// the kid is unknown and the last fetch is older than the refresh interval
+func (ks *KeySet) Key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	if key, ok := ks.lookup(kid); ok {
+		return key, nil
+	}
+
+	ks.fetchMu.Lock()
+	defer ks.fetchMu.Unlock()
+
+	// Another request may have fetched the set while we were waiting
+	if key, ok := ks.lookup(kid); ok {
+		return key, nil
+	}
+
+	ks.mu.RLock()
+	lastFetch, fetchErr := ks.lastFetch, ks.fetchErr
+	ks.mu.RUnlock()
+	if !lastFetch.IsZero() && time.Since(lastFetch) < ks.minRefreshInterval {
+		// The kid may be a rotated key the issuer could not serve, so the
+		// token is not rejected as invalid while the issuer is down
+		if fetchErr != nil {
+			return nil, fetchErr
+		}
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, kid)
+	}
+
+	keys, err := ks.fetch(ctx)
+
+	// Failed fetches are rate limited too, so an unavailable issuer is not
+	// called on every request
+	ks.mu.Lock()
+	ks.lastFetch = time.Now()
+	ks.fetchErr = err
+	if err == nil {
+		ks.keys = keys
+	}
+	ks.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if key, ok := ks.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnknownKey, kid)
+}
+
+// lookup returns a cached key. An empty kid matches the only key of a set
+// with a single key, as allowed by RFC 7515.
+func (ks *KeySet) lookup(kid string) (crypto.PublicKey, bool) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	if kid == "" && len(ks.keys) == 1 {
+		for _, key := range ks.keys {
+			return key, true
+		}
+	}
+	key, ok := ks.keys[kid]
+	return key, ok
+}
+
+func (ks *KeySet) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []JWK `json:"keys"`
+	}
+	if err := getJSON(ctx, ks.client, ks.url, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		// Keys of unsupported types are skipped so that adding one to the
+		// set does not break the others
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+// publicKey returns the public key of an RSA or EC key
+func (k JWK) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("RSA exponent is too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// getJSON fetches url and decodes the JSON response into v
+func getJSON(ctx context.Context, client *http.Client, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrIssuerUnavailable, err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrIssuerUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: GET %s returned %s", ErrIssuerUnavailable, url, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("%w: failed to decode %s: %v", ErrIssuerUnavailable, url, err)
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package auth
 import (
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -15,36 +16,92 @@ type User struct {
 	ID       string
 	Username string
 	Email    string
+	// Roles are set as the roles claim
+	Roles []string
 }
 
-// GenerateJWT creates a JWT token with  user data
+// GenerateJWT creates a JWT token with  user data that expires after
+// JWT_EXPIRATION_MINUTES
 func GenerateJWT(secretKey []byte) (string, error) {
+	return GenerateJWTWithExpiration(secretKey, time.Minute*time.Duration(getJWTExpirationMinutes()))
+}
+
+// GenerateJWTWithExpiration creates a JWT token with  user data that expires
+// after the given duration
+func GenerateJWTWithExpiration(secretKey []byte, expiration time.Duration) (string, error) {
+	return GenerateJWTWithOptions(secretKey, TokenOptions{Expiration: expiration})
+}
+
+// TokenOptions controls the registered claims of generated tokens
+type TokenOptions struct {
+	// User is the subject of the token. The  user is used when nil
+	User       *User
+	Expiration time.Duration
+	// Issuer is set as the iss claim when not empty
+	Issuer string
+	// Audience is set as the aud claim when not empty
+	Audience []string
+	// SessionID is set as the sid claim when not empty. It links access
+	// tokens to the refresh token family they were issued with.
+	SessionID string
+	// ClientID is set as the client_id claim when not empty
+	ClientID string
+	// Scopes are set as the space separated scope claim
+	Scopes []string
+	// Keys, when set, signs the token with its active key instead of the
+	// secret key
+	Keys *KeyRing
+}
+
+// GenerateJWTWithOptions creates a JWT token with  user data and the
+// registered claims described by opts
+func GenerateJWTWithOptions(secretKey []byte, opts TokenOptions) (string, error) {
 	// Create  user data
 	user := User{
 		ID:       "123456",
 		Username: "user",
 		Email:    "@example.com",
 	}
-
-	// Create claims
-	claims := jwt.MapClaims{
-		"user_id":  user.ID,
-		"username": user.Username,
-		"email":    user.Email,
-		"exp":      time.Now().Add(time.Minute * time.Duration(getJWTExpirationMinutes())).Unix(), // Token expires in 24 hours
-		"iat":      time.Now().Unix(),
+	if opts.User != nil {
+		user = *opts.User
 	}
 
-	// Create token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-
-	// Sign and get the complete encoded token as a string
-	tokenString, err := token.SignedString(secretKey)
+	// Every token gets a unique jti so it can be revoked
+	jti, err := randomID()
 	if err != nil {
 		return "", err
 	}
 
-	return tokenString, nil
+	// Create claims
+	now := time.Now()
+	claims := Claims{
+		UserID:    user.ID,
+		Username:  user.Username,
+		Email:     user.Email,
+		Roles:     user.Roles,
+		SessionID: opts.SessionID,
+		ClientID:  opts.ClientID,
+		Scope:     strings.Join(opts.Scopes, " "),
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			Subject:   user.ID,
+			Issuer:    opts.Issuer,
+			Audience:  opts.Audience,
+			ExpiresAt: jwt.NewNumericDate(now.Add(opts.Expiration)),
+			NotBefore: jwt.NewNumericDate(now),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+
+	// Sign with a kid header so that the key can be rotated
+	keys := opts.Keys
+	if keys == nil {
+		keys, err = NewKeyRing(NewHMACKey(secretKey))
+		if err != nil {
+			return "", err
+		}
+	}
+	return keys.Sign(claims)
 }
 
 // mustAtoi converts a string to an integer and panics if it fails
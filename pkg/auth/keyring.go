@@ -0,0 +1,308 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Signing algorithms supported by KeyRing
+const (
+	AlgorithmHS256 = "HS256"
+	AlgorithmRS256 = "RS256"
+	AlgorithmES256 = "ES256"
+	AlgorithmEdDSA = "EdDSA"
+)
+
+// SigningKey is a key of a KeyRing. Keys loaded from a public key, and
+// the previous keys of a ring, can only verify tokens.
+type SigningKey struct {
+	// ID is set as the kid header of the tokens signed with the key
+	ID        string
+	Algorithm string
+
+	signer crypto.Signer
+	public crypto.PublicKey
+	secret []byte
+}
+
+// NewHMACKey returns an HS256 key for secret. Its ID is derived from the
+// secret, so that tokens signed with a previous secret are recognised
+// without revealing it.
+func NewHMACKey(secret []byte) *SigningKey {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("kid"))
+	return &SigningKey{
+		ID:        "hs256-" + hex.EncodeToString(mac.Sum(nil))[:16],
+		Algorithm: AlgorithmHS256,
+		secret:    secret,
+	}
+}
+
+// NewSigningKey returns a key for an RSA, P-256 ECDSA or Ed25519 private
+// key (crypto.Signer) or public key. Its ID is the RFC 7638 thumbprint of
+// the public key.
+func NewSigningKey(key any) (*SigningKey, error) {
+	k := &SigningKey{public: key}
+	if signer, ok := key.(crypto.Signer); ok {
+		k.signer = signer
+		k.public = signer.Public()
+	}
+
+	switch public := k.public.(type) {
+	case *rsa.PublicKey:
+		if public.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA keys must be at least 2048 bits, got %d", public.N.BitLen())
+		}
+		k.Algorithm = AlgorithmRS256
+	case *ecdsa.PublicKey:
+		if public.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("unsupported curve %s (use P-256)", public.Curve.Params().Name)
+		}
+		k.Algorithm = AlgorithmES256
+	case ed25519.PublicKey:
+		k.Algorithm = AlgorithmEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported key type %T (use RSA, P-256 ECDSA or Ed25519)", key)
+	}
+
+	thumbprint, err := json.Marshal(k.JWK().thumbprintMembers())
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(thumbprint)
+	k.ID = base64.RawURLEncoding.EncodeToString(sum[:])
+	return k, nil
+}
+
+// LoadSigningKey reads a PEM encoded private key (PKCS #8, PKCS #1 or SEC 1)
+// or public key (PKIX) from path
+func LoadSigningKey(path string) (*SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+
+	var key any
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM block %q", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	k, err := NewSigningKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return k, nil
+}
+
+// CanSign reports whether the key holds a private key or secret
+func (k *SigningKey) CanSign() bool {
+	return k.signer != nil || k.secret != nil
+}
+
+// method returns the JWT signing method of the key
+func (k *SigningKey) method() jwt.SigningMethod {
+	return jwt.GetSigningMethod(k.Algorithm)
+}
+
+// verificationKey returns the key the jwt package verifies signatures with
+func (k *SigningKey) verificationKey() any {
+	if k.secret != nil {
+		return k.secret
+	}
+	return k.public
+}
+
+// JWK returns the public key as a JSON Web Key. It is empty for HMAC keys,
+// which must never be published.
+func (k *SigningKey) JWK() JWK {
+	encode := base64.RawURLEncoding.EncodeToString
+	jwk := JWK{Kid: k.ID, Use: "sig", Alg: k.Algorithm}
+	switch public := k.public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = encode(public.N.Bytes())
+		jwk.E = encode(bigEndian(public.E))
+	case *ecdsa.PublicKey:
+		size := (public.Curve.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = public.Curve.Params().Name
+		jwk.X = encode(public.X.FillBytes(make([]byte, size)))
+		jwk.Y = encode(public.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = encode(public)
+	default:
+		return JWK{}
+	}
+	return jwk
+}
+
+// JWK is a public JSON Web Key as published in a JWKS (RFC 7517)
+type JWK struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC and OKP
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// thumbprintMembers returns the required members of the key, which
+// encoding/json marshals in the lexicographic order RFC 7638 requires
+func (k JWK) thumbprintMembers() map[string]string {
+	switch k.Kty {
+	case "RSA":
+		return map[string]string{"e": k.E, "kty": k.Kty, "n": k.N}
+	case "EC":
+		return map[string]string{"crv": k.Crv, "kty": k.Kty, "x": k.X, "y": k.Y}
+	default:
+		return map[string]string{"crv": k.Crv, "kty": k.Kty, "x": k.X}
+	}
+}
+
+// bigEndian returns the minimal big-endian encoding of a positive int
+func bigEndian(n int) []byte {
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return b
+}
+
+// KeyRing signs tokens with its active key and verifies tokens signed with
+// any of its keys, so that keys can be rotated without invalidating the
+// tokens signed with the previous ones
+type KeyRing struct {
+	active *SigningKey
+	keys   map[string]*SigningKey
+	order  []*SigningKey
+}
+
+// NewKeyRing returns a ring signing with active. The previous keys are only
+// used to verify tokens.
+func NewKeyRing(active *SigningKey, previous ...*SigningKey) (*KeyRing, error) {
+	if active == nil || !active.CanSign() {
+		return nil, errors.New("the active key must be a private key or a secret")
+	}
+
+	r := &KeyRing{active: active, keys: make(map[string]*SigningKey, len(previous)+1)}
+	for _, key := range append([]*SigningKey{active}, previous...) {
+		if _, ok := r.keys[key.ID]; ok {
+			return nil, fmt.Errorf("key %q is in the ring twice", key.ID)
+		}
+		r.keys[key.ID] = key
+		r.order = append(r.order, key)
+	}
+	return r, nil
+}
+
+// Active returns the key new tokens are signed with
+func (r *KeyRing) Active() *SigningKey {
+	return r.active
+}
+
+// Sign signs claims with the active key and sets its kid header
+func (r *KeyRing) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(r.active.method(), claims)
+	token.Header["kid"] = r.active.ID
+	if r.active.secret != nil {
+		return token.SignedString(r.active.secret)
+	}
+	return token.SignedString(r.active.signer)
+}
+
+// Algorithms returns the algorithms of the keys in the ring
+func (r *KeyRing) Algorithms() []string {
+	var algorithms []string
+	seen := make(map[string]bool)
+	for _, key := range r.order {
+		if !seen[key.Algorithm] {
+			algorithms = append(algorithms, key.Algorithm)
+			seen[key.Algorithm] = true
+		}
+	}
+	return algorithms
+}
+
+// Keyfunc returns the key a token was signed with, chosen by its kid
+// header. Tokens without a kid, issued before keys had IDs, are checked
+// against every key of their algorithm.
+func (r *KeyRing) Keyfunc(token *jwt.Token) (any, error) {
+	alg, _ := token.Header["alg"].(string)
+
+	kid, ok := token.Header["kid"].(string)
+	if !ok || kid == "" {
+		var set jwt.VerificationKeySet
+		for _, key := range r.order {
+			if key.Algorithm == alg {
+				set.Keys = append(set.Keys, key.verificationKey())
+			}
+		}
+		if len(set.Keys) == 0 {
+			return nil, fmt.Errorf("%w: no %s key", ErrUnknownKey, alg)
+		}
+		return set, nil
+	}
+
+	key, ok := r.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, kid)
+	}
+	// The algorithm is bound to the key, so that a public key cannot be
+	// used as an HMAC secret
+	if key.Algorithm != alg {
+		return nil, fmt.Errorf("key %q is not a %s key", kid, alg)
+	}
+	return key.verificationKey(), nil
+}
+
+// JWKS returns the public keys of the ring as a JSON Web Key Set. HMAC keys
+// are left out.
+func (r *KeyRing) JWKS() map[string][]JWK {
+	keys := []JWK{}
+	for _, key := range r.order {
+		if key.secret == nil {
+			keys = append(keys, key.JWK())
+		}
+	}
+	return map[string][]JWK{"keys": keys}
+}
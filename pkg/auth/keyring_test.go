@@ -0,0 +1,206 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// writePEM writes key to a PEM file in a temporary directory
+func writePEM(t *testing.T, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	return path
+}
+
+func writePrivateKey(t *testing.T, key any) string {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey() returned an error: %v", err)
+	}
+	return writePEM(t, "PRIVATE KEY", der)
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	p384Key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	publicDER, _ := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+
+	tests := []struct {
+		name      string
+		path      string
+		algorithm string
+		canSign   bool
+		wantErr   bool
+	}{
+		{"RSA PKCS #8", writePrivateKey(t, rsaKey), AlgorithmRS256, true, false},
+		{"RSA PKCS #1", writePEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey)), AlgorithmRS256, true, false},
+		{"EC PKCS #8", writePrivateKey(t, ecKey), AlgorithmES256, true, false},
+		{"Ed25519", writePrivateKey(t, edKey), AlgorithmEdDSA, true, false},
+		{"Public key", writePEM(t, "PUBLIC KEY", publicDER), AlgorithmES256, false, false},
+		{"Unsupported curve", writePrivateKey(t, p384Key), "", false, true},
+		{"Not PEM", writePEM(t, "CERTIFICATE", []byte("garbage")), "", false, true},
+		{"Missing file", filepath.Join(t.TempDir(), "missing.pem"), "", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := LoadSigningKey(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadSigningKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if key.Algorithm != tt.algorithm || key.CanSign() != tt.canSign || key.ID == "" {
+				t.Errorf("Unexpected key: %+v", key)
+			}
+		})
+	}
+
+	// The private and public halves of a key get the same ID
+	private, _ := LoadSigningKey(tests[2].path)
+	public, _ := LoadSigningKey(tests[4].path)
+	if private.ID != public.ID {
+		t.Errorf("Expected the same kid for both halves of a key, got %q and %q", private.ID, public.ID)
+	}
+}
+
+func TestSigningKeyThumbprint(t *testing.T) {
+	// Example of RFC 7638 section 3.1
+	n, _ := base64.RawURLEncoding.DecodeString("0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw")
+	key, err := NewSigningKey(&rsa.PublicKey{N: new(big.Int).SetBytes(n), E: 65537})
+	if err != nil {
+		t.Fatalf("NewSigningKey() returned an error: %v", err)
+	}
+	if want := "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs"; key.ID != want {
+		t.Errorf("kid = %q, want %q", key.ID, want)
+	}
+}
+
+func TestKeyRingRotation(t *testing.T) {
+	oldKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, newKey, _ := ed25519.GenerateKey(rand.Reader)
+	oldSigning, _ := NewSigningKey(oldKey)
+	newSigning, _ := NewSigningKey(newKey)
+	hmacKey := NewHMACKey([]byte("secret"))
+
+	oldRing, err := NewKeyRing(oldSigning)
+	if err != nil {
+		t.Fatalf("NewKeyRing() returned an error: %v", err)
+	}
+	oldToken, err := GenerateJWTWithOptions(nil, TokenOptions{Expiration: time.Hour, Keys: oldRing})
+	if err != nil {
+		t.Fatalf("GenerateJWTWithOptions() returned an error: %v", err)
+	}
+	hmacToken, err := GenerateJWTWithExpiration([]byte("secret"), time.Hour)
+	if err != nil {
+		t.Fatalf("GenerateJWTWithExpiration() returned an error: %v", err)
+	}
+
+	// The old key is kept as a verify-only key after the rotation
+	publicOld, _ := NewSigningKey(&oldKey.PublicKey)
+	ring, err := NewKeyRing(newSigning, publicOld, hmacKey)
+	if err != nil {
+		t.Fatalf("NewKeyRing() returned an error: %v", err)
+	}
+	newToken, err := GenerateJWTWithOptions(nil, TokenOptions{Expiration: time.Hour, Keys: ring})
+	if err != nil {
+		t.Fatalf("GenerateJWTWithOptions() returned an error: %v", err)
+	}
+
+	header, _, _ := jwt.NewParser().ParseUnverified(newToken, &Claims{})
+	if header.Header["kid"] != newSigning.ID || header.Method.Alg() != AlgorithmEdDSA {
+		t.Errorf("Expected the token to be signed with the active key, got %v", header.Header)
+	}
+
+	for name, token := range map[string]string{"new": newToken, "old": oldToken, "HMAC": hmacToken} {
+		if _, err := ParseJWT(token, nil, VerifyOptions{Keys: ring}); err != nil {
+			t.Errorf("ParseJWT() of the %s token returned an error: %v", name, err)
+		}
+	}
+
+	// Tokens signed with a key that was dropped from the ring are rejected
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherSigning, _ := NewSigningKey(otherKey)
+	if _, err := ParseJWT(oldToken, nil, VerifyOptions{Keys: mustKeyRing(t, otherSigning)}); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("ParseJWT() error = %v, want %v", err, ErrUnknownKey)
+	}
+
+	if _, err := NewKeyRing(publicOld); err == nil {
+		t.Error("Expected an error for a ring without a private active key")
+	}
+	if _, err := NewKeyRing(newSigning, newSigning); err == nil {
+		t.Error("Expected an error for a key listed twice")
+	}
+}
+
+func TestKeyRingRejectsAlgorithmConfusion(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	signing, _ := NewSigningKey(rsaKey)
+	ring := mustKeyRing(t, signing, NewHMACKey([]byte("secret")))
+
+	// An attacker signs an HS256 token with the published RSA public key
+	publicDER, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))})
+	token.Header["kid"] = signing.ID
+	forged, _ := token.SignedString(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}))
+
+	if _, err := ParseJWT(forged, nil, VerifyOptions{Keys: ring}); err == nil {
+		t.Error("Expected a token signed with the public key as HMAC secret to be rejected")
+	}
+}
+
+func TestKeyRingJWKS(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaSigning, _ := NewSigningKey(rsaKey)
+	ecSigning, _ := NewSigningKey(&ecKey.PublicKey)
+	ring := mustKeyRing(t, rsaSigning, ecSigning, NewHMACKey([]byte("secret")))
+
+	keys := ring.JWKS()["keys"]
+	if len(keys) != 2 {
+		t.Fatalf("Expected 2 public keys, got %d", len(keys))
+	}
+	for i, want := range []*SigningKey{rsaSigning, ecSigning} {
+		if keys[i].Kid != want.ID || keys[i].Alg != want.Algorithm || keys[i].Use != "sig" {
+			t.Errorf("Unexpected key: %+v", keys[i])
+		}
+		// Published keys can be read back by a KeySet
+		if _, err := keys[i].publicKey(); err != nil {
+			t.Errorf("publicKey() returned an error: %v", err)
+		}
+	}
+	if strings.Contains(keys[0].N+keys[1].X, "secret") {
+		t.Error("Expected secrets not to be published")
+	}
+}
+
+func mustKeyRing(t *testing.T, active *SigningKey, previous ...*SigningKey) *KeyRing {
+	t.Helper()
+	ring, err := NewKeyRing(active, previous...)
+	if err != nil {
+		t.Fatalf("NewKeyRing() returned an error: %v", err)
+	}
+	return ring
+}
@@ -0,0 +1,180 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// OAuthOptions configures an OAuthClient
+type OAuthOptions struct {
+	ClientID string
+	// ClientSecret is empty for public clients, which rely on PKCE alone
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	// Client is used for the code exchange
+	Client *http.Client
+}
+
+// OAuthClient implements the OAuth 2.0 authorization code flow with PKCE
+// (RFC 7636) against an OpenID Connect provider
+type OAuthClient struct {
+	provider *OIDCVerifier
+	opts     OAuthOptions
+}
+
+// NewOAuthClient returns a client for the provider behind verifier. ID
+// tokens returned by the provider are checked with verifier, so its
+// audience should be the client ID.
+func NewOAuthClient(verifier *OIDCVerifier, opts OAuthOptions) *OAuthClient {
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &OAuthClient{provider: verifier, opts: opts}
+}
+
+// AuthCodeURL returns the provider URL the user is sent to in order to log
+// in. state and nonce are echoed back in the callback and the ID token, and
+// codeChallenge is derived from the verifier passed to Exchange.
+func (c *OAuthClient) AuthCodeURL(ctx context.Context, state, nonce, codeChallenge string) (string, error) {
+	metadata, err := c.provider.Provider(ctx)
+	if err != nil {
+		return "", err
+	}
+	if metadata.AuthorizationEndpoint == "" {
+		return "", fmt.Errorf("%w: discovery document has no authorization_endpoint", ErrIssuerUnavailable)
+	}
+
+	u, err := url.Parse(metadata.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid authorization_endpoint: %v", ErrIssuerUnavailable, err)
+	}
+	query := u.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", c.opts.ClientID)
+	query.Set("redirect_uri", c.opts.RedirectURL)
+	query.Set("scope", strings.Join(c.opts.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", codeChallenge)
+	query.Set("code_challenge_method", "S256")
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// OAuthToken is the response of the provider token endpoint
+type OAuthToken struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresIn    int    `json:"expires_in,omitempty"`
+	IDToken      string `json:"id_token"`
+}
+
+// OAuthError is an error response of the provider token endpoint
+type OAuthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *OAuthError) Error() string {
+	if e.Description == "" {
+		return "oauth: " + e.Code
+	}
+	return "oauth: " + e.Code + ": " + e.Description
+}
+
+// Exchange trades an authorization code for tokens, proving possession of
+// codeVerifier
+func (c *OAuthClient) Exchange(ctx context.Context, code, codeVerifier string) (*OAuthToken, error) {
+	metadata, err := c.provider.Provider(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if metadata.TokenEndpoint == "" {
+		return nil, fmt.Errorf("%w: discovery document has no token_endpoint", ErrIssuerUnavailable)
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {c.opts.RedirectURL},
+		"client_id":     {c.opts.ClientID},
+		"code_verifier": {codeVerifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if c.opts.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(c.opts.ClientID), url.QueryEscape(c.opts.ClientSecret))
+	}
+
+	resp, err := c.opts.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrIssuerUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrIssuerUnavailable, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		oauthErr := &OAuthError{}
+		if json.Unmarshal(body, oauthErr) == nil && oauthErr.Code != "" {
+			return nil, oauthErr
+		}
+		return nil, fmt.Errorf("%w: token endpoint returned %s", ErrIssuerUnavailable, resp.Status)
+	}
+
+	token := &OAuthToken{}
+	if err := json.Unmarshal(body, token); err != nil {
+		return nil, fmt.Errorf("%w: failed to decode token response: %v", ErrIssuerUnavailable, err)
+	}
+	if token.IDToken == "" {
+		return nil, errors.New("oauth: token response has no id_token (is the openid scope requested?)")
+	}
+	return token, nil
+}
+
+// VerifyIDToken verifies an ID token returned by Exchange, including that
+// its nonce matches the one sent in AuthCodeURL
+func (c *OAuthClient) VerifyIDToken(ctx context.Context, idToken, nonce string) (*OIDCClaims, error) {
+	claims, err := c.provider.Verify(ctx, idToken)
+	if err != nil {
+		return nil, err
+	}
+	if nonce == "" || claims.Nonce != nonce {
+		return nil, errors.New("invalid token: nonce does not match")
+	}
+	return claims, nil
+}
+
+// RandomString returns a URL safe random string with n bytes of entropy,
+// for use as state, nonce or PKCE code verifier
+func RandomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CodeChallenge returns the S256 PKCE challenge of codeVerifier
+func CodeChallenge(codeVerifier string) string {
+	sum := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
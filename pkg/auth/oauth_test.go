@@ -0,0 +1,32 @@
+package auth
+
+import "testing"
+
+func TestCodeChallenge(t *testing.T) {
+	// Example from RFC 7636, appendix B
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	expected := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	if got := CodeChallenge(verifier); got != expected {
+		t.Errorf("CodeChallenge() = %q, want %q", got, expected)
+	}
+}
+
+func TestRandomString(t *testing.T) {
+	a, err := RandomString(32)
+	if err != nil {
+		t.Fatalf("RandomString() returned an error: %v", err)
+	}
+	b, err := RandomString(32)
+	if err != nil {
+		t.Fatalf("RandomString() returned an error: %v", err)
+	}
+
+	// 32 bytes encode to 43 characters, the minimum PKCE verifier length
+	if len(a) != 43 {
+		t.Errorf("Expected 43 characters, got %d", len(a))
+	}
+	if a == b {
+		t.Errorf("Expected different values, got %q twice", a)
+	}
+}
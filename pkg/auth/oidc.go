@@ -0,0 +1,193 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// OIDCClaims are the claims of access and ID tokens issued by an OpenID
+// Connect provider
+type OIDCClaims struct {
+	// Nonce is only present in ID tokens
+	Nonce             string `json:"nonce,omitempty"`
+	Email             string `json:"email"`
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+	// Scope is the space separated list of scopes granted to an access
+	// token, when the provider sets it
+	Scope string `json:"scope,omitempty"`
+	// Roles are the roles of the user, when the provider sets them
+	Roles []string `json:"roles,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// Scopes returns the granted scopes
+func (c *OIDCClaims) Scopes() []string {
+	return strings.Fields(c.Scope)
+}
+
+// OIDCOptions configures an OIDCVerifier
+type OIDCOptions struct {
+	// Audience, when not empty, must be one of the aud claim values
+	Audience string
+	// Leeway is the clock skew tolerated when checking exp, nbf and iat
+	Leeway time.Duration
+	// MinRefreshInterval is the minimum time between two fetches of the
+	// discovery document or the JWKS
+	MinRefreshInterval time.Duration
+	// Client is used for discovery and JWKS requests
+	Client *http.Client
+}
+
+// OIDCVerifier validates RS256 and ES256 tokens issued by an OpenID Connect
+// provider. The provider is discovered on first use from
+// {issuer}/.well-known/openid-configuration, so the verifier can be created
+// while the provider is unreachable.
+type OIDCVerifier struct {
+	issuer string
+	opts   OIDCOptions
+
+	mu            sync.Mutex
+	metadata      *ProviderMetadata
+	keys          *KeySet
+	lastDiscovery time.Time
+}
+
+// NewOIDCVerifier returns a verifier for tokens issued by issuer
+func NewOIDCVerifier(issuer string, opts OIDCOptions) *OIDCVerifier {
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if opts.MinRefreshInterval <= 0 {
+		opts.MinRefreshInterval = DefaultMinRefreshInterval
+	}
+	return &OIDCVerifier{
+		issuer: strings.TrimSuffix(issuer, "/"),
+		opts:   opts,
+	}
+}
+
+// Issuer returns the issuer tokens must come from
+func (v *OIDCVerifier) Issuer() string {
+	return v.issuer
+}
+
+// Verify checks the signature and the exp, nbf, iat, iss and aud claims of
+// tokenString, requires a sub claim and returns its claims
+func (v *OIDCVerifier) Verify(ctx context.Context, tokenString string) (*OIDCClaims, error) {
+	parserOpts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodES256.Alg()}),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(v.opts.Leeway),
+		jwt.WithIssuer(v.issuer),
+	}
+	if v.opts.Audience != "" {
+		parserOpts = append(parserOpts, jwt.WithAudience(v.opts.Audience))
+	}
+
+	claims := &OIDCClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		keys, err := v.keySet(ctx)
+		if err != nil {
+			return nil, err
+		}
+		kid, _ := token.Header["kid"].(string)
+		return keys.Key(ctx, kid)
+	}, parserOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %w", err)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("invalid token: %w: sub", jwt.ErrTokenRequiredClaimMissing)
+	}
+
+	return claims, nil
+}
+
+// IssuedBy reports whether the unverified iss claim of tokenString is the
+// verifier issuer. It lets callers route tokens to the right verifier
+// before paying for signature verification.
+func (v *OIDCVerifier) IssuedBy(tokenString string) bool {
+	claims := jwt.RegisteredClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(tokenString, &claims); err != nil {
+		return false
+	}
+	return strings.TrimSuffix(claims.Issuer, "/") == v.issuer
+}
+
+// Provider returns the discovery document of the issuer, fetching it on
+// first use
+func (v *OIDCVerifier) Provider(ctx context.Context) (*ProviderMetadata, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if err := v.discover(ctx); err != nil {
+		return nil, err
+	}
+	return v.metadata, nil
+}
+
+func (v *OIDCVerifier) keySet(ctx context.Context) (*KeySet, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if err := v.discover(ctx); err != nil {
+		return nil, err
+	}
+	return v.keys, nil
+}
+
+// discover fetches the discovery document once. Failed discoveries are
+// retried at most once per MinRefreshInterval. v.mu must be held.
+func (v *OIDCVerifier) discover(ctx context.Context) error {
+	if v.metadata != nil {
+		return nil
+	}
+	if !v.lastDiscovery.IsZero() && time.Since(v.lastDiscovery) < v.opts.MinRefreshInterval {
+		return fmt.Errorf("%w: discovery of %s failed recently", ErrIssuerUnavailable, v.issuer)
+	}
+	v.lastDiscovery = time.Now()
+
+	metadata, err := Discover(ctx, v.opts.Client, v.issuer)
+	if err != nil {
+		return err
+	}
+	v.metadata = metadata
+	v.keys = NewKeySet(metadata.JWKSURI, v.opts.Client, v.opts.MinRefreshInterval)
+	return nil
+}
+
+// ProviderMetadata is the part of the OpenID Connect discovery document
+// used by this package
+type ProviderMetadata struct {
+	Issuer                string `json:"issuer"`
+	JWKSURI               string `json:"jwks_uri"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+}
+
+// Discover fetches the OpenID Connect discovery document of issuer
+func Discover(ctx context.Context, client *http.Client, issuer string) (*ProviderMetadata, error) {
+	issuer = strings.TrimSuffix(issuer, "/")
+
+	var metadata ProviderMetadata
+	if err := getJSON(ctx, client, issuer+"/.well-known/openid-configuration", &metadata); err != nil {
+		return nil, err
+	}
+
+	// The issuer must match to prevent a provider from impersonating another
+	if strings.TrimSuffix(metadata.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("%w: discovery document issuer %q does not match %q", ErrIssuerUnavailable, metadata.Issuer, issuer)
+	}
+	if metadata.JWKSURI == "" {
+		return nil, fmt.Errorf("%w: discovery document of %s has no jwks_uri", ErrIssuerUnavailable, issuer)
+	}
+	return &metadata, nil
+}
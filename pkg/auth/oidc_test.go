@@ -0,0 +1,291 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testIssuer is a minimal OpenID Connect provider serving a discovery
+// document and a JWKS that can be rotated
+type testIssuer struct {
+	*httptest.Server
+	mu          sync.Mutex
+	keys        map[string]crypto.Signer
+	jwksFetches atomic.Int32
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	issuer := &testIssuer{keys: make(map[string]crypto.Signer)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(ProviderMetadata{Issuer: issuer.URL, JWKSURI: issuer.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		issuer.jwksFetches.Add(1)
+		issuer.mu.Lock()
+		defer issuer.mu.Unlock()
+
+		var keys []JWK
+		for kid, key := range issuer.keys {
+			switch pub := key.Public().(type) {
+			case *rsa.PublicKey:
+				keys = append(keys, JWK{Kid: kid, Kty: "RSA", Use: "sig", N: encodeBigInt(pub.N), E: encodeBigInt(big.NewInt(int64(pub.E)))})
+			case *ecdsa.PublicKey:
+				keys = append(keys, JWK{Kid: kid, Kty: "EC", Crv: "P-256", X: encodeBigInt(pub.X), Y: encodeBigInt(pub.Y)})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	})
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+func encodeBigInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+func (i *testIssuer) addKey(t *testing.T, kid string, key crypto.Signer) {
+	t.Helper()
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.keys[kid] = key
+}
+
+func (i *testIssuer) removeKey(kid string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	delete(i.keys, kid)
+}
+
+func (i *testIssuer) sign(t *testing.T, kid string, key crypto.Signer, claims jwt.Claims) string {
+	t.Helper()
+	method := jwt.SigningMethod(jwt.SigningMethodRS256)
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		method = jwt.SigningMethodES256
+	}
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	return signed
+}
+
+func (i *testIssuer) claims(audience string) OIDCClaims {
+	now := time.Now()
+	return OIDCClaims{
+		Email: "jane@example.com",
+		Name:  "Jane",
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    i.URL,
+			Subject:   "jane",
+			Audience:  jwt.ClaimStrings{audience},
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+}
+
+func TestOIDCVerifier(t *testing.T) {
+	issuer := newTestIssuer(t)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer.addKey(t, "rsa", rsaKey)
+	issuer.addKey(t, "ec", ecKey)
+
+	verifier := NewOIDCVerifier(issuer.URL, OIDCOptions{Audience: "api"})
+
+	expired := issuer.claims("api")
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+	otherIssuer := issuer.claims("api")
+	otherIssuer.Issuer = "https://evil.example.com"
+	noSubject := issuer.claims("api")
+	noSubject.Subject = ""
+
+	tests := []struct {
+		name        string
+		token       string
+		expectedErr error
+	}{
+		{"RS256", issuer.sign(t, "rsa", rsaKey, issuer.claims("api")), nil},
+		{"ES256", issuer.sign(t, "ec", ecKey, issuer.claims("api")), nil},
+		{"Wrong audience", issuer.sign(t, "rsa", rsaKey, issuer.claims("other")), jwt.ErrTokenInvalidAudience},
+		{"Expired", issuer.sign(t, "rsa", rsaKey, expired), jwt.ErrTokenExpired},
+		{"Wrong issuer", issuer.sign(t, "rsa", rsaKey, otherIssuer), jwt.ErrTokenInvalidIssuer},
+		{"Without subject", issuer.sign(t, "rsa", rsaKey, noSubject), jwt.ErrTokenRequiredClaimMissing},
+		{"Forged signature", issuer.sign(t, "rsa", otherKey, issuer.claims("api")), jwt.ErrTokenSignatureInvalid},
+		{"Symmetric algorithm", signClaims(t, jwt.SigningMethodHS256, []byte("secret"), issuer.claims("api")), jwt.ErrTokenSignatureInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := verifier.Verify(context.Background(), tt.token)
+			if tt.expectedErr == nil {
+				if err != nil {
+					t.Fatalf("Verify() returned an error: %v", err)
+				}
+				if claims.Subject != "jane" || claims.Email != "jane@example.com" {
+					t.Errorf("Unexpected claims: %+v", claims)
+				}
+				return
+			}
+			if !errors.Is(err, tt.expectedErr) {
+				t.Errorf("Verify() error = %v, want %v", err, tt.expectedErr)
+			}
+		})
+	}
+
+	if fetches := issuer.jwksFetches.Load(); fetches != 1 {
+		t.Errorf("Expected the JWKS to be fetched once, got %d", fetches)
+	}
+}
+
+func TestOIDCVerifierKeyRotation(t *testing.T) {
+	issuer := newTestIssuer(t)
+
+	oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer.addKey(t, "old", oldKey)
+
+	verifier := NewOIDCVerifier(issuer.URL, OIDCOptions{MinRefreshInterval: 50 * time.Millisecond})
+	ctx := context.Background()
+
+	if _, err := verifier.Verify(ctx, issuer.sign(t, "old", oldKey, issuer.claims("api"))); err != nil {
+		t.Fatalf("Verify() returned an error: %v", err)
+	}
+
+	// Rotate: the new key is published, the old one is retired
+	issuer.addKey(t, "new", newKey)
+	issuer.removeKey("old")
+	time.Sleep(60 * time.Millisecond)
+
+	rotated := issuer.sign(t, "new", newKey, issuer.claims("api"))
+	if _, err := verifier.Verify(ctx, rotated); err != nil {
+		t.Fatalf("Verify() with the rotated key returned an error: %v", err)
+	}
+	if fetches := issuer.jwksFetches.Load(); fetches != 2 {
+		t.Errorf("Expected the JWKS to be refetched once for the new kid, got %d fetches", fetches)
+	}
+
+	// Unknown kids do not trigger a refetch within the refresh interval
+	for i := 0; i < 5; i++ {
+		_, err := verifier.Verify(ctx, issuer.sign(t, "bogus", newKey, issuer.claims("api")))
+		if !errors.Is(err, ErrUnknownKey) {
+			t.Fatalf("Verify() error = %v, want %v", err, ErrUnknownKey)
+		}
+	}
+	if fetches := issuer.jwksFetches.Load(); fetches != 2 {
+		t.Errorf("Expected unknown kids to be rate limited, got %d fetches", fetches)
+	}
+}
+
+func TestOIDCVerifierIssuerUnavailable(t *testing.T) {
+	issuer := newTestIssuer(t)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer.addKey(t, "rsa", key)
+	token := issuer.sign(t, "rsa", key, issuer.claims("api"))
+	issuer.Close()
+
+	verifier := NewOIDCVerifier(issuer.URL, OIDCOptions{})
+	_, err = verifier.Verify(context.Background(), token)
+	if !errors.Is(err, ErrIssuerUnavailable) {
+		t.Errorf("Verify() error = %v, want %v", err, ErrIssuerUnavailable)
+	}
+}
+
+func TestKeySetFetchFailure(t *testing.T) {
+	var failing atomic.Bool
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		if failing.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"keys": []JWK{}})
+	}))
+	defer server.Close()
+
+	keys := NewKeySet(server.URL, nil, time.Hour)
+	ctx := context.Background()
+
+	failing.Store(true)
+	for i := 0; i < 3; i++ {
+		if _, err := keys.Key(ctx, "rotated"); !errors.Is(err, ErrIssuerUnavailable) {
+			t.Fatalf("Key() error = %v, want %v", err, ErrIssuerUnavailable)
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("Expected failed fetches to be rate limited, got %d fetches", n)
+	}
+
+	// Once a fetch succeeds, unknown kids are reported as such
+	keys = NewKeySet(server.URL, nil, time.Hour)
+	failing.Store(false)
+	for i := 0; i < 2; i++ {
+		if _, err := keys.Key(ctx, "bogus"); !errors.Is(err, ErrUnknownKey) {
+			t.Fatalf("Key() error = %v, want %v", err, ErrUnknownKey)
+		}
+	}
+}
+
+func TestOIDCVerifierIssuedBy(t *testing.T) {
+	verifier := NewOIDCVerifier("https://issuer.example.com/", OIDCOptions{})
+
+	tests := []struct {
+		name     string
+		token    string
+		expected bool
+	}{
+		{"Same issuer", signClaims(t, jwt.SigningMethodHS256, []byte("k"), jwt.RegisteredClaims{Issuer: "https://issuer.example.com"}), true},
+		{"Other issuer", signClaims(t, jwt.SigningMethodHS256, []byte("k"), jwt.RegisteredClaims{Issuer: "https://other.example.com"}), false},
+		{"Opaque token", "opaque_token", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := verifier.IssuedBy(tt.token); got != tt.expected {
+				t.Errorf("IssuedBy() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,410 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RefreshTokenPrefix starts every refresh token
+const RefreshTokenPrefix = "rt_"
+
+var (
+	// ErrInvalidRefreshToken is returned for malformed, unknown, expired or
+	// revoked refresh tokens
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	// ErrRefreshTokenReused is returned when a refresh token is used twice.
+	// The whole token family is revoked when this happens, since either the
+	// client or an attacker holds a stolen token.
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+	// ErrRefreshTokenNotFound is returned by stores for unknown token IDs
+	ErrRefreshTokenNotFound = errors.New("refresh token not found")
+)
+
+// RefreshToken is a stored refresh token. Only the hash of the token is
+// kept. Tokens issued from one another share a Family, so that the whole
+// chain can be revoked at once.
+type RefreshToken struct {
+	ID        string
+	Family    string
+	Hash      string
+	User      User
+	ExpiresAt time.Time
+	// Used is set once the token has been exchanged for a new pair
+	Used bool
+	// ClientID, Scopes and AccessTokenExpiry are carried over from the
+	// Grant the family was issued for
+	ClientID          string
+	Scopes            []string
+	AccessTokenExpiry time.Duration
+}
+
+// TokenStore keeps refresh tokens and the list of revoked token IDs
+type TokenStore interface {
+	// SaveRefreshToken stores a new refresh token
+	SaveRefreshToken(ctx context.Context, token *RefreshToken) error
+	// GetRefreshToken returns the token with the given ID or
+	// ErrRefreshTokenNotFound
+	GetRefreshToken(ctx context.Context, id string) (*RefreshToken, error)
+	// UseRefreshToken marks a token as used. It returns false when the
+	// token was already used, atomically, so that a token can only be
+	// exchanged once even under concurrent requests.
+	UseRefreshToken(ctx context.Context, id string) (bool, error)
+	// Revoke adds an access token ID (jti) or a token family to the
+	// revocation list until the given time
+	Revoke(ctx context.Context, id string, until time.Time) error
+	// IsRevoked reports whether id is in the revocation list
+	IsRevoked(ctx context.Context, id string) (bool, error)
+}
+
+// TokenPair is the response of the token endpoints
+type TokenPair struct {
+	AccessToken string
+	// RefreshToken is empty for grants without refresh tokens
+	RefreshToken string
+	ExpiresIn    time.Duration
+	Scopes       []string
+}
+
+// Grant describes who a token pair is issued to
+type Grant struct {
+	User User
+	// ClientID is the client that requested the tokens, if any. Refresh
+	// tokens can then only be used by the same client.
+	ClientID string
+	Scopes   []string
+	// AccessTokenExpiry overrides the issuer default when not zero
+	AccessTokenExpiry time.Duration
+	// NoRefreshToken issues an access token alone, as for the
+	// client_credentials grant
+	NoRefreshToken bool
+}
+
+// TokenIssuerOptions configures a TokenIssuer
+type TokenIssuerOptions struct {
+	// AccessTokenExpiry is the lifetime of access tokens
+	AccessTokenExpiry time.Duration
+	// RefreshTokenExpiry is the lifetime of refresh tokens. Every refresh
+	// issues a new refresh token with a full lifetime.
+	RefreshTokenExpiry time.Duration
+	Issuer             string
+	Audience           []string
+	// Keys, when set, signs access tokens with the active key of the ring
+	// instead of the secret
+	Keys *KeyRing
+}
+
+// TokenIssuer issues short-lived access tokens together with rotating
+// refresh tokens, and revokes them
+type TokenIssuer struct {
+	secret []byte
+	store  TokenStore
+	opts   TokenIssuerOptions
+}
+
+// NewTokenIssuer returns an issuer signing access tokens with secret
+func NewTokenIssuer(secret []byte, store TokenStore, opts TokenIssuerOptions) *TokenIssuer {
+	return &TokenIssuer{secret: secret, store: store, opts: opts}
+}
+
+// Issue starts a new token family for user
+func (i *TokenIssuer) Issue(ctx context.Context, user User) (*TokenPair, error) {
+	return i.IssueGrant(ctx, Grant{User: user})
+}
+
+// IssueGrant starts a new token family for grant
+func (i *TokenIssuer) IssueGrant(ctx context.Context, grant Grant) (*TokenPair, error) {
+	family, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	return i.issue(ctx, grant, family)
+}
+
+// Refresh exchanges a refresh token for a new pair in the same family.
+// Presenting a refresh token that was already exchanged revokes the family
+// and returns ErrRefreshTokenReused. Tokens issued to a client can only be
+// refreshed by that client, and tokens issued without one only with an
+// empty clientID.
+func (i *TokenIssuer) Refresh(ctx context.Context, refreshToken, clientID string) (*TokenPair, error) {
+	stored, err := i.lookup(ctx, refreshToken)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(stored.ClientID), []byte(clientID)) != 1 {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	fresh, err := i.store.UseRefreshToken(ctx, stored.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !fresh {
+		if err := i.revokeFamily(ctx, stored.Family); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+
+	return i.issue(ctx, Grant{
+		User:              stored.User,
+		ClientID:          stored.ClientID,
+		Scopes:            stored.Scopes,
+		AccessTokenExpiry: stored.AccessTokenExpiry,
+	}, stored.Family)
+}
+
+// Revoke revokes an access token until it expires, or the whole family of
+// a refresh token. As required by RFC 7009, tokens that are invalid or were
+// already revoked are not an error.
+func (i *TokenIssuer) Revoke(ctx context.Context, token string) error {
+	if strings.HasPrefix(token, RefreshTokenPrefix) {
+		stored, err := i.lookup(ctx, token)
+		if errors.Is(err, ErrInvalidRefreshToken) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return i.revokeFamily(ctx, stored.Family)
+	}
+
+	claims, err := ParseJWT(token, i.secret, VerifyOptions{Issuer: i.opts.Issuer, Keys: i.opts.Keys})
+	if err != nil || claims.ID == "" {
+		return nil
+	}
+	return i.store.Revoke(ctx, claims.ID, claims.ExpiresAt.Time)
+}
+
+// lookup returns the stored refresh token if it is valid
+func (i *TokenIssuer) lookup(ctx context.Context, refreshToken string) (*RefreshToken, error) {
+	id, ok := splitOpaqueToken(RefreshTokenPrefix, refreshToken)
+	if !ok {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	stored, err := i.store.GetRefreshToken(ctx, id)
+	if errors.Is(err, ErrRefreshTokenNotFound) {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(HashAPIKey(refreshToken)), []byte(stored.Hash)) != 1 {
+		return nil, ErrInvalidRefreshToken
+	}
+	if !time.Now().Before(stored.ExpiresAt) {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	revoked, err := i.store.IsRevoked(ctx, stored.Family)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrInvalidRefreshToken
+	}
+	return stored, nil
+}
+
+// revokeFamily revokes every refresh token of a family and, through the
+// sid claim, every access token issued with them
+func (i *TokenIssuer) revokeFamily(ctx context.Context, family string) error {
+	until := time.Now().Add(max(i.opts.RefreshTokenExpiry, i.opts.AccessTokenExpiry))
+	return i.store.Revoke(ctx, family, until)
+}
+
+func (i *TokenIssuer) issue(ctx context.Context, grant Grant, family string) (*TokenPair, error) {
+	expiry := i.opts.AccessTokenExpiry
+	if grant.AccessTokenExpiry > 0 {
+		expiry = grant.AccessTokenExpiry
+	}
+	accessToken, err := GenerateJWTWithOptions(i.secret, TokenOptions{
+		User:       &grant.User,
+		Expiration: expiry,
+		Issuer:     i.opts.Issuer,
+		Audience:   i.opts.Audience,
+		SessionID:  family,
+		ClientID:   grant.ClientID,
+		Scopes:     grant.Scopes,
+		Keys:       i.opts.Keys,
+	})
+	if err != nil {
+		return nil, err
+	}
+	pair := &TokenPair{AccessToken: accessToken, ExpiresIn: expiry, Scopes: grant.Scopes}
+	if grant.NoRefreshToken {
+		return pair, nil
+	}
+
+	id, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	secret, err := RandomString(32)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken := RefreshTokenPrefix + id + "_" + secret
+
+	err = i.store.SaveRefreshToken(ctx, &RefreshToken{
+		ID:                id,
+		Family:            family,
+		Hash:              HashAPIKey(refreshToken),
+		User:              grant.User,
+		ExpiresAt:         time.Now().Add(i.opts.RefreshTokenExpiry),
+		ClientID:          grant.ClientID,
+		Scopes:            grant.Scopes,
+		AccessTokenExpiry: grant.AccessTokenExpiry,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pair.RefreshToken = refreshToken
+	return pair, nil
+}
+
+// IsTokenRevoked reports whether the access token with the given claims was
+// revoked, either by itself or through its token family
+func IsTokenRevoked(ctx context.Context, store TokenStore, claims *Claims) (bool, error) {
+	for _, id := range []string{claims.ID, claims.SessionID} {
+		if id == "" {
+			continue
+		}
+		revoked, err := store.IsRevoked(ctx, id)
+		if err != nil || revoked {
+			return revoked, err
+		}
+	}
+	return false, nil
+}
+
+// randomID returns a random 16 character hex ID
+func randomID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// splitOpaqueToken returns the ID of a "<prefix><id>_<secret>" token
+func splitOpaqueToken(prefix, token string) (string, bool) {
+	rest, ok := strings.CutPrefix(token, prefix)
+	if !ok {
+		return "", false
+	}
+	id, secret, ok := strings.Cut(rest, "_")
+	if !ok || id == "" || secret == "" {
+		return "", false
+	}
+	return id, true
+}
+
+// MemoryTokenStore keeps refresh tokens and revocations in memory. Expired
+// entries are removed periodically. It is only suitable for a single
+// instance; deployments with several replicas need a shared store.
+type MemoryTokenStore struct {
+	mu        sync.Mutex
+	refresh   map[string]RefreshToken
+	revoked   map[string]time.Time
+	lastSweep time.Time
+}
+
+// NewMemoryTokenStore returns an empty store
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{
+		refresh: make(map[string]RefreshToken),
+		revoked: make(map[string]time.Time),
+	}
+}
+
+// SaveRefreshToken implements TokenStore
+func (s *MemoryTokenStore) SaveRefreshToken(_ context.Context, token *RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep()
+	stored := *token
+	stored.Scopes = slices.Clone(token.Scopes)
+	s.refresh[token.ID] = stored
+	return nil
+}
+
+// GetRefreshToken implements TokenStore
+func (s *MemoryTokenStore) GetRefreshToken(_ context.Context, id string) (*RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.refresh[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrRefreshTokenNotFound, id)
+	}
+	return &token, nil
+}
+
+// UseRefreshToken implements TokenStore
+func (s *MemoryTokenStore) UseRefreshToken(_ context.Context, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.refresh[id]
+	if !ok {
+		return false, fmt.Errorf("%w: %s", ErrRefreshTokenNotFound, id)
+	}
+	if token.Used {
+		return false, nil
+	}
+	token.Used = true
+	s.refresh[id] = token
+	return true, nil
+}
+
+// Revoke implements TokenStore
+func (s *MemoryTokenStore) Revoke(_ context.Context, id string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep()
+	if until.After(s.revoked[id]) {
+		s.revoked[id] = until
+	}
+	return nil
+}
+
+// IsRevoked implements TokenStore
+func (s *MemoryTokenStore) IsRevoked(_ context.Context, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	until, ok := s.revoked[id]
+	return ok && time.Now().Before(until), nil
+}
+
+// sweep removes expired entries at most once a minute. s.mu must be held.
+func (s *MemoryTokenStore) sweep() {
+	now := time.Now()
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+
+	for id, token := range s.refresh {
+		if !now.Before(token.ExpiresAt) {
+			delete(s.refresh, id)
+		}
+	}
+	for id, until := range s.revoked {
+		if !now.Before(until) {
+			delete(s.revoked, id)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestTokenIssuer(t *testing.T) (*TokenIssuer, *MemoryTokenStore) {
+	t.Helper()
+	store := NewMemoryTokenStore()
+	return NewTokenIssuer([]byte("test-secret"), store, TokenIssuerOptions{
+		AccessTokenExpiry:  time.Minute,
+		RefreshTokenExpiry: time.Hour,
+	}), store
+}
+
+func TestTokenIssuerRefresh(t *testing.T) {
+	ctx := context.Background()
+	issuer, store := newTestTokenIssuer(t)
+
+	pair, err := issuer.Issue(ctx, User{ID: "42", Email: "jane@example.com"})
+	if err != nil {
+		t.Fatalf("Issue() returned an error: %v", err)
+	}
+	if !strings.HasPrefix(pair.RefreshToken, RefreshTokenPrefix) || pair.ExpiresIn != time.Minute {
+		t.Errorf("Unexpected pair: %+v", pair)
+	}
+
+	claims, err := ParseJWT(pair.AccessToken, []byte("test-secret"), VerifyOptions{})
+	if err != nil {
+		t.Fatalf("ParseJWT() returned an error: %v", err)
+	}
+	if claims.Subject != "42" || claims.ID == "" || claims.SessionID == "" {
+		t.Errorf("Unexpected claims: %+v", claims)
+	}
+
+	refreshed, err := issuer.Refresh(ctx, pair.RefreshToken, "")
+	if err != nil {
+		t.Fatalf("Refresh() returned an error: %v", err)
+	}
+	if refreshed.RefreshToken == pair.RefreshToken {
+		t.Errorf("Expected the refresh token to be rotated")
+	}
+	refreshedClaims, err := ParseJWT(refreshed.AccessToken, []byte("test-secret"), VerifyOptions{})
+	if err != nil {
+		t.Fatalf("ParseJWT() returned an error: %v", err)
+	}
+	if refreshedClaims.Subject != "42" || refreshedClaims.SessionID != claims.SessionID || refreshedClaims.ID == claims.ID {
+		t.Errorf("Unexpected refreshed claims: %+v", refreshedClaims)
+	}
+
+	// Reusing the first refresh token revokes the whole family
+	if _, err := issuer.Refresh(ctx, pair.RefreshToken, ""); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("Refresh() error = %v, want %v", err, ErrRefreshTokenReused)
+	}
+	if _, err := issuer.Refresh(ctx, refreshed.RefreshToken, ""); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("Refresh() error = %v, want %v", err, ErrInvalidRefreshToken)
+	}
+	if revoked, _ := IsTokenRevoked(ctx, store, refreshedClaims); !revoked {
+		t.Errorf("Expected access tokens of the family to be revoked")
+	}
+
+	for _, token := range []string{"", "rt_unknown_secret", RefreshTokenPrefix + "x", pair.AccessToken} {
+		if _, err := issuer.Refresh(ctx, token, ""); !errors.Is(err, ErrInvalidRefreshToken) {
+			t.Errorf("Refresh(%q) error = %v, want %v", token, err, ErrInvalidRefreshToken)
+		}
+	}
+}
+
+func TestTokenIssuerRevoke(t *testing.T) {
+	ctx := context.Background()
+	issuer, store := newTestTokenIssuer(t)
+
+	pair, err := issuer.Issue(ctx, User{ID: "42"})
+	if err != nil {
+		t.Fatalf("Issue() returned an error: %v", err)
+	}
+	other, err := issuer.Issue(ctx, User{ID: "42"})
+	if err != nil {
+		t.Fatalf("Issue() returned an error: %v", err)
+	}
+
+	// Revoking an access token only revokes that token
+	if err := issuer.Revoke(ctx, pair.AccessToken); err != nil {
+		t.Fatalf("Revoke() returned an error: %v", err)
+	}
+	claims, _ := ParseJWT(pair.AccessToken, []byte("test-secret"), VerifyOptions{})
+	if revoked, _ := IsTokenRevoked(ctx, store, claims); !revoked {
+		t.Errorf("Expected the access token to be revoked")
+	}
+	if _, err := issuer.Refresh(ctx, pair.RefreshToken, ""); err != nil {
+		t.Errorf("Refresh() returned an error after revoking the access token: %v", err)
+	}
+
+	// Revoking a refresh token revokes its family only
+	if err := issuer.Revoke(ctx, other.RefreshToken); err != nil {
+		t.Fatalf("Revoke() returned an error: %v", err)
+	}
+	if _, err := issuer.Refresh(ctx, other.RefreshToken, ""); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("Refresh() error = %v, want %v", err, ErrInvalidRefreshToken)
+	}
+	otherClaims, _ := ParseJWT(other.AccessToken, []byte("test-secret"), VerifyOptions{})
+	if revoked, _ := IsTokenRevoked(ctx, store, otherClaims); !revoked {
+		t.Errorf("Expected the access token of the revoked family to be revoked")
+	}
+
+	// Invalid tokens are not an error
+	for _, token := range []string{"garbage", "rt_unknown_secret"} {
+		if err := issuer.Revoke(ctx, token); err != nil {
+			t.Errorf("Revoke(%q) returned an error: %v", token, err)
+		}
+	}
+}
+
+func TestTokenIssuerConcurrentRefresh(t *testing.T) {
+	ctx := context.Background()
+	issuer, _ := newTestTokenIssuer(t)
+
+	pair, err := issuer.Issue(ctx, User{ID: "42"})
+	if err != nil {
+		t.Fatalf("Issue() returned an error: %v", err)
+	}
+
+	results := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			_, err := issuer.Refresh(ctx, pair.RefreshToken, "")
+			results <- err
+		}()
+	}
+
+	succeeded := 0
+	for i := 0; i < 10; i++ {
+		if err := <-results; err == nil {
+			succeeded++
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("Expected exactly one refresh to succeed, got %d", succeeded)
+	}
+}
@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Claims are the claims of the tokens generated by this package
+type Claims struct {
+	UserID   string `json:"user_id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	// SessionID is the refresh token family the token was issued with
+	SessionID string `json:"sid,omitempty"`
+	// ClientID is the client the token was issued to, if any
+	ClientID string `json:"client_id,omitempty"`
+	// Scope is the space separated list of granted scopes
+	Scope string `json:"scope,omitempty"`
+	// Roles are the roles of the user
+	Roles []string `json:"roles,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// Scopes returns the granted scopes
+func (c *Claims) Scopes() []string {
+	return strings.Fields(c.Scope)
+}
+
+// VerifyOptions controls which tokens ParseJWT accepts
+type VerifyOptions struct {
+	// Issuer, when not empty, must match the iss claim
+	Issuer string
+	// Audience, when not empty, must be one of the aud claim values
+	Audience string
+	// Leeway is the clock skew tolerated when checking exp, nbf and iat
+	Leeway time.Duration
+	// Keys, when set, verifies tokens against the keys of the ring instead
+	// of the secret key
+	Keys *KeyRing
+}
+
+// ParseJWT verifies the signature and the exp, nbf, iat, iss and aud claims
+// of a token signed with secretKey, or one of opts.Keys, and returns its
+// claims. Tokens without an expiration or a subject are rejected.
+func ParseJWT(tokenString string, secretKey []byte, opts VerifyOptions) (*Claims, error) {
+	keys := opts.Keys
+	if keys == nil {
+		var err error
+		if keys, err = NewKeyRing(NewHMACKey(secretKey)); err != nil {
+			return nil, err
+		}
+	}
+
+	parserOpts := []jwt.ParserOption{
+		jwt.WithValidMethods(keys.Algorithms()),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(opts.Leeway),
+	}
+	if opts.Issuer != "" {
+		parserOpts = append(parserOpts, jwt.WithIssuer(opts.Issuer))
+	}
+	if opts.Audience != "" {
+		parserOpts = append(parserOpts, jwt.WithAudience(opts.Audience))
+	}
+
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, keys.Keyfunc, parserOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %w", err)
+	}
+	// Other JWTs signed with the same keys, such as the OAuth flow state,
+	// have no subject and must not be accepted as access tokens
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("invalid token: %w: sub", jwt.ErrTokenRequiredClaimMissing)
+	}
+
+	return claims, nil
+}
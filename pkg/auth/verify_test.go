@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func signClaims(t *testing.T, method jwt.SigningMethod, key interface{}, claims jwt.Claims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	return token
+}
+
+func TestParseJWT(t *testing.T) {
+	secretKey := []byte("test-secret-key")
+	now := time.Now()
+
+	valid, err := GenerateJWTWithOptions(secretKey, TokenOptions{
+		Expiration: time.Hour,
+		Issuer:     "go-rest-api",
+		Audience:   []string{"api"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to generate JWT: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		token       string
+		opts        VerifyOptions
+		expectedErr error
+	}{
+		{"Valid token", valid, VerifyOptions{Issuer: "go-rest-api", Audience: "api"}, nil},
+		{"Wrong issuer", valid, VerifyOptions{Issuer: "someone-else"}, jwt.ErrTokenInvalidIssuer},
+		{"Wrong audience", valid, VerifyOptions{Audience: "other-api"}, jwt.ErrTokenInvalidAudience},
+		{"Wrong secret", signClaims(t, jwt.SigningMethodHS256, []byte("other-secret"), Claims{
+			RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour))},
+		}), VerifyOptions{}, jwt.ErrTokenSignatureInvalid},
+		{"Expired", signClaims(t, jwt.SigningMethodHS256, secretKey, Claims{
+			RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(now.Add(-time.Minute))},
+		}), VerifyOptions{}, jwt.ErrTokenExpired},
+		{"Expired within leeway", signClaims(t, jwt.SigningMethodHS256, secretKey, Claims{
+			RegisteredClaims: jwt.RegisteredClaims{Subject: "123", ExpiresAt: jwt.NewNumericDate(now.Add(-time.Minute))},
+		}), VerifyOptions{Leeway: 2 * time.Minute}, nil},
+		{"Not yet valid", signClaims(t, jwt.SigningMethodHS256, secretKey, Claims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+				NotBefore: jwt.NewNumericDate(now.Add(time.Minute)),
+			},
+		}), VerifyOptions{}, jwt.ErrTokenNotValidYet},
+		{"Issued in the future", signClaims(t, jwt.SigningMethodHS256, secretKey, Claims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+				IssuedAt:  jwt.NewNumericDate(now.Add(time.Minute)),
+			},
+		}), VerifyOptions{}, jwt.ErrTokenUsedBeforeIssued},
+		{"Without expiration", signClaims(t, jwt.SigningMethodHS256, secretKey, Claims{}), VerifyOptions{}, jwt.ErrTokenRequiredClaimMissing},
+		{"Without subject", signClaims(t, jwt.SigningMethodHS256, secretKey, Claims{
+			RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour))},
+		}), VerifyOptions{}, jwt.ErrTokenRequiredClaimMissing},
+		{"Unexpected algorithm", signClaims(t, jwt.SigningMethodHS512, secretKey, Claims{
+			RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour))},
+		}), VerifyOptions{}, jwt.ErrTokenSignatureInvalid},
+		{"Malformed", "not-a-jwt", VerifyOptions{}, jwt.ErrTokenMalformed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := ParseJWT(tt.token, secretKey, tt.opts)
+			if tt.expectedErr == nil {
+				if err != nil {
+					t.Fatalf("ParseJWT() returned an error: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.expectedErr) {
+				t.Errorf("ParseJWT() error = %v, want %v", err, tt.expectedErr)
+			}
+			if claims != nil {
+				t.Errorf("ParseJWT() returned claims along with an error")
+			}
+		})
+	}
+}
+
+func TestParseJWTClaims(t *testing.T) {
+	secretKey := []byte("test-secret-key")
+
+	token, err := GenerateJWTWithExpiration(secretKey, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to generate JWT: %v", err)
+	}
+
+	claims, err := ParseJWT(token, secretKey, VerifyOptions{})
+	if err != nil {
+		t.Fatalf("ParseJWT() returned an error: %v", err)
+	}
+	if claims.UserID != "123456" || claims.Subject != "123456" || claims.Username != "user" || claims.Email != "@example.com" {
+		t.Errorf("Unexpected claims: %+v", claims)
+	}
+}
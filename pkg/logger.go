@@ -11,6 +11,10 @@ import (
 var (
 	Log  *Logger
 	once sync.Once
+
+	// level is shared by the logger built in Init so that it can be
+	// changed at runtime with SetLevel.
+	level = zap.NewAtomicLevelAt(zap.InfoLevel)
 )
 
 type Logger struct {
@@ -20,6 +24,7 @@ type Logger struct {
 func Init() {
 	once.Do(func() {
 		config := zap.NewProductionConfig()
+		config.Level = level
 		config.EncoderConfig.TimeKey = "timestamp"
 		config.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
 
@@ -32,6 +37,22 @@ func Init() {
 	})
 }
 
+// SetLevel changes the minimum level of the logger built by Init. It accepts
+// the zap level names: debug, info, warn, error, dpanic, panic and fatal.
+func SetLevel(name string) error {
+	l, err := zapcore.ParseLevel(name)
+	if err != nil {
+		return err
+	}
+	level.SetLevel(l)
+	return nil
+}
+
+// Level returns the current level of the logger built by Init.
+func Level() string {
+	return level.Level().String()
+}
+
 func (l *Logger) Info(msg string, fields ...zap.Field) {
 	l.Logger.Info(msg, fields...)
 }
@@ -139,3 +139,26 @@ func TestGlobalLoggerMethods(t *testing.T) {
 		})
 	}
 }
+
+func TestSetLevel(t *testing.T) {
+	Init()
+	defer SetLevel("info")
+
+	if err := SetLevel("debug"); err != nil {
+		t.Fatalf("SetLevel(debug) returned an error: %v", err)
+	}
+	if !level.Enabled(zapcore.DebugLevel) {
+		t.Error("Expected debug level to be enabled after SetLevel(debug)")
+	}
+
+	if err := SetLevel("error"); err != nil {
+		t.Fatalf("SetLevel(error) returned an error: %v", err)
+	}
+	if level.Enabled(zapcore.InfoLevel) || Level() != "error" {
+		t.Errorf("Expected info level to be disabled after SetLevel(error), level is %s", Level())
+	}
+
+	if err := SetLevel("loud"); err == nil {
+		t.Error("Expected an error for an unknown level")
+	}
+}
@@ -0,0 +1,314 @@
+// Package policy evaluates attribute-based authorization rules. A policy is
+// a list of rules loaded from a file; each rule allows or denies an action
+// (the HTTP method) on a resource (the route) when all of its conditions on
+// the subject and resource attributes hold.
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Rule effects
+const (
+	EffectAllow = "allow"
+	EffectDeny  = "deny"
+)
+
+// Rule is a rule as written in a policy file:
+//
+//	rules:
+//	  - name: read-own-profile
+//	    effect: allow
+//	    actions: [GET]
+//	    resources: [/api/v1/users/:id]
+//	    conditions:
+//	      - subject.id == resource.id
+type Rule struct {
+	Name   string `yaml:"name"`
+	Effect string `yaml:"effect"`
+	// Actions are HTTP methods, or * for any method
+	Actions []string `yaml:"actions"`
+	// Resources are route patterns matched with path.Match. A pattern
+	// ending in /** also matches every route below it.
+	Resources []string `yaml:"resources"`
+	// Conditions must all hold for the rule to apply. They read
+	// "<attribute> <operator> <value>" with the operators ==, !=, in and
+	// contains.
+	Conditions []string `yaml:"conditions"`
+}
+
+// File is the format of a policy file
+type File struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+// Request is an access request to decide on
+type Request struct {
+	// Subject holds the attributes of the caller. Values are strings or
+	// string slices.
+	Subject map[string]any
+	// Action is the HTTP method
+	Action string
+	// Resource is the route pattern, such as /api/v1/users/:id
+	Resource string
+	// Params are the route parameters, read as resource.<name>
+	Params map[string]string
+}
+
+// Decision is the outcome of evaluating a Request
+type Decision struct {
+	Allowed bool
+	// Rule is the name of the rule that decided, or empty when no rule
+	// matched and the request was denied by default
+	Rule string
+}
+
+// Policy is a parsed set of rules. It is safe for concurrent use.
+type Policy struct {
+	rules []rule
+}
+
+type rule struct {
+	Rule
+	conditions []condition
+}
+
+// Load reads a policy file
+func Load(filename string) (*Policy, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	p, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return p, nil
+}
+
+// Parse parses a YAML (or JSON) policy
+func Parse(data []byte) (*Policy, error) {
+	var file File
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	return New(file.Rules...)
+}
+
+// New returns a policy of rules, reporting every invalid rule
+func New(rules ...Rule) (*Policy, error) {
+	p := &Policy{}
+	var errs []error
+	names := make(map[string]bool, len(rules))
+	for i, r := range rules {
+		invalid := func(format string, args ...any) {
+			errs = append(errs, fmt.Errorf("rules[%d]: "+format, append([]any{i}, args...)...))
+		}
+		switch {
+		case r.Name == "":
+			invalid("name is required")
+		case names[r.Name]:
+			invalid("duplicate name %q", r.Name)
+		}
+		names[r.Name] = true
+		if r.Effect != EffectAllow && r.Effect != EffectDeny {
+			invalid("effect must be %s or %s, got %q", EffectAllow, EffectDeny, r.Effect)
+		}
+		if len(r.Actions) == 0 {
+			invalid("at least one action is required")
+		}
+		if len(r.Resources) == 0 {
+			invalid("at least one resource is required")
+		}
+		for _, pattern := range r.Resources {
+			if _, err := path.Match(strings.TrimSuffix(pattern, "/**"), ""); err != nil {
+				invalid("resource %q: %v", pattern, err)
+			}
+		}
+
+		parsed := rule{Rule: r}
+		for _, expr := range r.Conditions {
+			cond, err := parseCondition(expr)
+			if err != nil {
+				invalid("%v", err)
+				continue
+			}
+			parsed.conditions = append(parsed.conditions, cond)
+		}
+		p.rules = append(p.rules, parsed)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return p, nil
+}
+
+// Evaluate decides on req. Requests are denied unless an allow rule
+// applies, and a deny rule that applies wins over every allow rule.
+func (p *Policy) Evaluate(req Request) Decision {
+	decision := Decision{}
+	for _, r := range p.rules {
+		if !r.applies(req) {
+			continue
+		}
+		if r.Effect == EffectDeny {
+			return Decision{Rule: r.Name}
+		}
+		if !decision.Allowed {
+			decision = Decision{Allowed: true, Rule: r.Name}
+		}
+	}
+	return decision
+}
+
+// applies reports whether the rule matches the action and resource of req
+// and all of its conditions hold
+func (r *rule) applies(req Request) bool {
+	if !slices.ContainsFunc(r.Actions, func(action string) bool {
+		return action == "*" || strings.EqualFold(action, req.Action)
+	}) {
+		return false
+	}
+	if !slices.ContainsFunc(r.Resources, func(pattern string) bool {
+		return matchResource(pattern, req.Resource)
+	}) {
+		return false
+	}
+	for _, cond := range r.conditions {
+		if !cond.holds(req) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchResource matches a route against a resource pattern
+func matchResource(pattern, resource string) bool {
+	prefix, recursive := strings.CutSuffix(pattern, "/**")
+	if !recursive {
+		matched, _ := path.Match(pattern, resource)
+		return matched
+	}
+	// Match the prefix against the route and each of its parents
+	for candidate := resource; ; {
+		if matched, _ := path.Match(prefix, candidate); matched {
+			return true
+		}
+		i := strings.LastIndex(candidate, "/")
+		if i <= 0 {
+			return false
+		}
+		candidate = candidate[:i]
+	}
+}
+
+var conditionPattern = regexp.MustCompile(`^\s*(\S+)\s+(==|!=|in|contains)\s+(.+?)\s*$`)
+
+// operand is an attribute reference or a literal value
+type operand struct {
+	attribute string
+	value     any
+}
+
+type condition struct {
+	left     operand
+	operator string
+	right    operand
+}
+
+// parseCondition parses "<attribute> <operator> <value>". The value is an
+// attribute, a quoted or bare string, or a [list, of, strings].
+func parseCondition(expr string) (condition, error) {
+	m := conditionPattern.FindStringSubmatch(expr)
+	if m == nil {
+		return condition{}, fmt.Errorf("condition %q: expected <attribute> <operator> <value>", expr)
+	}
+	left, right := parseOperand(m[1]), parseOperand(m[3])
+	if left.attribute == "" {
+		return condition{}, fmt.Errorf("condition %q: %q is not an attribute (subject.*, resource.* or action)", expr, m[1])
+	}
+	return condition{left: left, operator: m[2], right: right}, nil
+}
+
+func parseOperand(s string) operand {
+	if s == "action" || strings.HasPrefix(s, "subject.") || strings.HasPrefix(s, "resource.") {
+		return operand{attribute: s}
+	}
+	if inner, ok := strings.CutPrefix(s, "["); ok && strings.HasSuffix(inner, "]") {
+		list := []string{}
+		for _, item := range strings.Split(strings.TrimSuffix(inner, "]"), ",") {
+			if item = unquote(strings.TrimSpace(item)); item != "" {
+				list = append(list, item)
+			}
+		}
+		return operand{value: list}
+	}
+	return operand{value: unquote(s)}
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// resolve returns the value of the operand, or false when it refers to a
+// missing attribute
+func (o operand) resolve(req Request) (any, bool) {
+	if o.attribute == "" {
+		return o.value, true
+	}
+	switch {
+	case o.attribute == "action":
+		return req.Action, true
+	case o.attribute == "resource.path":
+		return req.Resource, true
+	case strings.HasPrefix(o.attribute, "resource."):
+		v, ok := req.Params[strings.TrimPrefix(o.attribute, "resource.")]
+		return v, ok && v != ""
+	default:
+		v, ok := req.Subject[strings.TrimPrefix(o.attribute, "subject.")]
+		if s, isString := v.(string); isString && s == "" {
+			return nil, false
+		}
+		return v, ok && v != nil
+	}
+}
+
+// holds evaluates the condition. Conditions on missing attributes never
+// hold, so that an empty subject ID cannot match an empty route parameter.
+func (c condition) holds(req Request) bool {
+	left, ok := c.left.resolve(req)
+	if !ok {
+		return false
+	}
+	right, ok := c.right.resolve(req)
+	if !ok {
+		return false
+	}
+
+	leftString, leftIsString := left.(string)
+	rightString, rightIsString := right.(string)
+	switch c.operator {
+	case "==":
+		return leftIsString && rightIsString && leftString == rightString
+	case "!=":
+		return leftIsString && rightIsString && leftString != rightString
+	case "in":
+		list, isList := right.([]string)
+		return leftIsString && isList && slices.Contains(list, leftString)
+	case "contains":
+		list, isList := left.([]string)
+		return rightIsString && isList && slices.Contains(list, rightString)
+	}
+	return false
+}
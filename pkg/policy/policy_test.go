@@ -0,0 +1,120 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const profilePolicy = `
+rules:
+  - name: read-own-profile
+    effect: allow
+    actions: [GET]
+    resources: [/api/v1/users/:id]
+    conditions:
+      - subject.id == resource.id
+  - name: org-x-reads-profiles
+    effect: allow
+    actions: [GET]
+    resources: [/api/v1/users/:id]
+    conditions:
+      - subject.roles contains org:x
+  - name: admins
+    effect: allow
+    actions: ["*"]
+    resources: [/api/v1/**]
+    conditions:
+      - subject.roles contains admin
+  - name: interns-cannot-delete-users
+    effect: deny
+    actions: [DELETE]
+    resources: [/api/v1/users/*]
+    conditions:
+      - subject.email in ["intern@example.com", 'temp@example.com']
+`
+
+func TestEvaluate(t *testing.T) {
+	p, err := Parse([]byte(profilePolicy))
+	if err != nil {
+		t.Fatalf("Parse() returned an error: %v", err)
+	}
+
+	jane := map[string]any{"id": "42", "email": "jane@example.com", "roles": []string{}}
+	orgX := map[string]any{"id": "7", "roles": []string{"org:x"}}
+	admin := map[string]any{"id": "1", "email": "intern@example.com", "roles": []string{"admin"}}
+	anonymous := map[string]any{"id": ""}
+
+	tests := []struct {
+		name         string
+		subject      map[string]any
+		action       string
+		resource     string
+		params       map[string]string
+		expected     bool
+		expectedRule string
+	}{
+		{"Own profile", jane, "GET", "/api/v1/users/:id", map[string]string{"id": "42"}, true, "read-own-profile"},
+		{"Other profile", jane, "GET", "/api/v1/users/:id", map[string]string{"id": "43"}, false, ""},
+		{"Other profile in org X", orgX, "GET", "/api/v1/users/:id", map[string]string{"id": "43"}, true, "org-x-reads-profiles"},
+		{"Writes are not allowed", jane, "PUT", "/api/v1/users/:id", map[string]string{"id": "42"}, false, ""},
+		{"Admin below a recursive pattern", admin, "POST", "/api/v1/orders/:id/items", nil, true, "admins"},
+		{"Deny wins over allow", admin, "DELETE", "/api/v1/users/:id", map[string]string{"id": "1"}, false, "interns-cannot-delete-users"},
+		{"Missing attributes never match", anonymous, "GET", "/api/v1/users/:id", map[string]string{"id": ""}, false, ""},
+		{"Unknown route", jane, "GET", "/internal", nil, false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision := p.Evaluate(Request{Subject: tt.subject, Action: tt.action, Resource: tt.resource, Params: tt.params})
+			if decision.Allowed != tt.expected || decision.Rule != tt.expectedRule {
+				t.Errorf("Evaluate() = %+v, want allowed %v by %q", decision, tt.expected, tt.expectedRule)
+			}
+		})
+	}
+}
+
+func TestParseReportsEveryInvalidRule(t *testing.T) {
+	_, err := Parse([]byte(`
+rules:
+  - name: a
+    effect: permit
+    actions: [GET]
+    resources: [/a]
+  - name: a
+    effect: allow
+    resources: ["/[a"]
+    conditions:
+      - "admin == subject.role"
+      - subject.id
+`))
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	for _, want := range []string{
+		`rules[0]: effect must be allow or deny, got "permit"`,
+		`rules[1]: duplicate name "a"`,
+		"rules[1]: at least one action is required",
+		`rules[1]: resource "/[a"`,
+		`"admin" is not an attribute`,
+		`condition "subject.id": expected`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %q in %v", want, err)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(filename, []byte(profilePolicy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(filename); err != nil {
+		t.Errorf("Load() returned an error: %v", err)
+	}
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
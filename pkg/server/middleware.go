@@ -0,0 +1,219 @@
+package server
+
+import (
+	"github.com/nicobistolfi/go-rest-api/internal/api/middleware"
+	"github.com/nicobistolfi/go-rest-api/pkg/auth"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+
+	logger "github.com/nicobistolfi/go-rest-api/pkg"
+)
+
+// Profile is the authenticated user stored in the gin context under "user".
+type Profile = middleware.Profile
+
+// ProfileFromContext returns the profile set by the token verification
+// middleware.
+func ProfileFromContext(c *gin.Context) (Profile, bool) {
+	return Dependency[Profile](c, "user")
+}
+
+// AuthMiddleware extracts the credential from the Authorization header,
+// X-API-Key header or access_token query parameter.
+func AuthMiddleware() gin.HandlerFunc {
+	return middleware.AuthMiddleware()
+}
+
+// VerifyTokenConfig configures VerifyToken.
+type VerifyTokenConfig = middleware.VerifyTokenConfig
+
+// VerifyToken validates the credential extracted by AuthMiddleware against
+// cfg.TokenURL and stores the resulting Profile in the context.
+func VerifyToken(cfg VerifyTokenConfig) gin.HandlerFunc {
+	return middleware.VerifyToken(cfg)
+}
+
+// TokenCache holds the profiles validated by VerifyToken. Pass one in
+// VerifyTokenConfig.Cache or WithTokenCache to read its Stats or use
+// another backend.
+type TokenCache = middleware.TokenCache
+
+// MemoryTokenCache is the in-memory LRU TokenCache.
+type MemoryTokenCache = middleware.MemoryTokenCache
+
+// TokenCacheOptions bounds a MemoryTokenCache.
+type TokenCacheOptions = middleware.TokenCacheOptions
+
+// TokenCacheStats are the counters of a token cache.
+type TokenCacheStats = middleware.TokenCacheStats
+
+// NewMemoryTokenCache returns an empty cache bounded by opts.
+func NewMemoryTokenCache(opts TokenCacheOptions) *MemoryTokenCache {
+	return middleware.NewMemoryTokenCache(opts)
+}
+
+// TokenCacheHandle gives access to the token cache a router currently uses,
+// e.g. to evict the profiles of a user on logout.
+type TokenCacheHandle = middleware.TokenCacheHandle
+
+// NewTokenCacheHandle returns a handle without a cache.
+func NewTokenCacheHandle() *TokenCacheHandle {
+	return middleware.NewTokenCacheHandle()
+}
+
+// RedisTokenCache is a TokenCache kept in Redis and shared by every
+// replica.
+type RedisTokenCache = middleware.RedisTokenCache
+
+// RedisTokenCacheOptions configures a RedisTokenCache.
+type RedisTokenCacheOptions = middleware.RedisTokenCacheOptions
+
+// NewRedisTokenCache returns a cache configured by opts.
+func NewRedisTokenCache(opts RedisTokenCacheOptions) *RedisTokenCache {
+	return middleware.NewRedisTokenCache(opts)
+}
+
+// ParseRedisURL returns the options of a redis:// or rediss:// URL.
+func ParseRedisURL(rawURL string) (RedisTokenCacheOptions, error) {
+	return middleware.ParseRedisURL(rawURL)
+}
+
+// FingerprintWithKey returns the fingerprint of credential computed with
+// key. Every process configured with the same key computes the same
+// fingerprints, as required to share a TokenCache.
+func FingerprintWithKey(key []byte, credential string) string {
+	return middleware.FingerprintWithKey(key, credential)
+}
+
+// UpstreamClient calls the token provider of VerifyToken with timeouts,
+// retries and a circuit breaker.
+type UpstreamClient = middleware.UpstreamClient
+
+// UpstreamOptions configures an UpstreamClient.
+type UpstreamOptions = middleware.UpstreamOptions
+
+// UpstreamStats are the counters of an UpstreamClient.
+type UpstreamStats = middleware.UpstreamStats
+
+// CircuitState is the state of the circuit breaker of an UpstreamClient.
+type CircuitState = middleware.CircuitState
+
+// NewUpstreamClient returns a client configured by opts.
+func NewUpstreamClient(opts UpstreamOptions) *UpstreamClient {
+	return middleware.NewUpstreamClient(opts)
+}
+
+// ProfileMapper builds the Profile of VerifyToken and VerifyOIDC from an
+// upstream response.
+type ProfileMapper = middleware.ProfileMapper
+
+// ProfileMapperFunc adapts a function to ProfileMapper.
+type ProfileMapperFunc = middleware.ProfileMapperFunc
+
+// FieldMapping locates the Profile fields in a JSON document.
+type FieldMapping = middleware.FieldMapping
+
+// NewFieldMapper returns a ProfileMapper reading the fields of mapping.
+func NewFieldMapper(mapping FieldMapping) (ProfileMapper, error) {
+	return middleware.NewFieldMapper(mapping)
+}
+
+// Built-in profile mappers.
+var (
+	GenericProfileMapper = middleware.GenericProfileMapper
+	GitHubProfileMapper  = middleware.GitHubProfileMapper
+	GoogleProfileMapper  = middleware.GoogleProfileMapper
+)
+
+// VerifyJWTConfig configures VerifyJWT.
+type VerifyJWTConfig = middleware.VerifyJWTConfig
+
+// VerifyJWT validates tokens issued by the /token endpoint locally and
+// stores the claims and the resulting Profile in the context. Use it after
+// AuthMiddleware, either alone or followed by VerifyToken with
+// cfg.Fallthrough set.
+func VerifyJWT(cfg VerifyJWTConfig) gin.HandlerFunc {
+	return middleware.VerifyJWT(cfg)
+}
+
+// ClaimsFromContext returns the claims set by VerifyJWT.
+func ClaimsFromContext(c *gin.Context) (*auth.Claims, bool) {
+	return middleware.ClaimsFromContext(c)
+}
+
+// VerifyOIDCConfig configures VerifyOIDC.
+type VerifyOIDCConfig = middleware.VerifyOIDCConfig
+
+// VerifyOIDC validates tokens issued by an OpenID Connect provider against
+// the provider JWKS and stores the claims and the resulting Profile in the
+// context. Use it after AuthMiddleware.
+func VerifyOIDC(cfg VerifyOIDCConfig) gin.HandlerFunc {
+	return middleware.VerifyOIDC(cfg)
+}
+
+// OIDCClaimsFromContext returns the claims set by VerifyOIDC.
+func OIDCClaimsFromContext(c *gin.Context) (*auth.OIDCClaims, bool) {
+	return middleware.OIDCClaimsFromContext(c)
+}
+
+// VerifyAPIKeyConfig configures VerifyAPIKey.
+type VerifyAPIKeyConfig = middleware.VerifyAPIKeyConfig
+
+// VerifyAPIKey resolves API keys against cfg.Store and stores the key and a
+// Profile for its owner in the context. Use it after AuthMiddleware.
+func VerifyAPIKey(cfg VerifyAPIKeyConfig) gin.HandlerFunc {
+	return middleware.VerifyAPIKey(cfg)
+}
+
+// APIKeyFromContext returns the key set by VerifyAPIKey.
+func APIKeyFromContext(c *gin.Context) (*auth.APIKey, bool) {
+	return middleware.APIKeyFromContext(c)
+}
+
+// RequireScopes rejects requests whose user was not granted every one of
+// scopes with 403. Use it after the token verification middlewares, for
+// example in WithProtectedRouteGroup.
+func RequireScopes(scopes ...string) gin.HandlerFunc {
+	return middleware.RequireScopes(scopes...)
+}
+
+// RequireRole rejects requests whose user has none of roles with 403. Use
+// it after the token verification middlewares.
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return middleware.RequireRole(roles...)
+}
+
+// AuthorizeConfig configures Authorize.
+type AuthorizeConfig = middleware.AuthorizeConfig
+
+// Authorize checks every request against cfg.Policy and rejects denied
+// requests with 403, or only logs them when cfg.DryRun is set. Use it after
+// the token verification middlewares.
+func Authorize(cfg AuthorizeConfig) gin.HandlerFunc {
+	return middleware.Authorize(cfg)
+}
+
+// CORSMiddleware sets the CORS headers for the allowed origins.
+func CORSMiddleware(allowedOrigins []string) gin.HandlerFunc {
+	return middleware.CORSMiddleware(allowedOrigins)
+}
+
+// RateLimiter limits requests per client IP and Authorization header.
+func RateLimiter(r rate.Limit, b int, keyPrefixes ...string) gin.HandlerFunc {
+	return middleware.RateLimiter(r, b, keyPrefixes...)
+}
+
+// RateLimiterConfig configures RateLimiterWithConfig.
+type RateLimiterConfig = middleware.RateLimiterConfig
+
+// RateLimiterWithConfig limits requests per client IP and Authorization
+// header as configured by cfg.
+func RateLimiterWithConfig(cfg RateLimiterConfig) gin.HandlerFunc {
+	return middleware.RateLimiterWithConfig(cfg)
+}
+
+// LoggerMiddleware logs every request.
+func LoggerMiddleware(l *logger.Logger) gin.HandlerFunc {
+	return middleware.LoggerMiddleware(l)
+}
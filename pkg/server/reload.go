@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// liveSettings are the config keys that take effect on reload. Changes to
+// any other key are applied to the stored configuration but only used after
+// a restart.
+var liveSettings = map[string]bool{
+	"allowed_origins":                    true,
+	"rate_limit_requests":                true,
+	"rate_limit_duration":                true,
+	"route_rate_limits":                  true,
+	"jwt_secret":                         true,
+	"jwt_expiration_minutes":             true,
+	"jwt_issuer":                         true,
+	"jwt_audience":                       true,
+	"jwt_leeway":                         true,
+	"jwt_signing_key":                    true,
+	"jwt_previous_keys":                  true,
+	"jwt_previous_secrets":               true,
+	"refresh_token_expiry":               true,
+	"oidc_issuer":                        true,
+	"oidc_audience":                      true,
+	"oidc_jwks_refresh_interval":         true,
+	"oauth_client_secret":                true,
+	"oauth_scopes":                       true,
+	"api_keys":                           true,
+	"clients":                            true,
+	"users":                              true,
+	"policy_file":                        true,
+	"policy_mode":                        true,
+	"token_url":                          true,
+	"token_introspection_client_id":      true,
+	"token_introspection_client_secret":  true,
+	"token_cache_expiry":                 true,
+	"token_cache_max_entries":            true,
+	"token_cache_max_bytes":              true,
+	"token_cache_cleanup_interval":       true,
+	"token_negative_cache_expiry":        true,
+	"token_cache_stale_while_revalidate": true,
+	"token_cache_max_stale":              true,
+	"token_cache_backend":                true,
+	"token_cache_redis_url":              true,
+	"token_cache_redis_prefix":           true,
+	"token_upstream_connect_timeout":     true,
+	"token_upstream_timeout":             true,
+	"token_upstream_max_retries":         true,
+	"token_upstream_retry_backoff":       true,
+	"token_upstream_failure_threshold":   true,
+	"token_upstream_open_timeout":        true,
+	"token_profile_mapper":               true,
+	"oidc_profile_mapper":                true,
+	"profile_mappers":                    true,
+	"log_level":                          true,
+	"reload_interval":                    true,
+	"shutdown_timeout":                   true,
+}
+
+// Reload loads and validates a new configuration and swaps it in. When the
+// new configuration is invalid the current one is kept and the error is
+// returned. It requires WithConfigReload.
+func (s *Server) Reload() error {
+	if s.loadConfig == nil {
+		return errors.New("configuration reload is not enabled")
+	}
+
+	changes, err := s.store.Reload(s.loadConfig)
+	if err != nil {
+		s.logger.Error("Configuration reload failed, keeping the current configuration", zap.Error(err))
+		return err
+	}
+
+	if len(changes) == 0 {
+		s.logger.Info("Configuration reloaded, nothing changed")
+		return nil
+	}
+	for _, change := range changes {
+		fields := []zap.Field{zap.String("key", change.Key), zap.String("old", change.Old), zap.String("new", change.New)}
+		if liveSettings[change.Key] {
+			s.logger.Info("Configuration changed", fields...)
+		} else {
+			s.logger.Warn("Configuration changed, restart required to apply", fields...)
+		}
+	}
+	s.logger.Info("Configuration reloaded", zap.Int("changes", len(changes)))
+	return nil
+}
+
+// watchConfig reloads the configuration on SIGHUP and whenever the config
+// file's modification time changes, until ctx is cancelled.
+func (s *Server) watchConfig(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	lastModified := modTime(s.Config().ConfigFile)
+
+	for {
+		// Re-read the interval so that a reload can change it
+		var poll <-chan time.Time
+		if cfg := s.Config(); cfg.ConfigFile != "" && cfg.ReloadInterval > 0 {
+			poll = time.After(cfg.ReloadInterval)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			s.logger.Info("Received SIGHUP, reloading configuration")
+			s.Reload()
+			lastModified = modTime(s.Config().ConfigFile)
+		case <-poll:
+			if modified := modTime(s.Config().ConfigFile); !modified.Equal(lastModified) {
+				lastModified = modified
+				s.logger.Info("Config file changed, reloading configuration", zap.String("path", s.Config().ConfigFile))
+				s.Reload()
+			}
+		}
+	}
+}
+
+func modTime(path string) time.Time {
+	if path == "" {
+		return time.Time{}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
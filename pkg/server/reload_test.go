@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	logger "github.com/nicobistolfi/go-rest-api/pkg"
+)
+
+func writeConfig(t *testing.T, path, content string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+}
+
+func corsOrigin(srv *Server, origin string) string {
+	req, _ := http.NewRequest("GET", "/api/v1/ping", nil)
+	req.Header.Set("Origin", origin)
+	w := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(w, req)
+	return w.Header().Get("Access-Control-Allow-Origin")
+}
+
+func TestReload(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger.Init()
+	defer logger.SetLevel("info")
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, `
+token_url: https://idp.example.com/userinfo
+allowed_origins: [https://old.example.com]
+`)
+	t.Setenv("CONFIG_FILE", path)
+
+	cfg, err := LoadConfig()
+	require.NoError(t, err)
+
+	srv := New(cfg, WithConfigReload(LoadConfig))
+	assert.Equal(t, "https://old.example.com", corsOrigin(srv, "https://old.example.com"))
+
+	// A valid change is applied without restarting
+	writeConfig(t, path, `
+token_url: https://idp.example.com/userinfo
+allowed_origins: [https://new.example.com]
+log_level: warn
+`)
+	require.NoError(t, srv.Reload())
+	assert.Equal(t, "*", corsOrigin(srv, "https://old.example.com"))
+	assert.Equal(t, "https://new.example.com", corsOrigin(srv, "https://new.example.com"))
+	assert.Equal(t, "warn", logger.Level())
+
+	// An invalid change keeps the current configuration
+	writeConfig(t, path, `
+token_url: https://idp.example.com/userinfo
+allowed_origins: [https://broken.example.com]
+rate_limit_requests: lots
+`)
+	assert.Error(t, srv.Reload())
+	assert.Equal(t, "https://new.example.com", corsOrigin(srv, "https://new.example.com"))
+	assert.Equal(t, []string{"https://new.example.com"}, srv.Config().AllowedOrigins)
+}
+
+func TestReloadWithoutLoader(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger.Init()
+
+	srv := New(&Config{})
+	assert.Error(t, srv.Reload())
+}
+
+func TestServeReloadsOnConfigFileChange(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger.Init()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, `
+token_url: https://idp.example.com/userinfo
+reload_interval: 10ms
+allowed_origins: [https://old.example.com]
+`)
+	t.Setenv("CONFIG_FILE", path)
+
+	cfg, err := LoadConfig()
+	require.NoError(t, err)
+	srv := New(cfg, WithConfigReload(LoadConfig))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.Serve(ctx, ln)
+
+	// Make sure the modification time changes even on coarse filesystems
+	time.Sleep(20 * time.Millisecond)
+	writeConfig(t, path, `
+token_url: https://idp.example.com/userinfo
+reload_interval: 10ms
+allowed_origins: [https://new.example.com]
+`)
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Second)))
+
+	assert.Eventually(t, func() bool {
+		return corsOrigin(srv, "https://new.example.com") == "https://new.example.com"
+	}, 2*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,323 @@
+// Package server exposes the API router, its middlewares and the HTTP server
+// lifecycle so that services built on this template can import them instead
+// of forking the repository.
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/nicobistolfi/go-rest-api/internal/api"
+	"github.com/nicobistolfi/go-rest-api/internal/config"
+	"github.com/nicobistolfi/go-rest-api/pkg/auth"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+
+	logger "github.com/nicobistolfi/go-rest-api/pkg"
+)
+
+// Config is the application configuration consumed by the router.
+type Config = config.Config
+
+// LoadConfig loads the configuration from the config file named by
+// CONFIG_FILE and the environment.
+func LoadConfig() (*Config, error) {
+	return config.LoadConfig()
+}
+
+// LoadConfigFromArgs loads the configuration from a config file, the
+// environment and command-line flags, in increasing order of precedence.
+func LoadConfigFromArgs(args []string) (*Config, error) {
+	return config.LoadConfigFromArgs(args)
+}
+
+// Server wires the API router into a gin engine and an HTTP server.
+type Server struct {
+	cfg          *Config
+	store        *config.Store
+	loadConfig   func() (*Config, error)
+	logger       *logger.Logger
+	engine       *gin.Engine
+	dependencies map[string]any
+	routerOpts   []api.RouterOption
+	tokenCache   *TokenCacheHandle
+}
+
+// Option customizes a Server built by New.
+type Option func(*Server)
+
+// WithLogger sets the logger used by the router and the server. Defaults to
+// the package level logger from pkg.
+func WithLogger(l *logger.Logger) Option {
+	return func(s *Server) {
+		s.logger = l
+	}
+}
+
+// WithConfigReload enables hot configuration reload. On SIGHUP, when the
+// config file changes, or when Reload is called, load is called to build a
+// new configuration; if it succeeds the rate limits, allowed origins, token
+// verification settings and log level are swapped in without a restart.
+// Typically load is a closure around LoadConfigFromArgs.
+func WithConfigReload(load func() (*Config, error)) Option {
+	return func(s *Server) {
+		s.loadConfig = load
+	}
+}
+
+// WithEngine registers the routes on an existing gin engine instead of a new
+// one.
+func WithEngine(engine *gin.Engine) Option {
+	return func(s *Server) {
+		s.engine = engine
+	}
+}
+
+// WithoutRateLimiting disables the global rate limiter.
+func WithoutRateLimiting() Option {
+	return func(s *Server) {
+		s.routerOpts = append(s.routerOpts, api.WithoutRateLimiting())
+	}
+}
+
+// WithMiddleware adds global middleware that runs after the built-in ones.
+func WithMiddleware(handlers ...gin.HandlerFunc) Option {
+	return func(s *Server) {
+		s.routerOpts = append(s.routerOpts, api.WithMiddleware(handlers...))
+	}
+}
+
+// WithCORSMiddleware replaces the default CORS middleware.
+func WithCORSMiddleware(handler gin.HandlerFunc) Option {
+	return func(s *Server) {
+		s.routerOpts = append(s.routerOpts, api.WithCORSMiddleware(handler))
+	}
+}
+
+// WithRateLimiter replaces the default rate limiting middleware.
+func WithRateLimiter(handler gin.HandlerFunc) Option {
+	return func(s *Server) {
+		s.routerOpts = append(s.routerOpts, api.WithRateLimiter(handler))
+	}
+}
+
+// WithAuthMiddleware replaces the middleware chain guarding protected routes.
+func WithAuthMiddleware(handlers ...gin.HandlerFunc) Option {
+	return func(s *Server) {
+		s.routerOpts = append(s.routerOpts, api.WithAuthMiddleware(handlers...))
+	}
+}
+
+// WithAPIKeyStore makes the apikey token verifier look keys up in store,
+// such as a database, instead of the api_keys of the configuration.
+func WithAPIKeyStore(store auth.APIKeyStore) Option {
+	return func(s *Server) {
+		s.routerOpts = append(s.routerOpts, api.WithAPIKeyStore(store))
+	}
+}
+
+// WithTokenStore keeps refresh tokens and revoked tokens in store, such as
+// a database shared by every instance, instead of in memory.
+func WithTokenStore(store auth.TokenStore) Option {
+	return func(s *Server) {
+		s.routerOpts = append(s.routerOpts, api.WithTokenStore(store))
+	}
+}
+
+// WithTokenCache makes the remote token verifier cache profiles in cache,
+// e.g. to export its Stats as metrics or use another backend.
+func WithTokenCache(cache TokenCache) Option {
+	return func(s *Server) {
+		s.routerOpts = append(s.routerOpts, api.WithTokenCache(cache))
+	}
+}
+
+// WithUpstreamClient makes the remote token verifier call TOKEN_URL with
+// client, e.g. to export its Stats or watch its circuit breaker.
+func WithUpstreamClient(client *UpstreamClient) Option {
+	return func(s *Server) {
+		s.routerOpts = append(s.routerOpts, api.WithUpstreamClient(client))
+	}
+}
+
+// WithClientStore makes the /token endpoint look clients up in store
+// instead of the clients of the configuration.
+func WithClientStore(store auth.ClientStore) Option {
+	return func(s *Server) {
+		s.routerOpts = append(s.routerOpts, api.WithClientStore(store))
+	}
+}
+
+// WithUserStore makes the password grant look users up in store instead of
+// the users of the configuration.
+func WithUserStore(store auth.UserStore) Option {
+	return func(s *Server) {
+		s.routerOpts = append(s.routerOpts, api.WithUserStore(store))
+	}
+}
+
+// WithRouteGroup registers a public route group.
+func WithRouteGroup(relativePath string, register func(*gin.RouterGroup), middlewares ...gin.HandlerFunc) Option {
+	return func(s *Server) {
+		s.routerOpts = append(s.routerOpts, api.WithRouteGroup(relativePath, register, middlewares...))
+	}
+}
+
+// WithProtectedRouteGroup registers a route group guarded by the
+// authentication middleware chain.
+func WithProtectedRouteGroup(relativePath string, register func(*gin.RouterGroup), middlewares ...gin.HandlerFunc) Option {
+	return func(s *Server) {
+		s.routerOpts = append(s.routerOpts, api.WithProtectedRouteGroup(relativePath, register, middlewares...))
+	}
+}
+
+// WithDependency makes value available to every handler under key. Use
+// Dependency to retrieve it.
+func WithDependency(key string, value any) Option {
+	return func(s *Server) {
+		if s.dependencies == nil {
+			s.dependencies = make(map[string]any)
+		}
+		s.dependencies[key] = value
+	}
+}
+
+// Dependency returns the dependency registered under key with WithDependency.
+func Dependency[T any](c *gin.Context, key string) (T, bool) {
+	value, ok := c.Get(key)
+	if !ok {
+		var zero T
+		return zero, false
+	}
+	typed, ok := value.(T)
+	return typed, ok
+}
+
+// New builds a Server from cfg and the given options.
+func New(cfg *Config, opts ...Option) *Server {
+	s := &Server{cfg: cfg, store: config.NewStore(cfg), tokenCache: NewTokenCacheHandle()}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.logger == nil {
+		logger.Init()
+		s.logger = logger.Log
+	}
+	if s.engine == nil {
+		s.engine = gin.New()
+	}
+
+	s.applyLogLevel(cfg)
+	s.store.OnChange(func(_, next *Config) {
+		s.applyLogLevel(next)
+	})
+
+	routerOpts := append([]api.RouterOption{api.WithConfigStore(s.store), api.WithTokenCacheHandle(s.tokenCache)}, s.routerOpts...)
+	if len(s.dependencies) > 0 {
+		// Inject dependencies before any user supplied middleware runs
+		routerOpts = append([]api.RouterOption{api.WithMiddleware(s.injectDependencies)}, routerOpts...)
+	}
+
+	api.SetupRouter(s.engine, s.cfg, s.logger, routerOpts...)
+	return s
+}
+
+func (s *Server) injectDependencies(c *gin.Context) {
+	for key, value := range s.dependencies {
+		c.Set(key, value)
+	}
+	c.Next()
+}
+
+func (s *Server) applyLogLevel(cfg *Config) {
+	if cfg.LogLevel == "" {
+		return
+	}
+	if err := logger.SetLevel(cfg.LogLevel); err != nil {
+		s.logger.Error("Invalid log level", zap.String("level", cfg.LogLevel), zap.Error(err))
+	}
+}
+
+// Config returns the current configuration, which changes on reload.
+func (s *Server) Config() *Config {
+	return s.store.Load()
+}
+
+// TokenCache returns a handle on the cache of the remote token verifier,
+// to evict profiles from other packages, e.g. on logout or when the
+// identity provider reports a disabled user.
+func (s *Server) TokenCache() *TokenCacheHandle {
+	return s.tokenCache
+}
+
+// Engine returns the underlying gin engine.
+func (s *Server) Engine() *gin.Engine {
+	return s.engine
+}
+
+// Handler returns the server as an http.Handler.
+func (s *Server) Handler() http.Handler {
+	return s.engine
+}
+
+// Run listens on the configured address and serves requests until ctx is
+// cancelled, then shuts down gracefully.
+func (s *Server) Run(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.cfg.Address())
+	if err != nil {
+		return err
+	}
+	return s.Serve(ctx, ln)
+}
+
+// Serve serves requests on ln until ctx is cancelled. In-flight requests get
+// up to Config.ShutdownTimeout to complete before their connections are
+// closed.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	srv := &http.Server{
+		Handler:           s.engine,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	if s.loadConfig != nil {
+		watchCtx, stopWatching := context.WithCancel(ctx)
+		defer stopWatching()
+		go s.watchConfig(watchCtx)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Serve(ln)
+	}()
+
+	s.logger.Info("Server listening", zap.String("address", ln.Addr().String()))
+
+	select {
+	case err := <-errCh:
+		// Serve returned before a shutdown was requested
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownTimeout := s.Config().ShutdownTimeout
+	s.logger.Info("Shutting down server", zap.Duration("timeout", shutdownTimeout))
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		// Deadline exceeded: force close the remaining connections
+		srv.Close()
+		return err
+	}
+
+	if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
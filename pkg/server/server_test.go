@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	logger "github.com/nicobistolfi/go-rest-api/pkg"
+)
+
+func TestNewRegistersRouteGroups(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger.Init()
+
+	type greeter struct{ greeting string }
+
+	srv := New(&Config{},
+		WithoutRateLimiting(),
+		WithDependency("greeter", &greeter{greeting: "hello"}),
+		WithRouteGroup("/api/v2", func(g *gin.RouterGroup) {
+			g.GET("/hello", func(c *gin.Context) {
+				gr, ok := Dependency[*greeter](c, "greeter")
+				if !ok {
+					c.AbortWithStatus(http.StatusInternalServerError)
+					return
+				}
+				c.JSON(http.StatusOK, gin.H{"message": gr.greeting})
+			})
+		}),
+		WithProtectedRouteGroup("/api/v2/private", func(g *gin.RouterGroup) {
+			g.GET("/me", func(c *gin.Context) {
+				profile, _ := ProfileFromContext(c)
+				c.JSON(http.StatusOK, profile)
+			})
+		}),
+		WithAuthMiddleware(func(c *gin.Context) {
+			if c.GetHeader("Authorization") != "let-me-in" {
+				c.AbortWithStatus(http.StatusUnauthorized)
+				return
+			}
+			c.Set("user", Profile{ID: "42"})
+			c.Next()
+		}),
+	)
+
+	tests := []struct {
+		name           string
+		path           string
+		token          string
+		expectedStatus int
+		expectedBody   map[string]string
+	}{
+		{"Built-in route", "/api/v1/ping", "", http.StatusOK, map[string]string{"message": "pong"}},
+		{"Custom route with dependency", "/api/v2/hello", "", http.StatusOK, map[string]string{"message": "hello"}},
+		{"Custom protected route without token", "/api/v2/private/me", "", http.StatusUnauthorized, nil},
+		{"Custom protected route", "/api/v2/private/me", "let-me-in", http.StatusOK, map[string]string{"id": "42", "email": "", "name": ""}},
+		{"Built-in protected route uses swapped middleware", "/api/v1/profile", "let-me-in", http.StatusOK, map[string]string{"id": "42", "email": "", "name": ""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", tt.token)
+			}
+			w := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			if tt.expectedBody != nil {
+				var body map[string]string
+				assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+				assert.Equal(t, tt.expectedBody, body)
+			}
+		})
+	}
+}
+
+func TestServerTokenCache(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger.Init()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"alice"}`))
+	}))
+	defer upstream.Close()
+
+	srv := New(&Config{
+		TokenVerifiers:   []string{"remote"},
+		TokenURL:         upstream.URL,
+		TokenCacheExpiry: time.Minute,
+	}, WithoutRateLimiting())
+
+	serve := func() string {
+		req, _ := http.NewRequest("GET", "/api/v1/profile", nil)
+		req.Header.Set("Authorization", "Bearer token")
+		w := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		return w.Header().Get("X-Token-Cache")
+	}
+
+	assert.Equal(t, "MISS", serve())
+	assert.Equal(t, "HIT", serve())
+
+	// e.g. on logout
+	srv.TokenCache().EvictToken("Bearer token")
+	assert.Equal(t, "MISS", serve())
+
+	// e.g. on a webhook of the identity provider
+	assert.Equal(t, 1, srv.TokenCache().EvictUser("alice"))
+	assert.Equal(t, "MISS", serve())
+}
+
+func TestServeDrainsInFlightRequests(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger.Init()
+
+	started := make(chan struct{})
+	srv := New(&Config{ShutdownTimeout: 5 * time.Second},
+		WithoutRateLimiting(),
+		WithRouteGroup("/slow", func(g *gin.RouterGroup) {
+			g.GET("", func(c *gin.Context) {
+				close(started)
+				time.Sleep(200 * time.Millisecond)
+				c.String(http.StatusOK, "done")
+			})
+		}),
+	)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(ctx, ln)
+	}()
+
+	respCh := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/slow")
+		if err != nil {
+			respCh <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		respCh <- string(body)
+	}()
+
+	// Request shutdown while the request is still being handled
+	<-started
+	cancel()
+
+	assert.Equal(t, "done", <-respCh)
+	assert.NoError(t, <-serveErr)
+}
+
+func TestServeShutdownDeadline(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	logger.Init()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	srv := New(&Config{ShutdownTimeout: 50 * time.Millisecond},
+		WithoutRateLimiting(),
+		WithRouteGroup("/stuck", func(g *gin.RouterGroup) {
+			g.GET("", func(c *gin.Context) {
+				close(started)
+				<-release
+			})
+		}),
+	)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(ctx, ln)
+	}()
+
+	go http.Get("http://" + ln.Addr().String() + "/stuck")
+
+	<-started
+	cancel()
+
+	assert.ErrorIs(t, <-serveErr, context.DeadlineExceeded)
+}
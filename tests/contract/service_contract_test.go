@@ -16,6 +16,9 @@ import (
 )
 
 func TestServiceContract(t *testing.T) {
+	// Protected routes require a token URL even though they are not exercised here
+	t.Setenv("TOKEN_URL", "http://localhost:8080/api/v1/token")
+
 	// Setup the router
 	cfg, err := config.LoadConfig()
 	assert.NoError(t, err, "Failed to load configuration")
@@ -14,6 +14,7 @@ import (
 )
 
 func BenchmarkPingEndpoint(b *testing.B) {
+	b.Setenv("TOKEN_URL", "http://localhost:8080/api/v1/token")
 	cfg, err := config.LoadConfig()
 	if err != nil {
 		b.Fatalf("Failed to load configuration: %v", err)
@@ -37,6 +38,7 @@ func BenchmarkPingEndpoint(b *testing.B) {
 }
 
 func BenchmarkRateLimiting(b *testing.B) {
+	b.Setenv("TOKEN_URL", "http://localhost:8080/api/v1/token")
 	cfg, err := config.LoadConfig()
 	if err != nil {
 		b.Fatalf("Failed to load configuration: %v", err)